@@ -1,6 +1,15 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xdung24/unirest/database"
+	"github.com/xdung24/unirest/service"
+)
 
 const (
 	// db driver
@@ -11,6 +20,11 @@ const (
 	MYSQL  = "mysql"    // relational database (sql)
 	REDIS  = "redis"    // keypair value database (nosql)
 	MONGO  = "mongo"    // bson document database (nosql)
+	BOLT   = "bolt"     // embedded key value file (bbolt), transactional, no cgo
+	S3     = "s3"       // s3 compatible object storage, one object per document
+	GIT    = "git"      // local git repository, one commit per change
+	RAFT   = "cluster"  // memory replicated with raft across several instances
+	TIERED = "tiered"   // memory in front of any of the drivers above
 
 	// env
 	envHostPort       = "IP_PORT"
@@ -25,6 +39,33 @@ const (
 	envSwaggerEnabled = "SWAGGER_ENABLED"
 	envAuthEnabled    = "AUTH_ENABLED"
 	envRawSqlEnabled  = "RAW_SQL_ENABLED"
+	envSqliteFts      = "SQLITE_FTS_ENABLED"
+	envS3Region       = "S3_REGION"
+	envS3UseSSL       = "S3_USE_SSL"
+	envClusterHttp    = "CLUSTER_HTTP_ADDR"
+	envClusterRaft    = "CLUSTER_RAFT_ADDR"
+	envClusterPeers   = "CLUSTER_PEERS"
+	envClusterStale   = "CLUSTER_STALE_READS"
+	envClusterSecret  = "CLUSTER_SECRET"
+	envTieredCold     = "TIERED_COLD_DRIVER"
+	envTieredMode     = "TIERED_MODE"
+	envTieredJournal  = "TIERED_JOURNAL"
+	envTieredQueue    = "TIERED_QUEUE_SIZE"
+	envTieredMaxItems = "TIERED_MAX_ITEMS"
+	envTieredMaxBytes = "TIERED_MAX_BYTES"
+	envTieredWarm     = "TIERED_WARM"
+	envCompression    = "COMPRESSION"
+	envRecompress     = "COMPRESSION_RECOMPRESS_INTERVAL"
+	envKeyring        = "ENCRYPTION_KEYRING"
+	envEncryptFields  = "ENCRYPTION_FIELDS"
+	envMemMaxBytes    = "MEMORY_MAX_BYTES"
+	envMemNsMaxBytes  = "MEMORY_NAMESPACE_MAX_BYTES"
+	envIdStrategy     = "ID_STRATEGY"
+	envSearchTimeout  = "SEARCH_TIMEOUT"
+	envSlurpMaxBytes  = "SLURP_MAX_BYTES"
+	envTextIndex      = "TEXT_INDEX_FIELDS"
+	envTextStemming   = "TEXT_INDEX_STEMMING"
+	envGeoFields      = "GEO_FIELDS"
 )
 
 type Config struct {
@@ -40,12 +81,46 @@ type Config struct {
 	BrokerEnabled  bool
 	AuthEnabled    bool
 	RawSqlEnabled  bool
+	SqliteFts      bool
+	S3Region       string
+	S3UseSSL       bool
+	ClusterHttp    string
+	ClusterRaft    string
+	ClusterPeers   []string
+	ClusterStale   bool
+	ClusterSecret  string
+	TieredCold     string
+	TieredMode     string
+	TieredJournal  string
+	TieredQueue    int
+	TieredMaxItems int
+	TieredMaxBytes int
+	TieredWarm     []string
+	Compression    map[string]string
+	Recompress     time.Duration
+	Keyring        string
+	EncryptFields  map[string][]database.EncryptedField
+	MemMaxBytes    int64
+	MemNsMaxBytes  map[string]int64
+	IdStrategies   map[string]string
+	SearchTimeout  time.Duration
+	SlurpMaxBytes  int64
+	TextIndex      map[string][]string
+	TextStemming   bool
+	GeoFields      map[string]string
 }
 
 func getConfig() Config {
 
-	var addr, dbDriver, dbHost, dbName, dbUser, dbPass, dbPath, brokerHostPort string
-	var swaggerEnabled, brokerEnabled, authEnabled, rawSqlEnabled bool
+	var addr, dbDriver, dbHost, dbName, dbUser, dbPass, dbPath, brokerHostPort, s3Region string
+	var clusterHttp, clusterRaft, clusterPeers, clusterSecret string
+	var tieredCold, tieredMode, tieredJournal, tieredWarm string
+	var tieredQueue, tieredMaxItems, tieredMaxBytes int
+	var compression, keyring, encryptFields, textIndex, geoFields string
+	var recompress, searchTimeout time.Duration
+	var memMaxBytes, slurpMaxBytes int64
+	var memNsMaxBytes, idStrategy string
+	var swaggerEnabled, brokerEnabled, authEnabled, rawSqlEnabled, sqliteFts, s3UseSSL, clusterStale, textStemming bool
 
 	flag.StringVar(&addr, envHostPort, "0.0.0.0:8000", "ip:port for rest api to expose")
 	flag.StringVar(&brokerHostPort, envBrokerHostPort, "0.0.0.0:8001", "ip:port for broker to expose")
@@ -54,13 +129,43 @@ func getConfig() Config {
 	flag.BoolVar(&brokerEnabled, envBrokerEnabled, false, "enable broker")
 	flag.BoolVar(&authEnabled, envAuthEnabled, false, "enable JWT auth")
 	flag.BoolVar(&rawSqlEnabled, envRawSqlEnabled, false, "enable raw sql (postgres)")
+	flag.BoolVar(&sqliteFts, envSqliteFts, false, "enable fts5 full text index (sqlite, needs the sqlite_fts5 build tag)")
+
+	flag.StringVar(&dbDriver, envDbDriver, MEMORY, "db type to use (memory | fs | sqlite| postgres | mysql | redis | mongo | bolt | s3 | git | cluster | tiered)")
+	flag.StringVar(&dbPath, envDbPath, "./data", "path of the file storage (for fs | sqlite | bolt | git | cluster)")
+	flag.StringVar(&dbHost, envDbHost, "localhost", "database host (for postgres | mysql | redis | mongo | s3 endpoint)")
+	flag.StringVar(&dbName, envDbName, "", "database name (for postgres | mysql | mongo | s3 bucket)")
+	flag.StringVar(&dbUser, envDbUser, "", "database user (for postgres | mysql | mongo | s3 access key)")
+	flag.StringVar(&dbPass, envDbPass, "", "database password (for postgres | mysql | mongo | s3 secret key)")
+	flag.StringVar(&s3Region, envS3Region, "", "bucket region (for s3)")
+	flag.BoolVar(&s3UseSSL, envS3UseSSL, true, "connect with https (for s3)")
+	flag.StringVar(&clusterHttp, envClusterHttp, "127.0.0.1:7001", "ip:port of this node for forwarded requests, also its id (for cluster)")
+	flag.StringVar(&clusterRaft, envClusterRaft, "127.0.0.1:7000", "ip:port of this node for raft (for cluster)")
+	flag.StringVar(&clusterPeers, envClusterPeers, "", "all nodes as http_ip:port=raft_ip:port, comma separated (for cluster)")
+	flag.BoolVar(&clusterStale, envClusterStale, false, "read from the local copy instead of the leader (for cluster)")
+	flag.StringVar(&clusterSecret, envClusterSecret, "", "secret shared by the nodes to forward requests to each other (for cluster)")
+	flag.StringVar(&tieredCold, envTieredCold, SQLITE, "durable driver behind the memory tier, configured by the flags above (for tiered)")
+	flag.StringVar(&tieredMode, envTieredMode, "through", "write through | behind (for tiered)")
+	flag.StringVar(&tieredJournal, envTieredJournal, "./tiered.journal", "journal of the writes not flushed yet (for tiered behind)")
+	flag.IntVar(&tieredQueue, envTieredQueue, 1024, "writes waiting for the durable driver before blocking (for tiered behind)")
+	flag.IntVar(&tieredMaxItems, envTieredMaxItems, 0, "documents kept in memory, 0 for unlimited (for tiered)")
+	flag.IntVar(&tieredMaxBytes, envTieredMaxBytes, 0, "bytes kept in memory, 0 for unlimited (for tiered)")
+	flag.StringVar(&tieredWarm, envTieredWarm, "", "namespaces loaded in memory on startup, comma separated (for tiered)")
+	flag.StringVar(&compression, envCompression, "", "compression at rest as namespace=zstd|gzip|none, comma separated, * for any other namespace")
+	flag.DurationVar(&recompress, envRecompress, 0, "interval of the recompression job, 0 to run it only on startup")
+	flag.StringVar(&keyring, envKeyring, "./certs/keyring.json", "keyring file of the field encryption")
+	flag.StringVar(&encryptFields, envEncryptFields, "", "encrypted fields as namespace:/json/pointer[:deterministic], comma separated")
+	flag.Int64Var(&memMaxBytes, envMemMaxBytes, 0, "bytes kept before evicting the least recently used documents, 0 for unlimited (for memory)")
+	flag.StringVar(&memNsMaxBytes, envMemNsMaxBytes, "", "budget of some namespaces as namespace=bytes, comma separated, * for any other namespace (for memory)")
 
-	flag.StringVar(&dbDriver, envDbDriver, MEMORY, "db type to use (memory | fs | sqlite| postgres | mysql | redis | mongo)")
-	flag.StringVar(&dbPath, envDbPath, "./data", "path of the file storage (for fs | sqlite)")
-	flag.StringVar(&dbHost, envDbHost, "localhost", "database host (for postgres | mysql | redis | mongo)")
-	flag.StringVar(&dbName, envDbName, "", "database name (for postgres | mysql | mongo)")
-	flag.StringVar(&dbUser, envDbUser, "", "database user (for postgres | mysql | mongo)")
-	flag.StringVar(&dbPass, envDbPass, "", "database password (for postgres | mysql | mongo)")
+	flag.StringVar(&idStrategy, envIdStrategy, "", "ids of the documents posted without a key as namespace=uuidv7|ulid|sequence, comma separated, * for any other namespace (uuidv7 by default)")
+
+	flag.DurationVar(&searchTimeout, envSearchTimeout, service.DEFAULT_SEARCH_TIMEOUT, "execution time of a jq search")
+	flag.Int64Var(&slurpMaxBytes, envSlurpMaxBytes, service.DEFAULT_SLURP_MAX_BYTES, "stored bytes of a namespace a slurp search can read")
+
+	flag.StringVar(&textIndex, envTextIndex, "", "fields of the built-in full text index as namespace:/json/pointer, comma separated")
+	flag.BoolVar(&textStemming, envTextStemming, false, "strip the english suffixes of the terms of the built-in full text index")
+	flag.StringVar(&geoFields, envGeoFields, "", "GeoJSON Point field of some namespaces as namespace:/json/pointer, comma separated (2dsphere index on mongo, in-process index otherwise)")
 
 	flag.Parse()
 
@@ -77,5 +182,129 @@ func getConfig() Config {
 		BrokerEnabled:  brokerEnabled,
 		AuthEnabled:    authEnabled,
 		RawSqlEnabled:  rawSqlEnabled,
+		SqliteFts:      sqliteFts,
+		S3Region:       s3Region,
+		S3UseSSL:       s3UseSSL,
+		ClusterHttp:    clusterHttp,
+		ClusterRaft:    clusterRaft,
+		ClusterPeers:   strings.Split(clusterPeers, ","),
+		ClusterStale:   clusterStale,
+		ClusterSecret:  clusterSecret,
+		TieredCold:     tieredCold,
+		TieredMode:     tieredMode,
+		TieredJournal:  tieredJournal,
+		TieredQueue:    tieredQueue,
+		TieredMaxItems: tieredMaxItems,
+		TieredMaxBytes: tieredMaxBytes,
+		TieredWarm:     strings.Split(tieredWarm, ","),
+		Compression:    parseCompression(compression),
+		Recompress:     recompress,
+		Keyring:        keyring,
+		EncryptFields:  parseEncryptedFields(encryptFields),
+		MemMaxBytes:    memMaxBytes,
+		MemNsMaxBytes:  parseNamespaceBytes(memNsMaxBytes),
+		IdStrategies:   parseIdStrategies(idStrategy),
+		SearchTimeout:  searchTimeout,
+		SlurpMaxBytes:  slurpMaxBytes,
+		TextIndex:      parseTextIndex(textIndex),
+		TextStemming:   textStemming,
+		GeoFields:      parseGeoFields(geoFields),
+	}
+}
+
+func parseCompression(compression string) map[string]string {
+	ret := make(map[string]string)
+	for _, entry := range strings.Split(compression, ",") {
+		if entry == "" {
+			continue
+		}
+		namespace, format, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Fatalf("invalid compression '%v', expected namespace=format", entry)
+		}
+		ret[namespace] = format
+	}
+	return ret
+}
+
+func parseIdStrategies(strategies string) map[string]string {
+	ret := make(map[string]string)
+	for _, entry := range strings.Split(strategies, ",") {
+		if entry == "" {
+			continue
+		}
+		namespace, strategy, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Fatalf("invalid id strategy '%v', expected namespace=strategy", entry)
+		}
+		ret[namespace] = strategy
+	}
+	return ret
+}
+
+func parseNamespaceBytes(budgets string) map[string]int64 {
+	ret := make(map[string]int64)
+	for _, entry := range strings.Split(budgets, ",") {
+		if entry == "" {
+			continue
+		}
+		namespace, value, ok := strings.Cut(entry, "=")
+		size, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil {
+			log.Fatalf("invalid memory budget '%v', expected namespace=bytes", entry)
+		}
+		ret[namespace] = size
+	}
+	return ret
+}
+
+func parseEncryptedFields(fields string) map[string][]database.EncryptedField {
+	ret := make(map[string][]database.EncryptedField)
+	for _, entry := range strings.Split(fields, ",") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || !strings.HasPrefix(parts[1], "/") || (len(parts) == 3 && parts[2] != "deterministic") {
+			log.Fatalf("invalid encrypted field '%v', expected namespace:/json/pointer[:deterministic]", entry)
+		}
+		ret[parts[0]] = append(ret[parts[0]], database.EncryptedField{
+			Pointer:       parts[1],
+			Deterministic: len(parts) == 3,
+		})
+	}
+	return ret
+}
+
+func parseTextIndex(fields string) map[string][]string {
+	ret := make(map[string][]string)
+	for _, entry := range strings.Split(fields, ",") {
+		if entry == "" {
+			continue
+		}
+		namespace, pointer, ok := strings.Cut(entry, ":")
+		if !ok || !strings.HasPrefix(pointer, "/") {
+			log.Fatalf("invalid indexed field '%v', expected namespace:/json/pointer", entry)
+		}
+		ret[namespace] = append(ret[namespace], pointer)
+	}
+	return ret
+}
+
+func parseGeoFields(fields string) map[string]string {
+	ret := make(map[string]string)
+	for _, entry := range strings.Split(fields, ",") {
+		if entry == "" {
+			continue
+		}
+		namespace, pointer, ok := strings.Cut(entry, ":")
+		if !ok || !strings.HasPrefix(pointer, "/") {
+			log.Fatalf("invalid geo field '%v', expected namespace:/json/pointer", entry)
+		}
+		if _, found := ret[namespace]; found {
+			log.Fatalf("namespace '%v' can only have one geo field", namespace)
+		}
+		ret[namespace] = pointer
 	}
+	return ret
 }
@@ -0,0 +1,265 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	ACC_COUNT = "count"
+	ACC_SUM   = "sum"
+	ACC_AVG   = "avg"
+	ACC_MIN   = "min"
+	ACC_MAX   = "max"
+)
+
+// Aggregation groups the documents matching Where by the value of the GroupBy field (dotted path going through
+// objects), all of them in a single group when it is empty, and computes the accumulators of each group
+type Aggregation struct {
+	Where        []Condition
+	GroupBy      string
+	Accumulators []Accumulator
+}
+
+// Accumulator computes a value over the documents of a group. ACC_COUNT counts them, the others only read the
+// numbers found in Field: ACC_SUM is 0 and the others are nil when there are none.
+type Accumulator struct {
+	Operator string
+	Field    string
+}
+
+// AggregateGroup holds the value of the GroupBy field shared by the documents of a group, null for the ones without it,
+// and the value of each accumulator in their order: int64 for ACC_COUNT, float64 or nil for the others.
+// An aggregation without GroupBy always has a single group, of key null.
+type AggregateGroup struct {
+	Key    json.RawMessage
+	Values []interface{}
+}
+
+// ValidAccumulator reports whether the operator is one of the ACC_ ones
+func ValidAccumulator(operator string) bool {
+	switch operator {
+	case ACC_COUNT, ACC_SUM, ACC_AVG, ACC_MIN, ACC_MAX:
+		return true
+	}
+	return false
+}
+
+// numbersState holds what an accumulator has read of the numbers of a group
+type numbersState struct {
+	count    int64
+	sum      float64
+	min, max float64
+}
+
+type groupState struct {
+	key     json.RawMessage
+	count   int64
+	numbers []numbersState
+}
+
+func (g *groupState) result(a Aggregation) AggregateGroup {
+	values := make([]interface{}, len(a.Accumulators))
+	for i, accumulator := range a.Accumulators {
+		n := g.numbers[i]
+		switch {
+		case accumulator.Operator == ACC_COUNT:
+			values[i] = g.count
+		case accumulator.Operator == ACC_SUM:
+			values[i] = n.sum
+		case n.count == 0:
+			values[i] = nil
+		case accumulator.Operator == ACC_AVG:
+			values[i] = n.sum / float64(n.count)
+		case accumulator.Operator == ACC_MIN:
+			values[i] = n.min
+		case accumulator.Operator == ACC_MAX:
+			values[i] = n.max
+		}
+	}
+	return AggregateGroup{Key: g.key, Values: values}
+}
+
+// AggregateScan computes the aggregation over the documents read by scanRange, for the drivers which can't do it
+// themselves. The groups are kept in memory, one per distinct value of the GroupBy field.
+func AggregateScan(scanRange func(string, KeyRange, ScanFunc) *DbError, namespace string, a Aggregation) ([]AggregateGroup, *DbError) {
+	groups := make(map[string]*groupState)
+	var order []string
+	if a.GroupBy == "" {
+		groups["null"] = &groupState{key: json.RawMessage("null"), numbers: make([]numbersState, len(a.Accumulators))}
+		order = append(order, "null")
+	}
+	var err error
+	dbErr := scanRange(namespace, KeyRange{}, func(key string, value []byte) bool {
+		var document interface{}
+		err = json.Unmarshal(value, &document)
+		if err != nil {
+			return false
+		}
+		for _, condition := range a.Where {
+			if !condition.matches(document) {
+				return true
+			}
+		}
+		groupKey := []byte("null")
+		if a.GroupBy != "" {
+			groupValue, _ := fieldValue(document, a.GroupBy)
+			groupKey, err = json.Marshal(groupValue)
+			if err != nil {
+				return false
+			}
+		}
+		group, ok := groups[string(groupKey)]
+		if !ok {
+			group = &groupState{key: groupKey, numbers: make([]numbersState, len(a.Accumulators))}
+			groups[string(groupKey)] = group
+			order = append(order, string(groupKey))
+		}
+		group.count++
+		for i, accumulator := range a.Accumulators {
+			if accumulator.Operator == ACC_COUNT {
+				continue
+			}
+			number, ok := fieldNumber(document, accumulator.Field)
+			if !ok {
+				continue
+			}
+			n := &group.numbers[i]
+			if n.count == 0 || number < n.min {
+				n.min = number
+			}
+			if n.count == 0 || number > n.max {
+				n.max = number
+			}
+			n.count++
+			n.sum += number
+		}
+		return true
+	})
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Aggregate: %v", err),
+		}
+	}
+	ret := make([]AggregateGroup, len(order))
+	for i, groupKey := range order {
+		ret[i] = groups[groupKey].result(a)
+	}
+	return ret, nil
+}
+
+func fieldNumber(document interface{}, field string) (float64, bool) {
+	value, _ := fieldValue(document, field)
+	number, ok := value.(float64)
+	return number, ok
+}
+
+// emptyGroup is the single group of an aggregation without GroupBy over no documents
+func emptyGroup(a Aggregation) AggregateGroup {
+	group := groupState{key: json.RawMessage("null"), numbers: make([]numbersState, len(a.Accumulators))}
+	return group.result(a)
+}
+
+// canonicalKey rewrites a group key read from a database as encoding/json writes it, like the keys of AggregateScan
+func canonicalKey(raw []byte) (json.RawMessage, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// sqlAggregate writes the columns (the group key then each accumulator) and the WHERE and GROUP BY clauses
+// of the aggregation. ok is false when a field can't be written in sql, see fieldPaths.
+func (d sqlDialect) sqlAggregate(a Aggregation) (columns string, clauses string, args []interface{}, ok bool) {
+	clauses, args, ok = d.sqlWhere(KeyRange{}, a.Where)
+	if !ok {
+		return "", "", nil, false
+	}
+	selected := make([]string, 0, len(a.Accumulators)+1)
+	if a.GroupBy == "" {
+		selected = append(selected, "'null'")
+	} else {
+		path, ok := fieldPath(a.GroupBy)
+		if !ok {
+			return "", "", nil, false
+		}
+		selected = append(selected, d.groupKey(path))
+		clauses += " GROUP BY 1"
+	}
+	for _, accumulator := range a.Accumulators {
+		if accumulator.Operator == ACC_COUNT {
+			selected = append(selected, "COUNT(*)")
+			continue
+		}
+		path, ok := fieldPath(accumulator.Field)
+		if !ok {
+			return "", "", nil, false
+		}
+		number := d.number(path)
+		switch accumulator.Operator {
+		case ACC_SUM:
+			selected = append(selected, "COALESCE(SUM("+number+"), 0)")
+		default:
+			selected = append(selected, strings.ToUpper(accumulator.Operator)+"("+number+")")
+		}
+	}
+	return strings.Join(selected, ", "), clauses, args, true
+}
+
+// scanAggregateRows reads the (group key, accumulators...) rows of sqlAggregate
+func scanAggregateRows(rows *sql.Rows, a Aggregation) ([]AggregateGroup, *DbError) {
+	defer rows.Close()
+
+	var ret []AggregateGroup
+	var key []byte
+	counts := make([]int64, len(a.Accumulators))
+	numbers := make([]sql.NullFloat64, len(a.Accumulators))
+	dest := make([]interface{}, 0, len(a.Accumulators)+1)
+	dest = append(dest, &key)
+	for i, accumulator := range a.Accumulators {
+		if accumulator.Operator == ACC_COUNT {
+			dest = append(dest, &counts[i])
+		} else {
+			dest = append(dest, &numbers[i])
+		}
+	}
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", err),
+			}
+		}
+		group := AggregateGroup{Values: make([]interface{}, len(a.Accumulators))}
+		group.Key, err = canonicalKey(key)
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", err),
+			}
+		}
+		for i, accumulator := range a.Accumulators {
+			if accumulator.Operator == ACC_COUNT {
+				group.Values[i] = counts[i]
+			} else if numbers[i].Valid {
+				group.Values[i] = numbers[i].Float64
+			}
+		}
+		ret = append(ret, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("scan %v", err),
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,312 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bolt_fileName  = "unirest.db"
+	bolt_dbTimeout = 10 * time.Second
+)
+
+type BoltDatabase struct {
+	DirPath string
+
+	db *bolt.DB
+}
+
+func (b *BoltDatabase) Init() {
+	err := os.MkdirAll(b.DirPath, os.ModePerm)
+	if err != nil {
+		log.Fatalf("error on BoltDatabase Init: %v", err)
+	}
+	db, err := bolt.Open(filepath.Join(b.DirPath, bolt_fileName), 0600, &bolt.Options{Timeout: bolt_dbTimeout})
+	if err != nil {
+		log.Fatalf("error opening bolt file: %v", err)
+	}
+	b.db = db
+	log.Println("db connected")
+}
+
+func (b *BoltDatabase) Disconnect() {
+	err := b.db.Close()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("diconnected")
+}
+
+func (b *BoltDatabase) CreateNameSpace(namespace string) *DbError {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		return err
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("could not create namespace %v: %v", namespace, err),
+		}
+	}
+	return nil
+}
+
+func (b *BoltDatabase) GetNamespaces() []string {
+	ret := make([]string, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != sequences_namespace {
+				ret = append(ret, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("error on GetNamespaces: %v\n", err)
+	}
+	return ret
+}
+
+func (b *BoltDatabase) DropNameSpace(namespace string) *DbError {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(namespace))
+	})
+	if err == bolt.ErrBucketNotFound {
+		return namespaceNotFound(namespace)
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DropNameSpace: %v", err),
+		}
+	}
+	return nil
+}
+
+func (b *BoltDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	var dbErr *DbError
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		if !allowOverWrite && bucket.Get([]byte(key)) != nil {
+			dbErr = &DbError{
+				ErrorCode: ITEM_CONFLICT,
+				Message:   "item already exists",
+			}
+			return nil
+		}
+		return bucket.Put([]byte(key), value)
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Upsert: %v", err),
+		}
+	}
+	return dbErr
+}
+
+func (b *BoltDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	var ret []byte
+	var dbErr *DbError
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		val := bucket.Get([]byte(key))
+		if val == nil {
+			dbErr = &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+			}
+			return nil
+		}
+		// values are only valid for the life of the transaction
+		ret = append([]byte(nil), val...)
+		return nil
+	})
+	return ret, dbErr
+}
+
+func (b *BoltDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(b.Scan, namespace)
+}
+
+func (b *BoltDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return b.ScanRange(namespace, KeyRange{}, fn)
+}
+
+func (b *BoltDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	var dbErr *DbError
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		// the keys of a bucket are sorted
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek([]byte(r.lower())); k != nil; k, v = cursor.Next() {
+			key := string(k)
+			if r.past(key) {
+				return nil
+			}
+			if r.Contains(key) && !fn(key, append([]byte(nil), v...)) {
+				return nil
+			}
+		}
+		return nil
+	})
+	return dbErr
+}
+
+func (b *BoltDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	var dbErr *DbError
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek([]byte(r.lower())); k != nil; k, _ = cursor.Next() {
+			key := string(k)
+			if r.past(key) {
+				return nil
+			}
+			if r.Contains(key) && !fn(key) {
+				return nil
+			}
+		}
+		return nil
+	})
+	return dbErr
+}
+
+// Count reads the number of keys from the bucket statistics, without reading the values
+func (b *BoltDatabase) Count(namespace string) (int64, *DbError) {
+	var count int64
+	var dbErr *DbError
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		count = int64(bucket.Stats().KeyN)
+		return nil
+	})
+	return count, dbErr
+}
+
+// NextSequence uses the native sequence of a bucket per namespace, nested in the sequences_namespace bucket
+// so that it survives the deletion of the namespace
+func (b *BoltDatabase) NextSequence(namespace string) (int64, *DbError) {
+	var value uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		sequences, err := tx.CreateBucketIfNotExists([]byte(sequences_namespace))
+		if err != nil {
+			return err
+		}
+		bucket, err := sequences.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		value, err = bucket.NextSequence()
+		return err
+	})
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on NextSequence: %v", err),
+		}
+	}
+	return int64(value), nil
+}
+
+func (b *BoltDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	var dbErr *DbError
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		for _, key := range keys {
+			if v := bucket.Get([]byte(key)); v != nil {
+				ret[key] = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return ret, nil
+}
+
+func (b *BoltDatabase) Delete(namespace string, key string) *DbError {
+	var dbErr *DbError
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		if bucket.Get([]byte(key)) == nil {
+			dbErr = &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+			}
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Delete: %v", err),
+		}
+	}
+	return dbErr
+}
+
+func (b *BoltDatabase) DeleteAll(namespace string) *DbError {
+	var dbErr *DbError
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(namespace))
+		if err == bolt.ErrBucketNotFound {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte(namespace))
+		return err
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DeleteAll: %v", err),
+		}
+	}
+	return dbErr
+}
+
+func namespaceNotFound(namespace string) *DbError {
+	return &DbError{
+		ErrorCode: NAMESPACE_NOT_FOUND,
+		Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+	}
+}
@@ -0,0 +1,621 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	cluster_applyTimeout     = 10 * time.Second
+	cluster_leaderWait       = 5 * time.Second // for a leader to accept a command, before answering UNAVAILABLE
+	cluster_leaderRetry      = 50 * time.Millisecond
+	cluster_snapshotsRetain  = 2
+	cluster_maxPool          = 3
+	cluster_forwardPattern   = "/cluster/forward"
+	cluster_secretHeader     = "X-Cluster-Secret"
+	cluster_opUpsert         = "upsert"
+	cluster_opDelete         = "delete"
+	cluster_opDeleteAll      = "delete_all"
+	cluster_opGet            = "get"
+	cluster_opGetAll         = "get_all"
+	cluster_opGetMany        = "get_many"
+	cluster_opScanRange      = "scan_range"
+	cluster_opScanKeys       = "scan_keys"
+	cluster_opCount          = "count"
+	cluster_opGetNamespaces  = "get_namespaces"
+	cluster_opNextSequence   = "next_sequence"
+	cluster_opEvent          = "event"
+	cluster_logFileName      = "raft.db"
+	cluster_forwardMaxLength = 16 << 20
+	cluster_scanPage         = 256 // documents read by a request of a scan
+)
+
+// ClusterDatabase replicates a MemDatabase across several unirest processes with raft.
+// Writes are applied through the leader, followers forward them over http.
+// Reads are linearizable (served by the leader after a barrier) unless StaleReads is set,
+// in which case every node answers from its own copy.
+// The forwarding endpoint only accepts the requests carrying the Secret shared by the nodes, neither it nor the raft
+// transport are meant to be reachable from outside the network of the cluster.
+type ClusterDatabase struct {
+	HttpAddress string   // internal forwarding endpoint, also the raft id of the node
+	RaftAddress string   // raft transport
+	Peers       []string // every node of the cluster as "http_address=raft_address", this one included
+	DirPath     string   // raft log and snapshots
+	StaleReads  bool
+	Secret      string // required on the forwarding endpoint, mandatory with several nodes
+
+	mem      *MemDatabase
+	raft     *raft.Raft
+	store    *raftboltdb.BoltStore
+	server   *http.Server
+	client   *http.Client
+	replayed uint64 // last index of the log on startup, its events were delivered by the previous run
+	eventMu  sync.Mutex
+	onEvent  func(event []byte)
+	events   [][]byte      // applied, waiting for the callback
+	queued   chan struct{} // signals new events
+	stop     chan struct{}
+}
+
+type clusterCommand struct {
+	Op             string    `json:"op"`
+	Namespace      string    `json:"namespace,omitempty"`
+	Key            string    `json:"key,omitempty"`
+	Value          []byte    `json:"value,omitempty"`
+	AllowOverWrite bool      `json:"allow_overwrite,omitempty"`
+	Keys           []string  `json:"keys,omitempty"`
+	Range          *KeyRange `json:"range,omitempty"`
+	After          string    `json:"after,omitempty"` // a page of a scan starts after this key
+	Limit          int       `json:"limit,omitempty"` // the size of a page of a scan, 0 for the whole range
+}
+
+type clusterResponse struct {
+	Error      *DbError          `json:"error,omitempty"`
+	Value      []byte            `json:"value,omitempty"`
+	Values     map[string][]byte `json:"values,omitempty"`
+	Namespaces []string          `json:"namespaces,omitempty"`
+	Keys       []string          `json:"keys,omitempty"`
+	Count      int64             `json:"count,omitempty"`
+}
+
+func (c *ClusterDatabase) Init() {
+	c.mem = &MemDatabase{}
+	c.mem.Init()
+	c.client = &http.Client{Timeout: cluster_applyTimeout}
+
+	err := os.MkdirAll(c.DirPath, os.ModePerm)
+	if err != nil {
+		log.Fatalf("error on ClusterDatabase Init: %v", err)
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(c.HttpAddress)
+	config.LogLevel = "WARN"
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(c.DirPath, cluster_logFileName))
+	if err != nil {
+		log.Fatalf("error opening raft log: %v", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(c.DirPath, cluster_snapshotsRetain, os.Stderr)
+	if err != nil {
+		log.Fatalf("error opening raft snapshots: %v", err)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", c.RaftAddress)
+	if err != nil {
+		log.Fatalf("error resolving raft address: %v", err)
+	}
+	transport, err := raft.NewTCPTransport(c.RaftAddress, advertise, cluster_maxPool, cluster_applyTimeout, os.Stderr)
+	if err != nil {
+		log.Fatalf("error starting raft transport: %v", err)
+	}
+
+	c.queued = make(chan struct{}, 1)
+	c.stop = make(chan struct{})
+	go c.deliverEvents()
+	c.replayed, err = store.LastIndex()
+	if err != nil {
+		log.Fatalf("error reading raft log: %v", err)
+	}
+
+	r, err := raft.NewRaft(config, (*clusterFSM)(c), store, store, snapshots, transport)
+	if err != nil {
+		log.Fatalf("error starting raft: %v", err)
+	}
+	c.raft = r
+	c.store = store
+
+	// every node bootstraps with the same configuration, this is a no-op once the cluster has a state
+	configuration := raft.Configuration{}
+	peers := make([]string, 0, len(c.Peers))
+	for _, peer := range c.Peers {
+		if peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		peers = append(peers, c.HttpAddress+"="+c.RaftAddress) // single node cluster
+	}
+	if len(peers) > 1 && c.Secret == "" {
+		log.Fatalf("a cluster of several nodes needs a secret for its forwarding endpoint")
+	}
+	for _, peer := range peers {
+		httpAddress, raftAddress, ok := strings.Cut(peer, "=")
+		if !ok {
+			log.Fatalf("invalid cluster peer '%v', expected http_address=raft_address", peer)
+		}
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(httpAddress),
+			Address: raft.ServerAddress(raftAddress),
+		})
+	}
+	err = r.BootstrapCluster(configuration).Error()
+	if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+		log.Fatalf("error bootstrapping cluster: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cluster_forwardPattern, c.forwardHandler)
+	c.server = &http.Server{Addr: c.HttpAddress, Handler: mux}
+	listener, err := net.Listen("tcp", c.HttpAddress)
+	if err != nil {
+		log.Fatalf("error starting cluster forwarding: %v", err)
+	}
+	go c.server.Serve(listener)
+
+	log.Println("db connected")
+}
+
+func (c *ClusterDatabase) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), cluster_applyTimeout)
+	defer cancel()
+
+	c.server.Shutdown(ctx)
+	err := c.raft.Shutdown().Error()
+	close(c.stop)
+	if err == nil {
+		err = c.store.Close()
+	}
+	if err != nil {
+		panic(err)
+	}
+	log.Println("diconnected")
+}
+
+// PublishEvent appends a broker event to the raft log: once applied, every node hands it to its OnEvent callback,
+// this one included, in the order of the writes
+func (c *ClusterDatabase) PublishEvent(event []byte) *DbError {
+	return c.apply(clusterCommand{Op: cluster_opEvent, Value: event}).Error
+}
+
+// OnEvent sets the callback of the events published on any node of the cluster
+func (c *ClusterDatabase) OnEvent(fn func(event []byte)) {
+	c.eventMu.Lock()
+	defer c.eventMu.Unlock()
+	c.onEvent = fn
+}
+
+// deliverEvents hands the applied events to the callback in the order of the log. The raft goroutine only queues
+// them: a callback reading the cluster would wait for it.
+func (c *ClusterDatabase) deliverEvents() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.queued:
+		}
+		c.eventMu.Lock()
+		events, onEvent := c.events, c.onEvent
+		c.events = nil
+		c.eventMu.Unlock()
+		for _, event := range events {
+			if onEvent != nil {
+				onEvent(event)
+			}
+		}
+	}
+}
+
+// IsLeader tells if this node currently accepts the writes of the cluster
+func (c *ClusterDatabase) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+func (c *ClusterDatabase) CreateNameSpace(namespace string) *DbError {
+	// Do nothing
+	return nil
+}
+
+func (c *ClusterDatabase) GetNamespaces() []string {
+	resp := c.read(clusterCommand{Op: cluster_opGetNamespaces})
+	if resp.Error != nil {
+		log.Printf("error on GetNamespaces: %v\n", resp.Error)
+		return []string{}
+	}
+	return resp.Namespaces
+}
+
+func (c *ClusterDatabase) DropNameSpace(namespace string) *DbError {
+	// Do nothing
+	return nil
+}
+
+func (c *ClusterDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	return c.apply(clusterCommand{
+		Op:             cluster_opUpsert,
+		Namespace:      namespace,
+		Key:            key,
+		Value:          value,
+		AllowOverWrite: allowOverWrite,
+	}).Error
+}
+
+func (c *ClusterDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	resp := c.read(clusterCommand{Op: cluster_opGet, Namespace: namespace, Key: key})
+	return resp.Value, resp.Error
+}
+
+func (c *ClusterDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	resp := c.read(clusterCommand{Op: cluster_opGetAll, Namespace: namespace})
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.Values == nil {
+		resp.Values = make(map[string][]byte)
+	}
+	return resp.Values, nil
+}
+
+func (c *ClusterDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	resp := c.read(clusterCommand{Op: cluster_opGetMany, Namespace: namespace, Keys: keys})
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.Values == nil {
+		resp.Values = make(map[string][]byte)
+	}
+	return resp.Values, nil
+}
+
+func (c *ClusterDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return c.ScanRange(namespace, KeyRange{}, fn)
+}
+
+// ScanRange reads the range by pages of cluster_scanPage documents, the forwarding protocol can't stream.
+// Every page is read at once, the scan as a whole isn't a snapshot.
+func (c *ClusterDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	return c.scanPages(clusterCommand{Op: cluster_opScanRange, Namespace: namespace, Range: &r}, func(resp clusterResponse, key string) bool {
+		return fn(key, resp.Values[key])
+	})
+}
+
+// ScanKeys reads the keys of the range by pages, like ScanRange
+func (c *ClusterDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	return c.scanPages(clusterCommand{Op: cluster_opScanKeys, Namespace: namespace, Range: &r}, func(_ clusterResponse, key string) bool {
+		return fn(key)
+	})
+}
+
+// scanPages reads the pages of a scan until one comes back short, handing their keys to fn in order
+func (c *ClusterDatabase) scanPages(cmd clusterCommand, fn func(clusterResponse, string) bool) *DbError {
+	cmd.Limit = cluster_scanPage
+	for {
+		resp := c.read(cmd)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		for _, key := range resp.Keys {
+			if !fn(resp, key) {
+				return nil
+			}
+		}
+		if len(resp.Keys) < cmd.Limit {
+			return nil
+		}
+		cmd.After = resp.Keys[len(resp.Keys)-1]
+	}
+}
+
+func (c *ClusterDatabase) Count(namespace string) (int64, *DbError) {
+	resp := c.read(clusterCommand{Op: cluster_opCount, Namespace: namespace})
+	return resp.Count, resp.Error
+}
+
+// NextSequence goes through the raft log, so that every node agrees on the values given
+func (c *ClusterDatabase) NextSequence(namespace string) (int64, *DbError) {
+	resp := c.apply(clusterCommand{Op: cluster_opNextSequence, Namespace: namespace})
+	return resp.Count, resp.Error
+}
+
+func (c *ClusterDatabase) Delete(namespace string, key string) *DbError {
+	return c.apply(clusterCommand{Op: cluster_opDelete, Namespace: namespace, Key: key}).Error
+}
+
+func (c *ClusterDatabase) DeleteAll(namespace string) *DbError {
+	return c.apply(clusterCommand{Op: cluster_opDeleteAll, Namespace: namespace}).Error
+}
+
+// apply commits the write to the raft log, or forwards it to the leader
+func (c *ClusterDatabase) apply(cmd clusterCommand) clusterResponse {
+	return c.onLeader(cmd, c.applyLocal)
+}
+
+func (c *ClusterDatabase) applyLocal(cmd clusterCommand) clusterResponse {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return clusterError(err)
+	}
+	future := c.raft.Apply(data, cluster_applyTimeout)
+	if err := future.Error(); err != nil {
+		return clusterError(err)
+	}
+	switch resp := future.Response().(type) {
+	case clusterResponse:
+		return resp
+	case *DbError:
+		return clusterResponse{Error: resp}
+	}
+	return clusterResponse{}
+}
+
+// read answers from the local copy for stale reads, otherwise from the leader once
+// every entry committed before the read has been applied
+func (c *ClusterDatabase) read(cmd clusterCommand) clusterResponse {
+	if c.StaleReads {
+		return c.readLocal(cmd)
+	}
+	return c.onLeader(cmd, c.readLeader)
+}
+
+// readLeader reads on the leader, once every entry committed before has been applied
+func (c *ClusterDatabase) readLeader(cmd clusterCommand) clusterResponse {
+	if err := c.raft.Barrier(cluster_applyTimeout).Error(); err != nil {
+		return clusterError(err)
+	}
+	return c.readLocal(cmd)
+}
+
+// onLeader runs the command with local when this node is the leader, forwards it otherwise. The leader is
+// resolved again while the command certainly didn't reach one (no leader known, a node refusing it as it is no
+// longer the leader, or unreachable), for up to cluster_leaderWait.
+func (c *ClusterDatabase) onLeader(cmd clusterCommand, local func(clusterCommand) clusterResponse) clusterResponse {
+	deadline := time.Now().Add(cluster_leaderWait)
+	for {
+		var resp clusterResponse
+		var retry bool
+		if c.raft.State() == raft.Leader {
+			resp = local(cmd)
+			retry = resp.notLeader() // raft refuses the command before it enters the log
+		} else {
+			resp, retry = c.forward(cmd)
+		}
+		if !retry || time.Now().After(deadline) {
+			return resp
+		}
+		time.Sleep(cluster_leaderRetry)
+	}
+}
+
+func (c *ClusterDatabase) readLocal(cmd clusterCommand) clusterResponse {
+	switch cmd.Op {
+	case cluster_opGet:
+		value, dbErr := c.mem.Get(cmd.Namespace, cmd.Key)
+		return clusterResponse{Value: value, Error: dbErr}
+	case cluster_opGetAll:
+		values, dbErr := c.mem.GetAll(cmd.Namespace)
+		return clusterResponse{Values: values, Error: dbErr}
+	case cluster_opGetMany:
+		values, dbErr := c.mem.GetMany(cmd.Namespace, cmd.Keys)
+		return clusterResponse{Values: values, Error: dbErr}
+	case cluster_opScanRange:
+		keys := make([]string, 0)
+		values := make(map[string][]byte)
+		dbErr := c.mem.ScanRange(cmd.Namespace, cmd.page(), func(key string, value []byte) bool {
+			if key == cmd.After {
+				return true
+			}
+			keys = append(keys, key)
+			values[key] = value
+			return cmd.Limit == 0 || len(keys) < cmd.Limit
+		})
+		return clusterResponse{Keys: keys, Values: values, Error: dbErr}
+	case cluster_opScanKeys:
+		keys := make([]string, 0)
+		dbErr := c.mem.ScanKeys(cmd.Namespace, cmd.page(), func(key string) bool {
+			if key == cmd.After {
+				return true
+			}
+			keys = append(keys, key)
+			return cmd.Limit == 0 || len(keys) < cmd.Limit
+		})
+		return clusterResponse{Keys: keys, Error: dbErr}
+	case cluster_opCount:
+		count, dbErr := c.mem.Count(cmd.Namespace)
+		return clusterResponse{Count: count, Error: dbErr}
+	case cluster_opGetNamespaces:
+		return clusterResponse{Namespaces: c.mem.GetNamespaces()}
+	}
+	return clusterResponse{Error: &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("unknown cluster read '%v'", cmd.Op),
+	}}
+}
+
+// page is the range left to scan after the last key of the previous page
+func (cmd clusterCommand) page() KeyRange {
+	r := *cmd.Range
+	r.Start = max(r.Start, cmd.After)
+	return r
+}
+
+// forward sends the command to the current leader, retry tells that it certainly didn't reach one
+func (c *ClusterDatabase) forward(cmd clusterCommand) (clusterResponse, bool) {
+	_, leaderID := c.raft.LeaderWithID()
+	if leaderID == "" {
+		return clusterError(raft.ErrNotLeader), true
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return clusterError(err), false
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+string(leaderID)+cluster_forwardPattern, bytes.NewReader(data))
+	if err != nil {
+		return clusterError(err), false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(cluster_secretHeader, c.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		// a command never sent can be sent again, the others may have been applied
+		return clusterUnavailable(err), errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	defer resp.Body.Close()
+
+	var ret clusterResponse
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		return clusterError(err), false
+	}
+	return ret, resp.StatusCode == http.StatusMisdirectedRequest
+}
+
+func (c *ClusterDatabase) forwardHandler(w http.ResponseWriter, r *http.Request) {
+	// a single node without secret is never forwarded to
+	if c.Secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(cluster_secretHeader)), []byte(c.Secret)) != 1 {
+		http.Error(w, "invalid cluster secret", http.StatusForbidden)
+		return
+	}
+	var cmd clusterCommand
+	err := json.NewDecoder(io.LimitReader(r.Body, cluster_forwardMaxLength)).Decode(&cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp clusterResponse
+	switch {
+	case c.raft.State() != raft.Leader:
+		// never forward twice, the caller resolves the leader again
+		resp = clusterError(raft.ErrNotLeader)
+	case cmd.Op == cluster_opUpsert || cmd.Op == cluster_opDelete || cmd.Op == cluster_opDeleteAll || cmd.Op == cluster_opNextSequence || cmd.Op == cluster_opEvent:
+		resp = c.applyLocal(cmd)
+	default:
+		resp = c.readLeader(cmd)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.notLeader() {
+		w.WriteHeader(http.StatusMisdirectedRequest)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// clusterError is UNAVAILABLE for the errors of a leadership change, INTERNAL_ERROR otherwise
+func clusterError(err error) clusterResponse {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return clusterUnavailable(err)
+	}
+	return clusterResponse{Error: &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("cluster error: %v", err),
+	}}
+}
+
+// notLeader tells that the command was refused by a node which is not the leader, it wasn't applied
+func (r clusterResponse) notLeader() bool {
+	return r.Error != nil && r.Error.ErrorCode == UNAVAILABLE && r.Error.Message == clusterUnavailable(raft.ErrNotLeader).Error.Message
+}
+
+func clusterUnavailable(err error) clusterResponse {
+	return clusterResponse{Error: &DbError{
+		ErrorCode: UNAVAILABLE,
+		Message:   fmt.Sprintf("cluster error: %v", err),
+	}}
+}
+
+// clusterFSM applies the committed log entries to the local MemDatabase
+type clusterFSM ClusterDatabase
+
+func (f *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd clusterCommand
+	err := json.Unmarshal(entry.Data, &cmd)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("invalid cluster command: %v", err),
+		}
+	}
+	switch cmd.Op {
+	case cluster_opUpsert:
+		return f.mem.Upsert(cmd.Namespace, cmd.Key, cmd.Value, cmd.AllowOverWrite)
+	case cluster_opDelete:
+		return f.mem.Delete(cmd.Namespace, cmd.Key)
+	case cluster_opDeleteAll:
+		return f.mem.DeleteAll(cmd.Namespace)
+	case cluster_opNextSequence:
+		value, dbErr := f.mem.NextSequence(cmd.Namespace)
+		return clusterResponse{Count: value, Error: dbErr}
+	case cluster_opEvent:
+		if entry.Index > f.replayed {
+			f.eventMu.Lock()
+			f.events = append(f.events, cmd.Value)
+			f.eventMu.Unlock()
+			select {
+			case f.queued <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}
+	return &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("unknown cluster command '%v'", cmd.Op),
+	}
+}
+
+// Snapshot is never called concurrently with Apply, the copy is consistent with the log index
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return clusterSnapshot(f.mem.snapshot()), nil
+}
+
+func (f *clusterFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	var data map[string]map[string][]byte
+	err := json.NewDecoder(snapshot).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	f.mem.restore(data)
+	return nil
+}
+
+type clusterSnapshot map[string]map[string][]byte
+
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := json.NewEncoder(sink).Encode(s)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s clusterSnapshot) Release() {}
@@ -0,0 +1,375 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+
+	// COMPRESSION_ANY_NAMESPACE is the Namespaces entry applying to the namespaces not listed
+	COMPRESSION_ANY_NAMESPACE = "*"
+
+	compressed_lockStripes = 64
+	compressed_formatGzip  = 'g'
+	compressed_formatZstd  = 'z'
+)
+
+// compressed values start with this marker and a format byte, json never starts with a NUL
+// so compressed and plain values can live side by side in the same namespace
+var compressed_marker = []byte{0, 'U', 'Z'}
+
+// CompressedDatabase compresses the documents at rest around any driver storing raw bytes
+// (memory, fs, sqlite, bolt, redis, s3, git, tiered), the json columns of postgres, mysql and mongo can't hold them.
+// A background job rewrites the values stored with another format than the one of their namespace.
+type CompressedDatabase struct {
+	Backend
+	Namespaces         map[string]string // namespace -> COMPRESSION_*, namespaces not listed are left as they are
+	RecompressInterval time.Duration     // 0 recompresses only on startup
+
+	nsMu    sync.RWMutex // held for writing by the whole namespace operations
+	locks   [compressed_lockStripes]sync.Mutex
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (c *CompressedDatabase) Init() {
+	for namespace, format := range c.Namespaces {
+		if format != COMPRESSION_NONE && format != COMPRESSION_GZIP && format != COMPRESSION_ZSTD {
+			log.Fatalf("invalid compression '%v' for namespace %v", format, namespace)
+		}
+	}
+
+	c.Backend.Init()
+
+	var err error
+	c.encoder, err = zstd.NewWriter(nil)
+	if err == nil {
+		c.decoder, err = zstd.NewReader(nil)
+	}
+	if err != nil {
+		log.Fatalf("error on CompressedDatabase Init: %v", err)
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.recompressJob()
+}
+
+func (c *CompressedDatabase) Disconnect() {
+	close(c.stop)
+	<-c.done
+	c.encoder.Close()
+	c.decoder.Close()
+	c.Backend.Disconnect()
+}
+
+// Unwrap returns the wrapped driver
+func (c *CompressedDatabase) Unwrap() Backend {
+	return c.Backend
+}
+
+// Transparent is false, the wrapped driver stores compressed documents: only its capabilities handling no document
+// (evictions, existence) answer for the wrapper
+func (c *CompressedDatabase) Transparent() bool {
+	return false
+}
+
+func (c *CompressedDatabase) DropNameSpace(namespace string) *DbError {
+	return c.DropNameSpaceAs("", namespace)
+}
+
+func (c *CompressedDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	return c.UpsertAs("", namespace, key, value, allowOverWrite)
+}
+
+func (c *CompressedDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	value, err := c.Backend.Get(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(value)
+}
+
+func (c *CompressedDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	stored, err := c.Backend.GetAll(namespace)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(stored))
+	for key, value := range stored {
+		ret[key], err = c.decompress(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (c *CompressedDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	stored, err := c.Backend.GetMany(namespace, keys)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(stored))
+	for key, value := range stored {
+		ret[key], err = c.decompress(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (c *CompressedDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return c.ScanRange(namespace, KeyRange{}, fn)
+}
+
+func (c *CompressedDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	var err *DbError
+	scanErr := c.Backend.ScanRange(namespace, r, func(key string, stored []byte) bool {
+		var value []byte
+		value, err = c.decompress(stored)
+		return err == nil && fn(key, value)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+func (c *CompressedDatabase) Delete(namespace string, key string) *DbError {
+	return c.DeleteAs("", namespace, key)
+}
+
+func (c *CompressedDatabase) DeleteAll(namespace string) *DbError {
+	return c.DeleteAllAs("", namespace)
+}
+
+// The writes recording their user are given compressed to the wrapped driver when it records them too (git),
+// as the plain ones otherwise
+
+func (c *CompressedDatabase) CreateNameSpaceAs(user string, namespace string) *DbError {
+	if db, ok := c.Backend.(authoredBackend); ok {
+		return db.CreateNameSpaceAs(user, namespace)
+	}
+	return c.Backend.CreateNameSpace(namespace)
+}
+
+func (c *CompressedDatabase) DropNameSpaceAs(user string, namespace string) *DbError {
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+	if db, ok := c.Backend.(authoredBackend); ok {
+		return db.DropNameSpaceAs(user, namespace)
+	}
+	return c.Backend.DropNameSpace(namespace)
+}
+
+func (c *CompressedDatabase) UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	stored, err := c.compress(c.format(namespace), value)
+	if err != nil {
+		return err
+	}
+	unlock := c.lock(namespace, key)
+	defer unlock()
+	if db, ok := c.Backend.(authoredBackend); ok {
+		return db.UpsertAs(user, namespace, key, stored, allowOverWrite)
+	}
+	return c.Backend.Upsert(namespace, key, stored, allowOverWrite)
+}
+
+func (c *CompressedDatabase) DeleteAs(user string, namespace string, key string) *DbError {
+	unlock := c.lock(namespace, key)
+	defer unlock()
+	if db, ok := c.Backend.(authoredBackend); ok {
+		return db.DeleteAs(user, namespace, key)
+	}
+	return c.Backend.Delete(namespace, key)
+}
+
+func (c *CompressedDatabase) DeleteAllAs(user string, namespace string) *DbError {
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+	if db, ok := c.Backend.(authoredBackend); ok {
+		return db.DeleteAllAs(user, namespace)
+	}
+	return c.Backend.DeleteAll(namespace)
+}
+
+// Recompress rewrites the documents of the namespace stored with another format than the configured one,
+// it returns how many were rewritten
+func (c *CompressedDatabase) Recompress(namespace string) (int, *DbError) {
+	format := c.format(namespace)
+	if format == "" {
+		return 0, nil
+	}
+	stored, err := c.Backend.GetAll(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for key := range stored {
+		rewritten, err := c.recompressKey(namespace, key, format)
+		if err != nil {
+			return count, err
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// recompressKey reads the value again under the lock, so that a concurrent write or delete is never undone
+func (c *CompressedDatabase) recompressKey(namespace string, key string, format string) (bool, *DbError) {
+	unlock := c.lock(namespace, key)
+	defer unlock()
+
+	stored, err := c.Backend.Get(namespace, key)
+	if err != nil {
+		if err.ErrorCode == ID_NOT_FOUND || err.ErrorCode == NAMESPACE_NOT_FOUND {
+			return false, nil
+		}
+		return false, err
+	}
+	if storedFormat(stored) == format {
+		return false, nil
+	}
+	value, err := c.decompress(stored)
+	if err == nil {
+		stored, err = c.compress(format, value)
+	}
+	if err == nil {
+		err = c.Backend.Upsert(namespace, key, stored, true)
+	}
+	return err == nil, err
+}
+
+func (c *CompressedDatabase) recompressJob() {
+	defer close(c.done)
+
+	var tick <-chan time.Time
+	if c.RecompressInterval > 0 {
+		ticker := time.NewTicker(c.RecompressInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		for _, namespace := range c.Backend.GetNamespaces() {
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			count, err := c.Recompress(namespace)
+			if err != nil {
+				log.Printf("error recompressing namespace %v: %v\n", namespace, err.Message)
+			}
+			if count > 0 {
+				log.Printf("recompressed %d documents of namespace %v\n", count, namespace)
+			}
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-tick:
+		}
+	}
+}
+
+func (c *CompressedDatabase) format(namespace string) string {
+	if format, ok := c.Namespaces[namespace]; ok {
+		return format
+	}
+	return c.Namespaces[COMPRESSION_ANY_NAMESPACE]
+}
+
+// lock serializes the writes of a document with the recompression job
+func (c *CompressedDatabase) lock(namespace string, key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	stripe := &c.locks[h.Sum32()%compressed_lockStripes]
+
+	c.nsMu.RLock()
+	stripe.Lock()
+	return func() {
+		stripe.Unlock()
+		c.nsMu.RUnlock()
+	}
+}
+
+func (c *CompressedDatabase) compress(format string, value []byte) ([]byte, *DbError) {
+	switch format {
+	case COMPRESSION_ZSTD:
+		dst := append(append([]byte{}, compressed_marker...), compressed_formatZstd)
+		return c.encoder.EncodeAll(value, dst), nil
+	case COMPRESSION_GZIP:
+		buf := bytes.NewBuffer(append(append([]byte{}, compressed_marker...), compressed_formatGzip))
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(value)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error compressing value: %v", err),
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	return value, nil
+}
+
+func (c *CompressedDatabase) decompress(stored []byte) ([]byte, *DbError) {
+	var value []byte
+	var err error
+	switch storedFormat(stored) {
+	case COMPRESSION_ZSTD:
+		value, err = c.decoder.DecodeAll(stored[len(compressed_marker)+1:], nil)
+	case COMPRESSION_GZIP:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(stored[len(compressed_marker)+1:]))
+		if err == nil {
+			value, err = io.ReadAll(r)
+		}
+	default:
+		return stored, nil
+	}
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error decompressing value: %v", err),
+		}
+	}
+	return value, nil
+}
+
+func storedFormat(stored []byte) string {
+	if len(stored) <= len(compressed_marker) || !bytes.HasPrefix(stored, compressed_marker) {
+		return COMPRESSION_NONE
+	}
+	switch stored[len(compressed_marker)] {
+	case compressed_formatZstd:
+		return COMPRESSION_ZSTD
+	case compressed_formatGzip:
+		return COMPRESSION_GZIP
+	}
+	return COMPRESSION_NONE
+}
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// sequences_namespace stores the counters of NextSequence in the drivers keeping them beside the namespaces,
+// it is hidden from GetNamespaces and can't clash with a namespace of the api, those never start with an underscore
+const sequences_namespace = "_sequences"
+
+// Document is a single key/value pair, used where the order of the results matters
+type Document struct {
+	Key   string
+	Value []byte
+}
+
+// ScanFunc receives the documents of a Scan in ascending key order, it returns false to stop the scan
+type ScanFunc func(key string, value []byte) bool
+
+// KeyFunc receives the keys of a ScanKeys in ascending order, it returns false to stop the scan
+type KeyFunc func(key string) bool
+
+// KeyRange selects the keys starting with Prefix and between Start and End included, an empty field doesn't restrict
+type KeyRange struct {
+	Prefix string `json:"prefix,omitempty"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+}
+
+func (r KeyRange) Contains(key string) bool {
+	return strings.HasPrefix(key, r.Prefix) && key >= r.Start && (r.End == "" || key <= r.End)
+}
+
+// past reports whether the key sorts after every key of the range, an ascending scan can stop there
+func (r KeyRange) past(key string) bool {
+	return (r.End != "" && key > r.End) || (key > r.Prefix && !strings.HasPrefix(key, r.Prefix))
+}
+
+// lower is the first key of the range
+func (r KeyRange) lower() string {
+	return max(r.Start, r.Prefix)
+}
+
+// prefixEnd is the first key after the ones starting with the prefix, "" when there is none
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// sqlRange is the WHERE clause selecting the keys of the range, placeholder numbers the parameters from 1.
+// collate is appended to the id so that it compares in byte order, like KeyRange, whatever the collation of the column.
+func sqlRange(r KeyRange, placeholder func(int) string, collate string) (string, []interface{}) {
+	conditions := make([]string, 0, 3)
+	args := make([]interface{}, 0, 3)
+	add := func(operator string, bound string) {
+		args = append(args, bound)
+		conditions = append(conditions, fmt.Sprintf("id%v %v %v", collate, operator, placeholder(len(args))))
+	}
+	if lower := r.lower(); lower != "" {
+		add(">=", lower)
+	}
+	if r.End != "" {
+		add("<=", r.End)
+	}
+	if end := prefixEnd(r.Prefix); end != "" {
+		add("<", end)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// sqlIn is the WHERE clause selecting the keys, placeholder numbers the parameters from 1
+func sqlIn(keys []string, placeholder func(int) string) (string, []interface{}) {
+	placeholders := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		placeholders[i] = placeholder(i + 1)
+		args[i] = key
+	}
+	return " WHERE id IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// scanKeys calls fn on the documents of the sorted keys belonging to the range, read one by one with get.
+// The keys deleted since they were listed are skipped.
+func scanKeys(keys []string, r KeyRange, namespace string, get func(string, string) ([]byte, *DbError), fn ScanFunc) *DbError {
+	for _, key := range keys[sort.SearchStrings(keys, r.lower()):] {
+		if r.past(key) {
+			return nil
+		}
+		if !r.Contains(key) {
+			continue
+		}
+		value, err := get(namespace, key)
+		if err != nil && err.ErrorCode == ID_NOT_FOUND {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// filterKeys calls fn on the sorted keys belonging to the range
+func filterKeys(keys []string, r KeyRange, fn KeyFunc) {
+	for _, key := range keys[sort.SearchStrings(keys, r.lower()):] {
+		if r.past(key) {
+			return
+		}
+		if r.Contains(key) && !fn(key) {
+			return
+		}
+	}
+}
+
+// getMany reads the keys one by one, for the drivers without a native multi-get. Missing keys are left out.
+func getMany(get func(string, string) ([]byte, *DbError), namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, err := get(namespace, key)
+		if err != nil && err.ErrorCode == ID_NOT_FOUND {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = value
+	}
+	return ret, nil
+}
+
+// collect gathers the documents of a scan, for the drivers implementing GetAll on top of Scan
+func collect(scan func(string, ScanFunc) *DbError, namespace string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte)
+	err := scan(namespace, func(key string, value []byte) bool {
+		ret[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// scanMap calls fn on the documents of data belonging to the range in ascending key order
+func scanMap(data map[string][]byte, r KeyRange, fn ScanFunc) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if r.Contains(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, data[key]) {
+			return
+		}
+	}
+}
+
+// scanKeyRows hands the id rows to fn, the query must sort them by id
+func scanKeyRows(rows *sql.Rows, fn KeyFunc) *DbError {
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		scanErr := rows.Scan(&id)
+		if scanErr != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", scanErr),
+			}
+		}
+		if !fn(id) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("scan %v", err),
+		}
+	}
+	return nil
+}
+
+// scanRows hands the (id, data) rows to fn, the query must sort them by id
+func scanRows(rows *sql.Rows, fn ScanFunc) *DbError {
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, data string
+		scanErr := rows.Scan(&id, &data)
+		if scanErr != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", scanErr),
+			}
+		}
+		if !fn(id, []byte(data)) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("scan %v", err),
+		}
+	}
+	return nil
+}
+
+// fieldNamePattern matches the names of a projection which can be written in a query as they are
+var fieldNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// fieldPaths splits the dotted fields of a projection, the ones inside another field of the list are dropped.
+// ok is false when a name doesn't match fieldNamePattern, the projection can't be pushed down then.
+func fieldPaths(fields []string) ([][]string, bool) {
+	sorted := append([]string{}, fields...)
+	sort.Strings(sorted)
+	kept := make([]string, 0, len(sorted))
+	paths := make([][]string, 0, len(sorted))
+	for _, field := range sorted {
+		if slices.ContainsFunc(kept, func(k string) bool { return field == k || strings.HasPrefix(field, k+".") }) {
+			continue
+		}
+		path := strings.Split(field, ".")
+		for _, name := range path {
+			if !fieldNamePattern.MatchString(name) {
+				return nil, false
+			}
+		}
+		kept = append(kept, field)
+		paths = append(paths, path)
+	}
+	return paths, true
+}
+
+// sqlJsonPath is the sqlite and mysql path of the field, like $."address"."city"
+func sqlJsonPath(path []string) string {
+	return `$."` + strings.Join(path, `"."`) + `"`
+}
+
+// projectedDocument nests the raw json values under their path, a nil value is a missing field
+func projectedDocument(paths [][]string, values [][]byte) ([]byte, error) {
+	document := make(map[string]interface{})
+	for i, path := range paths {
+		if values[i] == nil {
+			continue
+		}
+		parent := document
+		for _, name := range path[:len(path)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = json.RawMessage(values[i])
+	}
+	return json.Marshal(document)
+}
+
+// scanFieldRows hands the (id, value of each path...) rows to fn as the documents holding the fields found,
+// the query must sort them by id
+func scanFieldRows(rows *sql.Rows, paths [][]string, fn ScanFunc) *DbError {
+	defer rows.Close()
+
+	var id string
+	values := make([][]byte, len(paths))
+	dest := make([]interface{}, 0, len(paths)+1)
+	dest = append(dest, &id)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	for rows.Next() {
+		scanErr := rows.Scan(dest...)
+		if scanErr != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", scanErr),
+			}
+		}
+		document, err := projectedDocument(paths, values)
+		if err != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", err),
+			}
+		}
+		if !fn(id, document) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("scan %v", err),
+		}
+	}
+	return nil
+}
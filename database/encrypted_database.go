@@ -0,0 +1,531 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	encrypted_prefix        = "enc:"
+	encrypted_random        = "r2" // AES-GCM with a random nonce
+	encrypted_deterministic = "d2" // AES-GCM with a nonce derived from the value
+	// first format, the key of the keyring was used both for AES-GCM and the HMAC of the nonce: only read,
+	// the re-encryption job rewrites such values
+	encrypted_legacyRandom        = "r"
+	encrypted_legacyDeterministic = "d"
+	encrypted_lockStripes         = 64
+	encrypted_keySize             = 32 // AES-256
+)
+
+// labels of the subkeys derived from each key of the keyring
+var (
+	encrypted_aeadLabel  = []byte("unirest field encryption: aes-gcm")
+	encrypted_nonceLabel = []byte("unirest field encryption: deterministic nonce")
+)
+
+// EncryptedField is a field of the documents of a namespace encrypted at rest
+type EncryptedField struct {
+	Pointer       string // json pointer (rfc 6901) of the field, like /ssn or /address/zip
+	Deterministic bool   // equal values give equal ciphertexts, which allows equality searches
+}
+
+// keyring file:
+//
+//	{"active": "2024-06", "keys": {"2024-06": "<base64 of 32 bytes>", "2023-01": "<base64 of 32 bytes>"}}
+//
+// new values are encrypted with the active key, the other ones are kept to read the older values
+type encryptedKeyring struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// EncryptedDatabase encrypts some fields of the documents with AES-GCM before they reach the wrapped driver,
+// and decrypts them on read. An encrypted field holds a string "enc:<mode>:<key id>:<base64 nonce+ciphertext>",
+// the json value of the field being the plaintext. Documents of namespaces without encrypted fields are untouched.
+type EncryptedDatabase struct {
+	Backend
+	KeyringPath string
+	Fields      map[string][]EncryptedField // namespace -> encrypted fields
+	Envelope    string                      // pointer of the document in the stored value, /data when the server wraps it in a payload
+
+	activeKey   string
+	aeads       map[string]cipher.AEAD // key id -> AES-GCM with the subkey derived from the key
+	legacyAeads map[string]cipher.AEAD // key id -> AES-GCM with the key itself
+	nonceKeys   map[string][]byte      // key id -> HMAC subkey of the deterministic nonces
+	nsMu        sync.RWMutex           // held for writing by the whole namespace operations
+	locks       [encrypted_lockStripes]sync.Mutex
+}
+
+func (e *EncryptedDatabase) Init() {
+	content, err := os.ReadFile(e.KeyringPath)
+	if err != nil {
+		log.Fatalf("error reading keyring: %v", err)
+	}
+	var keyring encryptedKeyring
+	err = json.Unmarshal(content, &keyring)
+	if err != nil {
+		log.Fatalf("error parsing keyring: %v", err)
+	}
+	if _, ok := keyring.Keys[keyring.Active]; !ok {
+		log.Fatalf("active key '%v' is not in the keyring", keyring.Active)
+	}
+
+	e.activeKey = keyring.Active
+	e.aeads = make(map[string]cipher.AEAD, len(keyring.Keys))
+	e.legacyAeads = make(map[string]cipher.AEAD, len(keyring.Keys))
+	e.nonceKeys = make(map[string][]byte, len(keyring.Keys))
+	for id, encoded := range keyring.Keys {
+		if strings.Contains(id, ":") {
+			log.Fatalf("invalid key id '%v', ':' is not allowed", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != encrypted_keySize {
+			log.Fatalf("key '%v' must be %d bytes encoded in base64", id, encrypted_keySize)
+		}
+		e.aeads[id], err = newAead(deriveKey(key, encrypted_aeadLabel))
+		if err == nil {
+			e.legacyAeads[id], err = newAead(key)
+		}
+		if err != nil {
+			log.Fatalf("error on key '%v': %v", id, err)
+		}
+		e.nonceKeys[id] = deriveKey(key, encrypted_nonceLabel)
+	}
+
+	e.Backend.Init()
+}
+
+// EncryptedFields lists the encrypted fields of the namespace
+func (e *EncryptedDatabase) EncryptedFields(namespace string) []EncryptedField {
+	return e.Fields[namespace]
+}
+
+// Unwrap returns the wrapped driver
+func (e *EncryptedDatabase) Unwrap() Backend {
+	return e.Backend
+}
+
+// Transparent is false, the wrapped driver stores encrypted fields: only its capabilities handling no document
+// (evictions, existence) answer for the wrapper
+func (e *EncryptedDatabase) Transparent() bool {
+	return false
+}
+
+func (e *EncryptedDatabase) DropNameSpace(namespace string) *DbError {
+	return e.DropNameSpaceAs("", namespace)
+}
+
+func (e *EncryptedDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	return e.UpsertAs("", namespace, key, value, allowOverWrite)
+}
+
+func (e *EncryptedDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	stored, err := e.Backend.Get(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.transform(namespace, stored, e.decrypt)
+}
+
+func (e *EncryptedDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	stored, err := e.Backend.GetAll(namespace)
+	if err != nil || len(e.Fields[namespace]) == 0 {
+		return stored, err
+	}
+	ret := make(map[string][]byte, len(stored))
+	for key, value := range stored {
+		ret[key], err = e.transform(namespace, value, e.decrypt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (e *EncryptedDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	stored, err := e.Backend.GetMany(namespace, keys)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(stored))
+	for key, value := range stored {
+		ret[key], err = e.transform(namespace, value, e.decrypt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (e *EncryptedDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return e.ScanRange(namespace, KeyRange{}, fn)
+}
+
+func (e *EncryptedDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	if len(e.Fields[namespace]) == 0 {
+		return e.Backend.ScanRange(namespace, r, fn)
+	}
+	var err *DbError
+	scanErr := e.Backend.ScanRange(namespace, r, func(key string, stored []byte) bool {
+		var value []byte
+		value, err = e.transform(namespace, stored, e.decrypt)
+		return err == nil && fn(key, value)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+func (e *EncryptedDatabase) Delete(namespace string, key string) *DbError {
+	return e.DeleteAs("", namespace, key)
+}
+
+func (e *EncryptedDatabase) DeleteAll(namespace string) *DbError {
+	return e.DeleteAllAs("", namespace)
+}
+
+// The writes recording their user are given encrypted to the wrapped driver when it records them too (git),
+// as the plain ones otherwise
+
+func (e *EncryptedDatabase) CreateNameSpaceAs(user string, namespace string) *DbError {
+	if db, ok := e.Backend.(authoredBackend); ok {
+		return db.CreateNameSpaceAs(user, namespace)
+	}
+	return e.Backend.CreateNameSpace(namespace)
+}
+
+func (e *EncryptedDatabase) DropNameSpaceAs(user string, namespace string) *DbError {
+	e.nsMu.Lock()
+	defer e.nsMu.Unlock()
+	if db, ok := e.Backend.(authoredBackend); ok {
+		return db.DropNameSpaceAs(user, namespace)
+	}
+	return e.Backend.DropNameSpace(namespace)
+}
+
+func (e *EncryptedDatabase) UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	stored, err := e.transform(namespace, value, e.encrypt)
+	if err != nil {
+		return err
+	}
+	unlock := e.lock(namespace, key)
+	defer unlock()
+	if db, ok := e.Backend.(authoredBackend); ok {
+		return db.UpsertAs(user, namespace, key, stored, allowOverWrite)
+	}
+	return e.Backend.Upsert(namespace, key, stored, allowOverWrite)
+}
+
+func (e *EncryptedDatabase) DeleteAs(user string, namespace string, key string) *DbError {
+	unlock := e.lock(namespace, key)
+	defer unlock()
+	if db, ok := e.Backend.(authoredBackend); ok {
+		return db.DeleteAs(user, namespace, key)
+	}
+	return e.Backend.Delete(namespace, key)
+}
+
+func (e *EncryptedDatabase) DeleteAllAs(user string, namespace string) *DbError {
+	e.nsMu.Lock()
+	defer e.nsMu.Unlock()
+	if db, ok := e.Backend.(authoredBackend); ok {
+		return db.DeleteAllAs(user, namespace)
+	}
+	return e.Backend.DeleteAll(namespace)
+}
+
+// Reencrypt rewrites the documents of the namespace having a field encrypted with another key than the active one,
+// or not encrypted yet. It returns how many were rewritten.
+func (e *EncryptedDatabase) Reencrypt(namespace string) (int, *DbError) {
+	if len(e.Fields[namespace]) == 0 {
+		return 0, nil
+	}
+	stored, err := e.Backend.GetAll(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for key := range stored {
+		rewritten, err := e.reencryptKey(namespace, key)
+		if err != nil {
+			return count, err
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reencryptKey reads the value again under the lock, so that a concurrent write or delete is never undone
+func (e *EncryptedDatabase) reencryptKey(namespace string, key string) (bool, *DbError) {
+	unlock := e.lock(namespace, key)
+	defer unlock()
+
+	stored, err := e.Backend.Get(namespace, key)
+	if err != nil {
+		if err.ErrorCode == ID_NOT_FOUND || err.ErrorCode == NAMESPACE_NOT_FOUND {
+			return false, nil
+		}
+		return false, err
+	}
+	stale := false
+	_, err = e.transform(namespace, stored, func(namespace string, field EncryptedField, value interface{}) (interface{}, *DbError) {
+		mode, keyId, ok := e.parse(value)
+		stale = stale || !ok || keyId != e.activeKey || mode == encrypted_legacyRandom || mode == encrypted_legacyDeterministic
+		return value, nil
+	})
+	if err != nil || !stale {
+		return false, err
+	}
+
+	value, err := e.transform(namespace, stored, e.decrypt)
+	if err == nil {
+		stored, err = e.transform(namespace, value, e.seal)
+	}
+	if err == nil {
+		err = e.Backend.Upsert(namespace, key, stored, true)
+	}
+	return err == nil, err
+}
+
+// transform applies fn to the encrypted fields present in the document
+func (e *EncryptedDatabase) transform(namespace string, document []byte, fn func(string, EncryptedField, interface{}) (interface{}, *DbError)) ([]byte, *DbError) {
+	fields := e.Fields[namespace]
+	if len(fields) == 0 {
+		return document, nil
+	}
+
+	var parsed interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error parsing document: %v", err),
+		}
+	}
+	// the fields are pointed at from the document, inside the envelope if any
+	root := parsed
+	if e.Envelope != "" {
+		parent, last, ok := resolvePointer(parsed, e.Envelope)
+		if !ok {
+			return document, nil
+		}
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			root = container[last]
+		case []interface{}:
+			i, _ := strconv.Atoi(last)
+			root = container[i]
+		}
+	}
+	for _, field := range fields {
+		parent, last, ok := resolvePointer(root, field.Pointer)
+		if !ok {
+			continue
+		}
+		var dbErr *DbError
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[last], dbErr = fn(namespace, field, container[last])
+		case []interface{}:
+			i, _ := strconv.Atoi(last)
+			container[i], dbErr = fn(namespace, field, container[i])
+		}
+		if dbErr != nil {
+			return nil, dbErr
+		}
+	}
+	ret, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error serializing document: %v", err),
+		}
+	}
+	return ret, nil
+}
+
+// encrypt encrypts the value of a field written by a client, a value in the format of the encrypted fields is
+// refused: it would be taken for a ciphertext on read
+func (e *EncryptedDatabase) encrypt(namespace string, field EncryptedField, value interface{}) (interface{}, *DbError) {
+	if _, _, ok := e.parse(value); ok {
+		return nil, &DbError{
+			ErrorCode: INVALID_DOCUMENT,
+			Message:   fmt.Sprintf("field %v can't start with '%v'", field.Pointer, encrypted_prefix),
+		}
+	}
+	return e.seal(namespace, field, value)
+}
+
+// seal encrypts the value with the active key
+func (e *EncryptedDatabase) seal(namespace string, field EncryptedField, value interface{}) (interface{}, *DbError) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error encrypting field %v: %v", field.Pointer, err),
+		}
+	}
+
+	aead := e.aeads[e.activeKey]
+	additionalData := []byte(namespace + "\x00" + field.Pointer)
+	nonce := make([]byte, aead.NonceSize())
+	mode := encrypted_random
+	if field.Deterministic {
+		// synthetic nonce, only equal values of the same field share it
+		mac := hmac.New(sha256.New, e.nonceKeys[e.activeKey])
+		mac.Write(additionalData)
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+		mode = encrypted_deterministic
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error encrypting field %v: %v", field.Pointer, err),
+		}
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return encrypted_prefix + mode + ":" + e.activeKey + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (e *EncryptedDatabase) decrypt(namespace string, field EncryptedField, value interface{}) (interface{}, *DbError) {
+	mode, keyId, ok := e.parse(value)
+	if !ok {
+		return value, nil // written before the field was encrypted
+	}
+	aeads := e.aeads
+	if mode == encrypted_legacyRandom || mode == encrypted_legacyDeterministic {
+		aeads = e.legacyAeads
+	}
+	aead, ok := aeads[keyId]
+	if !ok {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("field %v is encrypted with the key '%v' which is not in the keyring", field.Pointer, keyId),
+		}
+	}
+
+	encoded := value.(string)
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded[strings.LastIndex(encoded, ":")+1:])
+	var plaintext []byte
+	if err == nil && len(sealed) >= aead.NonceSize() {
+		plaintext, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(namespace+"\x00"+field.Pointer))
+	}
+	var ret interface{}
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(plaintext))
+		decoder.UseNumber()
+		err = decoder.Decode(&ret)
+	}
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error decrypting field %v", field.Pointer),
+		}
+	}
+	return ret, nil
+}
+
+// parse returns the mode of the value and the id of the key it is encrypted with, if it is encrypted
+func (e *EncryptedDatabase) parse(value interface{}) (string, string, bool) {
+	str, ok := value.(string)
+	if !ok || !strings.HasPrefix(str, encrypted_prefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(str, encrypted_prefix), ":", 3)
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case encrypted_random, encrypted_deterministic, encrypted_legacyRandom, encrypted_legacyDeterministic:
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// deriveKey derives the subkey of the label from a key of the keyring (HKDF-Expand with SHA-256, one block)
+func deriveKey(key []byte, label []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(label)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// lock serializes the writes of a document with the re-encryption job
+func (e *EncryptedDatabase) lock(namespace string, key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	stripe := &e.locks[h.Sum32()%encrypted_lockStripes]
+
+	e.nsMu.RLock()
+	stripe.Lock()
+	return func() {
+		stripe.Unlock()
+		e.nsMu.RUnlock()
+	}
+}
+
+// resolvePointer returns the container of the value pointed at and its key in the container
+func resolvePointer(document interface{}, pointer string) (interface{}, string, bool) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, "", false
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	current := document
+	for i, token := range tokens {
+		var next interface{}
+		switch container := current.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, "", false
+			}
+			next = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil, "", false
+			}
+			next = container[index]
+		default:
+			return nil, "", false
+		}
+		if i == len(tokens)-1 {
+			return current, token, true
+		}
+		current = next
+	}
+	return nil, "", false
+}
@@ -11,6 +11,10 @@ const (
 	UNABLE_TO_CREATE_TABLE ErrorCode = 3
 	FILESYSTEM_ERROR       ErrorCode = 4
 	ITEM_CONFLICT          ErrorCode = 5
+	NOT_SUPPORTED          ErrorCode = 6
+	INVALID_QUERY          ErrorCode = 7
+	UNAVAILABLE            ErrorCode = 8 // transient, like a cluster without leader: the request can be retried
+	INVALID_DOCUMENT       ErrorCode = 9 // the document can't be stored as it is, the request must be changed
 )
 
 type DbError struct {
@@ -6,11 +6,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type StorageDatabase struct {
 	RootDirPath string
+
+	sequenceMu sync.Mutex
 }
 
 func (s *StorageDatabase) Init() {
@@ -46,7 +51,7 @@ func (s *StorageDatabase) GetNamespaces() []string {
 	}
 
 	for _, ns := range namespaces {
-		if ns.IsDir() {
+		if ns.IsDir() && ns.Name() != sequences_namespace {
 			results = append(results, ns.Name())
 		}
 	}
@@ -102,21 +107,60 @@ func (s *StorageDatabase) Upsert(namespace string, key string, value []byte, all
 }
 
 func (s *StorageDatabase) Get(namespace string, key string) ([]byte, *DbError) {
-	filePath := s.getFilePath(namespace, key)
-	bytes, err := os.ReadFile(filepath.Clean(filePath))
+	return s.read(namespace, key)
+}
+
+// Exists stats the file of the document
+func (s *StorageDatabase) Exists(namespace string, key string) *DbError {
+	_, err := os.Stat(filepath.Clean(s.getFilePath(namespace, key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
 	if err != nil {
-		return nil, &DbError{
+		return &DbError{
 			ErrorCode: FILESYSTEM_ERROR,
 			Message:   err.Error(),
 		}
-	} else {
-		return bytes, nil
 	}
+	return nil
 }
 
 func (s *StorageDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
-	result := make(map[string][]byte)
+	return collect(s.Scan, namespace)
+}
 
+func (s *StorageDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return s.ScanRange(namespace, KeyRange{}, fn)
+}
+
+// ScanRange lists the file names, only the documents of the range are read
+func (s *StorageDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	keys, err := s.listKeys(namespace)
+	if err != nil {
+		return err
+	}
+	return scanKeys(keys, r, namespace, s.read, fn)
+}
+
+func (s *StorageDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	keys, err := s.listKeys(namespace)
+	if err != nil {
+		return err
+	}
+	filterKeys(keys, r, fn)
+	return nil
+}
+
+func (s *StorageDatabase) Count(namespace string) (int64, *DbError) {
+	keys, err := s.listKeys(namespace)
+	return int64(len(keys)), err
+}
+
+// listKeys returns the sorted keys of the namespace from the file names
+func (s *StorageDatabase) listKeys(namespace string) ([]string, *DbError) {
 	docs, readDirErr := os.ReadDir(s.getNamespacePath(namespace))
 	if readDirErr != nil {
 		return nil, &DbError{
@@ -124,20 +168,77 @@ func (s *StorageDatabase) GetAll(namespace string) (map[string][]byte, *DbError)
 			Message:   readDirErr.Error(),
 		}
 	}
+	// only the names are held, "a-b.json" sorts before "a.json" so they are sorted once the extension is removed
+	keys := make([]string, 0, len(docs))
 	for _, doc := range docs {
 		keyParts := strings.SplitN(doc.Name(), ".", 2)
 		if len(keyParts) != 2 || keyParts[1] != "json" {
 			continue
 		}
-		rawKey := keyParts[0]
-		var err *DbError
-		result[rawKey], err = s.Get(namespace, rawKey)
-		if err != nil {
-			return nil, err
+		keys = append(keys, keyParts[0])
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *StorageDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	if _, err := os.Stat(s.getNamespacePath(namespace)); err != nil {
+		return nil, &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
 		}
 	}
+	return getMany(s.read, namespace, keys)
+}
 
-	return result, nil
+func (s *StorageDatabase) read(namespace string, key string) ([]byte, *DbError) {
+	value, err := os.ReadFile(filepath.Clean(s.getFilePath(namespace, key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return value, nil
+}
+
+// NextSequence keeps the counter of the namespace in a file of the sequences_namespace directory
+func (s *StorageDatabase) NextSequence(namespace string) (int64, *DbError) {
+	s.sequenceMu.Lock()
+	defer s.sequenceMu.Unlock()
+	return nextFileSequence(filepath.Join(s.RootDirPath, sequences_namespace, namespace))
+}
+
+// nextFileSequence increments the counter stored in the file, the callers serialize the calls.
+// The new value is written aside then renamed, a crash leaves either the previous value or the new one.
+func nextFileSequence(path string) (int64, *DbError) {
+	var value int64
+	current, err := os.ReadFile(path)
+	if err == nil {
+		value, err = strconv.ParseInt(strings.TrimSpace(string(current)), 10, 64)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	}
+	value++
+	if err == nil {
+		err = os.WriteFile(path+".tmp", []byte(strconv.FormatInt(value, 10)), os.ModePerm)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return value, nil
 }
 
 func (s *StorageDatabase) Delete(namespace string, key string) *DbError {
@@ -0,0 +1,249 @@
+package database
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	geo_earthRadius = 6371008.8 // mean radius in meters
+	// cells of the index, geohashes of 5 characters: 13 bits of longitude and 12 of latitude, about 4.9km wide
+	geo_lngBits  = 13
+	geo_latBits  = 12
+	geo_maxCells = 4096 // cells read by a search, the points are all checked past this
+)
+
+const geo_base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoPoint is a position in degrees
+type GeoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// GeoBox selects the positions between its south west and north east corners, it can't cross the antimeridian
+type GeoBox struct {
+	MinLng float64
+	MinLat float64
+	MaxLng float64
+	MaxLat float64
+}
+
+// GeoQuery selects the documents whose point is within Radius meters of Near (at any distance for 0) and within Box,
+// either can be nil. They are sorted by their distance to Near, or to the center of Box without Near, then by key.
+// At most Limit documents are given, 0 for no limit.
+type GeoQuery struct {
+	Near   *GeoPoint
+	Radius float64
+	Box    *GeoBox
+	Limit  int
+}
+
+// GeoDocument is a document found by a GeoQuery, with the distance in meters used to sort it
+type GeoDocument struct {
+	Document
+	Distance float64
+}
+
+// origin is the point the distances are measured from
+func (q GeoQuery) origin() GeoPoint {
+	if q.Near != nil {
+		return *q.Near
+	}
+	if q.Box != nil {
+		return GeoPoint{Lat: (q.Box.MinLat + q.Box.MaxLat) / 2, Lng: (q.Box.MinLng + q.Box.MaxLng) / 2}
+	}
+	return GeoPoint{}
+}
+
+// matches returns the distance of the point to the origin, ok is false when it is out of the query
+func (q GeoQuery) matches(p GeoPoint) (float64, bool) {
+	if q.Box != nil && (p.Lng < q.Box.MinLng || p.Lng > q.Box.MaxLng || p.Lat < q.Box.MinLat || p.Lat > q.Box.MaxLat) {
+		return 0, false
+	}
+	distance := geoDistance(q.origin(), p)
+	if q.Near != nil && q.Radius > 0 && distance > q.Radius {
+		return 0, false
+	}
+	return distance, true
+}
+
+// bounds is the box holding every point the query can match, ok is false when it isn't bounded
+func (q GeoQuery) bounds() (GeoBox, bool) {
+	box := GeoBox{MinLng: -180, MinLat: -90, MaxLng: 180, MaxLat: 90}
+	bounded := false
+	if q.Near != nil && q.Radius > 0 {
+		angle := q.Radius / geo_earthRadius
+		dLat := angle * 180 / math.Pi
+		box.MinLat = math.Max(q.Near.Lat-dLat, -90)
+		box.MaxLat = math.Min(q.Near.Lat+dLat, 90)
+		// around the poles the circle covers every longitude
+		if box.MinLat > -90 && box.MaxLat < 90 && math.Sin(angle) < math.Cos(q.Near.Lat*math.Pi/180) {
+			dLng := math.Asin(math.Sin(angle)/math.Cos(q.Near.Lat*math.Pi/180)) * 180 / math.Pi
+			box.MinLng, box.MaxLng = q.Near.Lng-dLng, q.Near.Lng+dLng
+		}
+		bounded = true
+	}
+	if q.Box != nil {
+		box.MinLng, box.MaxLng = math.Max(box.MinLng, q.Box.MinLng), math.Min(box.MaxLng, q.Box.MaxLng)
+		box.MinLat, box.MaxLat = math.Max(box.MinLat, q.Box.MinLat), math.Min(box.MaxLat, q.Box.MaxLat)
+		bounded = true
+	}
+	return box, bounded
+}
+
+// geoDistance is the great circle distance in meters (haversine formula)
+func geoDistance(a GeoPoint, b GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * geo_earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoJsonPoint reads the GeoJSON Point {"type": "Point", "coordinates": [lng, lat]} at the pointer of the document
+func geoJsonPoint(document interface{}, pointer string) (GeoPoint, bool) {
+	parent, last, ok := resolvePointer(document, pointer)
+	if !ok {
+		return GeoPoint{}, false
+	}
+	var field interface{}
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		field = container[last]
+	case []interface{}:
+		i, _ := strconv.Atoi(last)
+		field = container[i]
+	}
+	point, ok := field.(map[string]interface{})
+	if !ok || point["type"] != "Point" {
+		return GeoPoint{}, false
+	}
+	coordinates, ok := point["coordinates"].([]interface{})
+	if !ok || len(coordinates) < 2 {
+		return GeoPoint{}, false
+	}
+	lng, lngOk := coordinates[0].(float64)
+	lat, latOk := coordinates[1].(float64)
+	if !lngOk || !latOk || lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return GeoPoint{}, false
+	}
+	return GeoPoint{Lat: lat, Lng: lng}, true
+}
+
+// geoCell returns the indexes of the cell of the point on each axis
+func geoCell(p GeoPoint) (lngIndex int, latIndex int) {
+	lngIndex = int((p.Lng + 180) / 360 * (1 << geo_lngBits))
+	latIndex = int((p.Lat + 90) / 180 * (1 << geo_latBits))
+	return min(lngIndex, 1<<geo_lngBits-1), min(latIndex, 1<<geo_latBits-1)
+}
+
+// geohash of a cell, its bits interleaved from the longitude ones then encoded in base32
+func geohash(lngIndex int, latIndex int) string {
+	var bits uint32
+	for i := 0; i < geo_lngBits; i++ {
+		bits = bits<<1 | uint32(lngIndex>>(geo_lngBits-1-i))&1
+		if i < geo_latBits {
+			bits = bits<<1 | uint32(latIndex>>(geo_latBits-1-i))&1
+		}
+	}
+	hash := make([]byte, (geo_lngBits+geo_latBits)/5)
+	for i := len(hash) - 1; i >= 0; i-- {
+		hash[i] = geo_base32[bits&31]
+		bits >>= 5
+	}
+	return string(hash)
+}
+
+// geoIndex is the index of the points of a namespace by geohash
+type geoIndex struct {
+	points map[string]GeoPoint            // key -> point
+	cells  map[string]map[string]struct{} // geohash -> keys of the points in the cell
+}
+
+func newGeoIndex() *geoIndex {
+	return &geoIndex{
+		points: make(map[string]GeoPoint),
+		cells:  make(map[string]map[string]struct{}),
+	}
+}
+
+func (g *geoIndex) add(key string, p GeoPoint, ok bool) {
+	g.remove(key)
+	if !ok {
+		return
+	}
+	cell := geohash(geoCell(p))
+	keys, found := g.cells[cell]
+	if !found {
+		keys = make(map[string]struct{})
+		g.cells[cell] = keys
+	}
+	keys[key] = struct{}{}
+	g.points[key] = p
+}
+
+func (g *geoIndex) remove(key string) {
+	p, ok := g.points[key]
+	if !ok {
+		return
+	}
+	cell := geohash(geoCell(p))
+	delete(g.cells[cell], key)
+	if len(g.cells[cell]) == 0 {
+		delete(g.cells, cell)
+	}
+	delete(g.points, key)
+}
+
+// search returns the keys of the points matching the query and their distance, sorted
+func (g *geoIndex) search(q GeoQuery) ([]string, map[string]float64) {
+	distances := make(map[string]float64)
+	check := func(key string) {
+		if distance, ok := q.matches(g.points[key]); ok {
+			distances[key] = distance
+		}
+	}
+
+	box, bounded := q.bounds()
+	if box.MinLat > box.MaxLat || box.MinLng > box.MaxLng {
+		// the box and the circle don't meet
+		return nil, distances
+	}
+	minLng, minLat := geoCell(GeoPoint{Lat: box.MinLat, Lng: math.Max(box.MinLng, -180)})
+	maxLng, maxLat := geoCell(GeoPoint{Lat: box.MaxLat, Lng: math.Min(box.MaxLng, 180)})
+	lngCells := maxLng - minLng + 1
+	if box.MinLng < -180 || box.MaxLng > 180 {
+		// the circle crosses the antimeridian, every longitude is read
+		minLng, lngCells = 0, 1<<geo_lngBits
+	}
+	if !bounded || lngCells*(maxLat-minLat+1) > geo_maxCells {
+		for key := range g.points {
+			check(key)
+		}
+	} else {
+		for lngIndex := minLng; lngIndex < minLng+lngCells; lngIndex++ {
+			for latIndex := minLat; latIndex <= maxLat; latIndex++ {
+				for key := range g.cells[geohash(lngIndex, latIndex)] {
+					check(key)
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(distances))
+	for key := range distances {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if distances[keys[i]] != distances[keys[j]] {
+			return distances[keys[i]] < distances[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if q.Limit > 0 && len(keys) > q.Limit {
+		keys = keys[:q.Limit]
+	}
+	return keys, distances
+}
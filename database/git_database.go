@@ -0,0 +1,369 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	git_keepFile      = ".gitkeep"
+	git_defaultAuthor = "unirest"
+)
+
+// GitDatabase stores namespaces as directories of a local git repository,
+// every change is a commit authored by the user making it
+type GitDatabase struct {
+	DirPath string
+
+	mu       sync.Mutex
+	repo     *git.Repository
+	worktree *git.Worktree
+}
+
+func (g *GitDatabase) Init() {
+	repo, err := git.PlainOpen(g.DirPath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(g.DirPath, false)
+	}
+	if err != nil {
+		log.Fatalf("error opening git repository: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		log.Fatalf("error opening git worktree: %v", err)
+	}
+	g.repo = repo
+	g.worktree = worktree
+	log.Println("db connected")
+}
+
+func (g *GitDatabase) Disconnect() {
+	// do nothing
+}
+
+func (g *GitDatabase) CreateNameSpace(namespace string) *DbError {
+	return g.CreateNameSpaceAs("", namespace)
+}
+
+func (g *GitDatabase) CreateNameSpaceAs(user string, namespace string) *DbError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// git does not track empty directories
+	keepFile := path.Join(namespace, git_keepFile)
+	err := os.MkdirAll(g.getNamespacePath(namespace), os.ModePerm)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(g.DirPath, keepFile), nil, os.ModePerm)
+	}
+	if err == nil {
+		err = g.commit(user, fmt.Sprintf("create namespace %v", namespace), keepFile)
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *GitDatabase) GetNamespaces() []string {
+	results := make([]string, 0)
+
+	namespaces, err := os.ReadDir(g.DirPath)
+	if err != nil {
+		log.Println(err)
+		return results
+	}
+
+	for _, ns := range namespaces {
+		if ns.IsDir() && ns.Name() != git.GitDirName {
+			results = append(results, ns.Name())
+		}
+	}
+	return results
+}
+
+func (g *GitDatabase) DropNameSpace(namespace string) *DbError {
+	return g.DropNameSpaceAs("", namespace)
+}
+
+func (g *GitDatabase) DropNameSpaceAs(user string, namespace string) *DbError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, err := os.Stat(g.getNamespacePath(namespace)); err != nil {
+		return namespaceNotFound(namespace)
+	}
+	err := g.remove(user, fmt.Sprintf("drop namespace %v", namespace), namespace+"/*")
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	err = os.RemoveAll(g.getNamespacePath(namespace))
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *GitDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	return g.UpsertAs("", namespace, key, value, allowOverWrite)
+}
+
+func (g *GitDatabase) UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := os.MkdirAll(g.getNamespacePath(namespace), os.ModePerm)
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+
+	filePath := g.getFilePath(namespace, key)
+	_, statErr := os.Stat(filePath)
+	if statErr == nil && !allowOverWrite {
+		return &DbError{
+			ErrorCode: ITEM_CONFLICT,
+			Message:   "item already exists",
+		}
+	}
+	if statErr != nil && !errors.Is(statErr, os.ErrNotExist) {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   statErr.Error(),
+		}
+	}
+
+	err = os.WriteFile(filePath, value, os.ModePerm)
+	if err == nil {
+		err = g.commit(user, fmt.Sprintf("upsert %v/%v", namespace, key), g.getRelativePath(namespace, key))
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *GitDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	bytes, err := os.ReadFile(filepath.Clean(g.getFilePath(namespace, key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return bytes, nil
+}
+
+// Exists stats the file of the document
+func (g *GitDatabase) Exists(namespace string, key string) *DbError {
+	_, err := os.Stat(filepath.Clean(g.getFilePath(namespace, key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *GitDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(g.Scan, namespace)
+}
+
+func (g *GitDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return g.ScanRange(namespace, KeyRange{}, fn)
+}
+
+// ScanRange lists the file names, only the documents of the range are read
+func (g *GitDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	keys, err := g.listKeys(namespace)
+	if err != nil {
+		return err
+	}
+	return scanKeys(keys, r, namespace, g.Get, fn)
+}
+
+func (g *GitDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	keys, err := g.listKeys(namespace)
+	if err != nil {
+		return err
+	}
+	filterKeys(keys, r, fn)
+	return nil
+}
+
+func (g *GitDatabase) Count(namespace string) (int64, *DbError) {
+	keys, err := g.listKeys(namespace)
+	return int64(len(keys)), err
+}
+
+// NextSequence keeps the counters inside the git directory, they are not part of the history
+func (g *GitDatabase) NextSequence(namespace string) (int64, *DbError) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return nextFileSequence(filepath.Join(g.DirPath, git.GitDirName, sequences_namespace, namespace))
+}
+
+// listKeys returns the sorted keys of the namespace from the file names
+func (g *GitDatabase) listKeys(namespace string) ([]string, *DbError) {
+	docs, readDirErr := os.ReadDir(g.getNamespacePath(namespace))
+	if errors.Is(readDirErr, os.ErrNotExist) {
+		return nil, namespaceNotFound(namespace)
+	}
+	if readDirErr != nil {
+		return nil, &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   readDirErr.Error(),
+		}
+	}
+	keys := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		rawKey, ok := strings.CutSuffix(doc.Name(), ".json")
+		if ok && !doc.IsDir() {
+			keys = append(keys, rawKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (g *GitDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	if _, err := os.Stat(g.getNamespacePath(namespace)); errors.Is(err, os.ErrNotExist) {
+		return nil, namespaceNotFound(namespace)
+	}
+	return getMany(g.Get, namespace, keys)
+}
+
+func (g *GitDatabase) Delete(namespace string, key string) *DbError {
+	return g.DeleteAs("", namespace, key)
+}
+
+func (g *GitDatabase) DeleteAs(user string, namespace string, key string) *DbError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, err := os.Stat(g.getFilePath(namespace, key)); err != nil {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+
+	err := g.remove(user, fmt.Sprintf("delete %v/%v", namespace, key), g.getRelativePath(namespace, key))
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *GitDatabase) DeleteAll(namespace string) *DbError {
+	return g.DeleteAllAs("", namespace)
+}
+
+func (g *GitDatabase) DeleteAllAs(user string, namespace string) *DbError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, err := os.Stat(g.getNamespacePath(namespace)); err != nil {
+		return namespaceNotFound(namespace)
+	}
+	err := g.remove(user, fmt.Sprintf("delete all %v", namespace), namespace+"/*.json")
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+// commit stages the given path and commits it, nothing is committed when the content did not change
+func (g *GitDatabase) commit(user string, message string, relativePath string) error {
+	err := g.worktree.AddWithOptions(&git.AddOptions{Path: relativePath, SkipStatus: true})
+	if err != nil {
+		return err
+	}
+	_, err = g.worktree.Commit(message, &git.CommitOptions{Author: g.signature(user)})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return nil
+	}
+	return err
+}
+
+// remove deletes the files matching the pattern from the worktree and commits the removal, none is nothing to do
+func (g *GitDatabase) remove(user string, message string, pattern string) error {
+	err := g.worktree.RemoveGlob(pattern)
+	if errors.Is(err, git.ErrGlobNoMatches) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = g.worktree.Commit(message, &git.CommitOptions{Author: g.signature(user)})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return nil
+	}
+	return err
+}
+
+func (g *GitDatabase) signature(user string) *object.Signature {
+	if user == "" {
+		user = git_defaultAuthor
+	}
+	return &object.Signature{
+		Name:  user,
+		Email: user,
+		When:  time.Now(),
+	}
+}
+
+func (g *GitDatabase) getFilePath(namespace, key string) string {
+	return filepath.Join(g.getNamespacePath(namespace), fmt.Sprintf("%s.json", key))
+}
+
+func (g *GitDatabase) getRelativePath(namespace, key string) string {
+	return path.Join(namespace, fmt.Sprintf("%s.json", key))
+}
+
+func (g *GitDatabase) getNamespacePath(namespace string) string {
+	return filepath.Join(g.DirPath, namespace)
+}
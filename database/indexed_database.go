@@ -0,0 +1,529 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	indexed_lockStripes = 64
+	// BM25 parameters, the usual values: k1 saturates the frequency of a term, b normalizes by the document length
+	indexed_k1 = 1.2
+	indexed_b  = 0.75
+)
+
+// IndexedDatabase keeps in-process indexes of the documents, for the drivers without native ones: an inverted index
+// of some string fields ranked with BM25, and a geohash index of a GeoJSON Point field. The indexes of a namespace are
+// rebuilt from GetAll on Init, then updated by the writes going through the wrapper. The text is split on anything but
+// letters and digits, lowercased, and the english suffixes are stripped when Stemming is set.
+type IndexedDatabase struct {
+	Backend
+	Fields    map[string][]string // namespace -> json pointers of the text fields, strings or arrays of strings
+	Stemming  bool
+	GeoFields map[string]string // namespace -> json pointer of the point field
+
+	mu         sync.RWMutex
+	indexes    map[string]*textIndex
+	geoIndexes map[string]*geoIndex
+	nsMu       sync.RWMutex // held for writing by the whole namespace operations
+	locks      [indexed_lockStripes]sync.Mutex
+}
+
+// authoredBackend is implemented by the drivers recording the user behind each change
+type authoredBackend interface {
+	CreateNameSpaceAs(user string, namespace string) *DbError
+	DropNameSpaceAs(user string, namespace string) *DbError
+	UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *DbError
+	DeleteAs(user string, namespace string, key string) *DbError
+	DeleteAllAs(user string, namespace string) *DbError
+}
+
+// fullTextSearcher is implemented by the drivers having a native full text index
+type fullTextSearcher interface {
+	FullTextSearch(namespace string, query string) ([]Document, *DbError)
+}
+
+// evictor is implemented by the drivers evicting documents to stay within a memory budget
+type evictor interface {
+	OnEvict(fn func(namespace string, key string))
+}
+
+// unwrapper is implemented by the drivers wrapping another one
+type unwrapper interface {
+	Unwrap() Backend
+}
+
+// geoSearcher is implemented by the drivers having a native geo index
+type geoSearcher interface {
+	GeoSearch(namespace string, q GeoQuery) ([]GeoDocument, *DbError)
+}
+
+// textIndex is the inverted index of a namespace
+type textIndex struct {
+	postings map[string]map[string]int // term -> key -> frequency of the term in the document
+	terms    map[string]map[string]int // key -> frequency of each term of the document
+	lengths  map[string]int            // key -> number of terms of the document
+	total    int                       // number of terms of all the documents
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: make(map[string]map[string]int),
+		terms:    make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+	}
+}
+
+func (t *textIndex) add(key string, tokens []string) {
+	t.remove(key)
+	if len(tokens) == 0 {
+		return
+	}
+	frequencies := make(map[string]int)
+	for _, token := range tokens {
+		frequencies[token]++
+	}
+	for term, frequency := range frequencies {
+		postings, ok := t.postings[term]
+		if !ok {
+			postings = make(map[string]int)
+			t.postings[term] = postings
+		}
+		postings[key] = frequency
+	}
+	t.terms[key] = frequencies
+	t.lengths[key] = len(tokens)
+	t.total += len(tokens)
+}
+
+func (t *textIndex) remove(key string) {
+	for term := range t.terms[key] {
+		delete(t.postings[term], key)
+		if len(t.postings[term]) == 0 {
+			delete(t.postings, term)
+		}
+	}
+	t.total -= t.lengths[key]
+	delete(t.terms, key)
+	delete(t.lengths, key)
+}
+
+// search returns the keys of the documents having any of the terms, best BM25 score first then in key order
+func (t *textIndex) search(terms []string) []string {
+	if len(t.lengths) == 0 {
+		return nil
+	}
+	count := float64(len(t.lengths))
+	averageLength := float64(t.total) / count
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := t.postings[term]
+		idf := math.Log(1 + (count-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for key, frequency := range postings {
+			tf := float64(frequency)
+			norm := indexed_k1 * (1 - indexed_b + indexed_b*float64(t.lengths[key])/averageLength)
+			scores[key] += idf * tf * (indexed_k1 + 1) / (tf + norm)
+		}
+	}
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func (x *IndexedDatabase) Init() {
+	x.Backend.Init()
+
+	x.indexes = make(map[string]*textIndex, len(x.Fields))
+	x.geoIndexes = make(map[string]*geoIndex, len(x.GeoFields))
+	for _, namespace := range x.namespaces() {
+		x.reset(namespace)
+	}
+	// the documents evicted by a driver under the wrappers are dropped from the indexes like the deleted ones
+	for backend := x.Backend; backend != nil; {
+		if db, ok := backend.(evictor); ok {
+			db.OnEvict(x.evicted)
+			break
+		}
+		wrapper, ok := backend.(unwrapper)
+		if !ok {
+			break
+		}
+		backend = wrapper.Unwrap()
+	}
+	// the drivers don't agree on the error of a missing namespace, only the existing ones are read
+	for _, namespace := range x.Backend.GetNamespaces() {
+		if !x.indexed(namespace) {
+			continue
+		}
+		documents, err := x.Backend.GetAll(namespace)
+		if err != nil {
+			log.Fatalf("error indexing namespace '%v': %v", namespace, err)
+		}
+		for key, value := range documents {
+			x.add(namespace, key, value)
+		}
+		if index, ok := x.indexes[namespace]; ok {
+			log.Printf("full text index of '%v': %d documents, %d terms", namespace, len(index.lengths), len(index.postings))
+		}
+		if index, ok := x.geoIndexes[namespace]; ok {
+			log.Printf("geo index of '%v': %d points, %d cells", namespace, len(index.points), len(index.cells))
+		}
+	}
+}
+
+// Unwrap returns the wrapped driver
+func (x *IndexedDatabase) Unwrap() Backend {
+	return x.Backend
+}
+
+// Transparent is true, the documents are stored unchanged: the wrapped driver can read and filter them itself
+func (x *IndexedDatabase) Transparent() bool {
+	return true
+}
+
+// FullTextSearch returns the documents having any of the terms of the query, best match first.
+// The namespaces without index are searched by the wrapped driver when it has a native full text index.
+func (x *IndexedDatabase) FullTextSearch(namespace string, query string) ([]Document, *DbError) {
+	if len(x.Fields[namespace]) == 0 {
+		if searcher, ok := x.Backend.(fullTextSearcher); ok {
+			return searcher.FullTextSearch(namespace, query)
+		}
+		return nil, &DbError{
+			ErrorCode: NOT_SUPPORTED,
+			Message:   fmt.Sprintf("namespace '%v' has no full text index", namespace),
+		}
+	}
+	terms := x.analyze(query)
+	if len(terms) == 0 {
+		return nil, &DbError{
+			ErrorCode: INVALID_QUERY,
+			Message:   fmt.Sprintf("error on FullTextSearch: no term in '%v'", query),
+		}
+	}
+	x.mu.RLock()
+	keys := x.indexes[namespace].search(terms)
+	x.mu.RUnlock()
+
+	ret := make([]Document, 0, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	documents, err := x.Backend.GetMany(namespace, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		// deleted since the index was read
+		if value, ok := documents[key]; ok {
+			ret = append(ret, Document{Key: key, Value: value})
+		}
+	}
+	return ret, nil
+}
+
+// GeoSearch returns the documents whose point matches the query, nearest first.
+// The namespaces without index are searched by the wrapped driver when it has a native geo index (mongo).
+func (x *IndexedDatabase) GeoSearch(namespace string, q GeoQuery) ([]GeoDocument, *DbError) {
+	if x.GeoFields[namespace] == "" {
+		if searcher, ok := x.Backend.(geoSearcher); ok {
+			return searcher.GeoSearch(namespace, q)
+		}
+		return nil, &DbError{
+			ErrorCode: NOT_SUPPORTED,
+			Message:   fmt.Sprintf("namespace '%v' has no geo index", namespace),
+		}
+	}
+	x.mu.RLock()
+	keys, distances := x.geoIndexes[namespace].search(q)
+	x.mu.RUnlock()
+
+	ret := make([]GeoDocument, 0, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	documents, err := x.Backend.GetMany(namespace, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if value, ok := documents[key]; ok {
+			ret = append(ret, GeoDocument{Document: Document{Key: key, Value: value}, Distance: distances[key]})
+		}
+	}
+	return ret, nil
+}
+
+func (x *IndexedDatabase) DropNameSpace(namespace string) *DbError {
+	return x.DropNameSpaceAs("", namespace)
+}
+
+func (x *IndexedDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	return x.UpsertAs("", namespace, key, value, allowOverWrite)
+}
+
+func (x *IndexedDatabase) Delete(namespace string, key string) *DbError {
+	return x.DeleteAs("", namespace, key)
+}
+
+func (x *IndexedDatabase) DeleteAll(namespace string) *DbError {
+	return x.DeleteAllAs("", namespace)
+}
+
+// The writes recording their user are given to the wrapped driver when it records them too (git), as the plain ones otherwise
+
+func (x *IndexedDatabase) CreateNameSpaceAs(user string, namespace string) *DbError {
+	if db, ok := x.Backend.(authoredBackend); ok {
+		return db.CreateNameSpaceAs(user, namespace)
+	}
+	return x.Backend.CreateNameSpace(namespace)
+}
+
+func (x *IndexedDatabase) DropNameSpaceAs(user string, namespace string) *DbError {
+	x.nsMu.Lock()
+	defer x.nsMu.Unlock()
+	var err *DbError
+	if db, ok := x.Backend.(authoredBackend); ok {
+		err = db.DropNameSpaceAs(user, namespace)
+	} else {
+		err = x.Backend.DropNameSpace(namespace)
+	}
+	if err == nil {
+		x.reset(namespace)
+	}
+	return err
+}
+
+func (x *IndexedDatabase) UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	upsert := x.Backend.Upsert
+	if db, ok := x.Backend.(authoredBackend); ok {
+		upsert = func(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+			return db.UpsertAs(user, namespace, key, value, allowOverWrite)
+		}
+	}
+	if !x.indexed(namespace) {
+		return upsert(namespace, key, value, allowOverWrite)
+	}
+	unlock := x.lock(namespace, key)
+	defer unlock()
+	err := upsert(namespace, key, value, allowOverWrite)
+	if err == nil {
+		x.add(namespace, key, value)
+	}
+	return err
+}
+
+func (x *IndexedDatabase) DeleteAs(user string, namespace string, key string) *DbError {
+	remove := x.Backend.Delete
+	if db, ok := x.Backend.(authoredBackend); ok {
+		remove = func(namespace string, key string) *DbError {
+			return db.DeleteAs(user, namespace, key)
+		}
+	}
+	if !x.indexed(namespace) {
+		return remove(namespace, key)
+	}
+	unlock := x.lock(namespace, key)
+	defer unlock()
+	err := remove(namespace, key)
+	if err == nil {
+		x.remove(namespace, key)
+	}
+	return err
+}
+
+func (x *IndexedDatabase) DeleteAllAs(user string, namespace string) *DbError {
+	x.nsMu.Lock()
+	defer x.nsMu.Unlock()
+	var err *DbError
+	if db, ok := x.Backend.(authoredBackend); ok {
+		err = db.DeleteAllAs(user, namespace)
+	} else {
+		err = x.Backend.DeleteAll(namespace)
+	}
+	if err == nil {
+		x.reset(namespace)
+	}
+	return err
+}
+
+// indexed reports whether the namespace has any index
+func (x *IndexedDatabase) indexed(namespace string) bool {
+	return len(x.Fields[namespace]) > 0 || x.GeoFields[namespace] != ""
+}
+
+func (x *IndexedDatabase) namespaces() []string {
+	ret := make([]string, 0, len(x.Fields)+len(x.GeoFields))
+	for namespace := range x.Fields {
+		ret = append(ret, namespace)
+	}
+	for namespace := range x.GeoFields {
+		ret = append(ret, namespace)
+	}
+	return ret
+}
+
+// add indexes the document, in place of its previous version
+func (x *IndexedDatabase) add(namespace string, key string, value []byte) {
+	// a document which isn't json has no terms nor point
+	var document interface{}
+	json.Unmarshal(value, &document)
+	tokens := x.tokens(namespace, document)
+	point, hasPoint := geoJsonPoint(document, x.GeoFields[namespace])
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if index, ok := x.indexes[namespace]; ok {
+		index.add(key, tokens)
+	}
+	if index, ok := x.geoIndexes[namespace]; ok {
+		index.add(key, point, hasPoint)
+	}
+}
+
+// remove drops the document from the indexes
+func (x *IndexedDatabase) remove(namespace string, key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if index, ok := x.indexes[namespace]; ok {
+		index.remove(key)
+	}
+	if index, ok := x.geoIndexes[namespace]; ok {
+		index.remove(key)
+	}
+}
+
+// evicted drops the document evicted by the wrapped driver from the indexes. The eviction happens during the write
+// of another document, whose lock may be the one of this document: a version written meanwhile is indexed again.
+func (x *IndexedDatabase) evicted(namespace string, key string) {
+	if !x.indexed(namespace) {
+		return
+	}
+	x.remove(namespace, key)
+	if value, err := x.Backend.Get(namespace, key); err == nil {
+		x.add(namespace, key, value)
+	}
+}
+
+// reset empties the indexes of the namespace
+func (x *IndexedDatabase) reset(namespace string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.Fields[namespace]) > 0 {
+		x.indexes[namespace] = newTextIndex()
+	}
+	if x.GeoFields[namespace] != "" {
+		x.geoIndexes[namespace] = newGeoIndex()
+	}
+}
+
+// lock serializes the writes of a document, so that the index follows the order of the driver
+func (x *IndexedDatabase) lock(namespace string, key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	stripe := &x.locks[h.Sum32()%indexed_lockStripes]
+
+	x.nsMu.RLock()
+	stripe.Lock()
+	return func() {
+		stripe.Unlock()
+		x.nsMu.RUnlock()
+	}
+}
+
+// tokens returns the terms of the text fields of the document
+func (x *IndexedDatabase) tokens(namespace string, document interface{}) []string {
+	var ret []string
+	for _, pointer := range x.Fields[namespace] {
+		parent, last, ok := resolvePointer(document, pointer)
+		if !ok {
+			continue
+		}
+		var field interface{}
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			field = container[last]
+		case []interface{}:
+			i, _ := strconv.Atoi(last)
+			field = container[i]
+		}
+		switch v := field.(type) {
+		case string:
+			ret = append(ret, x.analyze(v)...)
+		case []interface{}:
+			for _, item := range v {
+				if text, ok := item.(string); ok {
+					ret = append(ret, x.analyze(text)...)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// analyze splits the text in lowercase terms, stemmed when Stemming is set
+func (x *IndexedDatabase) analyze(text string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if x.Stemming {
+		for i, term := range terms {
+			terms[i] = stem(term)
+		}
+	}
+	return terms
+}
+
+// stem strips the common english suffixes. It is a light stemmer, which only needs to give the same term for the
+// forms of a word (search, searches, searched, searching) since the queries are stemmed too.
+func stem(term string) string {
+	if len(term) <= 3 {
+		return term
+	}
+	switch {
+	case strings.HasSuffix(term, "ies") && len(term) > 4:
+		term = term[:len(term)-3] + "y"
+	case strings.HasSuffix(term, "sses"), strings.HasSuffix(term, "ches"), strings.HasSuffix(term, "shes"),
+		strings.HasSuffix(term, "xes"), strings.HasSuffix(term, "zes"):
+		term = term[:len(term)-2]
+	case strings.HasSuffix(term, "s") && !strings.HasSuffix(term, "ss") && !strings.HasSuffix(term, "us") && !strings.HasSuffix(term, "is"):
+		term = term[:len(term)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		root := strings.TrimSuffix(term, suffix)
+		if root == term || len(root) < 3 || !strings.ContainsAny(root, "aeiouy") {
+			continue
+		}
+		// running -> run, but not falling -> fal
+		if n := len(root); root[n-1] == root[n-2] && !strings.ContainsRune("aeioulsz", rune(root[n-1])) {
+			root = root[:n-1]
+		}
+		term = root
+		break
+	}
+	if len(term) > 4 && strings.HasSuffix(term, "e") {
+		term = term[:len(term)-1]
+	}
+	return term
+}
@@ -1,27 +1,161 @@
 package database
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/btree"
+)
+
+const (
+	mem_shards = 32
+	// documents sampled per shard to find the least recently used one, like redis does
+	mem_evictionSamples = 5
+
+	// MEMORY_ANY_NAMESPACE is the NamespaceMaxBytes entry applying to the namespaces not listed
+	MEMORY_ANY_NAMESPACE = "*"
 )
 
+// MemStats are the size and eviction counters of the memory driver, globally or for a namespace
+type MemStats struct {
+	Items      int64               `json:"items"`
+	Bytes      int64               `json:"bytes"`
+	MaxBytes   int64               `json:"max_bytes,omitempty"`
+	Evictions  int64               `json:"evictions"`
+	Namespaces map[string]MemStats `json:"namespaces,omitempty"`
+}
+
+// MemDatabase keeps the documents in memory. Namespaces are looked up without locking, and the keys of a namespace
+// are spread over shards with their own lock, so reads of different documents never wait for each other.
+// Values are copied on write and on read: callers can keep or modify what they get.
+//
+// With a memory budget (keys and values bytes), the least recently used documents are evicted once it is exceeded,
+// either the ones of the namespace over its own budget or the ones of any namespace for the global budget.
+// The least recently used document is approximated by sampling a few documents of every shard.
 type MemDatabase struct {
-	mu         sync.Mutex
-	namespaces map[string]namespace
+	MaxBytes          int64            // global budget, 0 for unlimited
+	NamespaceMaxBytes map[string]int64 // namespace -> budget, namespaces not listed are unlimited
+
+	namespaces *sync.Map // namespace name -> *memNamespace
+	sequences  *sync.Map // namespace name -> *atomic.Int64, kept when the namespace is deleted
+	onEvict    []func(namespace string, key string)
+	items      atomic.Int64
+	size       atomic.Int64
+	evictions  atomic.Int64
+}
+
+type memNamespace struct {
+	// held for reading by the writes, and for writing by the whole namespace operations
+	// so that they see (or drop) every shard at the same point. Get doesn't need it.
+	mu        sync.RWMutex
+	dropped   bool
+	name      string
+	maxBytes  int64
+	items     atomic.Int64
+	size      atomic.Int64
+	evictions atomic.Int64
+	shards    [mem_shards]memShard
+	// sorted keys for the scans, only changed when a key is added or removed
+	indexMu sync.Mutex
+	index   *btree.BTreeG[string]
+}
+
+type memShard struct {
+	mu   sync.RWMutex
+	data map[string]*memEntry
+}
+
+type memEntry struct {
+	value  []byte
+	access atomic.Int64 // unix nano of the last read or write, maintained only with a budget
 }
 
-type namespace struct {
-	data map[string][]byte
+func (e *memEntry) size(key string) int64 {
+	return int64(len(key) + len(e.value))
 }
 
-func newNamespace() namespace {
-	return namespace{
-		data: make(map[string][]byte),
+func (m *MemDatabase) newMemNamespace(name string) *memNamespace {
+	ns := &memNamespace{
+		name:     name,
+		maxBytes: m.NamespaceMaxBytes[MEMORY_ANY_NAMESPACE],
+		index:    btree.NewOrderedG[string](32),
+	}
+	if maxBytes, ok := m.NamespaceMaxBytes[name]; ok {
+		ns.maxBytes = maxBytes
+	}
+	for i := range ns.shards {
+		ns.shards[i].data = make(map[string]*memEntry)
+	}
+	return ns
+}
+
+// shard hashes the key with fnv-1a, inlined to keep Get free of allocations
+func (ns *memNamespace) shard(key string) *memShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &ns.shards[h%mem_shards]
+}
+
+func (ns *memNamespace) get(key string) (*memEntry, bool) {
+	shard := ns.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	entry, ok := shard.data[key]
+	return entry, ok
+}
+
+func (ns *memNamespace) indexKey(key string, add bool) {
+	ns.indexMu.Lock()
+	defer ns.indexMu.Unlock()
+	if add {
+		ns.index.ReplaceOrInsert(key)
+	} else {
+		ns.index.Delete(key)
+	}
+}
+
+// ascend calls fn on the keys of the range in a copy on write clone of the index
+func (ns *memNamespace) ascend(r KeyRange, fn KeyFunc) {
+	ns.indexMu.Lock()
+	index := ns.index.Clone()
+	ns.indexMu.Unlock()
+
+	index.AscendGreaterOrEqual(r.lower(), func(key string) bool {
+		if r.past(key) {
+			return false
+		}
+		return !r.Contains(key) || fn(key)
+	})
+}
+
+// snapshot copies the namespace, the caller holds ns.mu
+func (ns *memNamespace) snapshot() map[string][]byte {
+	size := 0
+	for i := range ns.shards {
+		size += len(ns.shards[i].data)
+	}
+	ret := make(map[string][]byte, size)
+	for i := range ns.shards {
+		for k, e := range ns.shards[i].data {
+			ret[k] = bytes.Clone(e.value)
+		}
 	}
+	return ret
 }
 
 func (m *MemDatabase) Init() {
-	m.namespaces = make(map[string]namespace)
+	m.namespaces = &sync.Map{}
+	m.sequences = &sync.Map{}
+	m.items.Store(0)
+	m.size.Store(0)
+	m.evictions.Store(0)
 }
 
 func (m *MemDatabase) Disconnect() {
@@ -34,13 +168,11 @@ func (m *MemDatabase) CreateNameSpace(namespace string) *DbError {
 }
 
 func (m *MemDatabase) GetNamespaces() []string {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	ret := make([]string, 0)
-	for k := range m.namespaces {
-		ret = append(ret, k)
-	}
+	m.namespaces.Range(func(k, _ interface{}) bool {
+		ret = append(ret, k.(string))
+		return true
+	})
 	return ret
 }
 
@@ -49,97 +181,354 @@ func (m *MemDatabase) DropNameSpace(namespace string) *DbError {
 	return nil
 }
 
+func (m *MemDatabase) lookup(namespace string) (*memNamespace, *DbError) {
+	ns, ok := m.namespaces.Load(namespace)
+	if !ok {
+		return nil, namespaceNotFound(namespace)
+	}
+	return ns.(*memNamespace), nil
+}
+
+// writable returns the namespace, created when missing, with its lock held for reading
+func (m *MemDatabase) writable(namespace string) *memNamespace {
+	for {
+		loaded, ok := m.namespaces.Load(namespace)
+		if !ok {
+			loaded, _ = m.namespaces.LoadOrStore(namespace, m.newMemNamespace(namespace))
+		}
+		ns := loaded.(*memNamespace)
+		ns.mu.RLock()
+		if !ns.dropped {
+			return ns
+		}
+		// deleted meanwhile, retry with a new one
+		ns.mu.RUnlock()
+	}
+}
+
 func (m *MemDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	ns := m.writable(namespace)
+	dbErr := m.upsert(ns, key, value, allowOverWrite)
+	ns.mu.RUnlock()
+	if dbErr == nil && m.budgeted() {
+		m.evict(ns)
+	}
+	return dbErr
+}
 
-	ns, ok := m.namespaces[namespace]
-	if !ok {
-		ns = newNamespace()
-		m.namespaces[namespace] = ns
-	}
-	if !allowOverWrite && ok { // if not allow overwrite and already has namespace
-		// look for existing record, if it is not null then return 409, conflict
-		if ns.data[key] != nil {
-			return &DbError{
-				ErrorCode: ITEM_CONFLICT,
-				Message:   "item already exists",
-			}
+func (m *MemDatabase) upsert(ns *memNamespace, key string, value []byte, allowOverWrite bool) *DbError {
+	shard := ns.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	previous := shard.data[key]
+	// if not allow overwrite, look for existing record, if it is not null then return 409, conflict
+	if !allowOverWrite && previous != nil {
+		return &DbError{
+			ErrorCode: ITEM_CONFLICT,
+			Message:   "item already exists",
 		}
 	}
-	ns.data[key] = value
+	entry := &memEntry{value: bytes.Clone(value)}
+	if m.budgeted() {
+		entry.access.Store(time.Now().UnixNano())
+	}
+	shard.data[key] = entry
+
+	delta := entry.size(key)
+	if previous != nil {
+		delta -= previous.size(key)
+	} else {
+		ns.indexKey(key, true)
+		ns.items.Add(1)
+		m.items.Add(1)
+	}
+	ns.size.Add(delta)
+	m.size.Add(delta)
 	return nil
 }
 
 func (m *MemDatabase) Get(namespace string, key string) ([]byte, *DbError) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	ns, ok := m.namespaces[namespace]
-	if !ok {
-		return nil, &DbError{
-			ErrorCode: NAMESPACE_NOT_FOUND,
-			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
-		}
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return nil, dbErr
 	}
-	val, ok := ns.data[key]
+	entry, ok := ns.get(key)
 	if !ok {
 		return nil, &DbError{
 			ErrorCode: ID_NOT_FOUND,
 			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
 		}
 	}
-	return val, nil
+	if m.budgeted() {
+		entry.access.Store(time.Now().UnixNano())
+	}
+	return bytes.Clone(entry.value), nil
 }
 
 func (m *MemDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.snapshot(), nil
+}
 
-	ns, ok := m.namespaces[namespace]
-	if !ok {
-		return nil, &DbError{
-			ErrorCode: NAMESPACE_NOT_FOUND,
-			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+// GetMany returns the documents of the keys found
+func (m *MemDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	ret := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if entry, ok := ns.get(key); ok {
+			if m.budgeted() {
+				entry.access.Store(time.Now().UnixNano())
+			}
+			ret[key] = bytes.Clone(entry.value)
 		}
 	}
-	return ns.data, nil
+	return ret, nil
 }
 
-func (m *MemDatabase) Delete(namespace string, key string) *DbError {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *MemDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return m.ScanRange(namespace, KeyRange{}, fn)
+}
 
-	ns, ok := m.namespaces[namespace]
-	if !ok {
-		return &DbError{
-			ErrorCode: NAMESPACE_NOT_FOUND,
-			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+// ScanRange walks a copy on write clone of the sorted keys, and reads the values as it goes:
+// only one document is copied at a time, and the writes are not blocked meanwhile.
+func (m *MemDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return dbErr
+	}
+	ns.ascend(r, func(key string) bool {
+		entry, ok := ns.get(key)
+		if !ok {
+			return true // deleted during the scan
 		}
+		return fn(key, bytes.Clone(entry.value))
+	})
+	return nil
+}
+
+func (m *MemDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return dbErr
 	}
-	_, ok = ns.data[key]
-	if !ok {
+	ns.ascend(r, fn)
+	return nil
+}
+
+func (m *MemDatabase) Count(namespace string) (int64, *DbError) {
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return 0, dbErr
+	}
+	return ns.items.Load(), nil
+}
+
+func (m *MemDatabase) NextSequence(namespace string) (int64, *DbError) {
+	seq, _ := m.sequences.LoadOrStore(namespace, &atomic.Int64{})
+	return seq.(*atomic.Int64).Add(1), nil
+}
+
+func (m *MemDatabase) Delete(namespace string, key string) *DbError {
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return dbErr
+	}
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if ns.dropped {
+		return namespaceNotFound(namespace)
+	}
+
+	if !m.remove(ns, key, nil) {
 		return &DbError{
 			ErrorCode: ID_NOT_FOUND,
 			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
 		}
 	}
-
-	delete(ns.data, key)
 	return nil
 }
 
+// remove deletes the document, only if it is still the given entry when not nil. The caller holds ns.mu for reading.
+func (m *MemDatabase) remove(ns *memNamespace, key string, expected *memEntry) bool {
+	shard := ns.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, ok := shard.data[key]
+	if !ok || (expected != nil && entry != expected) {
+		return false
+	}
+
+	delete(shard.data, key)
+	ns.indexKey(key, false)
+	ns.items.Add(-1)
+	m.items.Add(-1)
+	ns.size.Add(-entry.size(key))
+	m.size.Add(-entry.size(key))
+	return true
+}
+
 func (m *MemDatabase) DeleteAll(namespace string) *DbError {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	ns, dbErr := m.lookup(namespace)
+	if dbErr != nil {
+		return dbErr
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.dropped {
+		return namespaceNotFound(namespace)
+	}
+	ns.dropped = true
+	m.namespaces.CompareAndDelete(namespace, ns)
+	m.items.Add(-ns.items.Load())
+	m.size.Add(-ns.size.Load())
+	return nil
+}
 
-	_, ok := m.namespaces[namespace]
-	if !ok {
-		return &DbError{
-			ErrorCode: NAMESPACE_NOT_FOUND,
-			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+// OnEvict adds a function called after each eviction, the functions are registered before the first write
+func (m *MemDatabase) OnEvict(fn func(namespace string, key string)) {
+	m.onEvict = append(m.onEvict, fn)
+}
+
+// MemoryStats returns the size and eviction counters, globally and by namespace
+func (m *MemDatabase) MemoryStats() MemStats {
+	stats := MemStats{
+		Items:      m.items.Load(),
+		Bytes:      m.size.Load(),
+		MaxBytes:   m.MaxBytes,
+		Evictions:  m.evictions.Load(),
+		Namespaces: make(map[string]MemStats),
+	}
+	m.namespaces.Range(func(k, v interface{}) bool {
+		ns := v.(*memNamespace)
+		stats.Namespaces[k.(string)] = MemStats{
+			Items:     ns.items.Load(),
+			Bytes:     ns.size.Load(),
+			MaxBytes:  ns.maxBytes,
+			Evictions: ns.evictions.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+func (m *MemDatabase) budgeted() bool {
+	return m.MaxBytes > 0 || len(m.NamespaceMaxBytes) > 0
+}
+
+// evict removes the least recently used documents until the namespace and the whole database are within their budget
+func (m *MemDatabase) evict(ns *memNamespace) {
+	for {
+		var candidates []*memNamespace
+		if ns.maxBytes > 0 && ns.size.Load() > ns.maxBytes {
+			candidates = []*memNamespace{ns}
+		} else if m.MaxBytes > 0 && m.size.Load() > m.MaxBytes {
+			m.namespaces.Range(func(_, v interface{}) bool {
+				candidates = append(candidates, v.(*memNamespace))
+				return true
+			})
+		} else {
+			return
+		}
+
+		victim, key, entry := oldestEntry(candidates)
+		if entry == nil {
+			return
+		}
+		victim.mu.RLock()
+		evicted := !victim.dropped && m.remove(victim, key, entry)
+		victim.mu.RUnlock()
+		// otherwise it was written or deleted meanwhile, another one is sampled
+		if evicted {
+			victim.evictions.Add(1)
+			m.evictions.Add(1)
+			for _, fn := range m.onEvict {
+				fn(victim.name, key)
+			}
 		}
 	}
-	delete(m.namespaces, namespace)
-	return nil
+}
+
+func oldestEntry(candidates []*memNamespace) (*memNamespace, string, *memEntry) {
+	var oldestNs *memNamespace
+	var oldestKey string
+	var oldest *memEntry
+	for _, ns := range candidates {
+		for i := range ns.shards {
+			shard := &ns.shards[i]
+			shard.mu.RLock()
+			sampled := 0
+			// map iteration starts at a random position
+			for key, entry := range shard.data {
+				if oldest == nil || entry.access.Load() < oldest.access.Load() {
+					oldestNs, oldestKey, oldest = ns, key, entry
+				}
+				sampled++
+				if sampled == mem_evictionSamples {
+					break
+				}
+			}
+			shard.mu.RUnlock()
+		}
+	}
+	return oldestNs, oldestKey, oldest
+}
+
+// snapshot copies every namespace, and the sequences as the sequences_namespace
+func (m *MemDatabase) snapshot() map[string]map[string][]byte {
+	ret := make(map[string]map[string][]byte)
+	sequences := make(map[string][]byte)
+	m.sequences.Range(func(k, v interface{}) bool {
+		sequences[k.(string)] = strconv.AppendInt(nil, v.(*atomic.Int64).Load(), 10)
+		return true
+	})
+	ret[sequences_namespace] = sequences
+	m.namespaces.Range(func(k, v interface{}) bool {
+		ns := v.(*memNamespace)
+		ns.mu.Lock()
+		defer ns.mu.Unlock()
+		if !ns.dropped {
+			ret[k.(string)] = ns.snapshot()
+		}
+		return true
+	})
+	return ret
+}
+
+// restore replaces every namespace with the given data
+func (m *MemDatabase) restore(data map[string]map[string][]byte) {
+	m.namespaces.Range(func(k, _ interface{}) bool {
+		m.DeleteAll(k.(string))
+		return true
+	})
+	m.sequences = &sync.Map{}
+	for name, value := range data[sequences_namespace] {
+		seq := &atomic.Int64{}
+		current, _ := strconv.ParseInt(string(value), 10, 64)
+		seq.Store(current)
+		m.sequences.Store(name, seq)
+	}
+	for name, values := range data {
+		if name == sequences_namespace {
+			continue
+		}
+		ns := m.newMemNamespace(name)
+		for k, v := range values {
+			entry := &memEntry{value: v}
+			ns.shard(k).data[k] = entry
+			ns.index.ReplaceOrInsert(k)
+			ns.items.Add(1)
+			ns.size.Add(entry.size(k))
+		}
+		m.items.Add(ns.items.Load())
+		m.size.Add(ns.size.Load())
+		m.namespaces.Store(name, ns)
+	}
 }
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// go test ./database -run - -bench MemDatabase -cpu 1,2,4,8
+
+const mem_benchKeys = 10000
+
+func newBenchMemDatabase(b *testing.B) *MemDatabase {
+	m := &MemDatabase{}
+	m.Init()
+	for i := 0; i < mem_benchKeys; i++ {
+		m.Upsert("bench", strconv.Itoa(i), []byte(`{"name":"jack","age":25}`), true)
+	}
+	b.ResetTimer()
+	return m
+}
+
+func BenchmarkMemDatabase_Get(b *testing.B) {
+	m := newBenchMemDatabase(b)
+	var seed atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seed.Add(7919))
+		for pb.Next() {
+			i++
+			if _, err := m.Get("bench", strconv.Itoa(i%mem_benchKeys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// one write every 10 reads
+func BenchmarkMemDatabase_GetUpsert(b *testing.B) {
+	m := newBenchMemDatabase(b)
+	var seed atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seed.Add(7919))
+		for pb.Next() {
+			i++
+			key := strconv.Itoa(i % mem_benchKeys)
+			if i%10 == 0 {
+				m.Upsert("bench", key, []byte(`{"name":"john","age":30}`), true)
+			} else if _, err := m.Get("bench", key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,13 +18,16 @@ type MongoDatabase struct {
 	Name string
 	User string
 	Pass string
+	// namespace -> json pointer of a GeoJSON Point field, with a 2dsphere index
+	GeoFields map[string]string
 
 	client *mongo.Client
 	db     *mongo.Database
 }
 
 const (
-	mongo_dbTimeout = 10 * time.Second
+	mongo_dbTimeout   = 10 * time.Second
+	mongo_geoDistance = "_geo_distance"
 )
 
 func (m *MongoDatabase) Init() {
@@ -44,6 +48,15 @@ func (m *MongoDatabase) Init() {
 	}
 	m.db = db
 	log.Println("db connected")
+
+	for namespace := range m.GeoFields {
+		if err := m.ensureNamespace(namespace); err != nil {
+			log.Fatalf("error creating namespace '%v': %v", namespace, err)
+		}
+		if err := m.ensureGeoIndex(namespace); err != nil {
+			log.Fatalf("error creating the geo index of '%v': %v", namespace, err)
+		}
+	}
 }
 
 func (m *MongoDatabase) Disconnect() {
@@ -72,7 +85,7 @@ func (m *MongoDatabase) GetNamespaces() []string {
 	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
 	defer cancel()
 
-	filter := bson.D{{}}
+	filter := bson.M{"name": bson.M{"$ne": sequences_namespace}}
 	names, err := m.db.ListCollectionNames(ctx, filter)
 	if err != nil {
 		log.Panicf("error on GetNamespaces: %v", err.Error())
@@ -175,30 +188,479 @@ func (m *MongoDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 }
 
 func (m *MongoDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(m.Scan, namespace)
+}
+
+func (m *MongoDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return m.ScanRange(namespace, KeyRange{}, fn)
+}
+
+func (m *MongoDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	return m.find(namespace, rangeFilter(r), options.Find().SetSort(bson.D{{Key: "id", Value: 1}}), fn)
+}
+
+// ScanRangeFields is ScanRange with a projection on the fields
+func (m *MongoDatabase) ScanRangeFields(namespace string, r KeyRange, fields []string, fn ScanFunc) *DbError {
+	paths, ok := fieldPaths(fields)
+	if !ok || len(paths) == 0 {
+		return m.ScanRange(namespace, r, fn)
+	}
+	projection := bson.M{"id": 1, "_id": 0}
+	for _, path := range paths {
+		projection[strings.Join(path, ".")] = 1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetProjection(projection)
+	return m.find(namespace, rangeFilter(r), opts, fn)
+}
+
+// Query runs the query as an aggregation pipeline. The conditions and the sort keys are aggregation expressions
+// rather than query operators, which would look into the arrays, see mongo_field.
+func (m *MongoDatabase) Query(namespace string, q Query, fn ScanFunc) *DbError {
+	match, ok := mongo_match(q.Range, q.Where)
+	if !ok {
+		return QueryScan(m.ScanRange, namespace, q, fn)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	sortKeys := bson.D{}
+	sortValues := bson.M{}
+	for i, sortField := range q.Sort {
+		path, ok := fieldPath(sortField.Field)
+		if !ok {
+			return QueryScan(m.ScanRange, namespace, q, fn)
+		}
+		field := mongo_field(path)
+		direction := 1
+		if sortField.Descending {
+			direction = -1
+		}
+		for j, value := range []interface{}{field.rank(), field.number(), field.text(), field.boolean()} {
+			name := fmt.Sprintf("_sort_%d_%d", i, j)
+			sortValues[name] = value
+			sortKeys = append(sortKeys, bson.E{Key: name, Value: direction})
+		}
+	}
+	if len(sortValues) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: sortValues}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: append(sortKeys, bson.E{Key: "id", Value: 1})}})
+	if q.Offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: q.Offset}})
+	}
+	if q.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Limit}})
+	}
+
+	projection := bson.M{}
+	if paths, ok := fieldPaths(q.Fields); ok && len(paths) > 0 {
+		projection["id"] = 1
+		projection["_id"] = 0
+		for _, path := range paths {
+			projection[strings.Join(path, ".")] = 1
+		}
+	} else {
+		for name := range sortValues {
+			projection[name] = 0
+		}
+	}
+	if len(projection) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+
+	// no timeout, the documents are read as fast as the caller consumes them
+	ctx := context.Background()
+	cur, err := m.db.Collection(namespace).Aggregate(ctx, pipeline)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return scanCursor(ctx, cur, fn)
+}
+
+// GeoSearch runs the query as a $geoNear stage, over the 2dsphere index of the point field. The box is matched on the
+// coordinates rather than with $geoWithin, whose edges would follow the great circles instead of the parallels.
+func (m *MongoDatabase) GeoSearch(namespace string, q GeoQuery) ([]GeoDocument, *DbError) {
+	pointer, ok := m.GeoFields[namespace]
+	if !ok {
+		return nil, &DbError{
+			ErrorCode: NOT_SUPPORTED,
+			Message:   fmt.Sprintf("namespace '%v' has no geo index", namespace),
+		}
+	}
+	field := mongo_pointerField(pointer)
+	origin := q.origin()
+	geoNear := bson.M{
+		"near":          bson.M{"type": "Point", "coordinates": bson.A{origin.Lng, origin.Lat}},
+		"distanceField": mongo_geoDistance,
+		"key":           field,
+		"spherical":     true,
+	}
+	if q.Near != nil && q.Radius > 0 {
+		geoNear["maxDistance"] = q.Radius
+	}
+	pipeline := mongo.Pipeline{{{Key: "$geoNear", Value: geoNear}}}
+	if q.Box != nil {
+		lng := bson.M{"$arrayElemAt": bson.A{"$" + field + ".coordinates", 0}}
+		lat := bson.M{"$arrayElemAt": bson.A{"$" + field + ".coordinates", 1}}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"$expr": bson.M{"$and": bson.A{
+			bson.M{"$gte": bson.A{lng, q.Box.MinLng}}, bson.M{"$lte": bson.A{lng, q.Box.MaxLng}},
+			bson.M{"$gte": bson.A{lat, q.Box.MinLat}}, bson.M{"$lte": bson.A{lat, q.Box.MaxLat}},
+		}}}}})
+	}
+	// $geoNear gives the nearest first, the ties are ordered by key as the other drivers do
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.D{{Key: mongo_geoDistance, Value: 1}, {Key: "id", Value: 1}}}})
+	if q.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Limit}})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
 	defer cancel()
+	cur, err := m.db.Collection(namespace).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	defer cur.Close(ctx)
 
-	coll := m.db.Collection(namespace)
+	ret := make([]GeoDocument, 0)
+	for cur.Next(ctx) {
+		var result map[string]interface{}
+		err := bson.Unmarshal(cur.Current, &result)
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   err.Error(),
+			}
+		}
+		distance, _ := result[mongo_geoDistance].(float64)
+		id := fmt.Sprintf("%v", result["id"])
+		delete(result, "_id")
+		delete(result, "id")
+		delete(result, mongo_geoDistance)
 
-	filter := bson.M{}
-	cur, err := coll.Find(ctx, filter)
+		data, err := json.Marshal(result)
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   err.Error(),
+			}
+		}
+		ret = append(ret, GeoDocument{Document: Document{Key: id, Value: data}, Distance: distance})
+	}
+	if err := cur.Err(); err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return ret, nil
+}
+
+// mongo_pointerField is the dotted path of a json pointer
+func mongo_pointerField(pointer string) string {
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Aggregate runs the aggregation as a $group stage, with the expressions of Query
+func (m *MongoDatabase) Aggregate(namespace string, a Aggregation) ([]AggregateGroup, *DbError) {
+	match, ok := mongo_match(KeyRange{}, a.Where)
+	if !ok {
+		return AggregateScan(m.ScanRange, namespace, a)
+	}
+	group := bson.M{"_id": nil}
+	if a.GroupBy != "" {
+		path, ok := fieldPath(a.GroupBy)
+		if !ok {
+			return AggregateScan(m.ScanRange, namespace, a)
+		}
+		group["_id"] = mongo_field(path).groupKey()
+	}
+	for i, accumulator := range a.Accumulators {
+		name := fmt.Sprintf("_acc_%d", i)
+		if accumulator.Operator == ACC_COUNT {
+			group[name] = bson.M{"$sum": 1}
+			continue
+		}
+		path, ok := fieldPath(accumulator.Field)
+		if !ok {
+			return AggregateScan(m.ScanRange, namespace, a)
+		}
+		// $sum, $avg, $min and $max skip the nulls of the other types
+		group[name] = bson.M{"$" + accumulator.Operator: mongo_field(path).number()}
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}, {{Key: "$group", Value: group}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
+	defer cancel()
+	cur, err := m.db.Collection(namespace).Aggregate(ctx, pipeline)
 	if err != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
 			Message:   err.Error(),
 		}
 	}
+	defer cur.Close(ctx)
 
-	ret := make(map[string][]byte)
+	var ret []AggregateGroup
 	for cur.Next(ctx) {
 		var result map[string]interface{}
 		err := bson.Unmarshal(cur.Current, &result)
+		if err == nil {
+			var key []byte
+			key, err = json.Marshal(result["_id"])
+			if err == nil {
+				group := AggregateGroup{Values: make([]interface{}, len(a.Accumulators))}
+				group.Key, err = canonicalKey(key)
+				for i, accumulator := range a.Accumulators {
+					group.Values[i] = mongo_number(result[fmt.Sprintf("_acc_%d", i)], accumulator.Operator == ACC_COUNT)
+				}
+				ret = append(ret, group)
+			}
+		}
 		if err != nil {
 			return nil, &DbError{
 				ErrorCode: INTERNAL_ERROR,
 				Message:   err.Error(),
 			}
 		}
+	}
+	if len(ret) == 0 && a.GroupBy == "" {
+		ret = append(ret, emptyGroup(a))
+	}
+	return ret, nil
+}
+
+// mongo_number converts a number of an aggregation result to the int64 of a count or to a float64
+func mongo_number(value interface{}, count bool) interface{} {
+	var number float64
+	switch v := value.(type) {
+	case int32:
+		number = float64(v)
+	case int64:
+		number = float64(v)
+	case float64:
+		number = v
+	default:
+		return nil
+	}
+	if count {
+		return int64(number)
+	}
+	return number
+}
+
+// mongo_match is the filter selecting the keys of the range whose fields match the conditions
+func mongo_match(r KeyRange, where []Condition) (bson.M, bool) {
+	conditions := bson.A{}
+	for _, condition := range where {
+		path, ok := fieldPath(condition.Field)
+		if !ok {
+			return nil, false
+		}
+		field := mongo_field(path)
+		var expression bson.M
+		switch condition.Value.(type) {
+		case float64:
+			expression = mongo_compare(condition.Operator, field.number(), condition.Value)
+		case string:
+			expression = mongo_compare(condition.Operator, field.text(), condition.Value)
+		case bool:
+			expression = bson.M{"$eq": bson.A{field.boolean(), condition.Value}}
+		case nil:
+			expression = bson.M{"$eq": bson.A{bson.M{"$type": field.value}, "null"}}
+		}
+		if condition.Operator == OP_NE {
+			expression = bson.M{"$not": bson.A{expression}}
+		}
+		conditions = append(conditions, expression)
+	}
+	match := rangeFilter(r)
+	if len(conditions) > 0 {
+		match["$expr"] = bson.M{"$and": conditions}
+	}
+	return match, true
+}
+
+// mongo_field writes the aggregation expressions on a field, each of them null when the field doesn't have its type.
+// A path going through an array gives the array of the values found in its elements, which isn't any scalar type;
+// blocked lists those arrays so that the field counts as missing, as in QueryScan.
+type mongo_fieldExpressions struct {
+	value   string
+	blocked bson.A
+}
+
+func mongo_field(path []string) mongo_fieldExpressions {
+	field := mongo_fieldExpressions{value: "$" + strings.Join(path, ".")}
+	for i := 1; i < len(path); i++ {
+		field.blocked = append(field.blocked, bson.M{"$isArray": "$" + strings.Join(path[:i], ".")})
+	}
+	return field
+}
+
+func (f mongo_fieldExpressions) ofType(isType bson.M) bson.M {
+	return bson.M{"$cond": bson.A{isType, f.value, nil}}
+}
+
+func (f mongo_fieldExpressions) number() bson.M {
+	return f.ofType(bson.M{"$isNumber": f.value})
+}
+
+func (f mongo_fieldExpressions) text() bson.M {
+	return f.ofType(bson.M{"$eq": bson.A{bson.M{"$type": f.value}, "string"}})
+}
+
+func (f mongo_fieldExpressions) boolean() bson.M {
+	return f.ofType(bson.M{"$eq": bson.A{bson.M{"$type": f.value}, "bool"}})
+}
+
+// groupKey is the value of the field, null when it is missing
+func (f mongo_fieldExpressions) groupKey() interface{} {
+	if len(f.blocked) == 0 {
+		return f.value
+	}
+	return bson.M{"$cond": bson.A{bson.M{"$or": f.blocked}, nil, f.value}}
+}
+
+// rank orders the types as SortField does
+func (f mongo_fieldExpressions) rank() bson.M {
+	composite := bson.M{"$in": bson.A{bson.M{"$type": f.value}, bson.A{"object", "array"}}}
+	if len(f.blocked) > 0 {
+		composite = bson.M{"$and": bson.A{composite, bson.M{"$not": bson.A{bson.M{"$or": f.blocked}}}}}
+	}
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$isNumber": f.value}, "then": 1},
+			bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$type": f.value}, "string"}}, "then": 2},
+			bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$type": f.value}, "bool"}}, "then": 3},
+			bson.M{"case": composite, "then": 4},
+		},
+		"default": 0,
+	}}
+}
+
+// mongo_compare compares an expression of a type with a value, the null of the other types is never compared
+// since the aggregation operators order the values of all types
+func mongo_compare(operator string, expression bson.M, value interface{}) bson.M {
+	if operator == OP_NE {
+		operator = OP_EQ
+	}
+	return bson.M{"$and": bson.A{
+		bson.M{"$ne": bson.A{expression, nil}},
+		bson.M{"$" + operator: bson.A{expression, value}},
+	}}
+}
+
+// ScanKeys only reads the ids, sorted by the index on id
+func (m *MongoDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetProjection(bson.M{"id": 1, "_id": 0})
+	return m.find(namespace, rangeFilter(r), opts, func(key string, _ []byte) bool {
+		return fn(key)
+	})
+}
+
+func (m *MongoDatabase) Count(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
+	defer cancel()
+	count, err := m.db.Collection(namespace).CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return count, nil
+}
+
+// NextSequence increments the document of the namespace in the sequences collection with findAndModify
+func (m *MongoDatabase) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
+	defer cancel()
+	var sequence struct {
+		Value int64 `bson:"value"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := m.db.Collection(sequences_namespace).FindOneAndUpdate(ctx,
+		bson.M{"_id": namespace},
+		bson.M{"$inc": bson.M{"value": 1}},
+		opts,
+	).Decode(&sequence)
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return sequence.Value, nil
+}
+
+func rangeFilter(r KeyRange) bson.M {
+	bounds := bson.M{}
+	if lower := r.lower(); lower != "" {
+		bounds["$gte"] = lower
+	}
+	if r.End != "" {
+		bounds["$lte"] = r.End
+	}
+	if end := prefixEnd(r.Prefix); end != "" {
+		bounds["$lt"] = end
+	}
+	filter := bson.M{}
+	if len(bounds) > 0 {
+		filter["id"] = bounds
+	}
+	return filter
+}
+
+func (m *MongoDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	err := m.find(namespace, bson.M{"id": bson.M{"$in": keys}}, options.Find(), func(key string, value []byte) bool {
+		ret[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// find hands the documents matching the filter to fn, without their id fields
+func (m *MongoDatabase) find(namespace string, filter bson.M, opts *options.FindOptions, fn ScanFunc) *DbError {
+	// no timeout, the documents are read as fast as the caller consumes them
+	ctx := context.Background()
+
+	coll := m.db.Collection(namespace)
+
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return scanCursor(ctx, cur, fn)
+}
+
+// scanCursor hands the documents of the cursor to fn, without their id fields
+func scanCursor(ctx context.Context, cur *mongo.Cursor, fn ScanFunc) *DbError {
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var result map[string]interface{}
+		err := bson.Unmarshal(cur.Current, &result)
+		if err != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   err.Error(),
+			}
+		}
 
 		delete(result, "_id") // delete _id
 		id := fmt.Sprintf("%v", result["id"])
@@ -206,12 +668,17 @@ func (m *MongoDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 
 		data, err := json.Marshal(result)
 		if err != nil {
-			log.Fatal(err)
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   err.Error(),
+			}
+		}
+		if !fn(id, data) {
+			return nil
 		}
-		ret[id] = data
 	}
 
-	return ret, nil
+	return nil
 }
 
 func (m *MongoDatabase) Delete(namespace string, key string) *DbError {
@@ -270,7 +737,25 @@ func (m *MongoDatabase) ensureNamespace(namespace string) (err error) {
 			return err
 		}
 		log.Printf("Name of Index Created: %s\n", name)
+		if _, ok := m.GeoFields[namespace]; ok {
+			return m.ensureGeoIndex(namespace)
+		}
 	}
 
 	return nil
 }
+
+// ensureGeoIndex creates the 2dsphere index of the point field, nothing is done when it already exists
+func (m *MongoDatabase) ensureGeoIndex(namespace string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongo_dbTimeout)
+	defer cancel()
+
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: mongo_pointerField(m.GeoFields[namespace]), Value: "2dsphere"}},
+	}
+	_, err := m.db.Collection(namespace).Indexes().CreateOne(ctx, indexModel)
+	if err != nil {
+		log.Printf("error creating geo index: %v\n", err)
+	}
+	return err
+}
@@ -5,22 +5,34 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 const (
-	mysql_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v (id VARCHAR(14) NOT NULL, data json NOT NULL, PRIMARY KEY (id)) ENGINE=InnoDB;"
+	mysql_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v (id VARCHAR(64) NOT NULL, data json NOT NULL, PRIMARY KEY (id)) ENGINE=InnoDB;"
 	mysql_dropNamespaceQuery  = "DROP TABLE %v"
 	mysql_insertQuery         = "INSERT INTO %v (id, data) VALUES(?, ?) ON DUPLICATE KEY UPDATE data = ?"
-	mysql_tablesQuery         = "SELECT table_name FROM information_schema.tables WHERE table_schema = '%v'"
+	mysql_tablesQuery         = "SELECT table_name FROM information_schema.tables WHERE table_schema = '%v' AND table_name != '_sequences'"
 	mysql_recordExistentQuery = "SELECT COUNT(1) FROM %v WHERE id = ?"
 	mysql_getQuery            = "SELECT data FROM %v WHERE id = ?"
-	mysql_getAllQuery         = "SELECT id, data FROM %v ORDER BY id"
+	mysql_scanRangeQuery      = "SELECT id, data FROM %v%v ORDER BY id" + mysql_collate
+	mysql_scanKeysQuery       = "SELECT id FROM %v%v ORDER BY id" + mysql_collate
+	mysql_scanFieldsQuery     = "SELECT id, %v FROM %v%v ORDER BY id" + mysql_collate
+	mysql_queryQuery          = "SELECT id, %v FROM %v%v"
+	mysql_aggregateQuery      = "SELECT %v FROM %v%v"
+	mysql_countQuery          = "SELECT COUNT(*) FROM %v"
+	mysql_getManyQuery        = "SELECT id, data FROM %v%v"
+	mysql_getAllQuery         = "SELECT id, data FROM %v ORDER BY id" + mysql_collate
 	mysql_deleteQuery         = "DELETE FROM %v WHERE id = ?"
 	mysql_deleteAllQuery      = "TRUNCATE TABLE %v"
+	mysql_sequencesQuery      = "CREATE TABLE IF NOT EXISTS _sequences (namespace VARCHAR(64) NOT NULL, value BIGINT NOT NULL, PRIMARY KEY (namespace)) ENGINE=InnoDB;"
+	mysql_nextSequenceQuery   = "INSERT INTO _sequences (namespace, value) VALUES(?, LAST_INSERT_ID(1)) ON DUPLICATE KEY UPDATE value = LAST_INSERT_ID(value + 1)"
 	mysql_dbTimeout           = 10 * time.Second
+	// the ids and the texts of the documents compare in byte order, whatever the collation of the table
+	mysql_collate = " COLLATE utf8mb4_bin"
 )
 
 type MySqlDatabase struct {
@@ -162,35 +174,223 @@ func (m *MySqlDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	}
 }
 
-func (m *MySqlDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+func (m *MySqlDatabase) Exists(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
 	defer cancel()
+	var count int
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf(mysql_recordExistentQuery, namespace), key).Scan(&count)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Exists: %v", err),
+		}
+	}
+	if count == 0 {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace %v for key %v", namespace, key),
+		}
+	}
+	return nil
+}
+
+func (m *MySqlDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(m.Scan, namespace)
+}
+
+func (m *MySqlDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	// no timeout, the rows are read as fast as the caller consumes them
 	sqlStatement := fmt.Sprintf(mysql_getAllQuery, namespace)
-	rows, dbErr := m.db.QueryContext(ctx, sqlStatement)
+	rows, dbErr := m.db.QueryContext(context.Background(), sqlStatement)
 	if dbErr != nil {
-		return nil, &DbError{
+		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
-			Message:   fmt.Sprintf("error on Get: %v", dbErr),
+			Message:   fmt.Sprintf("error on Scan: %v", dbErr),
 		}
 	}
-	defer rows.Close()
+	return scanRows(rows, fn)
+}
 
-	ret := make(map[string][]byte)
+func (m *MySqlDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	where, args := sqlRange(r, mysql_placeholder, mysql_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, dbErr := m.db.QueryContext(context.Background(), fmt.Sprintf(mysql_scanRangeQuery, namespace, where), args...)
+	if dbErr != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanRange: %v", dbErr),
+		}
+	}
+	return scanRows(rows, fn)
+}
 
-	for rows.Next() {
-		var id, data string
-		scanErr := rows.Scan(&id, &data)
-		if scanErr != nil {
-			return nil, &DbError{
-				ErrorCode: INTERNAL_ERROR,
-				Message:   fmt.Sprintf("scan %v", scanErr),
-			}
+// ScanRangeFields is ScanRange reading only the fields of the documents, extracted with JSON_EXTRACT
+func (m *MySqlDatabase) ScanRangeFields(namespace string, r KeyRange, fields []string, fn ScanFunc) *DbError {
+	paths, ok := fieldPaths(fields)
+	if !ok || len(paths) == 0 {
+		return m.ScanRange(namespace, r, fn)
+	}
+	columns := make([]string, len(paths))
+	for i, path := range paths {
+		columns[i] = mysql_dialect.field(path)
+	}
+	where, args := sqlRange(r, mysql_placeholder, mysql_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, err := m.db.QueryContext(context.Background(), fmt.Sprintf(mysql_scanFieldsQuery, strings.Join(columns, ", "), namespace, where), args...)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanRangeFields: %v", err),
 		}
-		ret[id] = []byte(data)
+	}
+	return scanFieldRows(rows, paths, fn)
+}
+
+// Query filters, sorts and pages the documents with the json functions, see sqlDialect
+func (m *MySqlDatabase) Query(namespace string, q Query, fn ScanFunc) *DbError {
+	columns, clauses, args, paths, ok := mysql_dialect.sqlQuery(q)
+	if !ok {
+		return QueryScan(m.ScanRange, namespace, q, fn)
+	}
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, err := m.db.QueryContext(context.Background(), fmt.Sprintf(mysql_queryQuery, columns, namespace, clauses), args...)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Query: %v", err),
+		}
+	}
+	if paths != nil {
+		return scanFieldRows(rows, paths, fn)
+	}
+	return scanRows(rows, fn)
+}
+
+// Aggregate groups the documents with GROUP BY on the json of the field, see sqlDialect
+func (m *MySqlDatabase) Aggregate(namespace string, a Aggregation) ([]AggregateGroup, *DbError) {
+	columns, clauses, args, ok := mysql_dialect.sqlAggregate(a)
+	if !ok {
+		return AggregateScan(m.ScanRange, namespace, a)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf(mysql_aggregateQuery, columns, namespace, clauses), args...)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Aggregate: %v", err),
+		}
+	}
+	return scanAggregateRows(rows, a)
+}
+
+func (m *MySqlDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
+	defer cancel()
+	where, args := sqlIn(keys, mysql_placeholder)
+	rows, dbErr := m.db.QueryContext(ctx, fmt.Sprintf(mysql_getManyQuery, namespace, where), args...)
+	if dbErr != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on GetMany: %v", dbErr),
+		}
+	}
+	err := scanRows(rows, func(key string, value []byte) bool {
+		ret[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return ret, nil
 }
 
+func (m *MySqlDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	where, args := sqlRange(r, mysql_placeholder, mysql_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, dbErr := m.db.QueryContext(context.Background(), fmt.Sprintf(mysql_scanKeysQuery, namespace, where), args...)
+	if dbErr != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanKeys: %v", dbErr),
+		}
+	}
+	return scanKeyRows(rows, fn)
+}
+
+func (m *MySqlDatabase) Count(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
+	defer cancel()
+	var count int64
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf(mysql_countQuery, namespace)).Scan(&count)
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Count: %v", err),
+		}
+	}
+	return count, nil
+}
+
+// NextSequence increments the row of the namespace in the _sequences table,
+// LAST_INSERT_ID(expr) hands the new value back to this connection without a second query
+func (m *MySqlDatabase) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
+	defer cancel()
+	var value int64
+	_, err := m.db.ExecContext(ctx, mysql_sequencesQuery)
+	if err == nil {
+		var result sql.Result
+		result, err = m.db.ExecContext(ctx, mysql_nextSequenceQuery, namespace)
+		if err == nil {
+			value, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on NextSequence: %v", err),
+		}
+	}
+	return value, nil
+}
+
+func mysql_placeholder(i int) string {
+	return "?"
+}
+
+// JSON_TYPE is NULL for a missing field, the text is compared in byte order with utf8mb4_bin
+var mysql_dialect = sqlDialect{
+	placeholder: mysql_placeholder,
+	field: func(path []string) string {
+		return fmt.Sprintf("JSON_EXTRACT(data, '%v')", sqlJsonPath(path))
+	},
+	number: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN JSON_TYPE(JSON_EXTRACT(data, '%[1]v')) IN ('INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL') THEN CAST(JSON_EXTRACT(data, '%[1]v') AS DOUBLE) END", sqlJsonPath(path))
+	},
+	text: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN JSON_TYPE(JSON_EXTRACT(data, '%[1]v')) = 'STRING' THEN JSON_UNQUOTE(JSON_EXTRACT(data, '%[1]v')) END", sqlJsonPath(path))
+	},
+	boolean: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN JSON_TYPE(JSON_EXTRACT(data, '%[1]v')) = 'BOOLEAN' THEN JSON_EXTRACT(data, '%[1]v') = CAST('true' AS JSON) END", sqlJsonPath(path))
+	},
+	isNull: func(path []string) string {
+		return fmt.Sprintf("JSON_TYPE(JSON_EXTRACT(data, '%v')) = 'NULL'", sqlJsonPath(path))
+	},
+	isComposite: func(path []string) string {
+		return fmt.Sprintf("JSON_TYPE(JSON_EXTRACT(data, '%v')) IN ('OBJECT', 'ARRAY')", sqlJsonPath(path))
+	},
+	groupKey: func(path []string) string {
+		return fmt.Sprintf("COALESCE(JSON_EXTRACT(data, '%v'), CAST('null' AS JSON))", sqlJsonPath(path))
+	},
+	collate: mysql_collate,
+	noLimit: "18446744073709551615",
+}
+
 func (m *MySqlDatabase) Delete(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), mysql_dbTimeout)
 	defer cancel()
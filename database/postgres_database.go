@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -14,13 +15,24 @@ const (
 	pg_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v ( id text PRIMARY KEY, data json NOT NULL)"
 	pg_dropNamespaceQuery  = "DROP TABLE %v"
 	pg_insertQuery         = "INSERT INTO %v (id, data) VALUES($1, $2) ON CONFLICT (id) DO UPDATE SET data = $2"
-	pg_tablesQuery         = "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'"
+	pg_tablesQuery         = "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_name != '_sequences'"
 	pg_recordExistentQuery = "SELECT COUNT(1) FROM %v WHERE id = $1"
 	pg_getQuery            = "SELECT data FROM %v WHERE id = $1"
-	pg_getAllQuery         = "SELECT id, data FROM %v ORDER BY id"
+	pg_scanRangeQuery      = "SELECT id, data FROM %v%v ORDER BY id" + pg_collate
+	pg_scanKeysQuery       = "SELECT id FROM %v%v ORDER BY id" + pg_collate
+	pg_scanFieldsQuery     = "SELECT id, %v FROM %v%v ORDER BY id" + pg_collate
+	pg_queryQuery          = "SELECT id, %v FROM %v%v"
+	pg_aggregateQuery      = "SELECT %v FROM %v%v"
+	pg_countQuery          = "SELECT COUNT(*) FROM %v"
+	pg_getManyQuery        = "SELECT id, data FROM %v%v"
+	pg_getAllQuery         = "SELECT id, data FROM %v ORDER BY id" + pg_collate
 	pg_deleteQuery         = "DELETE FROM %v WHERE id = $1"
 	pg_deleteAllQuery      = "TRUNCATE TABLE %v"
+	pg_sequencesQuery      = "CREATE TABLE IF NOT EXISTS _sequences ( namespace text PRIMARY KEY, value bigint NOT NULL)"
+	pg_nextSequenceQuery   = "INSERT INTO _sequences (namespace, value) VALUES($1, 1) ON CONFLICT (namespace) DO UPDATE SET value = _sequences.value + 1 RETURNING value"
 	pg_dbTimeout           = 10 * time.Second
+	// the ids and the texts of the documents compare in byte order, whatever the collation of the database
+	pg_collate = ` COLLATE "C"`
 )
 
 type PGDatabase struct {
@@ -160,35 +172,223 @@ func (p *PGDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	}
 }
 
-func (p *PGDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+func (p *PGDatabase) Exists(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
+	var count int
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf(pg_recordExistentQuery, namespace), key).Scan(&count)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Exists: %v", err),
+		}
+	}
+	if count == 0 {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace %v for key %v", namespace, key),
+		}
+	}
+	return nil
+}
+
+func (p *PGDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(p.Scan, namespace)
+}
+
+func (p *PGDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	// no timeout, the rows are read as fast as the caller consumes them
 	sqlStatement := fmt.Sprintf(pg_getAllQuery, namespace)
-	rows, dbErr := p.db.QueryContext(ctx, sqlStatement)
+	rows, dbErr := p.db.QueryContext(context.Background(), sqlStatement)
 	if dbErr != nil {
-		return nil, &DbError{
+		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
-			Message:   fmt.Sprintf("error on Get: %v", dbErr),
+			Message:   fmt.Sprintf("error on Scan: %v", dbErr),
 		}
 	}
-	defer rows.Close()
+	return scanRows(rows, fn)
+}
 
-	ret := make(map[string][]byte)
+func (p *PGDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	where, args := sqlRange(r, pg_placeholder, pg_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, dbErr := p.db.QueryContext(context.Background(), fmt.Sprintf(pg_scanRangeQuery, namespace, where), args...)
+	if dbErr != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanRange: %v", dbErr),
+		}
+	}
+	return scanRows(rows, fn)
+}
 
-	for rows.Next() {
-		var id, data string
-		scanErr := rows.Scan(&id, &data)
-		if scanErr != nil {
-			return nil, &DbError{
-				ErrorCode: INTERNAL_ERROR,
-				Message:   fmt.Sprintf("scan %v", scanErr),
-			}
+// ScanRangeFields is ScanRange reading only the fields of the documents, extracted with the #> operator
+func (p *PGDatabase) ScanRangeFields(namespace string, r KeyRange, fields []string, fn ScanFunc) *DbError {
+	paths, ok := fieldPaths(fields)
+	if !ok || len(paths) == 0 {
+		return p.ScanRange(namespace, r, fn)
+	}
+	columns := make([]string, len(paths))
+	for i, path := range paths {
+		columns[i] = pg_dialect.field(path)
+	}
+	where, args := sqlRange(r, pg_placeholder, pg_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, err := p.db.QueryContext(context.Background(), fmt.Sprintf(pg_scanFieldsQuery, strings.Join(columns, ", "), namespace, where), args...)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanRangeFields: %v", err),
+		}
+	}
+	return scanFieldRows(rows, paths, fn)
+}
+
+// Query filters, sorts and pages the documents with the json operators, see sqlDialect
+func (p *PGDatabase) Query(namespace string, q Query, fn ScanFunc) *DbError {
+	columns, clauses, args, paths, ok := pg_dialect.sqlQuery(q)
+	if !ok {
+		return QueryScan(p.ScanRange, namespace, q, fn)
+	}
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, err := p.db.QueryContext(context.Background(), fmt.Sprintf(pg_queryQuery, columns, namespace, clauses), args...)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Query: %v", err),
+		}
+	}
+	if paths != nil {
+		return scanFieldRows(rows, paths, fn)
+	}
+	return scanRows(rows, fn)
+}
+
+// Aggregate groups the documents with GROUP BY on the json of the field, see sqlDialect
+func (p *PGDatabase) Aggregate(namespace string, a Aggregation) ([]AggregateGroup, *DbError) {
+	columns, clauses, args, ok := pg_dialect.sqlAggregate(a)
+	if !ok {
+		return AggregateScan(p.ScanRange, namespace, a)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(pg_aggregateQuery, columns, namespace, clauses), args...)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Aggregate: %v", err),
 		}
-		ret[id] = []byte(data)
+	}
+	return scanAggregateRows(rows, a)
+}
+
+func (p *PGDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	where, args := sqlIn(keys, pg_placeholder)
+	rows, dbErr := p.db.QueryContext(ctx, fmt.Sprintf(pg_getManyQuery, namespace, where), args...)
+	if dbErr != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on GetMany: %v", dbErr),
+		}
+	}
+	err := scanRows(rows, func(key string, value []byte) bool {
+		ret[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return ret, nil
 }
 
+func (p *PGDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	where, args := sqlRange(r, pg_placeholder, pg_dialect.collate)
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, dbErr := p.db.QueryContext(context.Background(), fmt.Sprintf(pg_scanKeysQuery, namespace, where), args...)
+	if dbErr != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanKeys: %v", dbErr),
+		}
+	}
+	return scanKeyRows(rows, fn)
+}
+
+func (p *PGDatabase) Count(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	var count int64
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf(pg_countQuery, namespace)).Scan(&count)
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Count: %v", err),
+		}
+	}
+	return count, nil
+}
+
+// NextSequence increments the row of the namespace in the _sequences table, the row lock serializes the callers
+func (p *PGDatabase) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	var value int64
+	_, err := p.db.ExecContext(ctx, pg_sequencesQuery)
+	if err == nil {
+		err = p.db.QueryRowContext(ctx, pg_nextSequenceQuery, namespace).Scan(&value)
+	}
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on NextSequence: %v", err),
+		}
+	}
+	return value, nil
+}
+
+func pg_placeholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
+// pg_jsonPath is the path of the field for the #> and #>> operators, like '{address,city}'
+func pg_jsonPath(path []string) string {
+	return "'{" + strings.Join(path, ",") + "}'"
+}
+
+// json_typeof is NULL for a missing field, the CASE keeps the casts away from the values of other types
+var pg_dialect = sqlDialect{
+	placeholder: pg_placeholder,
+	field: func(path []string) string {
+		return "data #> " + pg_jsonPath(path)
+	},
+	number: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN json_typeof(data #> %[1]v) = 'number' THEN (data #>> %[1]v)::numeric END", pg_jsonPath(path))
+	},
+	text: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN json_typeof(data #> %[1]v) = 'string' THEN data #>> %[1]v END", pg_jsonPath(path))
+	},
+	boolean: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN json_typeof(data #> %[1]v) = 'boolean' THEN (data #>> %[1]v)::boolean END", pg_jsonPath(path))
+	},
+	isNull: func(path []string) string {
+		return fmt.Sprintf("json_typeof(data #> %v) = 'null'", pg_jsonPath(path))
+	},
+	isComposite: func(path []string) string {
+		return fmt.Sprintf("json_typeof(data #> %v) IN ('object', 'array')", pg_jsonPath(path))
+	},
+	groupKey: func(path []string) string {
+		return fmt.Sprintf("COALESCE((data #> %v)::jsonb, 'null'::jsonb)", pg_jsonPath(path))
+	},
+	collate: pg_collate,
+	noLimit: "ALL",
+}
+
 func (p *PGDatabase) Delete(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	OP_EQ  = "eq"
+	OP_NE  = "ne"
+	OP_GT  = "gt"
+	OP_GTE = "gte"
+	OP_LT  = "lt"
+	OP_LTE = "lte"
+)
+
+// sql operator of each comparison
+var queryOperators = map[string]string{OP_EQ: "=", OP_NE: "!=", OP_GT: ">", OP_GTE: ">=", OP_LT: "<", OP_LTE: "<="}
+
+// Query selects the documents of the keys of Range whose fields match every condition of Where,
+// ordered by Sort then by key. Offset documents are skipped and at most Limit are given, 0 for no limit.
+type Query struct {
+	Range  KeyRange
+	Where  []Condition
+	Sort   []SortField
+	Offset int
+	Limit  int
+	Fields []string // projection, for the drivers reading only some fields
+}
+
+// Condition compares a field (dotted path going through objects) with a value.
+// Values of different types never compare: numbers are compared with numbers, strings with strings in byte order,
+// booleans and null can only be tested with OP_EQ and OP_NE. A missing field only matches OP_NE.
+type Condition struct {
+	Field    string
+	Operator string
+	Value    interface{} // float64, string, bool or nil
+}
+
+// SortField orders the documents by a field: the ones without it (or null) first, then numbers, strings,
+// booleans and the objects or arrays last, all of it reversed when Descending
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// ValidOperator reports whether the operator can compare the value
+func ValidOperator(operator string, value interface{}) bool {
+	if _, ok := queryOperators[operator]; !ok {
+		return false
+	}
+	switch value.(type) {
+	case float64, string:
+		return true
+	case bool, nil:
+		return operator == OP_EQ || operator == OP_NE
+	}
+	return false
+}
+
+// fieldValue returns the value at the dotted path of the field, found is false when it is missing
+func fieldValue(document interface{}, field string) (interface{}, bool) {
+	value := document
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (c Condition) matches(document interface{}) bool {
+	value, found := fieldValue(document, c.Field)
+	equal := false
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		// not comparable, never equal to the value
+	case float64:
+		if w, ok := c.Value.(float64); ok {
+			return compareResult(c.Operator, v == w, v < w)
+		}
+	case string:
+		if w, ok := c.Value.(string); ok {
+			return compareResult(c.Operator, v == w, v < w)
+		}
+	default:
+		equal = found && value == c.Value
+	}
+	switch c.Operator {
+	case OP_EQ:
+		return equal
+	case OP_NE:
+		return !equal
+	}
+	return false
+}
+
+func compareResult(operator string, equal bool, less bool) bool {
+	switch operator {
+	case OP_EQ:
+		return equal
+	case OP_NE:
+		return !equal
+	case OP_GT:
+		return !equal && !less
+	case OP_GTE:
+		return !less
+	case OP_LT:
+		return less
+	case OP_LTE:
+		return less || equal
+	}
+	return false
+}
+
+// sortValue is the rank of the type of a field in the order of the SortField, then its value
+type sortValue struct {
+	rank   int
+	number float64
+	text   string
+	flag   bool
+}
+
+func newSortValue(document interface{}, field string) sortValue {
+	value, _ := fieldValue(document, field)
+	return sortValueOf(value)
+}
+
+func sortValueOf(value interface{}) sortValue {
+	switch v := value.(type) {
+	case nil:
+		return sortValue{}
+	case float64:
+		return sortValue{rank: 1, number: v}
+	case string:
+		return sortValue{rank: 2, text: v}
+	case bool:
+		return sortValue{rank: 3, flag: v}
+	}
+	return sortValue{rank: 4}
+}
+
+func (a sortValue) compare(b sortValue) int {
+	switch {
+	case a.rank != b.rank:
+		return a.rank - b.rank
+	case a.number != b.number:
+		if a.number < b.number {
+			return -1
+		}
+		return 1
+	case a.text != b.text:
+		return strings.Compare(a.text, b.text)
+	case a.flag != b.flag:
+		if b.flag {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// CompareValues orders two json values as SortField does, nil standing for a missing value
+func CompareValues(a interface{}, b interface{}) int {
+	return sortValueOf(a).compare(sortValueOf(b))
+}
+
+type queryDocument struct {
+	key    string
+	value  []byte
+	values []sortValue
+}
+
+// QueryScan runs the query over the documents read by scanRange, for the drivers which can't run it themselves.
+// Without Sort the documents are given as they are scanned, otherwise the best Offset+Limit ones are kept in memory.
+func QueryScan(scanRange func(string, KeyRange, ScanFunc) *DbError, namespace string, q Query, fn ScanFunc) *DbError {
+	skipped, given := 0, 0
+	give := func(key string, value []byte) bool {
+		if skipped < q.Offset {
+			skipped++
+			return true
+		}
+		given++
+		return fn(key, value) && (q.Limit == 0 || given < q.Limit)
+	}
+
+	var documents []queryDocument
+	keep := q.Offset + q.Limit
+	var err error
+	dbErr := scanRange(namespace, q.Range, func(key string, value []byte) bool {
+		var document interface{}
+		err = json.Unmarshal(value, &document)
+		if err != nil {
+			return false
+		}
+		for _, condition := range q.Where {
+			if !condition.matches(document) {
+				return true
+			}
+		}
+		if len(q.Sort) == 0 {
+			return give(key, value)
+		}
+		values := make([]sortValue, len(q.Sort))
+		for i, field := range q.Sort {
+			values[i] = newSortValue(document, field.Field)
+		}
+		documents = append(documents, queryDocument{key: key, value: value, values: values})
+		if q.Limit > 0 && len(documents) >= 2*keep+64 {
+			sortDocuments(documents, q.Sort)
+			documents = documents[:keep]
+		}
+		return true
+	})
+	if dbErr != nil {
+		return dbErr
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Query: %v", err),
+		}
+	}
+	sortDocuments(documents, q.Sort)
+	for _, document := range documents {
+		if !give(document.key, document.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// sortDocuments orders the documents by their sort values, then by key
+func sortDocuments(documents []queryDocument, fields []SortField) {
+	sort.Slice(documents, func(i, j int) bool {
+		for k, field := range fields {
+			c := documents[i].values[k].compare(documents[j].values[k])
+			if field.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return documents[i].key < documents[j].key
+	})
+}
+
+// sqlDialect writes the json expressions of a sql driver, every expression is NULL when the field doesn't have its type
+type sqlDialect struct {
+	placeholder func(int) string
+	field       func(path []string) string // raw json of the field, for the projections
+	number      func(path []string) string
+	text        func(path []string) string
+	boolean     func(path []string) string
+	isNull      func(path []string) string // the field is present and null
+	isComposite func(path []string) string // the field is an object or an array
+	groupKey    func(path []string) string // json of the field which can be grouped on, null when missing
+	collate     string                     // appended to the text expressions so that they compare in byte order
+	noLimit     string                     // LIMIT of a query having only an OFFSET
+}
+
+// sqlQuery writes the columns and the WHERE, ORDER BY and LIMIT clauses of the query. The columns are data,
+// or each field of paths when the projection is pushed down. ok is false when a field of the query can't be
+// written in sql, see fieldPaths.
+func (d sqlDialect) sqlQuery(q Query) (columns string, clauses string, args []interface{}, paths [][]string, ok bool) {
+	where, args, ok := d.sqlWhere(q.Range, q.Where)
+	if !ok {
+		return "", "", nil, nil, false
+	}
+
+	order := make([]string, 0, 4*len(q.Sort)+1)
+	for _, field := range q.Sort {
+		path, ok := fieldPath(field.Field)
+		if !ok {
+			return "", "", nil, nil, false
+		}
+		direction := ""
+		if field.Descending {
+			direction = " DESC"
+		}
+		rank := fmt.Sprintf("CASE WHEN %v IS NOT NULL THEN 1 WHEN %v IS NOT NULL THEN 2 WHEN %v IS NOT NULL THEN 3 WHEN %v THEN 4 ELSE 0 END",
+			d.number(path), d.text(path), d.boolean(path), d.isComposite(path))
+		order = append(order, rank+direction, d.number(path)+direction, d.text(path)+d.collate+direction, d.boolean(path)+direction)
+	}
+	order = append(order, "id"+d.collate)
+
+	columns = "data"
+	if len(q.Fields) > 0 {
+		if paths, ok = fieldPaths(q.Fields); ok {
+			fieldColumns := make([]string, len(paths))
+			for i, path := range paths {
+				fieldColumns[i] = d.field(path)
+			}
+			columns = strings.Join(fieldColumns, ", ")
+		} else {
+			paths = nil
+		}
+	}
+
+	page := ""
+	if q.Limit > 0 {
+		page = fmt.Sprintf(" LIMIT %d", q.Limit)
+	} else if q.Offset > 0 {
+		page = " LIMIT " + d.noLimit
+	}
+	if q.Offset > 0 {
+		page += fmt.Sprintf(" OFFSET %d", q.Offset)
+	}
+
+	clauses = where + " ORDER BY " + strings.Join(order, ", ") + page
+	return columns, clauses, args, paths, true
+}
+
+// sqlWhere is the WHERE clause selecting the keys of the range whose fields match the conditions
+func (d sqlDialect) sqlWhere(r KeyRange, where []Condition) (string, []interface{}, bool) {
+	clause, args := sqlRange(r, d.placeholder, d.collate)
+	conditions := make([]string, 0, len(where))
+	for _, condition := range where {
+		path, ok := fieldPath(condition.Field)
+		if !ok {
+			return "", nil, false
+		}
+		var expression string
+		operator := queryOperators[condition.Operator]
+		if condition.Operator == OP_NE {
+			operator = "="
+		}
+		switch condition.Value.(type) {
+		case float64:
+			expression = d.number(path) + " " + operator + " "
+		case string:
+			expression = d.text(path) + d.collate + " " + operator + " "
+		case bool:
+			expression = d.boolean(path) + " = "
+		case nil:
+			expression = d.isNull(path)
+		}
+		if condition.Value != nil {
+			args = append(args, condition.Value)
+			expression += d.placeholder(len(args))
+		}
+		expression = "COALESCE(" + expression + ", FALSE)"
+		if condition.Operator == OP_NE {
+			expression = "NOT " + expression
+		}
+		conditions = append(conditions, expression)
+	}
+	if len(conditions) > 0 {
+		if clause == "" {
+			clause = " WHERE "
+		} else {
+			clause += " AND "
+		}
+		clause += strings.Join(conditions, " AND ")
+	}
+	return clause, args, true
+}
+
+// fieldPath splits a dotted field, ok is false when it can't be written in a query, see fieldPaths
+func fieldPath(field string) ([]string, bool) {
+	paths, ok := fieldPaths([]string{field})
+	if !ok {
+		return nil, false
+	}
+	return paths[0], true
+}
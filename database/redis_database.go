@@ -13,7 +13,9 @@ import (
 const (
 	redis_namespace_prefix = "ur_"
 	redis_schema_suffix    = "_schema"
+	redis_index_suffix     = "_keys" // sorted set of the fields of a hash, read by the scans in key order
 	redis_dbTimeout        = 10 * time.Second
+	redis_scanBatchSize    = 100
 )
 
 type RedisDatabase struct {
@@ -63,7 +65,7 @@ func (r *RedisDatabase) GetNamespaces() []string {
 		return ret
 	}
 	for _, v := range val {
-		if !strings.HasSuffix(v, redis_schema_suffix) {
+		if !strings.HasSuffix(v, redis_schema_suffix) && !strings.HasSuffix(v, redis_index_suffix) && v != redis_namespace_prefix+sequences_namespace {
 			ret = append(ret, strings.Replace(v, redis_namespace_prefix, "", 1))
 		}
 	}
@@ -89,7 +91,12 @@ func (r *RedisDatabase) Upsert(namespace string, key string, value []byte, allow
 		}
 	}
 
-	_, err := r.db.HSet(ctx, redis_namespace_prefix+namespace, key, string(value)).Result()
+	// the field and its entry in the index are written together
+	_, err := r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redis_namespace_prefix+namespace, key, string(value))
+		pipe.ZAdd(ctx, redis_namespace_prefix+namespace+redis_index_suffix, redis.Z{Member: key})
+		return nil
+	})
 	if err != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -119,6 +126,25 @@ func (r *RedisDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	return []byte(val), nil
 }
 
+func (r *RedisDatabase) Exists(namespace string, key string) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+	defer cancel()
+	found, err := r.db.HExists(ctx, redis_namespace_prefix+namespace, key).Result()
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Exists: %v", err),
+		}
+	}
+	if !found {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace %v for key %v", namespace, key),
+		}
+	}
+	return nil
+}
+
 func (r *RedisDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
 	defer cancel()
@@ -139,10 +165,204 @@ func (r *RedisDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 	return ret, nil
 }
 
+// Scan pages through the index of the namespace, the values are fetched by batches
+func (r *RedisDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return r.ScanRange(namespace, KeyRange{}, fn)
+}
+
+// ScanRange reads the keys of the range from the index by batches with ZRANGEBYLEX, then their values with HMGET
+func (r *RedisDatabase) ScanRange(namespace string, kr KeyRange, fn ScanFunc) *DbError {
+	var dbErr *DbError
+	err := r.scanIndex(namespace, kr, func(batch []string) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+		values, err := r.db.HMGet(ctx, redis_namespace_prefix+namespace, batch...).Result()
+		cancel()
+		if err != nil {
+			dbErr = &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on Scan: %v", err),
+			}
+			return false
+		}
+		for i, value := range values {
+			str, ok := value.(string)
+			if !ok {
+				continue // deleted during the scan
+			}
+			if !fn(batch[i], []byte(str)) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Scan: %v", err),
+		}
+	}
+	return dbErr
+}
+
+func (r *RedisDatabase) ScanKeys(namespace string, kr KeyRange, fn KeyFunc) *DbError {
+	err := r.scanIndex(namespace, kr, func(batch []string) bool {
+		for _, key := range batch {
+			if !fn(key) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on ScanKeys: %v", err),
+		}
+	}
+	return nil
+}
+
+func (r *RedisDatabase) Count(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+	defer cancel()
+	count, err := r.db.HLen(ctx, redis_namespace_prefix+namespace).Result()
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Count: %v", err),
+		}
+	}
+	return count, nil
+}
+
+// NextSequence increments the field of the namespace in the sequences hash with HINCRBY
+func (r *RedisDatabase) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+	defer cancel()
+	value, err := r.db.HIncrBy(ctx, redis_namespace_prefix+sequences_namespace, namespace, 1).Result()
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on NextSequence: %v", err),
+		}
+	}
+	return value, nil
+}
+
+// scanIndex hands the keys of the range to fn in ascending order, by batches of redis_scanBatchSize
+func (r *RedisDatabase) scanIndex(namespace string, kr KeyRange, fn func([]string) bool) error {
+	if err := r.checkIndex(namespace); err != nil {
+		return err
+	}
+	// the members all have the score 0, ZRANGEBYLEX sorts them in byte order like KeyRange
+	lower := "-"
+	if start := kr.lower(); start != "" {
+		lower = "[" + start
+	}
+	upper := "+"
+	if kr.End != "" {
+		upper = "[" + kr.End
+	}
+	if end := prefixEnd(kr.Prefix); end != "" && (kr.End == "" || end <= kr.End) {
+		upper = "(" + end
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+		keys, err := r.db.ZRangeByLex(ctx, redis_namespace_prefix+namespace+redis_index_suffix, &redis.ZRangeBy{
+			Min:   lower,
+			Max:   upper,
+			Count: redis_scanBatchSize,
+		}).Result()
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 && !fn(keys) {
+			return nil
+		}
+		if len(keys) < redis_scanBatchSize {
+			return nil
+		}
+		lower = "(" + keys[len(keys)-1]
+	}
+}
+
+// checkIndex builds again with HSCAN the index of a hash written before it existed, or by another client.
+// A field deleted while it is built can be left in the index until the next scan, HMGET skips it.
+func (r *RedisDatabase) checkIndex(namespace string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+	defer cancel()
+	hash := redis_namespace_prefix + namespace
+	index := hash + redis_index_suffix
+	fields, err := r.db.HLen(ctx, hash).Result()
+	if err != nil {
+		return err
+	}
+	indexed, err := r.db.ZCard(ctx, index).Result()
+	if err != nil {
+		return err
+	}
+	if indexed == fields {
+		return nil
+	}
+
+	// the members of the deleted fields are dropped with the index
+	if err = r.db.Del(ctx, index).Err(); err != nil {
+		return err
+	}
+	var cursor uint64
+	for {
+		// fields and values alternate
+		pairs, next, err := r.db.HScan(ctx, hash, cursor, "*", redis_scanBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		members := make([]redis.Z, 0, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			members = append(members, redis.Z{Member: pairs[i]})
+		}
+		if len(members) > 0 {
+			if err = r.db.ZAdd(ctx, index, members...).Err(); err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (r *RedisDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
+	defer cancel()
+	values, err := r.db.HMGet(ctx, redis_namespace_prefix+namespace, keys...).Result()
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on GetMany: %v", err),
+		}
+	}
+	for i, value := range values {
+		if str, ok := value.(string); ok {
+			ret[keys[i]] = []byte(str)
+		}
+	}
+	return ret, nil
+}
+
 func (r *RedisDatabase) Delete(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
 	defer cancel()
-	_, err := r.db.HDel(ctx, redis_namespace_prefix+namespace, key).Result()
+	_, err := r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redis_namespace_prefix+namespace, key)
+		pipe.ZRem(ctx, redis_namespace_prefix+namespace+redis_index_suffix, key)
+		return nil
+	})
 	if err != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -155,20 +375,11 @@ func (r *RedisDatabase) Delete(namespace string, key string) *DbError {
 func (r *RedisDatabase) DeleteAll(namespace string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), redis_dbTimeout)
 	defer cancel()
-	val, err := r.db.HGetAll(ctx, redis_namespace_prefix+namespace).Result()
+	err := r.db.Del(ctx, redis_namespace_prefix+namespace, redis_namespace_prefix+namespace+redis_index_suffix).Err()
 	if err != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
-			Message:   fmt.Sprintf("error on HGetAll: %v", err),
-		}
-	}
-	for i := range val {
-		_, err := r.db.HDel(ctx, redis_namespace_prefix+namespace, i).Result()
-		if err != nil {
-			return &DbError{
-				ErrorCode: INTERNAL_ERROR,
-				Message:   fmt.Sprintf("error on DeleteAll: %v", err),
-			}
+			Message:   fmt.Sprintf("error on DeleteAll: %v", err),
 		}
 	}
 	return nil
@@ -0,0 +1,396 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3_fileExtension = ".json"
+	s3_contentType   = "application/json"
+	s3_dbTimeout     = 10 * time.Second
+	s3_listPageSize  = 1000
+	// attempts of NextSequence before giving up when other writers keep changing the counter
+	s3_sequenceRetries = 10
+)
+
+// S3Database stores every document as <bucket>/<namespace>/<key>.json,
+// it works with any S3 compatible object storage (aws, minio, r2, ...)
+type S3Database struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+
+	client *minio.Client
+}
+
+func (s *S3Database) Init() {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	client, err := minio.New(s.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure: s.UseSSL,
+		Region: s.Region,
+	})
+	if err != nil {
+		log.Fatalf("error connecting to s3: %v", err)
+	}
+
+	exists, err := client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		log.Fatalf("error connecting to s3: %v", err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, s.Bucket, minio.MakeBucketOptions{Region: s.Region})
+		if err != nil {
+			log.Fatalf("error creating bucket %v: %v", s.Bucket, err)
+		}
+	}
+
+	s.client = client
+	log.Println("db connected")
+}
+
+func (s *S3Database) Disconnect() {
+	// do nothing, the client is stateless
+}
+
+func (s *S3Database) CreateNameSpace(namespace string) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	// a zero byte "folder" object, so that empty namespaces are listed too
+	_, err := s.client.PutObject(ctx, s.Bucket, s.getNamespacePath(namespace), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("could not create namespace %v: %v", namespace, err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) GetNamespaces() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	ret := make([]string, 0)
+	for object := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{MaxKeys: s3_listPageSize}) {
+		if object.Err != nil {
+			log.Printf("error on GetNamespaces: %v\n", object.Err)
+			return ret
+		}
+		if strings.HasSuffix(object.Key, "/") && object.Key != sequences_namespace+"/" {
+			ret = append(ret, strings.TrimSuffix(object.Key, "/"))
+		}
+	}
+	return ret
+}
+
+func (s *S3Database) DropNameSpace(namespace string) *DbError {
+	return s.removePrefix(namespace, true)
+}
+
+func (s *S3Database) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	opts := minio.PutObjectOptions{ContentType: s3_contentType}
+	if !allowOverWrite {
+		// If-None-Match: * makes the storage reject the write when the object exists,
+		// so two concurrent creations of the same key can't both succeed
+		opts.SetMatchETagExcept("*")
+	}
+
+	_, err := s.client.PutObject(ctx, s.Bucket, s.getObjectPath(namespace, key), bytes.NewReader(value), int64(len(value)), opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == minio.PreconditionFailed {
+			return &DbError{
+				ErrorCode: ITEM_CONFLICT,
+				Message:   "item already exists",
+			}
+		}
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Upsert: %v", err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) Get(namespace string, key string) ([]byte, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	object, err := s.client.GetObject(ctx, s.Bucket, s.getObjectPath(namespace, key), minio.GetObjectOptions{})
+	if err == nil {
+		defer object.Close()
+		var data []byte
+		data, err = io.ReadAll(object)
+		if err == nil {
+			return data, nil
+		}
+	}
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return nil, &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	return nil, &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("error on Get: %v", err),
+	}
+}
+
+// Exists reads the metadata of the object only
+func (s *S3Database) Exists(namespace string, key string) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+	_, err := s.client.StatObject(ctx, s.Bucket, s.getObjectPath(namespace, key), minio.StatObjectOptions{})
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	return &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("error on Exists: %v", err),
+	}
+}
+
+func (s *S3Database) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(s.Scan, namespace)
+}
+
+// Scan lists the keys of the namespace first, "a-b.json" is listed before "a.json" so they are sorted once the extension is removed
+func (s *S3Database) Scan(namespace string, fn ScanFunc) *DbError {
+	return s.ScanRange(namespace, KeyRange{}, fn)
+}
+
+// ScanRange lists the objects of the prefix, only the documents of the range are read
+func (s *S3Database) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	keys, err := s.listKeys(namespace, r.Prefix)
+	if err != nil {
+		return err
+	}
+	return scanKeys(keys, r, namespace, s.Get, fn)
+}
+
+func (s *S3Database) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	keys, err := s.listKeys(namespace, r.Prefix)
+	if err != nil {
+		return err
+	}
+	filterKeys(keys, r, fn)
+	return nil
+}
+
+func (s *S3Database) Count(namespace string) (int64, *DbError) {
+	keys, err := s.listKeys(namespace, "")
+	return int64(len(keys)), err
+}
+
+// NextSequence keeps the counter in the object <bucket>/_sequences/<namespace>. There is no atomic increment,
+// the new value is written only if the object is still the one read (If-Match), otherwise it is read again.
+func (s *S3Database) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	objectPath := sequences_namespace + "/" + namespace
+	for attempt := 0; attempt < s3_sequenceRetries; attempt++ {
+		var value int64
+		opts := minio.PutObjectOptions{ContentType: "text/plain"}
+		current, etag, err := s.readSequence(ctx, objectPath)
+		switch {
+		case minio.ToErrorResponse(err).Code == minio.NoSuchKey:
+			opts.SetMatchETagExcept("*")
+		case err != nil:
+			return 0, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on NextSequence: %v", err),
+			}
+		default:
+			value = current
+			opts.SetMatchETag(etag)
+		}
+
+		value++
+		data := []byte(strconv.FormatInt(value, 10))
+		_, err = s.client.PutObject(ctx, s.Bucket, objectPath, bytes.NewReader(data), int64(len(data)), opts)
+		if err == nil {
+			return value, nil
+		}
+		if minio.ToErrorResponse(err).Code != minio.PreconditionFailed {
+			return 0, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on NextSequence: %v", err),
+			}
+		}
+	}
+	return 0, &DbError{
+		ErrorCode: ITEM_CONFLICT,
+		Message:   fmt.Sprintf("sequence of namespace '%v' is changed too often, try again", namespace),
+	}
+}
+
+// readSequence returns the counter and the etag of its object
+func (s *S3Database) readSequence(ctx context.Context, objectPath string) (int64, string, error) {
+	object, err := s.client.GetObject(ctx, s.Bucket, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, "", err
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return 0, "", err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return value, info.ETag, err
+}
+
+// listKeys returns the sorted keys of the namespace starting with the prefix
+func (s *S3Database) listKeys(namespace string, prefix string) ([]string, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	keys := make([]string, 0)
+	found := false
+
+	// the listing is paginated by the client, s3_listPageSize keys per request
+	opts := minio.ListObjectsOptions{
+		Prefix:    s.getNamespacePath(namespace) + prefix,
+		Recursive: true,
+		MaxKeys:   s3_listPageSize,
+	}
+	for object := range s.client.ListObjects(ctx, s.Bucket, opts) {
+		if object.Err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on Scan: %v", object.Err),
+			}
+		}
+		found = true
+		rawKey, ok := strings.CutSuffix(strings.TrimPrefix(object.Key, s.getNamespacePath(namespace)), s3_fileExtension)
+		if !ok || strings.Contains(rawKey, "/") {
+			continue
+		}
+		keys = append(keys, rawKey)
+	}
+	// an empty prefix listing only means that no key starts with it
+	if !found && prefix == "" {
+		return nil, &DbError{
+			ErrorCode: NAMESPACE_NOT_FOUND,
+			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *S3Database) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	return getMany(s.Get, namespace, keys)
+}
+
+func (s *S3Database) Delete(namespace string, key string) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	objectPath := s.getObjectPath(namespace, key)
+	_, err := s.client.StatObject(ctx, s.Bucket, objectPath, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+			}
+		}
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Delete: %v", err),
+		}
+	}
+
+	err = s.client.RemoveObject(ctx, s.Bucket, objectPath, minio.RemoveObjectOptions{})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Delete: %v", err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) DeleteAll(namespace string) *DbError {
+	return s.removePrefix(namespace, false)
+}
+
+// removePrefix deletes the documents of the namespace, and the namespace itself when withFolder is set
+func (s *S3Database) removePrefix(namespace string, withFolder bool) *DbError {
+	ctx, cancel := context.WithTimeout(context.Background(), s3_dbTimeout)
+	defer cancel()
+
+	prefix := s.getNamespacePath(namespace)
+	objectsCh := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objectsCh)
+		opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true, MaxKeys: s3_listPageSize}
+		for object := range s.client.ListObjects(ctx, s.Bucket, opts) {
+			if object.Err != nil {
+				listErr <- object.Err
+				return
+			}
+			if object.Key == prefix && !withFolder {
+				continue
+			}
+			objectsCh <- object
+		}
+	}()
+
+	for removeErr := range s.client.RemoveObjects(ctx, s.Bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DeleteAll: %v", removeErr.Err),
+		}
+	}
+	select {
+	case err := <-listErr:
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DeleteAll: %v", err),
+		}
+	default:
+		return nil
+	}
+}
+
+func (s *S3Database) getObjectPath(namespace, key string) string {
+	return s.getNamespacePath(namespace) + key + s3_fileExtension
+}
+
+func (s *S3Database) getNamespacePath(namespace string) string {
+	return namespace + "/"
+}
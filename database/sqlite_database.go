@@ -5,37 +5,85 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	sqlite_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v ( id string PRIMARY KEY, data string NOT NULL)"
+	sqlite_connectionOptions   = "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	sqlite_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v ( id TEXT PRIMARY KEY, data TEXT NOT NULL)"
 	sqlite_dropNamespaceQuery  = "DROP TABLE %v"
 	sqlite_insertQuery         = "INSERT INTO %v (id, data) VALUES($1, $2) ON CONFLICT (id) DO UPDATE SET data = $2"
-	sqlite_tablesQuery         = "SELECT  `name` FROM sqlite_master WHERE `type`='table'  ORDER BY name"
+	sqlite_tablesQuery         = "SELECT  `name` FROM sqlite_master WHERE `type`='table' AND `name` NOT LIKE '%\\_fts%' ESCAPE '\\' AND `name` != '_sequences' ORDER BY name"
 	sqlite_recordExistentQuery = "SELECT COUNT(1) FROM %v WHERE id = $1"
 	sqlite_getQuery            = "SELECT data FROM %v WHERE id = $1"
 	sqlite_getAllQuery         = "SELECT id, data FROM %v ORDER BY id"
+	sqlite_scanRangeQuery      = "SELECT id, data FROM %v%v ORDER BY id"
+	sqlite_getManyQuery        = "SELECT id, data FROM %v%v"
+	sqlite_scanKeysQuery       = "SELECT id FROM %v%v ORDER BY id"
+	sqlite_scanFieldsQuery     = "SELECT id, %v FROM %%v%%v ORDER BY id"
+	sqlite_queryQuery          = "SELECT id, %v FROM %%v%%v"
+	sqlite_aggregateQuery      = "SELECT %v FROM %%v%%v"
+	sqlite_countQuery          = "SELECT COUNT(*) FROM %v%v"
 	sqlite_deleteQuery         = "DELETE FROM %v WHERE id = $1"
 	sqlite_deleteAllQuery      = "DELETE FROM %v"
+	sqlite_sequencesQuery      = "CREATE TABLE IF NOT EXISTS _sequences ( namespace TEXT PRIMARY KEY, value INTEGER NOT NULL)"
+	sqlite_nextSequenceQuery   = "INSERT INTO _sequences (namespace, value) VALUES($1, 1) ON CONFLICT (namespace) DO UPDATE SET value = value + 1 RETURNING value"
+
+	// full text search, the index only holds the string values of each document
+	sqlite_createFtsTableQuery = "CREATE VIRTUAL TABLE IF NOT EXISTS %v_fts USING fts5(id UNINDEXED, data)"
+	sqlite_ftsInsertQuery      = "INSERT INTO %v_fts (id, data) SELECT $1, group_concat(value, ' ') FROM json_tree($2) WHERE type = 'text'"
+	sqlite_ftsDeleteQuery      = "DELETE FROM %v_fts WHERE id = $1"
+	sqlite_ftsDeleteAllQuery   = "DELETE FROM %v_fts"
+	sqlite_ftsExistentQuery    = "SELECT COUNT(1) FROM sqlite_master WHERE `type`='table' AND `name` = $1"
+	sqlite_ftsRebuildQuery     = "INSERT INTO %[1]v_fts (id, data) SELECT %[1]v.id, group_concat(j.value, ' ') FROM %[1]v, json_tree(%[1]v.data) AS j WHERE j.type = 'text' GROUP BY %[1]v.id"
+	sqlite_ftsSearchQuery      = "SELECT %[1]v.id, %[1]v.data FROM %[1]v_fts JOIN %[1]v ON %[1]v.id = %[1]v_fts.id WHERE %[1]v_fts MATCH $1 ORDER BY %[1]v_fts.rank"
 )
 
 type SQLiteDatabase struct {
-	DirPath string
-	db      *sql.DB
+	DirPath         string
+	FullTextEnabled bool // requires the binary to be built with the sqlite_fts5 tag
+
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sqliteStatements
+}
+
+// prepared statements of a namespace, created once and reused for every call
+type sqliteStatements struct {
+	insert    *sql.Stmt
+	exists    *sql.Stmt
+	get       *sql.Stmt
+	getAll    *sql.Stmt
+	delete    *sql.Stmt
+	deleteAll *sql.Stmt
+
+	ftsInsert    *sql.Stmt
+	ftsDelete    *sql.Stmt
+	ftsDeleteAll *sql.Stmt
+	ftsSearch    *sql.Stmt
 }
 
 func (s *SQLiteDatabase) Init() {
-	db, err := sql.Open("sqlite3", s.DirPath)
+	db, err := sql.Open("sqlite3", s.DirPath+sqlite_connectionOptions)
 	if err != nil {
-		log.Fatalf("error connecting to postgres: %v", err)
+		log.Fatalf("error connecting to sqlite: %v", err)
 	}
 	s.db = db
+	s.stmts = make(map[string]*sqliteStatements)
 	log.Println("db connected")
 }
 
 func (s *SQLiteDatabase) Disconnect() {
+	s.mu.Lock()
+	for _, st := range s.stmts {
+		st.close()
+	}
+	s.stmts = make(map[string]*sqliteStatements)
+	s.mu.Unlock()
+
 	err := s.db.Close()
 	if err != nil {
 		panic(err)
@@ -58,13 +106,14 @@ func (s *SQLiteDatabase) CreateNameSpace(namespace string) *DbError {
 func (p *SQLiteDatabase) GetNamespaces() []string {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
+	ret := make([]string, 0)
 	rows, err := p.db.QueryContext(ctx, sqlite_tablesQuery)
 	if err != nil {
 		log.Printf("error on GetNamespaces: %v\n", err)
+		return ret
 	}
 	defer rows.Close()
 
-	ret := make([]string, 0)
 	for rows.Next() {
 		var tableName string
 		err = rows.Scan(&tableName)
@@ -83,7 +132,7 @@ func (r *SQLiteDatabase) DropNameSpace(namespace string) *DbError {
 func (s *SQLiteDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
-	err := s.ensureNamespace(namespace)
+	st, err := s.statements(namespace, true)
 
 	if err != nil {
 		return &DbError{
@@ -92,8 +141,17 @@ func (s *SQLiteDatabase) Upsert(namespace string, key string, value []byte, allo
 		}
 	}
 
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on BeginTx: %v", err),
+		}
+	}
+	defer tx.Rollback()
+
 	if !allowOverWrite {
-		res := s.db.QueryRowContext(ctx, fmt.Sprintf(sqlite_recordExistentQuery, namespace), key)
+		res := tx.StmtContext(ctx, st.exists).QueryRowContext(ctx, key)
 		var count string
 		err := res.Scan(&count)
 		if err != nil {
@@ -110,20 +168,48 @@ func (s *SQLiteDatabase) Upsert(namespace string, key string, value []byte, allo
 		}
 	}
 
-	_, dbErr := s.db.ExecContext(ctx, fmt.Sprintf(sqlite_insertQuery, namespace), key, string(value))
+	_, dbErr := tx.StmtContext(ctx, st.insert).ExecContext(ctx, key, string(value))
 	if dbErr != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
 			Message:   fmt.Sprintf("error on Upsert: %v", dbErr),
 		}
 	}
+
+	if st.ftsInsert != nil {
+		_, dbErr = tx.StmtContext(ctx, st.ftsDelete).ExecContext(ctx, key)
+		if dbErr == nil {
+			_, dbErr = tx.StmtContext(ctx, st.ftsInsert).ExecContext(ctx, key, string(value))
+		}
+		if dbErr != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on full text index: %v", dbErr),
+			}
+		}
+	}
+
+	dbErr = tx.Commit()
+	if dbErr != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Commit: %v", dbErr),
+		}
+	}
 	return nil
 }
 
 func (s *SQLiteDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
-	rows, dbErr := s.db.QueryContext(ctx, fmt.Sprintf(sqlite_getQuery, namespace), key)
+	st, err := s.statements(namespace, false)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Get: %v", err),
+		}
+	}
+	rows, dbErr := st.get.QueryContext(ctx, key)
 	if dbErr != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -148,39 +234,230 @@ func (s *SQLiteDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	}
 }
 
-func (s *SQLiteDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+func (s *SQLiteDatabase) Exists(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
-	sqlStatement := fmt.Sprintf(sqlite_getAllQuery, namespace)
-	rows, dbErr := s.db.QueryContext(ctx, sqlStatement)
+	st, err := s.statements(namespace, false)
+	if err == nil {
+		var count int
+		err = st.exists.QueryRowContext(ctx, key).Scan(&count)
+		if err == nil && count == 0 {
+			return &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace %v for key %v", namespace, key),
+			}
+		}
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Exists: %v", err),
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	return collect(s.Scan, namespace)
+}
+
+func (s *SQLiteDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	st, err := s.statements(namespace, false)
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Scan: %v", err),
+		}
+	}
+	// no timeout, the rows are read as fast as the caller consumes them
+	rows, dbErr := st.getAll.QueryContext(context.Background())
 	if dbErr != nil {
-		return nil, &DbError{
+		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
-			Message:   fmt.Sprintf("error on Get: %v", dbErr),
+			Message:   fmt.Sprintf("error on Scan: %v", dbErr),
 		}
 	}
-	defer rows.Close()
+	return scanRows(rows, fn)
+}
 
-	ret := make(map[string][]byte)
+func (s *SQLiteDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	where, args := sqlRange(r, sqlite_placeholder, "")
+	if where == "" {
+		return s.Scan(namespace, fn)
+	}
+	rows, dbErr := s.query(namespace, sqlite_scanRangeQuery, where, args)
+	if dbErr != nil {
+		return dbErr
+	}
+	return scanRows(rows, fn)
+}
 
-	for rows.Next() {
-		var id, data string
-		scanErr := rows.Scan(&id, &data)
-		if scanErr != nil {
-			return nil, &DbError{
+// ScanRangeFields is ScanRange reading only the fields of the documents, extracted with the -> operator
+func (s *SQLiteDatabase) ScanRangeFields(namespace string, r KeyRange, fields []string, fn ScanFunc) *DbError {
+	paths, ok := fieldPaths(fields)
+	if !ok || len(paths) == 0 {
+		return s.ScanRange(namespace, r, fn)
+	}
+	columns := make([]string, len(paths))
+	for i, path := range paths {
+		columns[i] = sqlite_dialect.field(path)
+	}
+	where, args := sqlRange(r, sqlite_placeholder, "")
+	rows, dbErr := s.query(namespace, fmt.Sprintf(sqlite_scanFieldsQuery, strings.Join(columns, ", ")), where, args)
+	if dbErr != nil {
+		return dbErr
+	}
+	return scanFieldRows(rows, paths, fn)
+}
+
+// Query filters, sorts and pages the documents with the json functions, see sqlDialect
+func (s *SQLiteDatabase) Query(namespace string, q Query, fn ScanFunc) *DbError {
+	columns, clauses, args, paths, ok := sqlite_dialect.sqlQuery(q)
+	if !ok {
+		return QueryScan(s.ScanRange, namespace, q, fn)
+	}
+	rows, dbErr := s.query(namespace, fmt.Sprintf(sqlite_queryQuery, columns), clauses, args)
+	if dbErr != nil {
+		return dbErr
+	}
+	if paths != nil {
+		return scanFieldRows(rows, paths, fn)
+	}
+	return scanRows(rows, fn)
+}
+
+// Aggregate groups the documents with GROUP BY on the json of the field, see sqlDialect
+func (s *SQLiteDatabase) Aggregate(namespace string, a Aggregation) ([]AggregateGroup, *DbError) {
+	columns, clauses, args, ok := sqlite_dialect.sqlAggregate(a)
+	if !ok {
+		return AggregateScan(s.ScanRange, namespace, a)
+	}
+	rows, dbErr := s.query(namespace, fmt.Sprintf(sqlite_aggregateQuery, columns), clauses, args)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return scanAggregateRows(rows, a)
+}
+
+func (s *SQLiteDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+	where, args := sqlIn(keys, sqlite_placeholder)
+	rows, dbErr := s.query(namespace, sqlite_getManyQuery, where, args)
+	if dbErr == nil {
+		dbErr = scanRows(rows, func(key string, value []byte) bool {
+			ret[key] = value
+			return true
+		})
+	}
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return ret, nil
+}
+
+func (s *SQLiteDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	where, args := sqlRange(r, sqlite_placeholder, "")
+	rows, dbErr := s.query(namespace, sqlite_scanKeysQuery, where, args)
+	if dbErr != nil {
+		return dbErr
+	}
+	return scanKeyRows(rows, fn)
+}
+
+func (s *SQLiteDatabase) Count(namespace string) (int64, *DbError) {
+	rows, dbErr := s.query(namespace, sqlite_countQuery, "", nil)
+	if dbErr != nil {
+		return 0, dbErr
+	}
+	defer rows.Close()
+	var count int64
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, &DbError{
 				ErrorCode: INTERNAL_ERROR,
-				Message:   fmt.Sprintf("scan %v", scanErr),
+				Message:   fmt.Sprintf("scan %v", err),
 			}
 		}
-		ret[id] = []byte(data)
 	}
-	return ret, nil
+	return count, nil
+}
+
+// query runs a statement built for the call, once the table is known to exist
+func (s *SQLiteDatabase) query(namespace string, query string, where string, args []interface{}) (*sql.Rows, *DbError) {
+	_, err := s.statements(namespace, false)
+	if err == nil {
+		var rows *sql.Rows
+		// no timeout, the rows are read as fast as the caller consumes them
+		rows, err = s.db.QueryContext(context.Background(), fmt.Sprintf(query, namespace, where), args...)
+		if err == nil {
+			return rows, nil
+		}
+	}
+	return nil, &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("error on query: %v", err),
+	}
+}
+
+func sqlite_placeholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
+// json_type is NULL for a missing field, json_extract gives the sql value of a scalar
+var sqlite_dialect = sqlDialect{
+	placeholder: sqlite_placeholder,
+	field: func(path []string) string {
+		return fmt.Sprintf("data -> '%v'", sqlJsonPath(path))
+	},
+	number: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN json_type(data, '%[1]v') IN ('integer', 'real') THEN json_extract(data, '%[1]v') END", sqlJsonPath(path))
+	},
+	text: func(path []string) string {
+		return fmt.Sprintf("CASE WHEN json_type(data, '%[1]v') = 'text' THEN json_extract(data, '%[1]v') END", sqlJsonPath(path))
+	},
+	boolean: func(path []string) string {
+		return fmt.Sprintf("CASE json_type(data, '%v') WHEN 'true' THEN 1 WHEN 'false' THEN 0 END", sqlJsonPath(path))
+	},
+	isNull: func(path []string) string {
+		return fmt.Sprintf("json_type(data, '%v') = 'null'", sqlJsonPath(path))
+	},
+	isComposite: func(path []string) string {
+		return fmt.Sprintf("json_type(data, '%v') IN ('object', 'array')", sqlJsonPath(path))
+	},
+	groupKey: func(path []string) string {
+		return fmt.Sprintf("COALESCE(data -> '%v', 'null')", sqlJsonPath(path))
+	},
+	noLimit: "-1",
+}
+
+// NextSequence increments the row of the namespace in the _sequences table, in a single statement
+func (s *SQLiteDatabase) NextSequence(namespace string) (int64, *DbError) {
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	var value int64
+	_, err := s.db.ExecContext(ctx, sqlite_sequencesQuery)
+	if err == nil {
+		err = s.db.QueryRowContext(ctx, sqlite_nextSequenceQuery, namespace).Scan(&value)
+	}
+	if err != nil {
+		return 0, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on NextSequence: %v", err),
+		}
+	}
+	return value, nil
 }
 
 func (s *SQLiteDatabase) Delete(namespace string, key string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx, fmt.Sprintf(sqlite_deleteQuery, namespace), key)
+	st, err := s.statements(namespace, false)
+	if err == nil {
+		err = s.execTx(ctx, []interface{}{key}, st.delete, st.ftsDelete)
+	}
 	if err != nil {
 		message := fmt.Sprintf("error on Delete: %v", err)
 		return &DbError{
@@ -194,8 +471,10 @@ func (s *SQLiteDatabase) Delete(namespace string, key string) *DbError {
 func (s *SQLiteDatabase) DeleteAll(namespace string) *DbError {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
-	sqlStatement := fmt.Sprintf(sqlite_deleteAllQuery, namespace)
-	_, err := s.db.ExecContext(ctx, sqlStatement)
+	st, err := s.statements(namespace, false)
+	if err == nil {
+		err = s.execTx(ctx, nil, st.deleteAll, st.ftsDeleteAll)
+	}
 	if err != nil {
 		message := fmt.Sprintf("error on DeleteAll: %v", err)
 		return &DbError{
@@ -206,6 +485,72 @@ func (s *SQLiteDatabase) DeleteAll(namespace string) *DbError {
 	return nil
 }
 
+// execTx runs the statements with the same arguments in a transaction, so that the full text index is left
+// as the table is. The nil statements (of a disabled index) are skipped.
+func (s *SQLiteDatabase) execTx(ctx context.Context, args []interface{}, stmts ...*sql.Stmt) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		if _, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FullTextSearch returns the documents matching the fts5 query, best match first
+func (s *SQLiteDatabase) FullTextSearch(namespace string, query string) ([]Document, *DbError) {
+	if !s.FullTextEnabled {
+		return nil, &DbError{
+			ErrorCode: NOT_SUPPORTED,
+			Message:   "full text search is not enabled",
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+	st, err := s.statements(namespace, false)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: NAMESPACE_NOT_FOUND,
+			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+		}
+	}
+	rows, err := st.ftsSearch.QueryContext(ctx, query)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INVALID_QUERY,
+			Message:   fmt.Sprintf("error on FullTextSearch: %v", err),
+		}
+	}
+	defer rows.Close()
+
+	ret := make([]Document, 0)
+	for rows.Next() {
+		var id, data string
+		scanErr := rows.Scan(&id, &data)
+		if scanErr != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", scanErr),
+			}
+		}
+		ret = append(ret, Document{Key: id, Value: []byte(data)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &DbError{
+			ErrorCode: INVALID_QUERY,
+			Message:   fmt.Sprintf("error on FullTextSearch: %v", err),
+		}
+	}
+	return ret, nil
+}
+
 func (p *SQLiteDatabase) ensureNamespace(namespace string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
 	defer cancel()
@@ -218,3 +563,99 @@ func (p *SQLiteDatabase) ensureNamespace(namespace string) (err error) {
 
 	return err
 }
+
+// statements returns the cached prepared statements of the namespace,
+// the table is created first when create is set
+func (s *SQLiteDatabase) statements(namespace string, create bool) (*sqliteStatements, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.stmts[namespace]; ok {
+		return st, nil
+	}
+
+	if create {
+		err := s.ensureNamespace(namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	st := &sqliteStatements{}
+	queries := map[**sql.Stmt]string{
+		&st.insert:    sqlite_insertQuery,
+		&st.exists:    sqlite_recordExistentQuery,
+		&st.get:       sqlite_getQuery,
+		&st.getAll:    sqlite_getAllQuery,
+		&st.delete:    sqlite_deleteQuery,
+		&st.deleteAll: sqlite_deleteAllQuery,
+	}
+	err := s.prepare(namespace, queries)
+	if err == nil && s.FullTextEnabled {
+		err = s.ensureFullTextIndex(namespace)
+		if err == nil {
+			err = s.prepare(namespace, map[**sql.Stmt]string{
+				&st.ftsInsert:    sqlite_ftsInsertQuery,
+				&st.ftsDelete:    sqlite_ftsDeleteQuery,
+				&st.ftsDeleteAll: sqlite_ftsDeleteAllQuery,
+				&st.ftsSearch:    sqlite_ftsSearchQuery,
+			})
+		}
+	}
+	if err != nil {
+		st.close()
+		return nil, err
+	}
+
+	s.stmts[namespace] = st
+	return st, nil
+}
+
+func (s *SQLiteDatabase) prepare(namespace string, queries map[**sql.Stmt]string) error {
+	for stmt, query := range queries {
+		prepared, err := s.db.Prepare(fmt.Sprintf(query, namespace))
+		if err != nil {
+			return err
+		}
+		*stmt = prepared
+	}
+	return nil
+}
+
+// ensureFullTextIndex creates the fts5 table of the namespace,
+// documents written before the index existed are indexed on creation
+func (s *SQLiteDatabase) ensureFullTextIndex(namespace string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pg_dbTimeout)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, sqlite_ftsExistentQuery, namespace+"_fts").Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(sqlite_createFtsTableQuery, namespace))
+	if err == nil {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(sqlite_ftsRebuildQuery, namespace))
+	}
+	if err != nil {
+		log.Printf("error creating full text index: %v\n", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *sqliteStatements) close() {
+	for _, stmt := range []*sql.Stmt{st.insert, st.exists, st.get, st.getAll, st.delete, st.deleteAll,
+		st.ftsInsert, st.ftsDelete, st.ftsDeleteAll, st.ftsSearch} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
@@ -0,0 +1,773 @@
+package database
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TIERED_WRITE_THROUGH = "through" // a write returns once the cold tier has it
+	TIERED_WRITE_BEHIND  = "behind"  // a write returns once journaled, the cold tier is updated in background
+
+	tiered_defaultQueueSize = 1024
+	tiered_lockStripes      = 64
+	tiered_retryDelay       = time.Second
+	tiered_opUpsert         = "upsert"
+	tiered_opDelete         = "delete"
+)
+
+// Backend is what the tiered driver needs from its durable tier, any driver of this package fits
+type Backend interface {
+	Init()
+	Disconnect()
+	CreateNameSpace(namespace string) *DbError
+	GetNamespaces() []string
+	DropNameSpace(namespace string) *DbError
+	Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError
+	Get(namespace string, key string) ([]byte, *DbError)
+	GetAll(namespace string) (map[string][]byte, *DbError)
+	GetMany(namespace string, keys []string) (map[string][]byte, *DbError)
+	Scan(namespace string, fn ScanFunc) *DbError
+	ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError
+	ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError
+	Count(namespace string) (int64, *DbError)
+	NextSequence(namespace string) (int64, *DbError)
+	Delete(namespace string, key string) *DbError
+	DeleteAll(namespace string) *DbError
+}
+
+// TieredDatabase keeps the recently used documents in a MemDatabase (hot tier) in front of a durable driver (cold tier).
+// In write behind mode the changes are appended to a local journal, then flushed to the cold tier by a background worker,
+// the journal is replayed on startup so that nothing acknowledged is lost on a crash.
+type TieredDatabase struct {
+	Cold        Backend
+	Mode        string   // TIERED_WRITE_THROUGH (default) or TIERED_WRITE_BEHIND
+	JournalPath string   // write behind journal
+	QueueSize   int      // pending writes before the writers are blocked (write behind)
+	MaxItems    int      // hot tier budget in documents, 0 for unlimited
+	MaxBytes    int      // hot tier budget in bytes, 0 for unlimited
+	Warm        []string // namespaces loaded in the hot tier on startup
+
+	mu       sync.Mutex
+	locks    [tiered_lockStripes]sync.Mutex // write through, serialize the writes of a document to both tiers
+	hot      *MemDatabase
+	lru      *list.List // front is the most recently used
+	entries  map[tieredKey]*list.Element
+	size     int
+	complete map[string]bool // namespaces entirely held by the hot tier
+	writes   uint64          // bumped on every change, a cold read older than a change is not cached
+
+	// write behind
+	queueMu   sync.Mutex // keeps the queue in journal order
+	queue     chan *tieredOp
+	pending   map[tieredKey]*tieredOp // latest queued change of each document
+	queued    int
+	flushed   *sync.Cond
+	journalMu sync.Mutex // held for the appends and the truncation of the journal, not by the readers
+	journal   *os.File
+	journaled int // changes in the journal not flushed yet, it is truncated when there are none
+	done      chan struct{}
+}
+
+type tieredKey struct {
+	namespace string
+	key       string
+}
+
+type tieredEntry struct {
+	tieredKey
+	size int
+}
+
+type tieredOp struct {
+	Op        string `json:"op"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+func (t *TieredDatabase) Init() {
+	t.Cold.Init()
+
+	t.hot = &MemDatabase{}
+	t.hot.Init()
+	t.lru = list.New()
+	t.entries = make(map[tieredKey]*list.Element)
+	t.complete = make(map[string]bool)
+	t.pending = make(map[tieredKey]*tieredOp)
+	t.flushed = sync.NewCond(&t.mu)
+
+	if t.Mode == "" {
+		t.Mode = TIERED_WRITE_THROUGH
+	}
+	if t.Mode != TIERED_WRITE_THROUGH && t.Mode != TIERED_WRITE_BEHIND {
+		log.Fatalf("invalid tiered mode '%v', expected %v or %v", t.Mode, TIERED_WRITE_THROUGH, TIERED_WRITE_BEHIND)
+	}
+	if t.Mode == TIERED_WRITE_BEHIND {
+		t.openJournal()
+		queueSize := t.QueueSize
+		if queueSize <= 0 {
+			queueSize = tiered_defaultQueueSize
+		}
+		t.queue = make(chan *tieredOp, queueSize)
+		t.done = make(chan struct{})
+		go t.flush()
+	}
+
+	for _, namespace := range t.Warm {
+		if namespace == "" {
+			continue
+		}
+		data, err := t.Cold.GetAll(namespace)
+		if err != nil {
+			log.Printf("error warming namespace %v: %v\n", namespace, err.Message)
+			continue
+		}
+		t.mu.Lock()
+		t.load(namespace, data)
+		t.mu.Unlock()
+	}
+	log.Println("db connected")
+}
+
+func (t *TieredDatabase) Disconnect() {
+	if t.Mode == TIERED_WRITE_BEHIND {
+		t.queueMu.Lock()
+		close(t.queue)
+		<-t.done
+		t.queueMu.Unlock()
+		if err := t.journal.Close(); err != nil {
+			log.Printf("error closing journal: %v\n", err)
+		}
+	}
+	t.Cold.Disconnect()
+}
+
+func (t *TieredDatabase) CreateNameSpace(namespace string) *DbError {
+	return t.Cold.CreateNameSpace(namespace)
+}
+
+func (t *TieredDatabase) GetNamespaces() []string {
+	ret := t.Cold.GetNamespaces()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	known := make(map[string]bool, len(ret))
+	for _, namespace := range ret {
+		known[namespace] = true
+	}
+	// namespaces created by writes not flushed yet
+	for k := range t.pending {
+		if !known[k.namespace] {
+			known[k.namespace] = true
+			ret = append(ret, k.namespace)
+		}
+	}
+	return ret
+}
+
+func (t *TieredDatabase) DropNameSpace(namespace string) *DbError {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	t.waitFlushed()
+
+	err := t.Cold.DropNameSpace(namespace)
+	if err == nil {
+		t.mu.Lock()
+		t.evictNamespace(namespace)
+		t.mu.Unlock()
+	}
+	return err
+}
+
+func (t *TieredDatabase) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *DbError {
+	if t.Mode == TIERED_WRITE_THROUGH {
+		unlock := t.lock(namespace, key)
+		defer unlock()
+		err := t.Cold.Upsert(namespace, key, value, allowOverWrite)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.writes++
+		t.store(namespace, key, value)
+		t.mu.Unlock()
+		return nil
+	}
+
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	if !allowOverWrite {
+		_, err := t.Get(namespace, key)
+		if err == nil {
+			return &DbError{
+				ErrorCode: ITEM_CONFLICT,
+				Message:   "item already exists",
+			}
+		}
+		if err.ErrorCode != ID_NOT_FOUND && err.ErrorCode != NAMESPACE_NOT_FOUND {
+			return err
+		}
+	}
+	return t.enqueue(&tieredOp{Op: tiered_opUpsert, Namespace: namespace, Key: key, Value: value})
+}
+
+func (t *TieredDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	// the hot tier has its own locks, a document found there is current
+	if value, err := t.hot.Get(namespace, key); err == nil {
+		t.touch(tieredKey{namespace, key})
+		return value, nil
+	}
+
+	t.mu.Lock()
+	k := tieredKey{namespace, key}
+	if elem, ok := t.entries[k]; ok {
+		// stored since the read above
+		t.lru.MoveToFront(elem)
+		value, err := t.hot.Get(namespace, key)
+		t.mu.Unlock()
+		return value, err
+	}
+	if op, ok := t.pending[k]; ok && op.Op == tiered_opDelete {
+		t.mu.Unlock()
+		return nil, &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	if t.complete[namespace] {
+		t.mu.Unlock()
+		return nil, &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	writes := t.writes
+	t.mu.Unlock()
+
+	value, err := t.Cold.Get(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.writes == writes {
+		t.store(namespace, key, value)
+	}
+	return value, nil
+}
+
+func (t *TieredDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	t.mu.Lock()
+	if t.complete[namespace] {
+		defer t.mu.Unlock()
+		return t.copyNamespace(namespace), nil
+	}
+	writes := t.writes
+	t.mu.Unlock()
+
+	cold, err := t.Cold.GetAll(namespace)
+	data := make(map[string][]byte, len(cold))
+	for key, value := range cold {
+		data[key] = value
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	overlaid := false
+	for k, op := range t.pending {
+		if k.namespace != namespace {
+			continue
+		}
+		overlaid = true
+		if op.Op == tiered_opDelete {
+			delete(data, k.key)
+		} else {
+			data[k.key] = op.Value
+		}
+	}
+	if err != nil && !(overlaid && err.ErrorCode == NAMESPACE_NOT_FOUND) {
+		return nil, err
+	}
+	if t.writes == writes {
+		t.load(namespace, data)
+	}
+	return data, nil
+}
+
+// Scan goes through the cold tier, with the changes not flushed yet merged in, unless the namespace is entirely in memory.
+// The scanned documents are not cached, so that a scan doesn't evict the working set.
+func (t *TieredDatabase) Scan(namespace string, fn ScanFunc) *DbError {
+	return t.ScanRange(namespace, KeyRange{}, fn)
+}
+
+func (t *TieredDatabase) ScanRange(namespace string, r KeyRange, fn ScanFunc) *DbError {
+	t.mu.Lock()
+	if t.complete[namespace] {
+		data := t.copyNamespace(namespace)
+		t.mu.Unlock()
+		scanMap(data, r, fn)
+		return nil
+	}
+	pending := t.pendingOps(namespace, r)
+	t.mu.Unlock()
+
+	return mergePending(pending, func(cold ScanFunc) *DbError {
+		return t.Cold.ScanRange(namespace, r, cold)
+	}, fn)
+}
+
+func (t *TieredDatabase) ScanKeys(namespace string, r KeyRange, fn KeyFunc) *DbError {
+	t.mu.Lock()
+	if t.complete[namespace] {
+		keys := make([]string, 0)
+		for k := range t.entries {
+			if k.namespace == namespace {
+				keys = append(keys, k.key)
+			}
+		}
+		t.mu.Unlock()
+		sort.Strings(keys)
+		filterKeys(keys, r, fn)
+		return nil
+	}
+	pending := t.pendingOps(namespace, r)
+	t.mu.Unlock()
+
+	return mergePending(pending, func(cold ScanFunc) *DbError {
+		return t.Cold.ScanKeys(namespace, r, func(key string) bool {
+			return cold(key, nil)
+		})
+	}, func(key string, _ []byte) bool {
+		return fn(key)
+	})
+}
+
+// Count asks the cold tier, unless writes not flushed yet may change its answer
+func (t *TieredDatabase) Count(namespace string) (int64, *DbError) {
+	t.mu.Lock()
+	if t.complete[namespace] {
+		defer t.mu.Unlock()
+		return int64(t.countNamespace(namespace)), nil
+	}
+	pending := len(t.pendingOps(namespace, KeyRange{}))
+	t.mu.Unlock()
+	if pending == 0 {
+		return t.Cold.Count(namespace)
+	}
+
+	var count int64
+	err := t.ScanKeys(namespace, KeyRange{}, func(string) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// NextSequence is always served by the cold tier, a value given before a crash is never given again
+func (t *TieredDatabase) NextSequence(namespace string) (int64, *DbError) {
+	return t.Cold.NextSequence(namespace)
+}
+
+// pendingOps returns the writes of the range not flushed yet, the caller holds t.mu
+func (t *TieredDatabase) pendingOps(namespace string, r KeyRange) map[string]*tieredOp {
+	pending := make(map[string]*tieredOp)
+	for k, op := range t.pending {
+		if k.namespace == namespace && r.Contains(k.key) {
+			pending[k.key] = op
+		}
+	}
+	return pending
+}
+
+// mergePending overlays the writes not flushed yet on an ascending scan of the cold tier
+func mergePending(pending map[string]*tieredOp, scanCold func(ScanFunc) *DbError, fn ScanFunc) *DbError {
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	i := 0
+	stopped := false
+	// the pending upserts of the keys sorted before the next cold document
+	emitPending := func(limit string, all bool) bool {
+		for ; i < len(keys) && (all || keys[i] < limit); i++ {
+			if op := pending[keys[i]]; op.Op == tiered_opUpsert && !fn(keys[i], op.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	err := scanCold(func(key string, value []byte) bool {
+		if !emitPending(key, false) {
+			stopped = true
+			return false
+		}
+		if op, ok := pending[key]; ok {
+			i++
+			if op.Op == tiered_opDelete {
+				return true
+			}
+			value = op.Value
+		}
+		stopped = !fn(key, value)
+		return !stopped
+	})
+	if err != nil && !(len(pending) > 0 && err.ErrorCode == NAMESPACE_NOT_FOUND) {
+		return err
+	}
+	if !stopped {
+		emitPending("", true)
+	}
+	return nil
+}
+
+// GetMany reads the documents missing from memory with a single call to the cold tier
+func (t *TieredDatabase) GetMany(namespace string, keys []string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte, len(keys))
+	missing := make([]string, 0, len(keys))
+	absent := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value, err := t.hot.Get(namespace, key); err == nil {
+			ret[key] = value
+			t.touch(tieredKey{namespace, key})
+		} else {
+			absent = append(absent, key)
+		}
+	}
+	t.mu.Lock()
+	for _, key := range absent {
+		k := tieredKey{namespace, key}
+		if elem, ok := t.entries[k]; ok {
+			t.lru.MoveToFront(elem)
+			ret[key], _ = t.hot.Get(namespace, key)
+		} else if op, ok := t.pending[k]; !(ok && op.Op == tiered_opDelete) && !t.complete[namespace] {
+			missing = append(missing, key)
+		}
+	}
+	writes := t.writes
+	t.mu.Unlock()
+	if len(missing) == 0 {
+		return ret, nil
+	}
+
+	cold, err := t.Cold.GetMany(namespace, missing)
+	if err != nil {
+		// documents found in memory may not be flushed yet
+		if len(ret) > 0 && err.ErrorCode == NAMESPACE_NOT_FOUND {
+			return ret, nil
+		}
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, value := range cold {
+		ret[key] = value
+		if t.writes == writes {
+			t.store(namespace, key, value)
+		}
+	}
+	return ret, nil
+}
+
+func (t *TieredDatabase) Delete(namespace string, key string) *DbError {
+	if t.Mode == TIERED_WRITE_THROUGH {
+		unlock := t.lock(namespace, key)
+		defer unlock()
+		err := t.Cold.Delete(namespace, key)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.writes++
+		t.evict(tieredKey{namespace, key})
+		t.mu.Unlock()
+		return nil
+	}
+
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	if _, err := t.Get(namespace, key); err != nil {
+		return err
+	}
+	return t.enqueue(&tieredOp{Op: tiered_opDelete, Namespace: namespace, Key: key})
+}
+
+func (t *TieredDatabase) DeleteAll(namespace string) *DbError {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	t.waitFlushed()
+
+	err := t.Cold.DeleteAll(namespace)
+	if err == nil {
+		t.mu.Lock()
+		t.evictNamespace(namespace)
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// lock serializes the write through of a document, so that the hot tier ends with the value of the last cold write
+func (t *TieredDatabase) lock(namespace string, key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	stripe := &t.locks[h.Sum32()%tiered_lockStripes]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+// store puts the document in the hot tier, then evicts the least recently used ones over the budget
+func (t *TieredDatabase) store(namespace string, key string, value []byte) {
+	k := tieredKey{namespace, key}
+	if elem, ok := t.entries[k]; ok {
+		entry := elem.Value.(*tieredEntry)
+		t.size += len(value) - entry.size
+		entry.size = len(value)
+		t.lru.MoveToFront(elem)
+	} else {
+		t.entries[k] = t.lru.PushFront(&tieredEntry{tieredKey: k, size: len(value)})
+		t.size += len(value)
+	}
+	t.hot.Upsert(namespace, key, value, true)
+
+	// documents waiting for the cold tier are pinned
+	for elem := t.lru.Back(); elem != nil && t.overBudget(); {
+		prev := elem.Prev()
+		entry := elem.Value.(*tieredEntry)
+		if t.pending[entry.tieredKey] == nil && entry.tieredKey != k {
+			t.evict(entry.tieredKey)
+			t.complete[entry.namespace] = false
+		}
+		elem = prev
+	}
+}
+
+// load puts a whole namespace in the hot tier, it is complete unless the budget evicted some of it
+func (t *TieredDatabase) load(namespace string, data map[string][]byte) {
+	t.complete[namespace] = false
+	for key, value := range data {
+		t.store(namespace, key, value)
+	}
+	for k := range t.entries {
+		if _, ok := data[k.key]; k.namespace == namespace && !ok {
+			t.evict(k)
+		}
+	}
+	t.complete[namespace] = len(data) == t.countNamespace(namespace)
+}
+
+// touch moves a document read from the hot tier to the front of the LRU. The promotion is skipped when the lock
+// is busy so that the reads never queue behind each other, the order of the LRU is approximate under contention.
+func (t *TieredDatabase) touch(k tieredKey) {
+	if !t.mu.TryLock() {
+		return
+	}
+	if elem, ok := t.entries[k]; ok {
+		t.lru.MoveToFront(elem)
+	}
+	t.mu.Unlock()
+}
+
+func (t *TieredDatabase) overBudget() bool {
+	return (t.MaxItems > 0 && len(t.entries) > t.MaxItems) || (t.MaxBytes > 0 && t.size > t.MaxBytes)
+}
+
+func (t *TieredDatabase) evict(k tieredKey) {
+	elem, ok := t.entries[k]
+	if !ok {
+		return
+	}
+	t.size -= elem.Value.(*tieredEntry).size
+	t.lru.Remove(elem)
+	delete(t.entries, k)
+	t.hot.Delete(k.namespace, k.key)
+}
+
+func (t *TieredDatabase) evictNamespace(namespace string) {
+	t.writes++
+	for k := range t.entries {
+		if k.namespace == namespace {
+			t.evict(k)
+		}
+	}
+	delete(t.complete, namespace)
+}
+
+func (t *TieredDatabase) countNamespace(namespace string) int {
+	count := 0
+	for k := range t.entries {
+		if k.namespace == namespace {
+			count++
+		}
+	}
+	return count
+}
+
+func (t *TieredDatabase) copyNamespace(namespace string) map[string][]byte {
+	ret := make(map[string][]byte)
+	for k, elem := range t.entries {
+		if k.namespace == namespace {
+			t.lru.MoveToFront(elem)
+			ret[k.key], _ = t.hot.Get(k.namespace, k.key)
+		}
+	}
+	return ret
+}
+
+// enqueue journals the change, applies it to the hot tier and hands it to the flush worker, queueMu must be held.
+// The journal is written without t.mu, the reads go on meanwhile.
+func (t *TieredDatabase) enqueue(op *tieredOp) *DbError {
+	line, err := json.Marshal(op)
+	t.journalMu.Lock()
+	if err == nil {
+		_, err = t.journal.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = t.journal.Sync()
+	}
+	if err == nil {
+		t.journaled++
+	}
+	t.journalMu.Unlock()
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   fmt.Sprintf("error writing journal: %v", err),
+		}
+	}
+
+	t.mu.Lock()
+	k := tieredKey{op.Namespace, op.Key}
+	t.pending[k] = op
+	t.queued++
+	t.writes++
+	if op.Op == tiered_opDelete {
+		t.evict(k)
+	} else {
+		t.store(op.Namespace, op.Key, op.Value)
+	}
+	t.mu.Unlock()
+
+	// blocks when the queue is full, the writers are slowed down to the pace of the cold tier
+	t.queue <- op
+	return nil
+}
+
+// flush applies the queued changes to the cold tier, a change is retried until the cold tier accepts it
+func (t *TieredDatabase) flush() {
+	defer close(t.done)
+	for op := range t.queue {
+		for {
+			err := t.apply(op)
+			if err == nil {
+				break
+			}
+			log.Printf("error flushing %v %v/%v, retrying: %v\n", op.Op, op.Namespace, op.Key, err.Message)
+			time.Sleep(tiered_retryDelay)
+		}
+
+		t.journalMu.Lock()
+		t.journaled--
+		if t.journaled == 0 {
+			// everything journaled is in the cold tier now
+			if err := t.resetJournal(); err != nil {
+				log.Printf("error truncating journal: %v\n", err)
+			}
+		}
+		t.journalMu.Unlock()
+
+		t.mu.Lock()
+		k := tieredKey{op.Namespace, op.Key}
+		if t.pending[k] == op {
+			delete(t.pending, k)
+		}
+		t.queued--
+		if t.queued == 0 {
+			t.flushed.Broadcast()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// apply writes the change to the cold tier, it is idempotent so that the journal can be replayed
+func (t *TieredDatabase) apply(op *tieredOp) *DbError {
+	if op.Op == tiered_opDelete {
+		err := t.Cold.Delete(op.Namespace, op.Key)
+		if err != nil && err.ErrorCode != ID_NOT_FOUND && err.ErrorCode != NAMESPACE_NOT_FOUND {
+			return err
+		}
+		return nil
+	}
+	return t.Cold.Upsert(op.Namespace, op.Key, op.Value, true)
+}
+
+// waitFlushed blocks until the cold tier has every queued change, queueMu must be held
+func (t *TieredDatabase) waitFlushed() {
+	if t.Mode != TIERED_WRITE_BEHIND {
+		return
+	}
+	t.mu.Lock()
+	for t.queued > 0 {
+		t.flushed.Wait()
+	}
+	t.mu.Unlock()
+}
+
+// openJournal replays the changes left by a previous run into the cold tier, then starts an empty journal
+func (t *TieredDatabase) openJournal() {
+	err := os.MkdirAll(filepath.Dir(t.JournalPath), os.ModePerm)
+	if err != nil {
+		log.Fatalf("error on TieredDatabase Init: %v", err)
+	}
+	journal, err := os.OpenFile(t.JournalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatalf("error opening journal: %v", err)
+	}
+	t.journal = journal
+
+	replayed := 0
+	scanner := bufio.NewScanner(journal)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var op tieredOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			// a torn last line, the write it holds was never acknowledged
+			log.Printf("skipping journal entry: %v\n", err)
+			continue
+		}
+		if dbErr := t.apply(&op); dbErr != nil {
+			log.Fatalf("error replaying journal: %v", dbErr.Message)
+		}
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading journal: %v", err)
+	}
+	if replayed > 0 {
+		log.Printf("replayed %d journal entries\n", replayed)
+	}
+	if err := t.resetJournal(); err != nil {
+		log.Fatalf("error truncating journal: %v", err)
+	}
+}
+
+func (t *TieredDatabase) resetJournal() error {
+	err := t.journal.Truncate(0)
+	if err == nil {
+		err = t.journal.Sync()
+	}
+	return err
+}
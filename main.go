@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
 
 	"github.com/xdung24/unirest/database"
 	"github.com/xdung24/unirest/service"
@@ -15,45 +16,58 @@ func main() {
 	config := getConfig()
 
 	// create db driver
-	var db service.Database
-	switch config.DbDriver {
-	case MEMORY:
-		db = &database.MemDatabase{}
-	case FS:
-		db = &database.StorageDatabase{
-			RootDirPath: config.DbPath,
+	db := newDatabase(config.DbDriver, config)
+	if len(config.Compression) > 0 {
+		storage := config.DbDriver
+		if storage == TIERED {
+			storage = config.TieredCold
 		}
-	case SQLITE:
-		db = &database.SQLiteDatabase{
-			DirPath: config.DbPath,
+		if storage == PG || storage == MYSQL || storage == MONGO {
+			panic("compression needs a driver storing raw bytes")
 		}
-	case PG:
-		db = &database.PGDatabase{
-			Host: config.DbHost,
-			Name: config.DbName,
-			User: config.DbUser,
-			Pass: config.DbPass,
+		if storage == SQLITE && config.SqliteFts {
+			// the full text index would be built from the compressed bytes
+			panic("compression can't be used with the sqlite full text index")
 		}
-	case MYSQL:
-		db = &database.MySqlDatabase{
-			Host: config.DbHost,
-			Name: config.DbName,
-			User: config.DbUser,
-			Pass: config.DbPass,
+		db = &database.CompressedDatabase{
+			Backend:            db,
+			Namespaces:         config.Compression,
+			RecompressInterval: config.Recompress,
 		}
-	case REDIS:
-		db = &database.RedisDatabase{
-			Host: config.DbHost,
+	}
+	if len(config.EncryptFields) > 0 {
+		// fields are encrypted before the document is compressed
+		encrypted := &database.EncryptedDatabase{
+			Backend:     db,
+			KeyringPath: config.Keyring,
+			Fields:      config.EncryptFields,
 		}
-	case MONGO:
-		db = &database.MongoDatabase{
-			Host: config.DbHost,
-			Name: config.DbName,
-			User: config.DbUser,
-			Pass: config.DbPass,
+		if config.AuthEnabled {
+			// the documents are stored in the data of a payload
+			encrypted.Envelope = "/data"
+		}
+		db = encrypted
+	}
+	// mongo indexes the geo fields itself
+	geoFields := config.GeoFields
+	if config.DbDriver == MONGO {
+		geoFields = nil
+	}
+	if len(config.TextIndex) > 0 || len(geoFields) > 0 {
+		// the index reads the decrypted documents, it would hold the plaintext of an encrypted field
+		for namespace, fields := range config.EncryptFields {
+			for _, field := range fields {
+				if slices.Contains(config.TextIndex[namespace], field.Pointer) || geoFields[namespace] == field.Pointer {
+					panic("an encrypted field can't be indexed")
+				}
+			}
+		}
+		db = &database.IndexedDatabase{
+			Backend:   db,
+			Fields:    config.TextIndex,
+			Stemming:  config.TextStemming,
+			GeoFields: geoFields,
 		}
-	default:
-		panic("invalid db type")
 	}
 
 	log.Println("db type: ", config.DbDriver)
@@ -66,6 +80,9 @@ func main() {
 		BrokerEnabled:  config.BrokerEnabled,
 		AuthEnabled:    config.AuthEnabled,
 		RawSqlEnabled:  config.RawSqlEnabled,
+		IdStrategies:   config.IdStrategies,
+		SearchTimeout:  config.SearchTimeout,
+		SlurpMaxBytes:  config.SlurpMaxBytes,
 	}
 	go server.Init(db)
 
@@ -81,3 +98,89 @@ func main() {
 
 	log.Println("Good bye")
 }
+
+func newDatabase(driver string, config Config) service.Database {
+	switch driver {
+	case MEMORY:
+		return &database.MemDatabase{
+			MaxBytes:          config.MemMaxBytes,
+			NamespaceMaxBytes: config.MemNsMaxBytes,
+		}
+	case FS:
+		return &database.StorageDatabase{
+			RootDirPath: config.DbPath,
+		}
+	case SQLITE:
+		return &database.SQLiteDatabase{
+			DirPath:         config.DbPath,
+			FullTextEnabled: config.SqliteFts,
+		}
+	case PG:
+		return &database.PGDatabase{
+			Host: config.DbHost,
+			Name: config.DbName,
+			User: config.DbUser,
+			Pass: config.DbPass,
+		}
+	case MYSQL:
+		return &database.MySqlDatabase{
+			Host: config.DbHost,
+			Name: config.DbName,
+			User: config.DbUser,
+			Pass: config.DbPass,
+		}
+	case REDIS:
+		return &database.RedisDatabase{
+			Host: config.DbHost,
+		}
+	case MONGO:
+		return &database.MongoDatabase{
+			Host:      config.DbHost,
+			Name:      config.DbName,
+			User:      config.DbUser,
+			Pass:      config.DbPass,
+			GeoFields: config.GeoFields,
+		}
+	case BOLT:
+		return &database.BoltDatabase{
+			DirPath: config.DbPath,
+		}
+	case S3:
+		return &database.S3Database{
+			Endpoint:  config.DbHost,
+			Bucket:    config.DbName,
+			AccessKey: config.DbUser,
+			SecretKey: config.DbPass,
+			Region:    config.S3Region,
+			UseSSL:    config.S3UseSSL,
+		}
+	case GIT:
+		return &database.GitDatabase{
+			DirPath: config.DbPath,
+		}
+	case RAFT:
+		return &database.ClusterDatabase{
+			HttpAddress: config.ClusterHttp,
+			RaftAddress: config.ClusterRaft,
+			Peers:       config.ClusterPeers,
+			DirPath:     config.DbPath,
+			StaleReads:  config.ClusterStale,
+			Secret:      config.ClusterSecret,
+		}
+	case TIERED:
+		if config.TieredCold == TIERED {
+			panic("tiered db can't be its own cold driver")
+		}
+		return &database.TieredDatabase{
+			Cold:        newDatabase(config.TieredCold, config),
+			Mode:        config.TieredMode,
+			JournalPath: config.TieredJournal,
+			QueueSize:   config.TieredQueue,
+			MaxItems:    config.TieredMaxItems,
+			MaxBytes:    config.TieredMaxBytes,
+			Warm:        config.TieredWarm,
+		}
+	default:
+		panic("invalid db type")
+	}
+}
@@ -11,6 +11,183 @@ type Database interface {
 	Upsert(namespace string, key string, value []byte, allowOverWrite bool) *database.DbError
 	Get(namespace string, key string) ([]byte, *database.DbError)
 	GetAll(namespace string) (map[string][]byte, *database.DbError)
+	// GetMany returns the documents of the keys found, in a single round trip when the driver allows it
+	GetMany(namespace string, keys []string) (map[string][]byte, *database.DbError)
+	// Scan calls fn on every document of the namespace in ascending key order, without loading them all at once
+	Scan(namespace string, fn database.ScanFunc) *database.DbError
+	// ScanRange is Scan restricted to the keys of the range
+	ScanRange(namespace string, r database.KeyRange, fn database.ScanFunc) *database.DbError
+	// ScanKeys calls fn on the keys of the range in ascending order, without reading the values
+	ScanKeys(namespace string, r database.KeyRange, fn database.KeyFunc) *database.DbError
+	Count(namespace string) (int64, *database.DbError)
+	// NextSequence increments the counter of the namespace atomically and returns its new value, starting from 1.
+	// The counters outlive the deletion of their namespace, a value is never given twice.
+	NextSequence(namespace string) (int64, *database.DbError)
 	Delete(namespace string, key string) *database.DbError
 	DeleteAll(namespace string) *database.DbError
 }
+
+// FullTextSearcher is implemented by the drivers having a native full text index
+type FullTextSearcher interface {
+	FullTextSearch(namespace string, query string) ([]database.Document, *database.DbError)
+}
+
+// GeoSearcher is implemented by the drivers having an index of a GeoJSON Point field (in-process geohashes, mongo 2dsphere)
+type GeoSearcher interface {
+	GeoSearch(namespace string, q database.GeoQuery) ([]database.GeoDocument, *database.DbError)
+}
+
+// FieldEncryptor is implemented by the drivers encrypting some fields of the documents at rest
+type FieldEncryptor interface {
+	EncryptedFields(namespace string) []database.EncryptedField
+	Reencrypt(namespace string) (int, *database.DbError)
+}
+
+// Projector is implemented by the drivers able to read only some fields of the documents (sql json functions,
+// mongo projections). The documents given to fn hold at least the fields found, nested like in the stored ones.
+type Projector interface {
+	ScanRangeFields(namespace string, r database.KeyRange, fields []string, fn database.ScanFunc) *database.DbError
+}
+
+// Querier is implemented by the drivers filtering, sorting and paging the documents themselves (sql json functions,
+// mongo aggregations), with the results of database.QueryScan
+type Querier interface {
+	Query(namespace string, q database.Query, fn database.ScanFunc) *database.DbError
+}
+
+// Aggregator is implemented by the drivers grouping the documents themselves (sql GROUP BY, mongo $group),
+// with the results of database.AggregateScan
+type Aggregator interface {
+	Aggregate(namespace string, a database.Aggregation) ([]database.AggregateGroup, *database.DbError)
+}
+
+// ExistenceChecker is implemented by the drivers telling whether a document is stored without reading it (object
+// metadata, HEXISTS, a count of the rows of the id, a stat of the file). Exists returns the error a Get would.
+type ExistenceChecker interface {
+	Exists(namespace string, key string) *database.DbError
+}
+
+// Evictor is implemented by the drivers evicting documents to stay within a memory budget
+type Evictor interface {
+	OnEvict(fn func(namespace string, key string))
+	MemoryStats() database.MemStats
+}
+
+// EventReplicator is implemented by the drivers replicated on several nodes, delivering the broker events of the
+// writes to every node: PublishEvent hands the event to the OnEvent callback of each of them, this one included
+type EventReplicator interface {
+	PublishEvent(event []byte) *database.DbError
+	OnEvent(fn func(event []byte))
+}
+
+// AuthoredDatabase is implemented by the drivers recording the user behind each change
+type AuthoredDatabase interface {
+	CreateNameSpaceAs(user string, namespace string) *database.DbError
+	DropNameSpaceAs(user string, namespace string) *database.DbError
+	UpsertAs(user string, namespace string, key string, value []byte, allowOverWrite bool) *database.DbError
+	DeleteAs(user string, namespace string, key string) *database.DbError
+	DeleteAllAs(user string, namespace string) *database.DbError
+}
+
+// Wrapper is implemented by the drivers wrapping another one. The transparent ones store the documents unchanged, the
+// capabilities of the wrapped driver reading or filtering them then answer for the wrapper.
+type Wrapper interface {
+	Unwrap() database.Backend
+	Transparent() bool
+}
+
+// capability returns the first driver of the chain implementing T, looked up through the transparent wrappers
+func capability[T any](db Database) (T, bool) {
+	return lookupCapability[T](db, false)
+}
+
+// anyCapability is capability looked up through every wrapper, for the capabilities handling no document
+func anyCapability[T any](db Database) (T, bool) {
+	return lookupCapability[T](db, true)
+}
+
+func lookupCapability[T any](db Database, opaque bool) (T, bool) {
+	for db != nil {
+		if ret, ok := db.(T); ok {
+			return ret, true
+		}
+		wrapper, ok := db.(Wrapper)
+		if !ok || (!opaque && !wrapper.Transparent()) {
+			break
+		}
+		db = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// The writes are given to the outermost driver, so that they go through every wrapper
+
+func (s *Server) createNameSpace(user string, namespace string) *database.DbError {
+	if db, ok := s.db.(AuthoredDatabase); ok {
+		return db.CreateNameSpaceAs(user, namespace)
+	}
+	return s.db.CreateNameSpace(namespace)
+}
+
+func (s *Server) dropNameSpace(user string, namespace string) *database.DbError {
+	var dbErr *database.DbError
+	if db, ok := s.db.(AuthoredDatabase); ok {
+		dbErr = db.DropNameSpaceAs(user, namespace)
+	} else {
+		dbErr = s.db.DropNameSpace(namespace)
+	}
+	if dbErr == nil {
+		s.clearViews(namespace)
+	}
+	return dbErr
+}
+
+func (s *Server) upsert(user string, namespace string, key string, value []byte, allowOverWrite bool) *database.DbError {
+	var dbErr *database.DbError
+	if db, ok := s.db.(AuthoredDatabase); ok {
+		dbErr = db.UpsertAs(user, namespace, key, value, allowOverWrite)
+	} else {
+		dbErr = s.db.Upsert(namespace, key, value, allowOverWrite)
+	}
+	if dbErr == nil {
+		s.refreshViews(namespace, key)
+	}
+	return dbErr
+}
+
+// exists tells whether the document is stored, by the error of a Get: the existence of a document is the same
+// whatever the wrappers do to its value
+func (s *Server) exists(namespace string, key string) *database.DbError {
+	if db, ok := anyCapability[ExistenceChecker](s.db); ok {
+		return db.Exists(namespace, key)
+	}
+	_, dbErr := s.db.Get(namespace, key)
+	return dbErr
+}
+
+func (s *Server) delete(user string, namespace string, key string) *database.DbError {
+	var dbErr *database.DbError
+	if db, ok := s.db.(AuthoredDatabase); ok {
+		dbErr = db.DeleteAs(user, namespace, key)
+	} else {
+		dbErr = s.db.Delete(namespace, key)
+	}
+	if dbErr == nil {
+		s.refreshViews(namespace, key)
+	}
+	return dbErr
+}
+
+func (s *Server) deleteAll(user string, namespace string) *database.DbError {
+	var dbErr *database.DbError
+	if db, ok := s.db.(AuthoredDatabase); ok {
+		dbErr = db.DeleteAllAs(user, namespace)
+	} else {
+		dbErr = s.db.DeleteAll(namespace)
+	}
+	if dbErr == nil {
+		s.clearViews(namespace)
+	}
+	return dbErr
+}
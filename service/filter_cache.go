@@ -0,0 +1,80 @@
+package service
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/itchyny/gojq"
+)
+
+// filterCacheSize is the number of compiled jq filters kept by a server
+const filterCacheSize = 256
+
+// compiledFilter is a jq filter of the search, compiled with $__key then the variables of the request
+type compiledFilter struct {
+	key       string
+	text      string
+	variables []string
+	query     *gojq.Query
+	code      *gojq.Code
+}
+
+// filterCache keeps the most recently used compiled filters by text and variable names, the zero value is ready to use
+type filterCache struct {
+	mu      sync.Mutex
+	lru     list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+// get returns the compiled filter, parsing and compiling it on a miss
+func (c *filterCache) get(filter string, variables []string) (*compiledFilter, error) {
+	return c.compile(filter+"\x00"+strings.Join(variables, ","), filter, variables, nil)
+}
+
+// getRewritten returns the filter compiled once its parsed query is rewritten, cached under the filter and the name
+// of the rewrite
+func (c *filterCache) getRewritten(filter *compiledFilter, name string, rewrite func(*gojq.Query)) (*compiledFilter, error) {
+	return c.compile(filter.key+"\x00"+name, filter.text, filter.variables, rewrite)
+}
+
+func (c *filterCache) compile(key string, filter string, variables []string, rewrite func(*gojq.Query)) (*compiledFilter, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*compiledFilter), nil
+	}
+	c.mu.Unlock()
+
+	// compiled outside of the lock, two requests may compile the same filter
+	query, err := gojq.Parse(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rewrite != nil {
+		rewrite(query)
+	}
+	code, err := gojq.Compile(query, gojq.WithVariables(append([]string{KEY_VARIABLE}, variables...)))
+	if err != nil {
+		return nil, err
+	}
+	compiled := &compiledFilter{key: key, text: filter, variables: variables, query: query, code: code}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*compiledFilter), nil
+	}
+	c.entries[key] = c.lru.PushFront(compiled)
+	if c.lru.Len() > filterCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*compiledFilter).key)
+	}
+	return compiled, nil
+}
@@ -17,19 +17,44 @@ import (
 )
 
 func (s *Server) Init(db Database) {
+	for namespace, strategy := range s.IdStrategies {
+		if !validIdStrategy(strategy) {
+			log.Fatalf("invalid id strategy '%v' for namespace %v", strategy, namespace)
+		}
+	}
+
 	s.db = db
 	s.db.Init()
+	s.loadViews()
 
 	s.router = mux.NewRouter()
 
 	s.router.HandleFunc(NamespaceHomePattern, s.homeHandler)
 	s.router.HandleFunc(NamespacePattern, s.namespaceHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
 
-	s.router.HandleFunc(DataSetPattern, s.dataSetHandler).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
-	s.router.HandleFunc(DataSetKeyValuePattern, s.dataSetKeyValueHandler).Methods(http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodOptions)
+	s.router.HandleFunc(DataSetPattern, s.dataSetHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+	s.router.HandleFunc(DataSetKeyValuePattern, s.dataSetKeyValueHandler).Methods(http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions)
+	s.router.HandleFunc(DataSetKeysPattern, s.dataSetKeysHandler).Methods(http.MethodGet, http.MethodOptions)
+	s.router.HandleFunc(DataSetCountPattern, s.dataSetCountHandler).Methods(http.MethodGet, http.MethodOptions)
 
+	s.router.HandleFunc(SearchPattern, s.searchHandler).Methods(http.MethodPost, http.MethodOptions)
 	s.router.HandleFunc(SearchPattern, s.searchHandler).Queries("filter", "{filter}")
+	s.router.HandleFunc(SearchPattern, s.fullTextSearchHandler).Queries("q", "{q}")
+	s.router.HandleFunc(SearchPattern, s.geoSearchHandler).Queries("near", "{near}")
+	s.router.HandleFunc(SearchPattern, s.geoSearchHandler).Queries("bbox", "{bbox}")
+	s.router.HandleFunc(SearchNamespacesPattern, s.searchNamespacesHandler).Methods(http.MethodGet, http.MethodOptions).Queries("namespaces", "{namespaces}", "filter", "{filter}")
+	s.router.HandleFunc(LivePattern, s.liveQueryHandler).Methods(http.MethodGet, http.MethodOptions).Queries("filter", "{filter}")
 	s.router.HandleFunc(SchemaPattern, s.schemaHandler)
+	s.router.HandleFunc(ViewHomePattern, s.viewsHandler).Methods(http.MethodGet, http.MethodOptions)
+	s.router.HandleFunc(ViewPattern, s.viewHandler).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+	s.router.HandleFunc(AggregatePattern, s.aggregateHandler).Methods(http.MethodPost, http.MethodOptions)
+	if _, ok := anyCapability[FieldEncryptor](s.db); ok {
+		s.router.HandleFunc(ReencryptPattern, s.reencryptHandler).Methods(http.MethodPost, http.MethodOptions)
+	}
+	s.receiveEvents()
+	if s.notifyEvictions() {
+		s.router.HandleFunc(MemoryStatsPattern, s.memoryStatsHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 
 	if s.SwaggerEnabled {
 		s.router.HandleFunc(OpenAPIPattern, s.openAPIHandler)
@@ -88,10 +113,10 @@ func (s *Server) Init(db Database) {
 	}
 
 	srv := &http.Server{
-		Handler: handlers.CompressHandlerLevel(s.router, gzip.BestSpeed),
+		Handler: withResponseController(handlers.CompressHandlerLevel(s.router, gzip.BestSpeed)),
 		// Handler:      s.router,
 		Addr:         s.Address,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: writeTimeout, // the streamed responses extend it at each write
 		ReadTimeout:  15 * time.Second,
 	}
 
@@ -134,7 +159,89 @@ func (s *Server) validate(namespace string, data []byte) (interface{}, error) {
 	return parsed, nil
 }
 
+// notifyEvictions publishes the evictions of the driver, found through every wrapper, false when it evicts nothing
+func (s *Server) notifyEvictions() bool {
+	db, ok := anyCapability[Evictor](s.db)
+	if ok {
+		// an eviction only concerns the memory of this node
+		db.OnEvict(func(namespace string, key string) {
+			s.publish(BrokerEvent{
+				Event:     EVENT_ITEM_EVICTED,
+				Namespace: namespace,
+				Key:       key,
+			})
+		})
+	}
+	return ok
+}
+
+// Notify publishes the event to the live queries and the broker, of every node when the driver is replicated
 func (s *Server) Notify(event BrokerEvent) {
+	db, ok := anyCapability[EventReplicator](s.db)
+	if !ok {
+		s.publish(event)
+		return
+	}
+	if s.encrypted(event.Namespace) {
+		// the raft log holds the documents as written by the wrappers, each node reads them back
+		event.Value = nil
+		event.Patch = nil
+	}
+	jsonData, err := json.Marshal(event)
+	if err == nil {
+		if dbErr := db.PublishEvent(jsonData); dbErr != nil {
+			err = dbErr
+		}
+	}
+	if err != nil {
+		log.Printf("error replicating the event, only published on this node: %v\n", err)
+		s.publish(event)
+	}
+}
+
+// receiveEvents publishes the events replicated by the driver, false when it doesn't replicate them
+func (s *Server) receiveEvents() bool {
+	db, ok := anyCapability[EventReplicator](s.db)
+	if ok {
+		db.OnEvent(func(data []byte) {
+			var event BrokerEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				log.Printf("invalid replicated event: %v\n", err)
+				return
+			}
+			if event.Value == nil && (event.Event == EVENT_ITEM_CREATED || event.Event == EVENT_ITEM_UPDATED) {
+				event.Value = s.readEventValue(event.Namespace, event.Key)
+			}
+			s.publish(event)
+		})
+	}
+	return ok
+}
+
+// readEventValue reads the data of the document of an event, nil when it is gone
+func (s *Server) readEventValue(namespace string, key string) interface{} {
+	value, dbErr := s.db.Get(namespace, key)
+	if dbErr != nil {
+		return nil
+	}
+	data, err := s.payloadData(value)
+	if err != nil {
+		return nil
+	}
+	var ret interface{}
+	json.Unmarshal(data, &ret)
+	return ret
+}
+
+// encrypted tells whether the namespace has encrypted fields
+func (s *Server) encrypted(namespace string) bool {
+	db, ok := anyCapability[FieldEncryptor](s.db)
+	return ok && len(db.EncryptedFields(namespace)) > 0
+}
+
+// publish gives the event to the live queries and the broker of this node
+func (s *Server) publish(event BrokerEvent) {
+	s.live.publish(event)
 	if s.broker != nil {
 		jsonData, _ := json.Marshal(event)
 		s.broker.Publish("messages", &sse.Event{
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// reencryptHandler starts the re-encryption of a namespace with the active key, its end is notified on the broker
+func (s *Server) reencryptHandler(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get(USER_HEADER)
+
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+
+	switch r.Method {
+	case http.MethodPost:
+		db, _ := anyCapability[FieldEncryptor](s.db)
+		if _, running := s.reencrypting.LoadOrStore(namespace, true); running {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("namespace '%v' is already being re-encrypted", namespace))
+			return
+		}
+		go func() {
+			defer s.reencrypting.Delete(namespace)
+			count, dbErr := db.Reencrypt(namespace)
+			if dbErr != nil {
+				log.Printf("error re-encrypting namespace '%s' after %d documents: %v\n", namespace, count, dbErr)
+				return
+			}
+			log.Printf("re-encrypted %d documents of namespace '%s'\n", count, namespace)
+			s.Notify(BrokerEvent{
+				Event:     EVENT_NAMESPACE_REENCRYPTED,
+				User:      userId,
+				Namespace: namespace,
+				Value:     map[string]int{"reencrypted": count},
+			})
+		}()
+		respondWithJSON(w, http.StatusAccepted, "{}")
+	}
+}
+
+// memoryStatsHandler returns the size and eviction counters of the memory driver
+func (s *Server) memoryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		db, _ := anyCapability[Evictor](s.db)
+		stats, err := json.Marshal(db.MemoryStats())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, string(stats))
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/xdung24/unirest/database"
+)
+
+// AGGREGATE_KEY is the field of the group key in the rows of an aggregation, it can't name an accumulator
+const AGGREGATE_KEY = "key"
+
+// accumulatorNamePattern matches the names of the accumulators, the fields of the rows
+var accumulatorNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// aggregateRequest is the body of POST /aggregate/{namespace}, the fields are json pointers.
+// Match maps a field to a value it must be equal to, or to {"operator": value, ...} with the operators of where[].
+// Each accumulator is {"operator": field}, like {"sum": "/amount"} or {"count": ""}.
+// Sort lists the accumulators (or key) to sort the rows on, - for descending order, the rows are in key order otherwise.
+type aggregateRequest struct {
+	Match        map[string]json.RawMessage   `json:"match"`
+	Group        string                       `json:"group"`
+	Accumulators map[string]map[string]string `json:"accumulators"`
+	Sort         string                       `json:"sort"`
+	Limit        int                          `json:"limit"`
+}
+
+// aggregation reads the request, with the names of the accumulators in the order of the aggregation
+func (ar *aggregateRequest) aggregation() (database.Aggregation, []string, error) {
+	var a database.Aggregation
+	var err error
+	for pointer, raw := range ar.Match {
+		field, err := pointerField(pointer)
+		if err != nil {
+			return a, nil, err
+		}
+		var value interface{}
+		if err = json.Unmarshal(raw, &value); err != nil {
+			return a, nil, fmt.Errorf("invalid match on '%v': %v", pointer, err)
+		}
+		operators, ok := value.(map[string]interface{})
+		if !ok {
+			operators = map[string]interface{}{database.OP_EQ: value}
+		}
+		for operator, operand := range operators {
+			if !database.ValidOperator(operator, operand) {
+				return a, nil, fmt.Errorf("invalid match on '%v'", pointer)
+			}
+			a.Where = append(a.Where, database.Condition{Field: field, Operator: operator, Value: operand})
+		}
+	}
+	// the order of the conditions doesn't change the result, but keeps the queries sent to the drivers stable
+	sort.Slice(a.Where, func(i, j int) bool {
+		if a.Where[i].Field != a.Where[j].Field {
+			return a.Where[i].Field < a.Where[j].Field
+		}
+		return a.Where[i].Operator < a.Where[j].Operator
+	})
+
+	if ar.Group != "" {
+		if a.GroupBy, err = pointerField(ar.Group); err != nil {
+			return a, nil, err
+		}
+	}
+
+	names := make([]string, 0, len(ar.Accumulators))
+	for name := range ar.Accumulators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == AGGREGATE_KEY || !accumulatorNamePattern.MatchString(name) {
+			return a, nil, fmt.Errorf("invalid accumulator name '%v'", name)
+		}
+		accumulator := ar.Accumulators[name]
+		if len(accumulator) != 1 {
+			return a, nil, fmt.Errorf("accumulator '%v' must have a single operator", name)
+		}
+		for operator, pointer := range accumulator {
+			if !database.ValidAccumulator(operator) {
+				return a, nil, fmt.Errorf("invalid operator '%v' of accumulator '%v'", operator, name)
+			}
+			field := ""
+			if operator != database.ACC_COUNT {
+				if field, err = pointerField(pointer); err != nil {
+					return a, nil, err
+				}
+			}
+			a.Accumulators = append(a.Accumulators, database.Accumulator{Operator: operator, Field: field})
+		}
+	}
+
+	if ar.Limit < 0 {
+		return a, nil, fmt.Errorf("invalid limit %d", ar.Limit)
+	}
+	for _, field := range strings.Split(ar.Sort, ",") {
+		if field = strings.TrimPrefix(strings.TrimSpace(field), "-"); field != "" && field != AGGREGATE_KEY {
+			if _, ok := ar.Accumulators[field]; !ok {
+				return a, nil, fmt.Errorf("invalid sort on '%v', not an accumulator", field)
+			}
+		}
+	}
+	return a, names, nil
+}
+
+// pointerField converts a json pointer to the dotted path of the queries, the names can't hold dots
+func pointerField(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return "", fmt.Errorf("invalid json pointer '%v'", pointer)
+	}
+	names := strings.Split(pointer[1:], "/")
+	for i, name := range names {
+		name = strings.ReplaceAll(strings.ReplaceAll(name, "~1", "/"), "~0", "~")
+		if name == "" || strings.Contains(name, ".") {
+			return "", fmt.Errorf("unsupported json pointer '%v'", pointer)
+		}
+		names[i] = name
+	}
+	return strings.Join(names, "."), nil
+}
+
+// aggregateRow is a group of the response, values holds the key and the accumulators by name
+type aggregateRow struct {
+	values map[string]interface{}
+	raw    json.RawMessage
+}
+
+// sortRows orders the rows on the fields of sort (accumulators or key) then on the key, as the listings do
+func sortRows(rows []aggregateRow, fields string) {
+	var sortFields []database.SortField
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			sortFields = append(sortFields, database.SortField{Field: strings.TrimPrefix(field, "-"), Descending: strings.HasPrefix(field, "-")})
+		}
+	}
+	sortFields = append(sortFields, database.SortField{Field: AGGREGATE_KEY})
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, field := range sortFields {
+			c := database.CompareValues(sortable(rows[i].values[field.Field]), sortable(rows[j].values[field.Field]))
+			if field.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return string(rows[i].raw) < string(rows[j].raw)
+	})
+}
+
+// sortable converts the counts to the float64 of the json numbers
+func sortable(value interface{}) interface{} {
+	if count, ok := value.(int64); ok {
+		return float64(count)
+	}
+	return value
+}
+
+func (s *Server) aggregate(namespace string, a database.Aggregation) ([]database.AggregateGroup, *database.DbError) {
+	if db, ok := capability[Aggregator](s.db); ok {
+		return db.Aggregate(namespace, a)
+	}
+	return database.AggregateScan(s.db.ScanRange, namespace, a)
+}
+
+func (s *Server) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	namespace := mux.Vars(r)["namespace"]
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	var request aggregateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid aggregation: %v", err))
+		return
+	}
+	a, names, err := request.aggregation()
+	if err == nil {
+		fields := []string{a.GroupBy}
+		for _, accumulator := range a.Accumulators {
+			fields = append(fields, accumulator.Field)
+		}
+		err = s.fieldMask(namespace).checkPaths(a.Where, fields...)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	groups, dbErr := s.aggregate(namespace, a)
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+		default:
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+
+	rows := make([]aggregateRow, len(groups))
+	for i, group := range groups {
+		var key interface{}
+		if err = json.Unmarshal(group.Key, &key); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		row := aggregateRow{values: map[string]interface{}{AGGREGATE_KEY: key}, raw: group.Key}
+		for j, name := range names {
+			row.values[name] = group.Values[j]
+		}
+		rows[i] = row
+	}
+	sortRows(rows, request.Sort)
+	if request.Limit > 0 && len(rows) > request.Limit {
+		rows = rows[:request.Limit]
+	}
+
+	response := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		response[i] = row.values
+	}
+	content, err := jsonWrapper(response)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, string(content))
+}
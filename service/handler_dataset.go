@@ -1,10 +1,19 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gorilla/mux"
+	"github.com/itchyny/gojq"
 	"github.com/xdung24/unirest/database"
 )
 
@@ -22,50 +31,72 @@ func (s *Server) dataSetHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		data, dbErr := s.db.GetAll(namespace)
-		if dbErr != nil {
-			switch dbErr.ErrorCode {
-			case database.NAMESPACE_NOT_FOUND:
-				respondWithError(w, http.StatusBadRequest, dbErr.Error())
-			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
-			}
+		query := r.URL.Query()
+		stream := newJsonStream(w, r, query.Get("format"))
+		if stream == nil {
+			respondWithError(w, 400, "Invalid query")
+			return
 		}
-		format := r.URL.Query().Get("format")
-		switch format {
-		case "", "1":
-			namespaceData, err := jsonWrapper(data)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			respondWithJSON(w, http.StatusOK, string(namespaceData))
-		case "2":
-			namespaceData, err := jsonWrapper2(data)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
+		shape, err := s.newResponseShape(query, s.fieldMask(namespace))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		stream.shape = shape
+		keyRange := database.KeyRange{
+			Prefix: query.Get("prefix"),
+			Start:  query.Get("start"),
+			End:    query.Get("end"),
+		}
+		listing, err := newListingQuery(query, keyRange)
+		if err == nil && listing != nil {
+			sorted := make([]string, len(listing.Sort))
+			for i, field := range listing.Sort {
+				sorted[i] = field.Field
 			}
-			respondWithJSON(w, http.StatusOK, string(namespaceData))
-		case "3":
-			namespaceData, err := jsonWrapper3(data)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+			err = s.fieldMask(namespace).checkPaths(listing.Where, sorted...)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if query.Has("ids") {
+			if keyRange != (database.KeyRange{}) || listing != nil {
+				respondWithError(w, http.StatusBadRequest, "ids can't be combined with prefix, start, end, where, sort, limit or offset")
 				return
 			}
-			respondWithJSON(w, http.StatusOK, string(namespaceData))
-		default:
-			respondWithError(w, 400, "Invalid query")
+			s.streamDocuments(stream, namespace, strings.Split(query.Get("ids"), ","))
+			return
 		}
-
+		s.streamNamespace(stream, namespace, keyRange, listing)
+	case http.MethodPost:
+		if s.rejectViewWrite(w, namespace) {
+			return
+		}
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		key, dbErr := s.generateId(namespace)
+		if dbErr != nil {
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			return
+		}
+		_onUpsert(s, w, r.Method, userId, namespace, key, data, true)
 	case http.MethodDelete:
-		dbErr := s.db.DeleteAll(namespace)
+		if s.rejectViewWrite(w, namespace) {
+			return
+		}
+		dbErr := s.deleteAll(userId, namespace)
 		if dbErr != nil {
 			switch dbErr.ErrorCode {
 			case database.NAMESPACE_NOT_FOUND:
 				respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
 			}
 		}
 		s.Notify(BrokerEvent{
@@ -92,6 +123,12 @@ func (s *Server) dataSetKeyValueHandler(w http.ResponseWriter, r *http.Request)
 	namespace := vars["namespace"]
 	key := vars["key"]
 
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		if s.rejectViewWrite(w, namespace) {
+			return
+		}
+	}
 	switch r.Method {
 	case http.MethodPost, http.MethodPut:
 		defer r.Body.Close()
@@ -101,9 +138,23 @@ func (s *Server) dataSetKeyValueHandler(w http.ResponseWriter, r *http.Request)
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		_onUpsert(s, w, r.Method, userId, namespace, key, data)
+		_onUpsert(s, w, r.Method, userId, namespace, key, data, false)
+	case http.MethodPatch:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		patch, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		_onPatch(s, w, r.Header.Get("Content-Type"), userId, namespace, key, patch)
 	case http.MethodGet:
-		data, dbErr := s.db.Get(namespace, key)
+		shape, err := s.newResponseShape(r.URL.Query(), s.fieldMask(namespace))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, dbErr := s.get(namespace, key, shape)
 		if dbErr != nil {
 			switch dbErr.ErrorCode {
 			case database.ID_NOT_FOUND:
@@ -111,13 +162,34 @@ func (s *Server) dataSetKeyValueHandler(w http.ResponseWriter, r *http.Request)
 			case database.NAMESPACE_NOT_FOUND:
 				respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
 			}
 			return
 		}
+		if shape != nil {
+			data, err = shapeDocument(shape, data)
+			if err != nil {
+				respondWithError(w, streamErrorCode(err), err.Error())
+				return
+			}
+		}
 		respondWithJSON(w, http.StatusOK, string(data))
+	case http.MethodHead:
+		dbErr := s.exists(namespace, key)
+		switch {
+		case dbErr == nil:
+			w.WriteHeader(http.StatusOK)
+		case dbErr.ErrorCode == database.ID_NOT_FOUND:
+			w.WriteHeader(http.StatusNotFound)
+		case dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(dbErrorStatus(dbErr))
+		}
 	case http.MethodDelete:
-		err := s.db.Delete(namespace, key)
+		unlock := s.lockDocument(namespace, key)
+		defer unlock()
+		err := s.delete(userId, namespace, key)
 		if err != nil {
 
 			switch err.ErrorCode {
@@ -126,7 +198,7 @@ func (s *Server) dataSetKeyValueHandler(w http.ResponseWriter, r *http.Request)
 			case database.NAMESPACE_NOT_FOUND:
 				respondWithError(w, http.StatusBadRequest, err.Error())
 			default:
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+				respondWithError(w, dbErrorStatus(err), err.Error())
 			}
 			return
 		}
@@ -141,9 +213,205 @@ func (s *Server) dataSetKeyValueHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// dataSetKeysHandler lists the keys of the namespace, or of the range given like on dataSetHandler
+func (s *Server) dataSetKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	namespace := mux.Vars(r)["namespace"]
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		stream := newJsonStream(w, r, FORMAT_ARRAY)
+		var err error
+		dbErr := s.db.ScanKeys(namespace, database.KeyRange{
+			Prefix: query.Get("prefix"),
+			Start:  query.Get("start"),
+			End:    query.Get("end"),
+		}, func(key string) bool {
+			err = stream.write(key)
+			return err == nil
+		})
+		if dbErr != nil {
+			switch dbErr.ErrorCode {
+			case database.NAMESPACE_NOT_FOUND:
+				stream.fail(http.StatusBadRequest, dbErr.Error())
+			default:
+				stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+			}
+			return
+		}
+		if err != nil {
+			stream.fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		stream.end()
+	}
+}
+
+// dataSetCountHandler counts the documents of the namespace, or the ones for which the jq filter
+// outputs a value other than false or null
+func (s *Server) dataSetCountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	namespace := mux.Vars(r)["namespace"]
+
+	switch r.Method {
+	case http.MethodGet:
+		var count int64
+		var dbErr *database.DbError
+		if filter := r.URL.Query().Get("filter"); filter != "" {
+			compiled, err := s.filters.get(filter, nil)
+			if err == nil {
+				err = s.checkEncryptedFields(namespace, compiled.query)
+			}
+			var code *gojq.Code
+			var mask *fieldMask
+			if err == nil {
+				code, mask, err = s.filterFor(namespace, compiled)
+			}
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			count, dbErr = s.countMatching(namespace, code, mask)
+		} else {
+			count, dbErr = s.db.Count(namespace)
+		}
+		if dbErr != nil {
+			switch dbErr.ErrorCode {
+			case database.NAMESPACE_NOT_FOUND:
+				respondWithError(w, http.StatusBadRequest, dbErr.Error())
+			default:
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			}
+			return
+		}
+		respondWithJSON(w, http.StatusOK, fmt.Sprintf(`{"count":%d}`, count))
+	}
+}
+
+// countMatching scans the namespace, only one document is parsed at a time and given to the filter hidden by the mask
+func (s *Server) countMatching(namespace string, code *gojq.Code, mask *fieldMask) (int64, *database.DbError) {
+	var count int64
+	var err error
+	dbErr := s.db.Scan(namespace, func(key string, value []byte) bool {
+		var jsonContent map[string]interface{}
+		err = json.Unmarshal(value, &jsonContent)
+		if err != nil {
+			return false
+		}
+		masked, _ := mask.hide(jsonContent)
+		iter := code.Run(masked, key)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				return true
+			}
+			if err, ok = v.(error); ok {
+				return false
+			}
+			if v != nil && v != false {
+				count++
+				return true
+			}
+		}
+	})
+	if dbErr != nil {
+		return 0, dbErr
+	}
+	if err != nil {
+		return 0, &database.DbError{
+			ErrorCode: database.INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return count, nil
+}
+
+// streamNamespace writes the documents of the range to the stream in ascending key order,
+// or the ones selected by the listing query in its order when there is one
+func (s *Server) streamNamespace(stream *jsonStream, namespace string, keyRange database.KeyRange, listing *database.Query) {
+	var err error
+	write := func(key string, value []byte) bool {
+		err = stream.writeDocument(key, value)
+		return err == nil
+	}
+	var dbErr *database.DbError
+	if listing != nil {
+		if stream.shape != nil {
+			listing.Fields = stream.shape.fields
+		}
+		dbErr = s.query(namespace, *listing, write)
+	} else {
+		dbErr = s.scanRange(namespace, keyRange, stream.shape, write)
+	}
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			stream.fail(http.StatusBadRequest, dbErr.Error())
+		default:
+			stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+	if err != nil {
+		stream.fail(streamErrorCode(err), err.Error())
+		return
+	}
+	stream.end()
+}
+
+// streamDocuments writes the documents found in the order of the keys, the missing ones are left out
+func (s *Server) streamDocuments(stream *jsonStream, namespace string, keys []string) {
+	unique := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	if len(unique) > maxMultiGetKeys {
+		stream.fail(http.StatusBadRequest, fmt.Sprintf("at most %d ids can be read at once", maxMultiGetKeys))
+		return
+	}
+
+	data, dbErr := s.db.GetMany(namespace, unique)
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			stream.fail(http.StatusBadRequest, dbErr.Error())
+		default:
+			stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+	for _, key := range unique {
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+		if err := stream.writeDocument(key, value); err != nil {
+			stream.fail(streamErrorCode(err), err.Error())
+			return
+		}
+	}
+	stream.end()
+}
+
 // both POST and PUT methods will create new item
-// POST will reject updating record while PUT will update record when existing
-func _onUpsert(s *Server, w http.ResponseWriter, method, userId, namespace, key string, data []byte) {
+// POST will reject updating record while PUT will update record when existing.
+// A generated key is sent back in the Location header and as the "id" field of the response.
+func _onUpsert(s *Server, w http.ResponseWriter, method, userId, namespace, key string, data []byte, generated bool) {
 	parsedData, err := s.validate(namespace, data)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
@@ -169,7 +437,9 @@ func _onUpsert(s *Server, w http.ResponseWriter, method, userId, namespace, key
 		allowOverWrite = true
 	}
 
-	dbErr := s.db.Upsert(namespace, key, data, allowOverWrite)
+	unlock := s.lockDocument(namespace, key)
+	defer unlock()
+	dbErr := s.upsert(userId, namespace, key, data, allowOverWrite)
 	if dbErr != nil {
 		switch dbErr.ErrorCode {
 		case database.NAMESPACE_NOT_FOUND:
@@ -177,7 +447,7 @@ func _onUpsert(s *Server, w http.ResponseWriter, method, userId, namespace, key
 		case database.ITEM_CONFLICT:
 			respondWithError(w, http.StatusConflict, dbErr.Error())
 		default:
-			respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
 		}
 		return
 	}
@@ -194,5 +464,129 @@ func _onUpsert(s *Server, w http.ResponseWriter, method, userId, namespace, key
 		Key:       key,
 		Value:     parsedData,
 	})
+	if generated {
+		document, err := withId(key, data)
+		if err == nil {
+			data, err = json.Marshal(document)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/dataset/%v/%v", namespace, key))
+	}
 	respondWithJSON(w, http.StatusCreated, string(data))
 }
+
+// _onPatch applies a merge patch or a json patch to the stored document, the result is validated like a PUT.
+// The writes of the same document are serialized, so that a patch isn't applied to a value another write is replacing.
+// This only holds within the process, the writes made by other instances sharing the storage are not waited for.
+func _onPatch(s *Server, w http.ResponseWriter, contentType, userId, namespace, key string, patch []byte) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != MERGE_PATCH_CONTENT_TYPE && mediaType != JSON_PATCH_CONTENT_TYPE {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("expected %v or %v", MERGE_PATCH_CONTENT_TYPE, JSON_PATCH_CONTENT_TYPE))
+		return
+	}
+	var parsedPatch interface{}
+	if err := json.Unmarshal(patch, &parsedPatch); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	unlock := s.lockDocument(namespace, key)
+	defer unlock()
+
+	stored, dbErr := s.db.Get(namespace, key)
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.ID_NOT_FOUND:
+			respondWithError(w, http.StatusNotFound, dbErr.Error())
+		case database.NAMESPACE_NOT_FOUND:
+			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+		default:
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+	// the patch applies to the data of the payload
+	stored, err := s.payloadData(stored)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var data []byte
+	if mediaType == MERGE_PATCH_CONTENT_TYPE {
+		data, err = jsonpatch.MergePatch(stored, patch)
+	} else {
+		var operations jsonpatch.Patch
+		operations, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			data, err = operations.Apply(stored)
+		}
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parsedData, err := s.validate(namespace, data)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.AuthEnabled {
+		payload := Payload{
+			User: userId,
+			Data: parsedData,
+		}
+		data, err = payload.wrap()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	dbErr = s.upsert(userId, namespace, key, data, true)
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+		case database.ITEM_CONFLICT:
+			respondWithError(w, http.StatusConflict, dbErr.Error())
+		default:
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+
+	s.Notify(BrokerEvent{
+		Event:     EVENT_ITEM_UPDATED,
+		User:      userId,
+		Namespace: namespace,
+		Key:       key,
+		Value:     parsedData,
+		Patch:     parsedPatch,
+	})
+	respondWithJSON(w, http.StatusOK, string(data))
+}
+
+// lockDocument serializes the writes of a document, the patches read the document under the lock
+func (s *Server) lockDocument(namespace string, key string) func() {
+	return stripeLock(s.documentLocks[:], namespace, key)
+}
+
+// stripeLock locks the stripe of the document and returns its unlock
+func stripeLock(stripes []sync.Mutex, namespace string, key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	stripe := &stripes[h.Sum32()%uint32(len(stripes))]
+	stripe.Lock()
+	return stripe.Unlock
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/itchyny/gojq"
+)
+
+// liveBufferSize is the number of events queued for a live query, a subscriber falling behind is closed
+const liveBufferSize = 256
+
+// liveSubscription receives the events of a namespace for a live query
+type liveSubscription struct {
+	namespace string
+	events    chan BrokerEvent
+	overflow  chan struct{} // closed when an event couldn't be queued
+	once      sync.Once
+}
+
+// liveRegistry holds the live queries, the zero value is ready to use
+type liveRegistry struct {
+	mu            sync.RWMutex
+	subscriptions map[*liveSubscription]struct{}
+}
+
+func (r *liveRegistry) subscribe(namespace string) *liveSubscription {
+	sub := &liveSubscription{
+		namespace: namespace,
+		events:    make(chan BrokerEvent, liveBufferSize),
+		overflow:  make(chan struct{}),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscriptions == nil {
+		r.subscriptions = make(map[*liveSubscription]struct{})
+	}
+	r.subscriptions[sub] = struct{}{}
+	return sub
+}
+
+func (r *liveRegistry) unsubscribe(sub *liveSubscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subscriptions, sub)
+}
+
+// publish queues the event for the live queries of its namespace without waiting for them
+func (r *liveRegistry) publish(event BrokerEvent) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for sub := range r.subscriptions {
+		if sub.namespace != event.Namespace {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.once.Do(func() { close(sub.overflow) })
+		}
+	}
+}
+
+// liveQueryHandler streams the results of a jq filter over a namespace as server sent events: a "results" event with
+// the current {"key", "value"} of the documents, then "added", "changed" and "removed" events as the writes change them.
+// Like the views, a document gives the first output of the filter, the ones without output are left out.
+// The events of a document are published under its lock (see lockDocument), in the order of its writes; this only
+// holds for the writes made through this process, and not between the events of a document and of its namespace.
+// On a cluster, every node publishes the events of all the writes in the order of the raft log.
+func (s *Server) liveQueryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	namespace := mux.Vars(r)["namespace"]
+	query := r.URL.Query()
+	filter, err := s.filters.get(query.Get("filter"), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = s.checkEncryptedFields(namespace, filter.query); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shape, err := s.newResponseShape(query, nil) // the filter runs masked, see runFilter
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// subscribed before reading the namespace, the writes made meanwhile are applied on top of it
+	sub := s.live.subscribe(namespace)
+	defer s.live.unsubscribe(sub)
+
+	current := make(map[string]string) // key -> json of the result
+	results := make([]interface{}, 0)
+	if slices.Contains(s.db.GetNamespaces(), namespace) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.searchTimeout())
+		defer cancel()
+		var marshalErr error
+		// the events carry the data of the documents, not the Payload they are stored in
+		dbErr, err := s.searchDocuments(ctx, namespace, filter, nil, shape, 1, s.AuthEnabled, func(key string, value interface{}) bool {
+			var content []byte
+			content, marshalErr = json.Marshal(value)
+			current[key] = string(content)
+			results = append(results, map[string]interface{}{"key": key, "value": value})
+			return marshalErr == nil
+		})
+		if dbErr != nil {
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			return
+		}
+		if err == nil {
+			err = marshalErr
+		}
+		if err != nil {
+			respondWithError(w, searchErrorCode(ctx, err), err.Error())
+			return
+		}
+	}
+
+	// the stream outlives the write timeout of the server
+	responseController(w, r).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if writeServerEvent(w, "results", map[string]interface{}{"results": results}) != nil {
+		return
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.overflow:
+			writeServerEvent(w, "error", map[string]interface{}{"error": "the live query fell behind the writes, subscribe again"})
+			return
+		case <-ticker.C:
+			// a comment as a heartbeat, clients ignore it
+			fmt.Fprintf(w, ":heartbeat\n\n")
+			w.(http.Flusher).Flush()
+		case event := <-sub.events:
+			if s.applyLiveEvent(w, r.Context(), filter, shape, current, event) != nil {
+				return
+			}
+		}
+	}
+}
+
+// applyLiveEvent sends the changes of the results made by the event
+func (s *Server) applyLiveEvent(w http.ResponseWriter, ctx context.Context, filter *compiledFilter, shape *responseShape, current map[string]string, event BrokerEvent) error {
+	remove := func(key string) error {
+		if _, ok := current[key]; !ok {
+			return nil
+		}
+		delete(current, key)
+		return writeServerEvent(w, "removed", map[string]interface{}{"key": key})
+	}
+
+	switch event.Event {
+	case EVENT_ITEM_CREATED, EVENT_ITEM_UPDATED:
+		data, err := json.Marshal(event.Value)
+		var outputs []interface{}
+		if err == nil {
+			var code *gojq.Code
+			var mask *fieldMask
+			code, mask, err = s.filterFor(event.Namespace, filter)
+			if err == nil {
+				runCtx, cancel := context.WithTimeout(ctx, s.searchTimeout())
+				outputs, err = runFilter(runCtx, code, mask, event.Key, data, nil, shape, 1)
+				cancel()
+			}
+		}
+		if err != nil {
+			return writeServerEvent(w, "error", map[string]interface{}{"key": event.Key, "error": err.Error()})
+		}
+		if len(outputs) == 0 {
+			return remove(event.Key)
+		}
+		content, err := json.Marshal(outputs[0])
+		if err != nil {
+			return writeServerEvent(w, "error", map[string]interface{}{"key": event.Key, "error": err.Error()})
+		}
+		previous, ok := current[event.Key]
+		if ok && previous == string(content) {
+			return nil
+		}
+		current[event.Key] = string(content)
+		kind := "added"
+		if ok {
+			kind = "changed"
+		}
+		return writeServerEvent(w, kind, map[string]interface{}{"key": event.Key, "value": outputs[0]})
+	case EVENT_ITEM_DELETED, EVENT_ITEM_EVICTED:
+		return remove(event.Key)
+	case EVENT_NAMESPACE_DELETED:
+		keys := make([]string, 0, len(current))
+		for key := range current {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			delete(current, key)
+			if err := writeServerEvent(w, "removed", map[string]interface{}{"key": key}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeServerEvent writes and flushes a server sent event with its json data
+func writeServerEvent(w http.ResponseWriter, event string, data interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, content); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
@@ -30,9 +30,9 @@ func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodPost:
-		dbErr := s.db.CreateNameSpace(namespace)
+		dbErr := s.createNameSpace(userId, namespace)
 		if dbErr != nil {
-			respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
 		}
 		s.Notify(BrokerEvent{
 			Event:     EVENT_NAMESPACE_CREATED,
@@ -43,29 +43,18 @@ func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		respondWithJSON(w, http.StatusCreated, "{}")
 	case http.MethodGet:
-		data, dbErr := s.db.GetAll(namespace)
-		if dbErr != nil {
-			switch dbErr.ErrorCode {
-			case database.NAMESPACE_NOT_FOUND:
-				respondWithError(w, http.StatusBadRequest, dbErr.Error())
-			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
-			}
-		}
-		namespaceData, err := jsonWrapper(data)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		s.streamNamespace(newJsonStream(w, r, FORMAT_KEY_VALUE), namespace, database.KeyRange{}, nil)
+	case http.MethodDelete:
+		if s.rejectViewWrite(w, namespace) {
 			return
 		}
-		respondWithJSON(w, http.StatusOK, string(namespaceData))
-	case http.MethodDelete:
-		dbErr := s.db.DropNameSpace(namespace)
+		dbErr := s.dropNameSpace(userId, namespace)
 		if dbErr != nil {
 			switch dbErr.ErrorCode {
 			case database.NAMESPACE_NOT_FOUND:
 				respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
 			}
 		}
 		s.Notify(BrokerEvent{
@@ -9,6 +9,8 @@ import (
 )
 
 func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get(USER_HEADER)
+
 	vars := mux.Vars(r)
 	namespace := vars["namespace"] + SchemaId
 
@@ -22,7 +24,7 @@ func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		dbErr := s.db.Upsert(namespace, SchemaId, data, true)
+		dbErr := s.upsert(userId, namespace, SchemaId, data, true)
 		if dbErr != nil {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
@@ -37,7 +39,7 @@ func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		respondWithJSON(w, http.StatusOK, string(data))
 	case http.MethodDelete:
-		dbErr := s.db.Delete(namespace, SchemaId)
+		dbErr := s.delete(userId, namespace, SchemaId)
 		if dbErr != nil {
 			respondWithError(w, http.StatusNotFound, dbErr.Error())
 			return
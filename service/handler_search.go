@@ -1,14 +1,46 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/itchyny/gojq"
+	"github.com/xdung24/unirest/database"
 )
 
+// searchMaxOutputs is the number of outputs of the filter for a single document, they are kept until the
+// results of the documents before it are written
+const searchMaxOutputs = 100000
+
+// namespaceNamePattern matches the names of the namespaces of the api, see NamespacePattern
+var namespaceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9\-]+$`)
+
+// variableNamePattern matches the names of the variables of a search, with or without their $
+var variableNamePattern = regexp.MustCompile(`^\$?[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// searchRequest is the body of POST /search/{namespace}. Variables are bound to $name in the filter,
+// Timeout is a duration like "500ms" which can only shorten SearchTimeout, Limit caps the number of results.
+type searchRequest struct {
+	Filter    string                 `json:"filter"`
+	Variables map[string]interface{} `json:"variables"`
+	Limit     int                    `json:"limit"`
+	Timeout   string                 `json:"timeout"`
+	Slurp     bool                   `json:"slurp"`
+}
+
 func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "*")
@@ -16,6 +48,507 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vars := mux.Vars(r)
+	switch r.Method {
+	case http.MethodGet:
+		s.search(w, r, vars["namespace"], searchRequest{Filter: vars["filter"], Slurp: r.URL.Query().Get("slurp") == "true"})
+	case http.MethodPost:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		var request searchRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid search: %v", err))
+			return
+		}
+		if request.Filter == "" {
+			respondWithError(w, http.StatusBadRequest, "missing filter")
+			return
+		}
+		s.search(w, r, vars["namespace"], request)
+	}
+}
+
+// search writes the results of the request, the fields and transform parameters of the url shape them
+func (s *Server) search(w http.ResponseWriter, r *http.Request, namespace string, request searchRequest) {
+	names := make([]string, 0, len(request.Variables))
+	for name := range request.Variables {
+		if !variableNamePattern.MatchString(name) || "$"+strings.TrimPrefix(name, "$") == KEY_VARIABLE {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid variable name '%v'", name))
+			return
+		}
+		names = append(names, "$"+strings.TrimPrefix(name, "$"))
+	}
+	sort.Strings(names)
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		value, ok := request.Variables[name]
+		if !ok {
+			value = request.Variables[strings.TrimPrefix(name, "$")]
+		}
+		values[i] = value
+	}
+	if request.Limit < 0 {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %d", request.Limit))
+		return
+	}
+	timeout := s.searchTimeout()
+	if request.Timeout != "" {
+		requested, err := time.ParseDuration(request.Timeout)
+		if err != nil || requested <= 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid timeout '%v'", request.Timeout))
+			return
+		}
+		timeout = min(timeout, requested)
+	}
+
+	filter, err := s.filters.get(request.Filter, names)
+	if err == nil {
+		err = s.checkEncryptedFields(namespace, filter.query)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shape, err := s.newResponseShape(r.URL.Query(), nil) // the filter runs masked, see runFilter
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if request.Slurp {
+		s.slurpSearch(ctx, w, namespace, filter, values, shape, request.Limit)
+		return
+	}
+
+	// results are written in key order as the workers produce them
+	stream := newJsonStream(w, r, FORMAT_RESULTS)
+	count := 0
+	var writeErr error
+	dbErr, err := s.searchDocuments(ctx, namespace, filter, values, shape, request.Limit, false, func(key string, v interface{}) bool {
+		writeErr = stream.write(map[string]interface{}{"key": key, "value": v})
+		count++
+		return writeErr == nil && (request.Limit == 0 || count < request.Limit)
+	})
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			stream.fail(http.StatusBadRequest, dbErr.Error())
+		default:
+			stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		stream.fail(searchErrorCode(ctx, err), err.Error())
+		return
+	}
+	stream.end()
+}
+
+// searchNamespacesHandler runs a jq filter over several namespaces, GET /search?namespaces=a,b&filter=... (or namespaces=*).
+// The namespaces are searched in name order and each result is {"namespace", "key", "value"}, limit and offset page
+// through all of them. A filter reading the encrypted fields of a namespace is rejected when the namespace is named,
+// the namespace is left out of a * search and listed in the "skipped" field of the response.
+func (s *Server) searchNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := s.filters.get(query.Get("filter"), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	namespaces, skipped, err := s.searchedNamespaces(query.Get("namespaces"), filter.query)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page := map[string]int{"limit": 0, "offset": 0}
+	for param := range page {
+		if !query.Has(param) {
+			continue
+		}
+		count, err := strconv.Atoi(query.Get(param))
+		if err != nil || count < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid %v '%v'", param, query.Get(param)))
+			return
+		}
+		page[param] = count
+	}
+	limit, offset := page["limit"], page["offset"]
+	shape, err := s.newResponseShape(query, nil) // the filter runs masked, see runFilter
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.searchTimeout())
+	defer cancel()
+
+	// a single document gives at most the outputs of the page
+	documentLimit := 0
+	if limit > 0 {
+		documentLimit = offset + limit
+	}
+	stream := newJsonStream(w, r, FORMAT_RESULTS)
+	if len(skipped) > 0 {
+		content, _ := json.Marshal(skipped)
+		stream.close = `],"skipped":` + string(content) + "}"
+	}
+	passed, count := 0, 0
+	var writeErr error
+	for _, namespace := range namespaces {
+		dbErr, err := s.searchDocuments(ctx, namespace, filter, nil, shape, documentLimit, false, func(key string, v interface{}) bool {
+			if passed < offset {
+				passed++
+				return true
+			}
+			writeErr = stream.write(map[string]interface{}{"namespace": namespace, "key": key, "value": v})
+			count++
+			return writeErr == nil && (limit == 0 || count < limit)
+		})
+		if dbErr != nil {
+			switch dbErr.ErrorCode {
+			case database.NAMESPACE_NOT_FOUND:
+				stream.fail(http.StatusBadRequest, dbErr.Error())
+			default:
+				stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+			}
+			return
+		}
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			stream.fail(searchErrorCode(ctx, err), err.Error())
+			return
+		}
+		if limit > 0 && count == limit {
+			break
+		}
+	}
+	stream.end()
+}
+
+// searchedNamespaces lists the namespaces of a search, sorted: the comma separated names or all of them for *,
+// but the ones whose encrypted fields the filter reads, returned as skipped
+func (s *Server) searchedNamespaces(names string, query *gojq.Query) ([]string, []string, error) {
+	existing := make(map[string]bool)
+	for _, namespace := range s.db.GetNamespaces() {
+		if !strings.HasSuffix(namespace, SchemaId) && !strings.HasSuffix(namespace, ViewId) {
+			existing[namespace] = true
+		}
+	}
+
+	var namespaces []string
+	if strings.TrimSpace(names) == "*" {
+		var skipped []string
+		for namespace := range existing {
+			if s.checkEncryptedFields(namespace, query) == nil {
+				namespaces = append(namespaces, namespace)
+			} else {
+				skipped = append(skipped, namespace)
+			}
+		}
+		sort.Strings(namespaces)
+		sort.Strings(skipped)
+		return namespaces, skipped, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, namespace := range strings.Split(names, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if !namespaceNamePattern.MatchString(namespace) {
+			return nil, nil, fmt.Errorf("invalid namespace '%v'", namespace)
+		}
+		if !existing[namespace] {
+			return nil, nil, fmt.Errorf("namespace '%v' not found", namespace)
+		}
+		if err := s.checkEncryptedFields(namespace, query); err != nil {
+			return nil, nil, fmt.Errorf("namespace '%v': %v", namespace, err)
+		}
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil, nil
+}
+
+// searchJob is a document read for the workers, seq is its rank in the scan
+type searchJob struct {
+	seq   int
+	key   string
+	value []byte
+}
+
+type searchResult struct {
+	seq     int
+	key     string
+	outputs []interface{}
+	err     error
+}
+
+// searchDocuments runs the filter over each document of the namespace on a pool of workers, one per cpu.
+// The outputs are handed to fn in the order of the scan, then of the filter, at most limit of them per document
+// (0 for no limit). It stops at the first error, when fn returns false or once ctx is done: the evaluation of
+// a filter is interrupted then, and the error of ctx returned. The encrypted fields are hidden from the filter.
+// With unwrap, the filter is given the data of the documents stored in a Payload, see payloadData.
+func (s *Server) searchDocuments(ctx context.Context, namespace string, filter *compiledFilter, values []interface{}, shape *responseShape, limit int, unwrap bool, fn func(key string, v interface{}) bool) (*database.DbError, error) {
+	code, mask, err := s.filterFor(namespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := runtime.GOMAXPROCS(0)
+	// documents scanned but not handed to fn yet, a slow document holds back at most this many results
+	window := make(chan struct{}, 4*workers)
+	jobs := make(chan searchJob)
+	results := make(chan searchResult, workers)
+
+	var dbErr *database.DbError
+	go func() {
+		defer close(jobs)
+		seq := 0
+		dbErr = s.db.Scan(namespace, func(key string, value []byte) bool {
+			select {
+			case window <- struct{}{}:
+			case <-runCtx.Done():
+				return false
+			}
+			select {
+			case jobs <- searchJob{seq: seq, key: key, value: value}:
+				seq++
+				return true
+			case <-runCtx.Done():
+				return false
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the jobs are drained until the scan is over, so that dbErr is set once results is closed
+			for job := range jobs {
+				if runCtx.Err() != nil {
+					continue
+				}
+				value, err := job.value, error(nil)
+				if unwrap {
+					value, err = s.payloadData(value)
+				}
+				var outputs []interface{}
+				if err == nil {
+					outputs, err = runFilter(runCtx, code, mask, job.key, value, values, shape, limit)
+				}
+				select {
+				case results <- searchResult{seq: job.seq, key: job.key, outputs: outputs, err: err}:
+				case <-runCtx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]searchResult)
+	next := 0
+	for result := range results {
+		if runCtx.Err() != nil {
+			continue
+		}
+		pending[result.seq] = result
+		for runCtx.Err() == nil {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+			if ready.err != nil {
+				err = ready.err
+				cancel()
+				break
+			}
+			for _, output := range ready.outputs {
+				if !fn(ready.key, output) {
+					cancel()
+					break
+				}
+			}
+		}
+	}
+	if dbErr != nil {
+		return dbErr, nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return nil, err
+}
+
+// runFilter returns the first limit outputs of the filter for a document (all of them for 0), shaped.
+// The filter and the transform of the shape run on the document hidden by the mask, see fieldMask.
+func runFilter(ctx context.Context, code *gojq.Code, mask *fieldMask, key string, value []byte, values []interface{}, shape *responseShape, limit int) ([]interface{}, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(value, &document); err != nil {
+		return nil, err
+	}
+	masked, hidden := mask.hide(document)
+	var outputs []interface{}
+	iter := code.RunWithContext(ctx, masked, append([]interface{}{key}, values...)...)
+	for limit == 0 || len(outputs) < limit {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		v, ok, err := shape.run(ctx, shape.project(v))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if len(outputs) == searchMaxOutputs {
+				return nil, transformError{fmt.Errorf("the filter outputs more than %d values for the document '%v'", searchMaxOutputs, key)}
+			}
+			outputs = append(outputs, mask.reveal(v, hidden))
+		}
+	}
+	return outputs, nil
+}
+
+func (s *Server) searchTimeout() time.Duration {
+	if s.SearchTimeout > 0 {
+		return s.SearchTimeout
+	}
+	return DEFAULT_SEARCH_TIMEOUT
+}
+
+func (s *Server) slurpMaxBytes() int64 {
+	if s.SlurpMaxBytes > 0 {
+		return s.SlurpMaxBytes
+	}
+	return DEFAULT_SLURP_MAX_BYTES
+}
+
+// searchErrorCode is the status of an error raised while searching, see streamErrorCode
+func searchErrorCode(ctx context.Context, err error) int {
+	if ctx.Err() != nil {
+		return http.StatusRequestTimeout
+	}
+	return streamErrorCode(err)
+}
+
+// slurpSearch runs the filter once over the whole namespace, given as an array of {"key", "value"} in key order,
+// $__key is null.
+// The namespace is loaded in memory, up to SlurpMaxBytes of stored documents, with the encrypted fields hidden.
+func (s *Server) slurpSearch(ctx context.Context, w http.ResponseWriter, namespace string, filter *compiledFilter, values []interface{}, shape *responseShape, limit int) {
+	code, mask, err := s.filterFor(namespace, filter)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hidden := make(map[string]interface{})
+	var size int64
+	tooLarge := false
+	documents := make([]interface{}, 0)
+	dbErr := s.db.Scan(namespace, func(key string, value []byte) bool {
+		size += int64(len(key) + len(value))
+		if size > s.slurpMaxBytes() {
+			tooLarge = true
+			return false
+		}
+		var jsonContent interface{}
+		err = json.Unmarshal(value, &jsonContent)
+		if err != nil {
+			return false
+		}
+		masked, values := mask.hide(jsonContent)
+		for token, value := range values {
+			hidden[token] = value
+		}
+		documents = append(documents, map[string]interface{}{"key": key, "value": masked})
+		return ctx.Err() == nil
+	})
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NAMESPACE_NOT_FOUND:
+			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+		default:
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+	if tooLarge {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("namespace '%v' is larger than the %d bytes a slurp search can read", namespace, s.slurpMaxBytes()))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if ctx.Err() != nil {
+		respondWithError(w, http.StatusRequestTimeout, ctx.Err().Error())
+		return
+	}
+
+	results := make([]interface{}, 0)
+	iter := code.RunWithContext(ctx, documents, append([]interface{}{nil}, values...)...)
+	for limit == 0 || len(results) < limit {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok = v.(error); !ok {
+			v, ok, err = shape.run(ctx, shape.project(v))
+		}
+		if err != nil {
+			respondWithError(w, searchErrorCode(ctx, err), err.Error())
+			return
+		}
+		if ok {
+			results = append(results, mask.reveal(v, hidden))
+		}
+	}
+	if ctx.Err() != nil {
+		respondWithError(w, http.StatusRequestTimeout, ctx.Err().Error())
+		return
+	}
+	content, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, string(content))
+}
+
+func (s *Server) fullTextSearchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
 	result := struct {
 		Results []interface{} `json:"results"`
 	}{
@@ -25,40 +558,291 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		vars := mux.Vars(r)
-		query, err := gojq.Parse(vars["filter"])
+		searcher, ok := capability[FullTextSearcher](s.db)
+		if !ok {
+			respondWithError(w, http.StatusNotImplemented, "full text search is not supported by the database")
+			return
+		}
+		shape, err := s.newResponseShape(r.URL.Query(), s.fieldMask(vars["namespace"]))
 		if err != nil {
-			log.Println("error on parsing", err)
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		data, dbErr := s.db.GetAll(vars["namespace"])
+		docs, dbErr := searcher.FullTextSearch(vars["namespace"], vars["q"])
 		if dbErr != nil {
-			log.Println("error on GetAll", err)
-			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+			switch dbErr.ErrorCode {
+			case database.NOT_SUPPORTED:
+				respondWithError(w, http.StatusNotImplemented, dbErr.Error())
+			case database.NAMESPACE_NOT_FOUND, database.INVALID_QUERY:
+				respondWithError(w, http.StatusBadRequest, dbErr.Error())
+			default:
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			}
 			return
 		}
-		for key, value := range data {
-			var jsonContent map[string]interface{}
-			err := json.Unmarshal(value, &jsonContent)
+		for _, doc := range docs {
+			var jsonContent interface{}
+			err := json.Unmarshal(doc.Value, &jsonContent)
 			if err != nil {
 				respondWithError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
-			iter := query.Run(jsonContent)
-			for {
-				v, ok := iter.Next()
-				if !ok {
-					break
-				}
-				if err, ok := v.(error); ok {
-					log.Println("error on query", err)
-					respondWithError(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-				result.Results = append(result.Results, map[string]interface{}{"key": key, "value": v})
+			jsonContent, ok, err = shape.shape(jsonContent)
+			if err != nil {
+				respondWithError(w, streamErrorCode(err), err.Error())
+				return
+			}
+			if !ok {
+				continue
 			}
+			result.Results = append(result.Results, map[string]interface{}{"key": doc.Key, "value": jsonContent})
 		}
 		jsonResponse, _ := json.Marshal(result)
 		respondWithJSON(w, http.StatusOK, string(jsonResponse))
 	}
 }
+
+// newGeoQuery reads the near=lat,lng, radius (meters, or a number followed by m or km) and bbox=minLng,minLat,maxLng,maxLat
+// parameters of a geo search, bbox being in the order of GeoJSON
+func newGeoQuery(query url.Values) (database.GeoQuery, error) {
+	var q database.GeoQuery
+	if query.Has("near") {
+		coordinates, err := parseCoordinates(query.Get("near"), 2)
+		if err != nil || coordinates[0] < -90 || coordinates[0] > 90 || coordinates[1] < -180 || coordinates[1] > 180 {
+			return q, fmt.Errorf("invalid near '%v', expected lat,lng", query.Get("near"))
+		}
+		q.Near = &database.GeoPoint{Lat: coordinates[0], Lng: coordinates[1]}
+	}
+	if query.Has("radius") {
+		radius := query.Get("radius")
+		unit := 1.0
+		if strings.HasSuffix(radius, "km") {
+			radius, unit = strings.TrimSuffix(radius, "km"), 1000
+		} else {
+			radius = strings.TrimSuffix(radius, "m")
+		}
+		meters, err := strconv.ParseFloat(radius, 64)
+		if err != nil || meters <= 0 || math.IsInf(meters, 0) || q.Near == nil {
+			return q, fmt.Errorf("invalid radius '%v', expected a distance like 500m or 2km after near", query.Get("radius"))
+		}
+		q.Radius = meters * unit
+	}
+	if query.Has("bbox") {
+		coordinates, err := parseCoordinates(query.Get("bbox"), 4)
+		if err != nil || coordinates[0] < -180 || coordinates[2] > 180 || coordinates[1] < -90 || coordinates[3] > 90 ||
+			coordinates[0] > coordinates[2] || coordinates[1] > coordinates[3] {
+			return q, fmt.Errorf("invalid bbox '%v', expected minLng,minLat,maxLng,maxLat", query.Get("bbox"))
+		}
+		q.Box = &database.GeoBox{MinLng: coordinates[0], MinLat: coordinates[1], MaxLng: coordinates[2], MaxLat: coordinates[3]}
+	}
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 0 {
+			return q, fmt.Errorf("invalid limit '%v'", query.Get("limit"))
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+func parseCoordinates(value string, count int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != count {
+		return nil, fmt.Errorf("expected %d numbers", count)
+	}
+	ret := make([]float64, count)
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(number) {
+			return nil, fmt.Errorf("invalid number '%v'", part)
+		}
+		ret[i] = number
+	}
+	return ret, nil
+}
+
+// geoSearchHandler answers GET /search/{namespace}?near=...&radius=... or ?bbox=..., nearest first.
+// Each result holds the distance in meters to near, or to the center of the box without near.
+func (s *Server) geoSearchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	searcher, ok := capability[GeoSearcher](s.db)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "geo search is not supported by the database")
+		return
+	}
+	q, err := newGeoQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shape, err := s.newResponseShape(r.URL.Query(), s.fieldMask(mux.Vars(r)["namespace"]))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	docs, dbErr := searcher.GeoSearch(mux.Vars(r)["namespace"], q)
+	if dbErr != nil {
+		switch dbErr.ErrorCode {
+		case database.NOT_SUPPORTED:
+			respondWithError(w, http.StatusNotImplemented, dbErr.Error())
+		case database.NAMESPACE_NOT_FOUND, database.INVALID_QUERY:
+			respondWithError(w, http.StatusBadRequest, dbErr.Error())
+		default:
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+		}
+		return
+	}
+
+	results := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		var jsonContent interface{}
+		err := json.Unmarshal(doc.Value, &jsonContent)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonContent, ok, err = shape.shape(jsonContent)
+		if err != nil {
+			respondWithError(w, streamErrorCode(err), err.Error())
+			return
+		}
+		if ok {
+			results = append(results, map[string]interface{}{"key": doc.Key, "value": jsonContent, "distance": doc.Distance})
+		}
+	}
+	jsonResponse, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, string(jsonResponse))
+}
+
+// checkEncryptedFields rejects the filters reading encrypted fields, but the comparisons of the deterministic ones
+// with literals (== or !=), to report them clearly: the documents are given to the filters with these fields hidden
+// anyway, see fieldMask. Fields are matched by the last segment of their pointer.
+func (s *Server) checkEncryptedFields(namespace string, query *gojq.Query) error {
+	db, ok := anyCapability[FieldEncryptor](s.db)
+	if !ok {
+		return nil
+	}
+	fields := db.EncryptedFields(namespace)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	refs := make(map[string]int)
+	equalities := make(map[string]int)
+	collectFieldRefs(query, refs, equalities)
+	for _, field := range fields {
+		tokens := pointerTokens(field.Pointer)
+		name := tokens[len(tokens)-1]
+		if refs[name] == 0 {
+			continue
+		}
+		if !field.Deterministic {
+			return fmt.Errorf("field %v is encrypted and can't be searched", field.Pointer)
+		}
+		if refs[name] > equalities[name] {
+			return fmt.Errorf("field %v is encrypted, it can only be compared with a literal with == or !=", field.Pointer)
+		}
+	}
+	return nil
+}
+
+// collectFieldRefs counts the fields read by the query, and how many times they are compared with a literal
+// with == or !=
+func collectFieldRefs(query *gojq.Query, refs map[string]int, equalities map[string]int) {
+	walkQuery(reflect.ValueOf(query), func(v interface{}) {
+		switch node := v.(type) {
+		case *gojq.Query:
+			if node.Op == gojq.OpEq || node.Op == gojq.OpNe {
+				for _, sides := range [][2]*gojq.Query{{node.Left, node.Right}, {node.Right, node.Left}} {
+					if name, ok := pathFieldName(sides[0]); ok {
+						if _, ok = literalValue(sides[1]); ok {
+							equalities[name]++
+						}
+					}
+				}
+			}
+		case *gojq.Index:
+			if name, ok := indexFieldName(node); ok {
+				refs[name]++
+			}
+		}
+	})
+}
+
+// walkQuery calls fn on each node of the parsed query, before its children
+func walkQuery(v reflect.Value, fn func(node interface{})) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		fn(v.Interface())
+		walkQuery(v.Elem(), fn)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanInterface() {
+				walkQuery(v.Field(i), fn)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkQuery(v.Index(i), fn)
+		}
+	}
+}
+
+// pathFieldName returns the last field of a plain path like .a.b
+func pathFieldName(query *gojq.Query) (string, bool) {
+	path, ok := pathFields(query)
+	if !ok {
+		return "", false
+	}
+	return path[len(path)-1], true
+}
+
+// pathFields returns the fields of a plain path like .a.b
+func pathFields(query *gojq.Query) ([]string, bool) {
+	if query == nil || query.Term == nil || query.Left != nil || query.Term.Type != gojq.TermTypeIndex {
+		return nil, false
+	}
+	var path []string
+	indexes := []*gojq.Index{query.Term.Index}
+	for _, suffix := range query.Term.SuffixList {
+		if suffix.Index == nil || suffix.Iter || suffix.Bind != nil {
+			return nil, false
+		}
+		indexes = append(indexes, suffix.Index)
+	}
+	for _, index := range indexes {
+		name, ok := indexFieldName(index)
+		if !ok {
+			return nil, false
+		}
+		path = append(path, name)
+	}
+	return path, true
+}
+
+func indexFieldName(index *gojq.Index) (string, bool) {
+	switch {
+	case index == nil:
+		return "", false
+	case index.Name != "":
+		return index.Name, true
+	case index.Str != nil && len(index.Str.Queries) == 0:
+		return index.Str.Str, true
+	case index.Start != nil && index.End == nil && !index.IsSlice && index.Start.Term != nil &&
+		index.Start.Term.Type == gojq.TermTypeString && len(index.Start.Term.Str.Queries) == 0:
+		return index.Start.Term.Str.Str, true
+	}
+	return "", false
+}
@@ -0,0 +1,456 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/xdung24/unirest/database"
+)
+
+// viewDefinition is the body of PUT /views/{name}, stored in the namespace {name}_view like the schemas.
+// Each document of the namespace is mapped to the first output of the filter, the documents without output
+// are left out. Materialize names the namespace the results are kept in, updated by the writes of the api.
+type viewDefinition struct {
+	Namespace   string `json:"namespace"`
+	Filter      string `json:"filter"`
+	Materialize string `json:"materialize,omitempty"`
+}
+
+type view struct {
+	name       string
+	definition viewDefinition
+	filter     *compiledFilter
+}
+
+// viewRegistry holds the views by name, the zero value is ready to use
+type viewRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*view
+}
+
+func (r *viewRegistry) get(name string) (*view, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.byName[name]
+	return v, ok
+}
+
+func (r *viewRegistry) put(v *view) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byName == nil {
+		r.byName = make(map[string]*view)
+	}
+	r.byName[v.name] = v
+}
+
+func (r *viewRegistry) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byName, name)
+}
+
+// list returns the views sorted by name
+func (r *viewRegistry) list() []*view {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]*view, 0, len(r.byName))
+	for _, v := range r.byName {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// materialized returns the materialized views of the source namespace
+func (r *viewRegistry) materialized(namespace string) []*view {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ret []*view
+	for _, v := range r.byName {
+		if v.definition.Namespace == namespace && v.definition.Materialize != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// materializedIn returns the view whose results are kept in the namespace
+func (r *viewRegistry) materializedIn(namespace string) (*view, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.byName {
+		if v.definition.Materialize == namespace {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// rejectViewWrite answers a write of the namespace of a materialized view with a conflict, its documents are
+// written by the view only
+func (s *Server) rejectViewWrite(w http.ResponseWriter, namespace string) bool {
+	v, ok := s.views.materializedIn(namespace)
+	if ok {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("namespace '%v' holds the results of the view '%v', it can't be written", namespace, v.name))
+	}
+	return ok
+}
+
+// newView checks and compiles the definition of a view
+func (s *Server) newView(name string, definition viewDefinition) (*view, error) {
+	if !namespaceNamePattern.MatchString(definition.Namespace) {
+		return nil, fmt.Errorf("invalid namespace '%v'", definition.Namespace)
+	}
+	if definition.Filter == "" {
+		return nil, fmt.Errorf("missing filter")
+	}
+	filter, err := s.filters.get(definition.Filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkEncryptedFields(definition.Namespace, filter.query); err != nil {
+		return nil, err
+	}
+	if definition.Materialize != "" {
+		// the copy would hold the decrypted fields
+		if db, ok := anyCapability[FieldEncryptor](s.db); ok && len(db.EncryptedFields(definition.Namespace)) > 0 {
+			return nil, fmt.Errorf("namespace '%v' has encrypted fields, its views can't be materialized", definition.Namespace)
+		}
+		if !namespaceNamePattern.MatchString(definition.Materialize) || definition.Materialize == definition.Namespace {
+			return nil, fmt.Errorf("invalid materialize '%v', expected a namespace other than the source", definition.Materialize)
+		}
+		for _, other := range s.views.list() {
+			if other.name == name || other.definition.Materialize == "" {
+				continue
+			}
+			// the views are refreshed by the writes of the api only, not by the ones of another view
+			if other.definition.Materialize == definition.Namespace {
+				return nil, fmt.Errorf("namespace '%v' is materialized by the view '%v', it can't be the source of another materialized view", definition.Namespace, other.name)
+			}
+			if other.definition.Materialize == definition.Materialize || other.definition.Namespace == definition.Materialize {
+				return nil, fmt.Errorf("namespace '%v' is already used by the view '%v'", definition.Materialize, other.name)
+			}
+		}
+	}
+	return &view{name: name, definition: definition, filter: filter}, nil
+}
+
+// loadViews registers the views stored in the database, the materialized ones are filled again as the writes made
+// while the server was down didn't refresh them
+func (s *Server) loadViews() {
+	for _, namespace := range s.db.GetNamespaces() {
+		if !strings.HasSuffix(namespace, ViewId) {
+			continue
+		}
+		name := strings.TrimSuffix(namespace, ViewId)
+		data, dbErr := s.db.Get(namespace, ViewId)
+		if dbErr != nil {
+			continue
+		}
+		var definition viewDefinition
+		err := json.Unmarshal(data, &definition)
+		var v *view
+		if err == nil {
+			v, err = s.newView(name, definition)
+		}
+		if err != nil {
+			log.Printf("error loading view '%v': %v\n", name, err)
+			continue
+		}
+		s.views.put(v)
+		if v.definition.Materialize != "" {
+			if dbErr := s.materialize(v); dbErr != nil {
+				log.Printf("error materializing view '%v': %v\n", name, dbErr)
+			}
+		}
+	}
+}
+
+// refreshViews updates the materialized views of the namespace after a write of the document
+func (s *Server) refreshViews(namespace string, key string) {
+	for _, v := range s.views.materialized(namespace) {
+		s.refreshView(v, key)
+	}
+}
+
+// clearViews empties the materialized views of the namespace after it was emptied or dropped
+func (s *Server) clearViews(namespace string) {
+	for _, v := range s.views.materialized(namespace) {
+		if dbErr := s.db.DeleteAll(v.definition.Materialize); dbErr != nil && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+			log.Printf("error clearing view '%v': %v\n", v.name, dbErr)
+		}
+	}
+}
+
+// refreshView writes the result of the view for the document, read again so that concurrent writes
+// leave the result of the last one
+func (s *Server) refreshView(v *view, key string) {
+	backing := v.definition.Materialize
+	unlock := stripeLock(s.viewLocks[:], backing, key)
+	defer unlock()
+
+	var output interface{}
+	found := false
+	value, dbErr := s.db.Get(v.definition.Namespace, key)
+	if dbErr == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s.searchTimeout())
+		code, mask, err := s.filterFor(v.definition.Namespace, v.filter)
+		var outputs []interface{}
+		if err == nil {
+			outputs, err = runFilter(ctx, code, mask, key, value, nil, nil, 1)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("error on view '%v' for '%v': %v\n", v.name, key, err)
+		}
+		if len(outputs) > 0 {
+			output, found = outputs[0], true
+		}
+	} else if dbErr.ErrorCode != database.ID_NOT_FOUND && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		log.Printf("error on view '%v' for '%v': %v\n", v.name, key, dbErr)
+		return
+	}
+
+	if !found {
+		if dbErr = s.db.Delete(backing, key); dbErr != nil && dbErr.ErrorCode != database.ID_NOT_FOUND && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+			log.Printf("error on view '%v' for '%v': %v\n", v.name, key, dbErr)
+		}
+		return
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		log.Printf("error on view '%v' for '%v': %v\n", v.name, key, err)
+		return
+	}
+	if dbErr = s.db.Upsert(backing, key, data, true); dbErr != nil {
+		log.Printf("error on view '%v' for '%v': %v\n", v.name, key, dbErr)
+	}
+}
+
+// dropMaterialized removes the namespace of the results of a view, emptied first as some drivers keep the dropped ones
+func (s *Server) dropMaterialized(v *view) {
+	if dbErr := s.db.DeleteAll(v.definition.Materialize); dbErr != nil && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		log.Printf("error dropping view '%v': %v\n", v.name, dbErr)
+	}
+	s.db.DropNameSpace(v.definition.Materialize)
+}
+
+// materialize fills the namespace of a new materialized view from the documents of its source
+func (s *Server) materialize(v *view) *database.DbError {
+	if dbErr := s.db.DeleteAll(v.definition.Materialize); dbErr != nil && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		return dbErr
+	}
+	// the drivers don't agree on the error of a missing namespace, an empty source has nothing to read
+	if !slices.Contains(s.db.GetNamespaces(), v.definition.Namespace) {
+		return nil
+	}
+	var keys []string
+	dbErr := s.db.ScanKeys(v.definition.Namespace, database.KeyRange{}, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if dbErr != nil {
+		return dbErr
+	}
+	for _, key := range keys {
+		s.refreshView(v, key)
+	}
+	return nil
+}
+
+func (s *Server) viewsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	views := s.views.list()
+	response := make([]map[string]interface{}, len(views))
+	for i, v := range views {
+		response[i] = map[string]interface{}{
+			"name":        v.name,
+			"namespace":   v.definition.Namespace,
+			"filter":      v.definition.Filter,
+			"materialize": v.definition.Materialize,
+		}
+	}
+	content, err := jsonWrapper(response)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, string(content))
+}
+
+func (s *Server) viewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	userId := r.Header.Get(USER_HEADER)
+	name := mux.Vars(r)["name"]
+
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := s.views.get(name)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("view '%v' not found", name))
+			return
+		}
+		namespace := v.definition.Namespace
+		if v.definition.Materialize != "" {
+			namespace = v.definition.Materialize
+		}
+		shape, err := s.newResponseShape(r.URL.Query(), s.fieldMask(namespace))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.streamView(w, r, v, shape)
+	case http.MethodPut:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		var definition viewDefinition
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&definition); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid view: %v", err))
+			return
+		}
+		v, err := s.newView(name, definition)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		previous, replaced := s.views.get(name)
+		// the namespace of the results is filled from scratch, it can't hold other documents
+		if definition.Materialize != "" && (!replaced || previous.definition.Materialize != definition.Materialize) && slices.Contains(s.db.GetNamespaces(), definition.Materialize) {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("namespace '%v' already exists", definition.Materialize))
+			return
+		}
+		data, err := json.Marshal(definition)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if dbErr := s.upsert(userId, name+ViewId, ViewId, data, true); dbErr != nil {
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			return
+		}
+		// registered before it is filled, the writes happening meanwhile are applied too
+		s.views.put(v)
+		if replaced && previous.definition.Materialize != "" && previous.definition.Materialize != definition.Materialize {
+			s.dropMaterialized(previous)
+		}
+		if definition.Materialize != "" {
+			if dbErr := s.materialize(v); dbErr != nil {
+				respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+				return
+			}
+		}
+		s.Notify(BrokerEvent{
+			Event:     EVENT_VIEW_CREATED,
+			User:      userId,
+			Namespace: name,
+			Value:     definition,
+		})
+		respondWithJSON(w, http.StatusCreated, string(data))
+	case http.MethodDelete:
+		v, ok := s.views.get(name)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("view '%v' not found", name))
+			return
+		}
+		if dbErr := s.delete(userId, name+ViewId, ViewId); dbErr != nil {
+			respondWithError(w, dbErrorStatus(dbErr), dbErr.Error())
+			return
+		}
+		s.views.remove(name)
+		if v.definition.Materialize != "" {
+			s.dropMaterialized(v)
+		}
+		s.Notify(BrokerEvent{
+			Event:     EVENT_VIEW_DELETED,
+			User:      userId,
+			Namespace: name,
+		})
+		respondWithJSON(w, http.StatusAccepted, "{}")
+	}
+}
+
+// streamView writes the results of the view as {"results": [{"key", "value"}]} in key order,
+// read from its namespace when it is materialized
+func (s *Server) streamView(w http.ResponseWriter, r *http.Request, v *view, shape *responseShape) {
+	stream := newJsonStream(w, r, FORMAT_RESULTS)
+	var err error
+	write := func(key string, value interface{}) bool {
+		err = stream.write(map[string]interface{}{"key": key, "value": value})
+		return err == nil
+	}
+
+	if v.definition.Materialize != "" {
+		if !slices.Contains(s.db.GetNamespaces(), v.definition.Materialize) {
+			stream.end()
+			return
+		}
+		dbErr := s.db.Scan(v.definition.Materialize, func(key string, value []byte) bool {
+			var parsed interface{}
+			if err = json.Unmarshal(value, &parsed); err != nil {
+				return false
+			}
+			parsed, ok, shapeErr := shape.shape(parsed)
+			if err = shapeErr; err != nil {
+				return false
+			}
+			return !ok || write(key, parsed)
+		})
+		if dbErr != nil {
+			stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+			return
+		}
+		if err != nil {
+			stream.fail(streamErrorCode(err), err.Error())
+			return
+		}
+		stream.end()
+		return
+	}
+
+	if !slices.Contains(s.db.GetNamespaces(), v.definition.Namespace) {
+		stream.end()
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.searchTimeout())
+	defer cancel()
+	dbErr, viewErr := s.searchDocuments(ctx, v.definition.Namespace, v.filter, nil, nil, 1, false, func(key string, value interface{}) bool {
+		value, ok, shapeErr := shape.shape(value)
+		if err = shapeErr; err != nil {
+			return false
+		}
+		return !ok || write(key, value)
+	})
+	if dbErr != nil {
+		stream.fail(dbErrorStatus(dbErr), dbErr.Error())
+		return
+	}
+	if viewErr == nil {
+		viewErr = err
+	}
+	if viewErr != nil {
+		stream.fail(searchErrorCode(ctx, viewErr), viewErr.Error())
+		return
+	}
+	stream.end()
+}
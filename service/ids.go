@@ -0,0 +1,55 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+	"github.com/xdung24/unirest/database"
+)
+
+const (
+	ID_UUIDV7   = "uuidv7"   // time ordered uuid, the default
+	ID_ULID     = "ulid"     // time ordered, 26 characters
+	ID_SEQUENCE = "sequence" // 1, 2, 3... from the counter of the namespace kept by the driver
+
+	// ID_ANY_NAMESPACE is the IdStrategies entry applying to the namespaces not listed
+	ID_ANY_NAMESPACE = "*"
+)
+
+func validIdStrategy(strategy string) bool {
+	return strategy == ID_UUIDV7 || strategy == ID_ULID || strategy == ID_SEQUENCE
+}
+
+func (s *Server) idStrategy(namespace string) string {
+	if strategy, ok := s.IdStrategies[namespace]; ok {
+		return strategy
+	}
+	if strategy, ok := s.IdStrategies[ID_ANY_NAMESPACE]; ok {
+		return strategy
+	}
+	return ID_UUIDV7
+}
+
+// generateId returns a new key for a document of the namespace posted without one
+func (s *Server) generateId(namespace string) (string, *database.DbError) {
+	switch s.idStrategy(namespace) {
+	case ID_SEQUENCE:
+		value, dbErr := s.db.NextSequence(namespace)
+		if dbErr != nil {
+			return "", dbErr
+		}
+		return strconv.FormatInt(value, 10), nil
+	case ID_ULID:
+		return ulid.Make().String(), nil
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", &database.DbError{
+			ErrorCode: database.INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error generating id: %v", err),
+		}
+	}
+	return id.String(), nil
+}
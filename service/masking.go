@@ -0,0 +1,279 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/itchyny/gojq"
+	"github.com/xdung24/unirest/database"
+)
+
+// maskTokenPrefix starts the tokens standing for the values of the encrypted fields in the documents given to jq
+const maskTokenPrefix = "encrypted:"
+
+// maskSecret keys the tokens of the deterministic fields, drawn at random once per server, the zero value is ready to use
+type maskSecret struct {
+	once sync.Once
+	key  []byte
+}
+
+func (m *maskSecret) get() []byte {
+	m.once.Do(func() {
+		m.key = make([]byte, 32)
+		if _, err := rand.Read(m.key); err != nil {
+			panic(err)
+		}
+	})
+	return m.key
+}
+
+// fieldMask hides the encrypted fields of a namespace from the jq filters: the documents are given to jq with the
+// value of each encrypted field replaced by an opaque token, whatever the filter does it can't read them. A token of
+// a random field is new for each evaluation, the one of a deterministic field is a keyed hash of the value, so that
+// the equality comparisons of the field with literals (rewritten into their token, see maskedFilter) and between
+// fields keep working. The tokens found in the outputs are replaced by their value, like a read of the document.
+type fieldMask struct {
+	fields []maskedField
+	secret []byte
+}
+
+type maskedField struct {
+	pointer       string
+	path          []string
+	deterministic bool
+}
+
+// fieldMask returns the mask of the namespace, nil when none of its fields is encrypted
+func (s *Server) fieldMask(namespace string) *fieldMask {
+	db, ok := anyCapability[FieldEncryptor](s.db)
+	if !ok {
+		return nil
+	}
+	fields := db.EncryptedFields(namespace)
+	if len(fields) == 0 {
+		return nil
+	}
+	mask := &fieldMask{secret: s.masks.get()}
+	for _, field := range fields {
+		mask.fields = append(mask.fields, maskedField{pointer: field.Pointer, path: pointerTokens(field.Pointer), deterministic: field.Deterministic})
+		if s.AuthEnabled {
+			// the searches give the filters the payloads the documents are stored in
+			path := append([]string{"data"}, pointerTokens(field.Pointer)...)
+			mask.fields = append(mask.fields, maskedField{pointer: field.Pointer, path: path, deterministic: field.Deterministic})
+		}
+	}
+	return mask
+}
+
+// hide returns a copy of the document with the encrypted fields replaced by their token, and their values by token.
+// The containers on the way to the fields are copied, the document is left as it is.
+func (m *fieldMask) hide(document interface{}) (interface{}, map[string]interface{}) {
+	if m == nil {
+		return document, nil
+	}
+	values := make(map[string]interface{})
+	for _, field := range m.fields {
+		document = replacePath(document, field.path, func(value interface{}) interface{} {
+			token := m.token(field, value)
+			values[token] = value
+			return token
+		})
+	}
+	return document, values
+}
+
+// reveal replaces the tokens of the output by their value
+func (m *fieldMask) reveal(v interface{}, values map[string]interface{}) interface{} {
+	if len(values) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case string:
+		if value, ok := values[v]; ok {
+			return value
+		}
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			ret[k] = m.reveal(child, values)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, child := range v {
+			ret[i] = m.reveal(child, values)
+		}
+		return ret
+	}
+	return v
+}
+
+func (m *fieldMask) token(field maskedField, value interface{}) string {
+	if field.deterministic {
+		return m.deterministicToken(value)
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return maskTokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+}
+
+// deterministicToken is the keyed hash of the json of the value, the keys of the objects are sorted by json.Marshal
+func (m *fieldMask) deterministicToken(value interface{}) string {
+	content, _ := json.Marshal(value)
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write(content)
+	return maskTokenPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+// maskedFilter returns the code of the filter to run on the documents hidden by the mask: the literals compared
+// with == or != to a deterministic field are replaced by the token of their value
+func (s *Server) maskedFilter(filter *compiledFilter, namespace string, mask *fieldMask) (*gojq.Code, error) {
+	if mask == nil || !slices.ContainsFunc(mask.fields, func(field maskedField) bool { return field.deterministic }) {
+		return filter.code, nil
+	}
+	masked, err := s.filters.getRewritten(filter, "mask:"+namespace, mask.rewriteLiterals)
+	if err != nil {
+		return nil, err
+	}
+	return masked.code, nil
+}
+
+func (m *fieldMask) rewriteLiterals(query *gojq.Query) {
+	walkQuery(reflect.ValueOf(query), func(v interface{}) {
+		node, ok := v.(*gojq.Query)
+		if !ok || (node.Op != gojq.OpEq && node.Op != gojq.OpNe) {
+			return
+		}
+		for _, sides := range [][2]*gojq.Query{{node.Left, node.Right}, {node.Right, node.Left}} {
+			path, ok := pathFields(sides[0])
+			if !ok || !slices.ContainsFunc(m.fields, func(field maskedField) bool {
+				return field.deterministic && slices.Equal(field.path, path)
+			}) {
+				continue
+			}
+			if value, ok := literalValue(sides[1]); ok {
+				*sides[1] = gojq.Query{Term: &gojq.Term{Type: gojq.TermTypeString, Str: &gojq.String{Str: m.deterministicToken(value)}}}
+			}
+		}
+	})
+}
+
+// checkPaths rejects the conditions and the fields (dotted paths) of a query or an aggregation reaching an encrypted
+// field, or an object holding one: only the equality of a whole deterministic field with a value is allowed
+func (m *fieldMask) checkPaths(where []database.Condition, fields ...string) error {
+	if m == nil {
+		return nil
+	}
+	for _, condition := range where {
+		field, ok := m.overlapping(condition.Field)
+		if !ok {
+			continue
+		}
+		if !field.deterministic {
+			return fmt.Errorf("field %v is encrypted and can't be searched", field.pointer)
+		}
+		if condition.Operator != database.OP_EQ || !slices.Equal(field.path, strings.Split(condition.Field, ".")) {
+			return fmt.Errorf("field %v is encrypted, it can only be matched for equality", field.pointer)
+		}
+	}
+	for _, path := range fields {
+		if path == "" {
+			continue
+		}
+		if field, ok := m.overlapping(path); ok {
+			return fmt.Errorf("field %v is encrypted, it can only be matched for equality", field.pointer)
+		}
+	}
+	return nil
+}
+
+// overlapping returns the encrypted field at the dotted path, in or holding it
+func (m *fieldMask) overlapping(path string) (maskedField, bool) {
+	names := strings.Split(path, ".")
+	for _, field := range m.fields {
+		n := min(len(names), len(field.path))
+		if slices.Equal(names[:n], field.path[:n]) {
+			return field, true
+		}
+	}
+	return maskedField{}, false
+}
+
+// literalValue returns the value of a null, boolean, number or string literal, as decoded from json
+func literalValue(query *gojq.Query) (interface{}, bool) {
+	if query == nil || query.Term == nil || query.Left != nil || len(query.Term.SuffixList) > 0 {
+		return nil, false
+	}
+	switch term := query.Term; term.Type {
+	case gojq.TermTypeNull:
+		return nil, true
+	case gojq.TermTypeTrue:
+		return true, true
+	case gojq.TermTypeFalse:
+		return false, true
+	case gojq.TermTypeNumber:
+		number, err := strconv.ParseFloat(term.Number, 64)
+		return number, err == nil
+	case gojq.TermTypeString:
+		if term.Str != nil && len(term.Str.Queries) == 0 {
+			return term.Str.Str, true
+		}
+	}
+	return nil, false
+}
+
+// replacePath returns a copy of the document with the value at the path replaced, when there is one
+func replacePath(document interface{}, path []string, fn func(interface{}) interface{}) interface{} {
+	if len(path) == 0 {
+		return fn(document)
+	}
+	switch container := document.(type) {
+	case map[string]interface{}:
+		value, ok := container[path[0]]
+		if !ok {
+			return document
+		}
+		copied := make(map[string]interface{}, len(container))
+		for k, v := range container {
+			copied[k] = v
+		}
+		copied[path[0]] = replacePath(value, path[1:], fn)
+		return copied
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(container) {
+			return document
+		}
+		copied := slices.Clone(container)
+		copied[i] = replacePath(container[i], path[1:], fn)
+		return copied
+	}
+	return document
+}
+
+// pointerTokens returns the unescaped tokens of a json pointer
+func pointerTokens(pointer string) []string {
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
+
+// filterFor returns the code of the filter for the namespace and the mask to run it with, see fieldMask
+func (s *Server) filterFor(namespace string, filter *compiledFilter) (*gojq.Code, *fieldMask, error) {
+	mask := s.fieldMask(namespace)
+	code, err := s.maskedFilter(filter, namespace, mask)
+	return code, mask, err
+}
@@ -30,7 +30,7 @@ func (s *Server) generateOpenAPIMap(namespaces []string) (map[string]interface{}
 	}
 
 	for _, namespace := range namespaces {
-		if strings.HasSuffix(namespace, SchemaId) {
+		if strings.HasSuffix(namespace, SchemaId) || strings.HasSuffix(namespace, ViewId) {
 			continue
 		}
 
@@ -312,6 +312,50 @@ func (s *Server) generateOpenAPIMap(namespaces []string) (map[string]interface{}
 		"get": getAllNamespacesOperationMap,
 	}
 
+	for _, v := range s.views.list() {
+		description := fmt.Sprintf("Results of the view '%v', filter `%v` on the namespace '%v'.", v.name, v.definition.Filter, v.definition.Namespace)
+		if v.definition.Materialize != "" {
+			description += fmt.Sprintf(" Materialized in the namespace '%v'.", v.definition.Materialize)
+		}
+		getViewOperationMap := map[string]interface{}{
+			"description": description,
+			"tags": []interface{}{
+				"views",
+			},
+			"parameters": []interface{}{},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "200 OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"title": fmt.Sprintf("View %v", v.name),
+								"properties": map[string]interface{}{
+									"results": map[string]interface{}{
+										"type": "array",
+										"items": map[string]interface{}{
+											"type": "object",
+											"properties": map[string]interface{}{
+												"key": map[string]interface{}{
+													"type": "string",
+												},
+												"value": map[string]interface{}{},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		pathsMap[fmt.Sprintf("/views/%s", v.name)] = map[string]interface{}{
+			"get": getViewOperationMap,
+		}
+	}
+
 	if len(schemasMap) != 0 {
 		rootMap["components"] = map[string]interface{}{
 			"schemas": schemasMap,
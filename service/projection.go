@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/xdung24/unirest/database"
+)
+
+// responseShape reduces the documents read to the fields parameter (dotted paths going through objects),
+// then replaces each of them with the first output of the transform parameter (jq), run with the encrypted
+// fields of the namespace hidden and for at most timeout per document
+type responseShape struct {
+	fields    []string
+	transform *gojq.Code
+	mask      *fieldMask
+	timeout   time.Duration
+}
+
+// transformError is a jq error raised by a document, the request is at fault
+type transformError struct {
+	error
+}
+
+// newResponseShape returns nil when the query asks for neither, the transform is compiled through the filter cache
+func (s *Server) newResponseShape(query url.Values, mask *fieldMask) (*responseShape, error) {
+	shape := &responseShape{mask: mask, timeout: s.searchTimeout()}
+	for _, field := range strings.Split(query.Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			shape.fields = append(shape.fields, field)
+		}
+	}
+	if transform := query.Get("transform"); transform != "" {
+		compiled, err := s.filters.get(transform, nil)
+		if err != nil {
+			return nil, err
+		}
+		shape.transform = compiled.code
+	}
+	if len(shape.fields) == 0 && shape.transform == nil {
+		return nil, nil
+	}
+	return shape, nil
+}
+
+// project keeps the fields of an object, the other documents are left as they are
+func (sh *responseShape) project(document interface{}) interface{} {
+	object, ok := document.(map[string]interface{})
+	if sh == nil || len(sh.fields) == 0 || !ok {
+		return document
+	}
+	ret := make(map[string]interface{})
+	for _, field := range sh.fields {
+		path := strings.Split(field, ".")
+		value, found := interface{}(object), true
+		for _, name := range path {
+			var parent map[string]interface{}
+			if parent, found = value.(map[string]interface{}); found {
+				value, found = parent[name]
+			}
+			if !found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		target := ret
+		for _, name := range path[:len(path)-1] {
+			child, ok := target[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				target[name] = child
+			}
+			target = child
+		}
+		target[path[len(path)-1]] = value
+	}
+	return ret
+}
+
+// apply runs the transform on the document, ok is false when it outputs nothing
+func (sh *responseShape) apply(document interface{}) (interface{}, bool, error) {
+	if sh == nil || sh.transform == nil {
+		return document, true, nil
+	}
+	document, values := sh.mask.hide(document)
+	v, ok, err := sh.run(context.Background(), document)
+	return sh.mask.reveal(v, values), ok, err
+}
+
+// run runs the transform on the document as it is, see apply. $__key is null.
+func (sh *responseShape) run(ctx context.Context, document interface{}) (interface{}, bool, error) {
+	if sh == nil || sh.transform == nil {
+		return document, true, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, sh.timeout)
+	defer cancel()
+	v, ok := sh.transform.RunWithContext(ctx, document, nil).Next()
+	if !ok {
+		return nil, false, nil
+	}
+	if err, isErr := v.(error); isErr {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		return nil, false, transformError{err}
+	}
+	return v, true, nil
+}
+
+// shape projects then transforms the document
+func (sh *responseShape) shape(document interface{}) (interface{}, bool, error) {
+	return sh.apply(sh.project(document))
+}
+
+// shapeDocument shapes a single stored document, null when the transform outputs nothing
+func shapeDocument(shape *responseShape, value []byte) ([]byte, error) {
+	var parsed interface{}
+	err := json.Unmarshal(value, &parsed)
+	if err != nil {
+		return nil, err
+	}
+	parsed, _, err = shape.shape(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(parsed)
+}
+
+// scanRange reads the documents of the range, with only the fields asked for when the driver can
+func (s *Server) scanRange(namespace string, r database.KeyRange, shape *responseShape, fn database.ScanFunc) *database.DbError {
+	if db, ok := capability[Projector](s.db); ok && shape != nil && len(shape.fields) > 0 {
+		return db.ScanRangeFields(namespace, r, shape.fields, fn)
+	}
+	return s.db.ScanRange(namespace, r, fn)
+}
+
+// get reads a document, with only the fields asked for when the driver can
+func (s *Server) get(namespace string, key string, shape *responseShape) ([]byte, *database.DbError) {
+	db, ok := capability[Projector](s.db)
+	if !ok || shape == nil || len(shape.fields) == 0 {
+		return s.db.Get(namespace, key)
+	}
+	var value []byte
+	dbErr := db.ScanRangeFields(namespace, database.KeyRange{Start: key, End: key}, shape.fields, func(_ string, v []byte) bool {
+		value = v
+		return false
+	})
+	if dbErr == nil && value == nil {
+		dbErr = &database.DbError{
+			ErrorCode: database.ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	return value, dbErr
+}
+
+// streamErrorCode is the status of an error raised while writing a response
+func streamErrorCode(err error) int {
+	if errors.As(err, &transformError{}) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusInternalServerError
+}
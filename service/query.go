@@ -0,0 +1,96 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xdung24/unirest/database"
+)
+
+// wherePattern matches the filter parameters, where[field] or where[field][operator]
+var wherePattern = regexp.MustCompile(`^where\[([^\[\]]+)\](?:\[([a-z]+)\])?$`)
+
+// newListingQuery reads the where, sort, limit and offset parameters of a listing, it returns nil when there are none.
+// A value is read as json when it is a number, a boolean or null (a quoted string too), as a plain string otherwise.
+func newListingQuery(query url.Values, keyRange database.KeyRange) (*database.Query, error) {
+	q := &database.Query{Range: keyRange}
+	listed := false
+
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		match := wherePattern.FindStringSubmatch(param)
+		if match == nil {
+			if strings.HasPrefix(param, "where") {
+				return nil, fmt.Errorf("invalid filter '%v', expected where[field] or where[field][operator]", param)
+			}
+			continue
+		}
+		operator := match[2]
+		if operator == "" {
+			operator = database.OP_EQ
+		}
+		for _, raw := range query[param] {
+			value := whereValue(raw)
+			if !database.ValidOperator(operator, value) {
+				return nil, fmt.Errorf("invalid filter '%v=%v'", param, raw)
+			}
+			q.Where = append(q.Where, database.Condition{Field: match[1], Operator: operator, Value: value})
+		}
+		listed = true
+	}
+
+	for _, field := range strings.Split(query.Get("sort"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		descending := strings.HasPrefix(field, "-")
+		q.Sort = append(q.Sort, database.SortField{Field: strings.TrimPrefix(field, "-"), Descending: descending})
+		listed = true
+	}
+
+	var err error
+	for param, count := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if !query.Has(param) {
+			continue
+		}
+		*count, err = strconv.Atoi(query.Get(param))
+		if err != nil || *count < 0 {
+			return nil, fmt.Errorf("invalid %v '%v'", param, query.Get(param))
+		}
+		listed = true
+	}
+
+	if !listed {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func whereValue(raw string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return raw
+	}
+	switch value.(type) {
+	case float64, string, bool, nil:
+		return value
+	}
+	return raw
+}
+
+// query runs the query in the driver when it can, over a scan of the range otherwise
+func (s *Server) query(namespace string, q database.Query, fn database.ScanFunc) *database.DbError {
+	if db, ok := capability[Querier](s.db); ok {
+		return db.Query(namespace, q, fn)
+	}
+	return database.QueryScan(s.db.ScanRange, namespace, q, fn)
+}
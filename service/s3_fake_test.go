@@ -0,0 +1,220 @@
+package service
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3 is a minimal in-process S3 stand-in, enough for the S3Database driver:
+// buckets, objects with etags and conditional writes, paginated ListObjectsV2 and batch deletes
+type fakeS3 struct {
+	mu       sync.Mutex
+	pageSize int
+	buckets  map[string]map[string][]byte
+}
+
+type fakeS3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+type fakeS3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []fakeS3Object `xml:"Contents"`
+	CommonPrefixes        []fakeS3Prefix `xml:"CommonPrefixes"`
+}
+
+func newFakeS3(pageSize int) *httptest.Server {
+	fake := &fakeS3{
+		pageSize: pageSize,
+		buckets:  make(map[string]map[string][]byte),
+	}
+	return httptest.NewServer(fake)
+}
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeS3Error(w http.ResponseWriter, code int, s3Code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%v</Code><Message>%v</Message></Error>`, s3Code, s3Code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	bucket, bucketExists := f.buckets[bucketName]
+	query := r.URL.Query()
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			if !bucketExists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut:
+			f.buckets[bucketName] = make(map[string][]byte)
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			f.list(w, bucketName, bucket, query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token"))
+		case r.Method == http.MethodPost && query.Has("delete"):
+			var req struct {
+				Objects []struct {
+					Key string `xml:"Key"`
+				} `xml:"Object"`
+			}
+			xml.NewDecoder(r.Body).Decode(&req)
+			for _, object := range req.Objects {
+				delete(bucket, object.Key)
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><DeleteResult></DeleteResult>`)
+		default:
+			fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	if !bucketExists {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	data, exists := bucket[key]
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || (match != "*" && match != fakeS3ETag(data))) {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = fakeS3DecodeChunked(body)
+		}
+		bucket[key] = body
+		w.Header().Set("ETag", fakeS3ETag(body))
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fakeS3ETag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucketName string, bucket map[string][]byte, prefix, delimiter, token string) {
+	keys := make([]string, 0)
+	prefixes := make(map[string]bool)
+	for key := range bucket {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixes[key[:len(prefix)+i+1]] = true
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	for p := range prefixes {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token != "" {
+		start = sort.SearchStrings(keys, token)
+	}
+	end := min(start+f.pageSize, len(keys))
+
+	result := fakeS3ListResult{
+		Name:        bucketName,
+		Prefix:      prefix,
+		KeyCount:    end - start,
+		MaxKeys:     f.pageSize,
+		IsTruncated: end < len(keys),
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = keys[end]
+	}
+	for _, key := range keys[start:end] {
+		if prefixes[key] {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeS3Prefix{Prefix: key})
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Object{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         fakeS3ETag(bucket[key]),
+			Size:         len(bucket[key]),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// fakeS3DecodeChunked strips the aws-chunked framing used by signed streaming uploads:
+// <hex size>;chunk-signature=<sig>\r\n<data>\r\n ... 0;chunk-signature=<sig>\r\n
+func fakeS3DecodeChunked(body []byte) []byte {
+	decoded := make([]byte, 0, len(body))
+	rest := string(body)
+	for {
+		header, after, ok := strings.Cut(rest, "\r\n")
+		if !ok {
+			return decoded
+		}
+		sizeHex, _, _ := strings.Cut(header, ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 || int(size) > len(after) {
+			return decoded
+		}
+		decoded = append(decoded, after[:size]...)
+		rest = strings.TrimPrefix(after[size:], "\r\n")
+	}
+}
@@ -2,27 +2,53 @@ package service
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/r3labs/sse/v2"
 )
 
 const (
-	NamespaceHomePattern   = "/namespace"
-	NamespacePattern       = "/namespace/{namespace:[a-zA-Z0-9\\-]+}"
-	DataSetPattern         = "/dataset/{namespace:[a-zA-Z0-9\\-]+}"
-	DataSetKeyValuePattern = "/dataset/{namespace:[a-zA-Z0-9\\-]+}/{key:[a-zA-Z0-9\\-]+}"
-	SearchPattern          = "/search/{namespace:[a-zA-Z0-9\\-]+}"
-	SchemaPattern          = "/schema/{namespace:[a-zA-Z0-9\\-]+}"
-	OpenAPIPattern         = "/{openapi|swagger}.json"
-	BrokerPattern          = "/broker"
-	SwaggerUIPattern       = "/swaggerui/"
+	NamespaceHomePattern    = "/namespace"
+	NamespacePattern        = "/namespace/{namespace:[a-zA-Z0-9\\-]+}"
+	DataSetPattern          = "/dataset/{namespace:[a-zA-Z0-9\\-]+}"
+	DataSetKeyValuePattern  = "/dataset/{namespace:[a-zA-Z0-9\\-]+}/{key:[a-zA-Z0-9\\-]+}"
+	DataSetKeysPattern      = "/dataset/{namespace:[a-zA-Z0-9\\-]+}/_keys"
+	DataSetCountPattern     = "/dataset/{namespace:[a-zA-Z0-9\\-]+}/_count"
+	SearchPattern           = "/search/{namespace:[a-zA-Z0-9\\-]+}"
+	SearchNamespacesPattern = "/search"
+	LivePattern             = "/live/{namespace:[a-zA-Z0-9\\-]+}"
+	SchemaPattern           = "/schema/{namespace:[a-zA-Z0-9\\-]+}"
+	ViewHomePattern         = "/views"
+	ViewPattern             = "/views/{name:[a-zA-Z0-9\\-]+}"
+	AggregatePattern        = "/aggregate/{namespace:[a-zA-Z0-9\\-]+}"
+	ReencryptPattern        = "/admin/reencrypt/{namespace:[a-zA-Z0-9\\-]+}"
+	MemoryStatsPattern      = "/admin/memory"
+	OpenAPIPattern          = "/{openapi|swagger}.json"
+	BrokerPattern           = "/broker"
+	SwaggerUIPattern        = "/swaggerui/"
 
 	SchemaId = "_schema"
+	ViewId   = "_view"
+
+	maxMultiGetKeys = 1000
+
+	MERGE_PATCH_CONTENT_TYPE = "application/merge-patch+json" // RFC 7396
+	JSON_PATCH_CONTENT_TYPE  = "application/json-patch+json"  // RFC 6902
+
+	documentLockStripes = 64
+
+	writeTimeout = 15 * time.Second // of a response, or of each write of a streamed one
+
+	KEY_VARIABLE            = "$__key" // key of the document in the jq filters of the search
+	DEFAULT_SEARCH_TIMEOUT  = 10 * time.Second
+	DEFAULT_SLURP_MAX_BYTES = 64 << 20
 
 	EVENT_ITEM_CREATED = "ITEM_CREATED"
 	EVENT_ITEM_UPDATED = "ITEM_UPDATED"
 	EVENT_ITEM_DELETED = "ITEM_DELETED"
+	EVENT_ITEM_EVICTED = "ITEM_EVICTED"
 
 	EVENT_NAMESPACE_CREATED = "NAMESPACE_CREATED"
 	EVENT_NAMESPACE_DELETED = "NAMESPACE_DELETED"
@@ -30,6 +56,11 @@ const (
 	EVENT_SCHEMA_CREATED = "SCHEMA_CREATED"
 	EVENT_SCHEMA_DELETED = "SCHEMA_DELETED"
 
+	EVENT_NAMESPACE_REENCRYPTED = "NAMESPACE_REENCRYPTED"
+
+	EVENT_VIEW_CREATED = "VIEW_CREATED"
+	EVENT_VIEW_DELETED = "VIEW_DELETED"
+
 	certsPublicKey = "./certs/public-cert.pem"
 )
 
@@ -43,6 +74,7 @@ type BrokerEvent struct {
 	Namespace string      `json:"namespace"`
 	Key       string      `json:"key,omitempty"`
 	Value     interface{} `json:"value,omitempty"`
+	Patch     interface{} `json:"patch,omitempty"`
 }
 
 type Server struct {
@@ -52,8 +84,18 @@ type Server struct {
 	BrokerEnabled  bool
 	AuthEnabled    bool
 	RawSqlEnabled  bool
+	IdStrategies   map[string]string // namespace -> ID_*, for the documents posted without a key
+	SearchTimeout  time.Duration     // of a jq search, DEFAULT_SEARCH_TIMEOUT when 0
+	SlurpMaxBytes  int64             // stored bytes of a namespace read by a slurp search, DEFAULT_SLURP_MAX_BYTES when 0
 
-	router *mux.Router
-	broker *sse.Server
-	db     Database
+	router        *mux.Router
+	broker        *sse.Server
+	db            Database
+	reencrypting  sync.Map                        // namespaces being re-encrypted
+	documentLocks [documentLockStripes]sync.Mutex // serialize the writes of a document, see lockDocument
+	filters       filterCache
+	masks         maskSecret
+	views         viewRegistry
+	viewLocks     [documentLockStripes]sync.Mutex // serialize the refresh of a document in a materialized view
+	live          liveRegistry
 }
@@ -0,0 +1,69 @@
+//go:build sqlite_fts5
+
+package service
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/xdung24/unirest/database"
+)
+
+func Test_UnitTest_SQLiteDb_FullTextSearch(t *testing.T) {
+	os.MkdirAll("/tmp/caffeine_fts", os.ModePerm)
+	defer os.RemoveAll("/tmp/caffeine_fts")
+
+	db := &database.SQLiteDatabase{
+		DirPath:         "/tmp/caffeine_fts/db.sqlite",
+		FullTextEnabled: true,
+	}
+	testingRouter := setupCaffeineTest(db)
+	defer db.Disconnect()
+
+	db.Upsert(testNamespace, "key2", []byte(`{"name":"john","city":"new york"}`), true)
+	db.Upsert(testNamespace, "key3", []byte(`{"name":"jack","city":"york"}`), true)
+	db.Upsert(testNamespace, "key4", []byte(`{"name":"jack","city":"paris"}`), true)
+	db.Delete(testNamespace, "key4")
+
+	ftsTests := []testCase{
+		{
+			name:                 "test full text search",
+			path:                 "/search/" + testNamespace + "?q=jack",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"results":[{"key":"key1","value":{"age":25,"name":"jack"}},{"key":"key3","value":{"city":"york","name":"jack"}}]}`,
+		},
+		{
+			name:                 "test full text search ignores keys",
+			path:                 "/search/" + testNamespace + "?q=city",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"results":[]}`,
+		},
+		{
+			name:                 "test full text search phrase",
+			path:                 "/search/" + testNamespace + "?q=%22new%20york%22",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"results":[{"key":"key2","value":{"city":"new york","name":"john"}}]}`,
+		},
+		{
+			name:                 "test full text search invalid query",
+			path:                 "/search/" + testNamespace + "?q=%22unterminated",
+			expectedResponseCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range ftsTests {
+		req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedResponseCode, response.Code)
+		if test.expectedResponse != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expectedResponse)
+		}
+	}
+
+	// the index is emptied with the table
+	db.DeleteAll(testNamespace)
+	req, _ := http.NewRequest(http.MethodGet, "/search/"+testNamespace+"?q=jack", nil)
+	response := testingRouter.ExecuteRequest(req)
+	checkResponse(t, "full text search after a delete all", response.Body.String(), `{"results":[]}`)
+}
@@ -1,14 +1,31 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/xdung24/unirest/database"
@@ -49,15 +66,15 @@ var tests = []testCase{
 	{
 		name:                 "test namespace get",
 		method:               http.MethodGet,
-		path:                 "/ns/" + testNamespace,
+		path:                 "/dataset/" + testNamespace,
 		payload:              "",
 		expectedResponseCode: http.StatusOK,
-		expectedResponse:     fmt.Sprintf(`[{"key":"%v","value":%v}]`, testKey, jsonPayload),
+		expectedResponse:     fmt.Sprintf(`[{"key":"%v","value":{"age":25,"id":"%v","name":"jack"}}]`, testKey, testKey),
 	},
 	{
 		name:                 "test namespace get not existing",
 		method:               http.MethodGet,
-		path:                 "/ns/" + "not_existing_namespace",
+		path:                 "/dataset/" + "not_existing_namespace",
 		payload:              "",
 		expectedResponseCode: http.StatusNotFound,
 		expectedResponse:     "",
@@ -65,7 +82,7 @@ var tests = []testCase{
 	{
 		name:                 "test namespace delete",
 		method:               http.MethodDelete,
-		path:                 "/ns/" + testNamespace,
+		path:                 "/dataset/" + testNamespace,
 		payload:              "",
 		expectedResponseCode: http.StatusAccepted,
 		expectedResponse:     "{}",
@@ -73,7 +90,7 @@ var tests = []testCase{
 	{
 		name:                 "test namespace delete not existing",
 		method:               http.MethodDelete,
-		path:                 "/ns/" + "not_existing_namespace",
+		path:                 "/dataset/" + "not_existing_namespace",
 		payload:              "",
 		expectedResponseCode: http.StatusNotFound,
 		expectedResponse:     "",
@@ -81,7 +98,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue post",
 		method:               http.MethodPost,
-		path:                 "/ns/test/1",
+		path:                 "/dataset/test/1",
 		payload:              jsonPayload,
 		expectedResponseCode: http.StatusCreated,
 		expectedResponse:     "",
@@ -100,7 +117,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue post invalid json",
 		method:               http.MethodPost,
-		path:                 "/ns/test/1",
+		path:                 "/dataset/test/1",
 		payload:              "{some bad data...",
 		expectedResponseCode: http.StatusBadRequest,
 		expectedResponse:     "",
@@ -108,7 +125,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue get",
 		method:               http.MethodGet,
-		path:                 "/ns/" + testNamespace + "/" + testKey,
+		path:                 "/dataset/" + testNamespace + "/" + testKey,
 		payload:              "",
 		expectedResponseCode: http.StatusOK,
 		expectedResponse:     jsonPayload,
@@ -116,7 +133,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue get not existing",
 		method:               http.MethodGet,
-		path:                 "/ns/" + testNamespace + "/not_existing",
+		path:                 "/dataset/" + testNamespace + "/not_existing",
 		payload:              "",
 		expectedResponseCode: http.StatusNotFound,
 		expectedResponse:     "",
@@ -124,7 +141,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue delete",
 		method:               http.MethodDelete,
-		path:                 "/ns/" + testNamespace + "/" + testKey,
+		path:                 "/dataset/" + testNamespace + "/" + testKey,
 		payload:              "",
 		expectedResponseCode: http.StatusAccepted,
 		expectedResponse:     "{}",
@@ -132,7 +149,7 @@ var tests = []testCase{
 	{
 		name:                 "test keyvalue delete not existing",
 		method:               http.MethodDelete,
-		path:                 "/ns/" + testNamespace + "/not_existing",
+		path:                 "/dataset/" + testNamespace + "/not_existing",
 		payload:              "",
 		expectedResponseCode: http.StatusNotFound,
 		expectedResponse:     "",
@@ -189,7 +206,7 @@ var tests = []testCase{
 	{
 		name:                 "test post valid json with schema",
 		method:               http.MethodPost,
-		path:                 "/ns/user/1",
+		path:                 "/dataset/user/1",
 		payload:              validJsonForSchema,
 		expectedResponseCode: http.StatusCreated,
 		expectedResponse:     validJsonForSchema,
@@ -200,7 +217,7 @@ var tests = []testCase{
 	{
 		name:                 "test post invalid json with schema",
 		method:               http.MethodPost,
-		path:                 "/ns/user/1",
+		path:                 "/dataset/user/1",
 		payload:              invalidJsonForSchema,
 		expectedResponseCode: http.StatusBadRequest,
 		expectedResponse:     `{ "status": 400, "message": "(root): lastName is required" }`,
@@ -223,7 +240,10 @@ func setupCaffeineTest(db Database) *TestingRouter {
 	testingRouter.AddHandler(NamespacePattern, server.namespaceHandler)
 	testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
 	testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	testingRouter.AddHandler(DataSetKeysPattern, server.dataSetKeysHandler)
+	testingRouter.AddHandler(DataSetCountPattern, server.dataSetCountHandler)
 	testingRouter.AddHandler(SchemaPattern, server.schemaHandler)
+	testingRouter.AddHandler(SearchPattern, server.fullTextSearchHandler, "q", "{q}")
 
 	return &testingRouter
 }
@@ -244,9 +264,10 @@ func testHandlers(db Database, t *testing.T) {
 		if test.dbCheck != nil {
 			err := test.dbCheck(db)
 			if err != nil {
-				t.Errorf(err.Error())
+				t.Error(err)
 			}
 		}
+		db.Disconnect()
 	}
 }
 
@@ -254,6 +275,86 @@ func Test_UnitTest_MemoryDb(t *testing.T) {
 	testHandlers(&database.MemDatabase{}, t)
 }
 
+func Test_UnitTest_MemoryDb_Eviction(t *testing.T) {
+	db := &database.MemDatabase{
+		MaxBytes:          100,
+		NamespaceMaxBytes: map[string]int64{"cache": 40},
+	}
+	db.Init()
+	defer db.Disconnect()
+	var evicted []string
+	db.OnEvict(func(namespace string, key string) {
+		evicted = append(evicted, namespace+"/"+key)
+	})
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(MemoryStatsPattern, server.memoryStatsHandler)
+
+	// 11 bytes per document, the namespace budget holds 3 of them
+	for _, key := range []string{"a", "b", "c"} {
+		db.Upsert("cache", key, []byte(`{"v":"01"}`), true)
+		time.Sleep(time.Millisecond)
+	}
+	db.Get("cache", "a")
+	db.Upsert("cache", "d", []byte(`{"v":"01"}`), true)
+	if _, err := db.Get("cache", "b"); err == nil || len(evicted) != 1 || evicted[0] != "cache/b" {
+		t.Errorf("Expected the least recently used cache/b to be evicted. Got %v", evicted)
+	}
+
+	// the global budget evicts from any namespace
+	db.Upsert("other", "big", []byte(`{"v":"`+strings.Repeat("x", 60)+`"}`), true)
+	if len(evicted) != 2 || !strings.HasPrefix(evicted[1], "cache/") {
+		t.Errorf("Expected a cache document to be evicted by the global budget. Got %v", evicted)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, MemoryStatsPattern, nil)
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "memory stats", http.StatusOK, response.Code)
+	checkResponse(t, "memory stats", response.Body.String(),
+		`{"items":3,"bytes":93,"max_bytes":100,"evictions":2,"namespaces":{"cache":{"items":2,"bytes":22,"max_bytes":40,"evictions":2},"other":{"items":1,"bytes":71,"evictions":0}}}`)
+}
+
+// the evictions and the memory stats of the memory driver are found through the wrappers
+func Test_UnitTest_MemoryDb_EvictionThroughWrappers(t *testing.T) {
+	db := &database.IndexedDatabase{
+		Backend: &database.CompressedDatabase{
+			Backend:    &database.MemDatabase{NamespaceMaxBytes: map[string]int64{"cache": 40}},
+			Namespaces: map[string]string{"*": database.COMPRESSION_NONE},
+		},
+		Fields: map[string][]string{"cache": {"/v"}},
+	}
+	db.Init()
+	defer db.Disconnect()
+	server := Server{db: db}
+	if !server.notifyEvictions() {
+		t.Fatal("no evicting driver found through the wrappers")
+	}
+	sub := server.live.subscribe("cache")
+	defer server.live.unsubscribe(sub)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		db.Upsert("cache", key, []byte(`{"v":"word"}`), true)
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case event := <-sub.events:
+		if event.Event != EVENT_ITEM_EVICTED || event.Key != "a" {
+			t.Errorf("Expected the eviction of cache/a. Got %v", event)
+		}
+	default:
+		t.Error("no eviction published")
+	}
+	documents, _ := db.FullTextSearch("cache", "word")
+	if count, _ := db.Count("cache"); int64(len(documents)) != count {
+		t.Errorf("Expected the %d documents left to be found. Got %d", count, len(documents))
+	}
+
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(MemoryStatsPattern, server.memoryStatsHandler)
+	req, _ := http.NewRequest(http.MethodGet, MemoryStatsPattern, nil)
+	checkResponseCode(t, "memory stats through the wrappers", http.StatusOK, testingRouter.ExecuteRequest(req).Code)
+}
+
 func Test_UnitTest_StorageDb(t *testing.T) {
 	db := &database.StorageDatabase{
 		RootDirPath: "/tmp/caffeine_test1",
@@ -265,8 +366,1778 @@ func Test_UnitTest_StorageDb(t *testing.T) {
 func Test_UnitTest_SQLiteDb(t *testing.T) {
 	os.MkdirAll("/tmp/caffeine", os.ModePerm)
 	db := &database.SQLiteDatabase{
-		DirPath: "/tmp/caffeine",
+		DirPath: "/tmp/caffeine/db.sqlite",
 	}
 	testHandlers(db, t)
 	os.RemoveAll("/tmp/caffeine")
 }
+
+func Test_UnitTest_BoltDb(t *testing.T) {
+	os.MkdirAll("/tmp/caffeine_bolt", os.ModePerm)
+	db := &database.BoltDatabase{
+		DirPath: "/tmp/caffeine_bolt",
+	}
+	testHandlers(db, t)
+	os.RemoveAll("/tmp/caffeine_bolt")
+}
+
+func Test_UnitTest_StreamedFormats(t *testing.T) {
+	db := &database.MemDatabase{}
+	testingRouter := setupCaffeineTest(db)
+	defer db.Disconnect()
+	server := Server{db: db}
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+	db.Upsert(testNamespace, "a-b", []byte(`{"age":30}`), true)
+	db.Upsert(testNamespace, "a", []byte(`{"age":40}`), true)
+
+	streamTests := []struct {
+		path     string
+		expected string
+	}{
+		{"/dataset/ns1", `[{"key":"a","value":{"age":40,"id":"a"}},{"key":"a-b","value":{"age":30,"id":"a-b"}},{"key":"key1","value":{"age":25,"id":"key1","name":"jack"}}]`},
+		{"/dataset/ns1?format=2", `[{"age":40,"id":"a"},{"age":30,"id":"a-b"},{"age":25,"id":"key1","name":"jack"}]`},
+		{"/dataset/ns1?format=3", `{"results":[{"age":40,"id":"a"},{"age":30,"id":"a-b"},{"age":25,"id":"key1","name":"jack"}]}`},
+		{"/dataset/ns1?format=ndjson", "{\"age\":40,\"id\":\"a\"}\n{\"age\":30,\"id\":\"a-b\"}\n{\"age\":25,\"id\":\"key1\",\"name\":\"jack\"}\n"},
+		{"/search/ns1?filter=" + url.QueryEscape("select(.age < 35) | .age"), `{"results":[{"key":"a-b","value":30},{"key":"key1","value":25}]}`},
+		{"/search/ns1?filter=" + url.QueryEscape("select(.age > 99)"), `{"results":[]}`},
+	}
+	for _, test := range streamTests {
+		req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.path, http.StatusOK, response.Code)
+		checkResponse(t, test.path, response.Body.String(), test.expected)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/dataset/ns1?format=4", nil)
+	checkResponseCode(t, "invalid format", http.StatusBadRequest, testingRouter.ExecuteRequest(req).Code)
+
+	// the scan stops as soon as the callback returns false
+	count := 0
+	db.Scan(testNamespace, func(key string, value []byte) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("Expected the scan to stop after 1 document. Got %d", count)
+	}
+}
+
+func Test_UnitTest_KeyRanges(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_ranges")
+	os.MkdirAll("/tmp/caffeine_ranges/bolt", os.ModePerm)
+
+	for _, db := range []Database{
+		&database.MemDatabase{},
+		&database.StorageDatabase{RootDirPath: "/tmp/caffeine_ranges/fs"},
+		&database.SQLiteDatabase{DirPath: "/tmp/caffeine_ranges/db.sqlite"},
+		&database.BoltDatabase{DirPath: "/tmp/caffeine_ranges/bolt"},
+	} {
+		testingRouter := setupCaffeineTest(db)
+		for i, key := range []string{"order-2024-2", "order-2023-1", "order-2024-1", "user-1"} {
+			db.Upsert("orders", key, []byte(fmt.Sprintf(`{"v":%d}`, i)), true)
+		}
+
+		rangeTests := []struct {
+			query    string
+			expected string
+		}{
+			{"?format=2&prefix=order-2024", `[{"id":"order-2024-1","v":2},{"id":"order-2024-2","v":0}]`},
+			{"?format=2&start=order-2024-2&end=user-1", `[{"id":"order-2024-2","v":0},{"id":"user-1","v":3}]`},
+			{"?format=2&prefix=order&start=order-2024", `[{"id":"order-2024-1","v":2},{"id":"order-2024-2","v":0}]`},
+			{"?format=2&prefix=none", `[]`},
+			{"?format=2&ids=user-1,missing,order-2023-1,user-1", `[{"id":"user-1","v":3},{"id":"order-2023-1","v":1}]`},
+			{"/_keys", `["order-2023-1","order-2024-1","order-2024-2","user-1"]`},
+			{"/_keys?prefix=order-2024", `["order-2024-1","order-2024-2"]`},
+			{"/_count", `{"count":4}`},
+			{"/_count?filter=" + url.QueryEscape(".v >= 2"), `{"count":2}`},
+			{"/_count?filter=" + url.QueryEscape("select(.v == 0)"), `{"count":1}`},
+		}
+		for _, test := range rangeTests {
+			name := fmt.Sprintf("%T %v", db, test.query)
+			req, _ := http.NewRequest(http.MethodGet, "/dataset/orders"+test.query, nil)
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, name, http.StatusOK, response.Code)
+			checkResponse(t, name, response.Body.String(), test.expected)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "/dataset/orders?ids=1&prefix=order", nil)
+		checkResponseCode(t, "ids with a prefix", http.StatusBadRequest, testingRouter.ExecuteRequest(req).Code)
+		req, _ = http.NewRequest(http.MethodHead, "/dataset/orders/user-1", nil)
+		checkResponseCode(t, "head existing", http.StatusOK, testingRouter.ExecuteRequest(req).Code)
+		req, _ = http.NewRequest(http.MethodHead, "/dataset/orders/user-2", nil)
+		checkResponseCode(t, "head missing", http.StatusNotFound, testingRouter.ExecuteRequest(req).Code)
+		db.Disconnect()
+	}
+}
+
+// the ids of a table with a linguistic collation are still ranged and sorted in byte order, against the postgres
+// of PG_TEST_HOST, PG_TEST_NAME, PG_TEST_USER and PG_TEST_PASS
+func Test_UnitTest_PGDb_KeyRanges(t *testing.T) {
+	host := os.Getenv("PG_TEST_HOST")
+	if host == "" {
+		t.Skip("PG_TEST_HOST is not set")
+	}
+	db := &database.PGDatabase{Host: host, Name: os.Getenv("PG_TEST_NAME"), User: os.Getenv("PG_TEST_USER"), Pass: os.Getenv("PG_TEST_PASS")}
+	conn, err := sql.Open("postgres", fmt.Sprintf("postgres://%v:%v@%v/%v?sslmode=disable", db.User, db.Pass, db.Host, db.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Exec("DROP TABLE IF EXISTS collated")
+	created := false
+	for _, collation := range []string{"en_US.utf8", "en_US", "en-x-icu", "und-x-icu"} {
+		_, err = conn.Exec(fmt.Sprintf(`CREATE TABLE collated (id text COLLATE "%v" PRIMARY KEY, data json NOT NULL)`, collation))
+		if created = err == nil; created {
+			break
+		}
+	}
+	if !created {
+		t.Skipf("no linguistic collation: %v", err)
+	}
+	defer conn.Exec("DROP TABLE IF EXISTS collated")
+
+	db.Init()
+	defer db.Disconnect()
+	for _, key := range []string{"b", "B", "a-b", "ab", "_x", "a", "c"} {
+		db.Upsert("collated", key, []byte(`{}`), true)
+	}
+	for _, test := range []struct {
+		r        database.KeyRange
+		expected []string
+	}{
+		{database.KeyRange{}, []string{"B", "_x", "a", "a-b", "ab", "b", "c"}},
+		{database.KeyRange{Start: "B", End: "_x"}, []string{"B", "_x"}},
+		{database.KeyRange{Prefix: "a"}, []string{"a", "a-b", "ab"}},
+	} {
+		var keys, scanned []string
+		db.ScanKeys("collated", test.r, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		db.ScanRange("collated", test.r, func(key string, _ []byte) bool {
+			scanned = append(scanned, key)
+			return true
+		})
+		if !slices.Equal(keys, test.expected) || !slices.Equal(scanned, test.expected) {
+			t.Errorf("range %+v: expected %v. Got %v and %v", test.r, test.expected, keys, scanned)
+		}
+	}
+}
+
+func Test_UnitTest_GeneratedIds(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_ids")
+	os.MkdirAll("/tmp/caffeine_ids/bolt", os.ModePerm)
+
+	for _, db := range []Database{
+		&database.MemDatabase{},
+		&database.StorageDatabase{RootDirPath: "/tmp/caffeine_ids/fs"},
+		&database.SQLiteDatabase{DirPath: "/tmp/caffeine_ids/db.sqlite"},
+		&database.BoltDatabase{DirPath: "/tmp/caffeine_ids/bolt"},
+		&database.GitDatabase{DirPath: "/tmp/caffeine_ids/git"},
+	} {
+		db.Init()
+		server := Server{
+			db:           db,
+			IdStrategies: map[string]string{"orders": ID_SEQUENCE, "events": ID_ULID},
+		}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+		testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+
+		post := func(namespace string) string {
+			name := fmt.Sprintf("%T post %v", db, namespace)
+			req, _ := http.NewRequest(http.MethodPost, "/dataset/"+namespace, strings.NewReader(jsonPayload))
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, name, http.StatusCreated, response.Code)
+			var body struct {
+				Id   string `json:"id"`
+				Name string `json:"name"`
+			}
+			json.Unmarshal(response.Body.Bytes(), &body)
+			if body.Name != "jack" || response.Header().Get("Location") != "/dataset/"+namespace+"/"+body.Id {
+				t.Errorf("%v: unexpected response %v, location %v", name, response.Body.String(), response.Header().Get("Location"))
+			}
+			req, _ = http.NewRequest(http.MethodGet, response.Header().Get("Location"), nil)
+			checkResponseCode(t, name+" get", http.StatusOK, testingRouter.ExecuteRequest(req).Code)
+			return body.Id
+		}
+
+		if id1, id2 := post("orders"), post("orders"); id1 != "1" || id2 != "2" {
+			t.Errorf("%T: expected sequence 1, 2. Got %v, %v", db, id1, id2)
+		}
+		// the sequence outlives the documents
+		db.DeleteAll("orders")
+		if id := post("orders"); id != "3" {
+			t.Errorf("%T: expected 3 after DeleteAll. Got %v", db, id)
+		}
+		if id := post("events"); len(id) != 26 {
+			t.Errorf("%T: expected a ulid. Got %v", db, id)
+		}
+		if id, err := uuid.Parse(post("users")); err != nil || id.Version() != 7 {
+			t.Errorf("%T: expected a uuidv7. Got %v (%v)", db, id, err)
+		}
+
+		var wg sync.WaitGroup
+		values := make(chan int64, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := db.NextSequence("concurrent")
+				if err != nil {
+					t.Error(err)
+				}
+				values <- value
+			}()
+		}
+		wg.Wait()
+		close(values)
+		seen := make(map[int64]bool)
+		for value := range values {
+			if seen[value] || value < 1 || value > 20 {
+				t.Errorf("%T: unexpected sequence value %d", db, value)
+			}
+			seen[value] = true
+		}
+
+		for _, namespace := range db.GetNamespaces() {
+			if strings.HasPrefix(namespace, "_") {
+				t.Errorf("%T: unexpected namespace %v", db, namespace)
+			}
+		}
+		db.Disconnect()
+	}
+}
+
+func Test_UnitTest_Projection(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_projection")
+	os.MkdirAll("/tmp/caffeine_projection", os.ModePerm)
+
+	// the sqlite driver reads the fields itself, the memory one gets them projected by the server
+	for _, db := range []Database{
+		&database.MemDatabase{},
+		&database.SQLiteDatabase{DirPath: "/tmp/caffeine_projection/db.sqlite"},
+	} {
+		db.Init()
+		db.Upsert("people", "1", []byte(`{"name":"jack","age":25,"address":{"city":"paris","zip":"75001"},"nick":null}`), true)
+		db.Upsert("people", "2", []byte(`{"name":"john","age":40,"address":"unknown"}`), true)
+		server := Server{db: db, SearchTimeout: time.Second}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+		testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+		testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+
+		projectionTests := []struct {
+			path         string
+			expectedCode int
+			expected     string
+		}{
+			{"/dataset/people?format=2&fields=name,address.city", http.StatusOK, `[{"address":{"city":"paris"},"id":"1","name":"jack"},{"id":"2","name":"john"}]`},
+			{"/dataset/people?format=2&fields=address,address.zip,nick", http.StatusOK, `[{"address":{"city":"paris","zip":"75001"},"id":"1","nick":null},{"address":"unknown","id":"2"}]`},
+			{"/dataset/people?format=2&fields=missing.field", http.StatusOK, `[{"id":"1"},{"id":"2"}]`},
+			{"/dataset/people?format=2&transform=" + url.QueryEscape("select(.age > 30) | {id, n: .name}"), http.StatusOK, `[{"id":"2","n":"john"}]`},
+			{"/dataset/people?format=2&fields=age&transform=" + url.QueryEscape(".age"), http.StatusOK, `[25,40]`},
+			{"/dataset/people?format=2&ids=2,1&fields=name", http.StatusOK, `[{"id":"2","name":"john"},{"id":"1","name":"jack"}]`},
+			{"/dataset/people?transform=" + url.QueryEscape(".name +"), http.StatusBadRequest, ""},
+			{"/dataset/people?transform=" + url.QueryEscape(".name + 1"), http.StatusBadRequest, ""},
+			{"/dataset/people/1?fields=address.city,name", http.StatusOK, `{"address":{"city":"paris"},"name":"jack"}`},
+			{"/dataset/people/1?transform=" + url.QueryEscape(".address.city"), http.StatusOK, `"paris"`},
+			{"/dataset/people/3?fields=name", http.StatusNotFound, ""},
+			{"/dataset/people?transform=" + url.QueryEscape("[range(1e9)] | length"), http.StatusRequestTimeout, ""},
+			{"/dataset/people/1?transform=" + url.QueryEscape("last(range(1e9))"), http.StatusRequestTimeout, ""},
+			{"/search/people?filter=" + url.QueryEscape("select(.age < 30)") + "&fields=name", http.StatusOK, `{"results":[{"key":"1","value":{"name":"jack"}}]}`},
+			{"/search/people?filter=" + url.QueryEscape("select(.age > 0)") + "&transform=" + url.QueryEscape(".name"), http.StatusOK, `{"results":[{"key":"1","value":"jack"},{"key":"2","value":"john"}]}`},
+		}
+		for _, test := range projectionTests {
+			name := fmt.Sprintf("%T %v", db, test.path)
+			req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, name, test.expectedCode, response.Code)
+			if test.expected != "" {
+				checkResponse(t, name, response.Body.String(), test.expected)
+			}
+		}
+		db.Disconnect()
+	}
+}
+
+func Test_UnitTest_Listing(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_listing")
+	os.MkdirAll("/tmp/caffeine_listing", os.ModePerm)
+
+	// the sqlite driver runs the queries in sql, the memory one over a scan: both must give the same results
+	for _, db := range []Database{
+		&database.MemDatabase{},
+		&database.SQLiteDatabase{DirPath: "/tmp/caffeine_listing/db.sqlite"},
+	} {
+		db.Init()
+		db.Upsert("people", "1", []byte(`{"name":"jack","age":25,"status":"active","address":{"city":"paris"}}`), true)
+		db.Upsert("people", "2", []byte(`{"name":"john","age":40,"status":"inactive"}`), true)
+		db.Upsert("people", "3", []byte(`{"name":"anna","age":17,"status":"active","address":{"city":"lyon"}}`), true)
+		db.Upsert("people", "4", []byte(`{"name":"bob","age":"unknown","status":"active","vip":true}`), true)
+		db.Upsert("people", "5", []byte(`{"name":"carl","status":"active","address":"none"}`), true)
+		server := Server{db: db}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+
+		listingTests := []struct {
+			query        string
+			expectedCode int
+			expected     string
+		}{
+			{"where[age][gte]=18&where[status]=active&fields=name", http.StatusOK, `[{"id":"1","name":"jack"}]`},
+			{"where[address.city]=paris&fields=name", http.StatusOK, `[{"id":"1","name":"jack"}]`},
+			{"where[age][ne]=25&fields=age", http.StatusOK, `[{"age":40,"id":"2"},{"age":17,"id":"3"},{"age":"unknown","id":"4"},{"id":"5"}]`},
+			{"where[age][lt]=30&fields=name", http.StatusOK, `[{"id":"1","name":"jack"},{"id":"3","name":"anna"}]`},
+			{"where[name][gt]=c&fields=name", http.StatusOK, `[{"id":"1","name":"jack"},{"id":"2","name":"john"},{"id":"5","name":"carl"}]`},
+			{"where[vip]=true&fields=name", http.StatusOK, `[{"id":"4","name":"bob"}]`},
+			{"where[age]=%2225%22", http.StatusOK, `[]`},
+			{"sort=age&transform=.id", http.StatusOK, `["5","3","1","2","4"]`},
+			{"sort=-age,name&transform=.id", http.StatusOK, `["4","2","1","3","5"]`},
+			{"sort=address.city&limit=2&offset=1&transform=.id", http.StatusOK, `["4","5"]`},
+			{"where[status]=active&sort=-name&transform=.name", http.StatusOK, `["jack","carl","bob","anna"]`},
+			{"limit=2&offset=3&transform=.id", http.StatusOK, `["4","5"]`},
+			{"start=2&limit=2&transform=.id", http.StatusOK, `["2","3"]`},
+			{"offset=3&sort=address&transform=.id", http.StatusOK, `["1","3"]`},
+			{"where[age][foo]=1", http.StatusBadRequest, ""},
+			{"where[vip][gt]=true", http.StatusBadRequest, ""},
+			{"where=1", http.StatusBadRequest, ""},
+			{"limit=-1", http.StatusBadRequest, ""},
+			{"ids=1&sort=name", http.StatusBadRequest, ""},
+		}
+		for _, test := range listingTests {
+			name := fmt.Sprintf("%T %v", db, test.query)
+			req, _ := http.NewRequest(http.MethodGet, "/dataset/people?format=2&"+test.query, nil)
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, name, test.expectedCode, response.Code)
+			if test.expected != "" {
+				checkResponse(t, name, response.Body.String(), test.expected)
+			}
+		}
+		db.Disconnect()
+	}
+}
+
+func Test_UnitTest_SlurpSearch(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert("products", "1", []byte(`{"name":"a","price":10,"country":"fr"}`), true)
+	db.Upsert("products", "2", []byte(`{"name":"b","price":20,"country":"us"}`), true)
+	db.Upsert("products", "3", []byte(`{"name":"c","price":30,"country":"fr"}`), true)
+	db.Upsert("big", "1", []byte(`{"text":"`+strings.Repeat("x", 2000)+`"}`), true)
+	server := Server{db: db, SlurpMaxBytes: 1000, SearchTimeout: 200 * time.Millisecond}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+	testingRouter.AddHandler(DataSetCountPattern, server.dataSetCountHandler)
+
+	slurpTests := []struct {
+		path         string
+		expectedCode int
+		expected     string
+	}{
+		{"/search/products?slurp=true&filter=" + url.QueryEscape("map(.value.price) | add"), http.StatusOK, `{"results":[60]}`},
+		{"/search/products?slurp=true&filter=" + url.QueryEscape("group_by(.value.country)[] | {country: .[0].value.country, keys: map(.key)}"), http.StatusOK,
+			`{"results":[{"country":"fr","keys":["1","3"]},{"country":"us","keys":["2"]}]}`},
+		{"/search/products?slurp=true&transform=" + url.QueryEscape(".name") + "&filter=" + url.QueryEscape(".[] | .value | select(.price > 15)"), http.StatusOK, `{"results":["b","c"]}`},
+		{"/search/products?filter=" + url.QueryEscape(`select($__key == "2") | .name`), http.StatusOK, `{"results":[{"key":"2","value":"b"}]}`},
+		{"/dataset/products/_count?filter=" + url.QueryEscape(`$__key > "1"`), http.StatusOK, `{"count":2}`},
+		{"/search/big?slurp=true&filter=length", http.StatusRequestEntityTooLarge, ""},
+		{"/search/products?slurp=true&filter=" + url.QueryEscape("[range(1e9)] | length"), http.StatusRequestTimeout, ""},
+	}
+	for _, test := range slurpTests {
+		req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.path, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.path, response.Body.String(), test.expected)
+		}
+	}
+}
+
+func Test_UnitTest_PostSearch(t *testing.T) {
+	// several workers even on a single cpu, the results must still come in key order
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	db := &database.MemDatabase{}
+	db.Init()
+	expected := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%03d", i)
+		db.Upsert("items", key, []byte(fmt.Sprintf(`{"n":%d}`, i)), true)
+		if i%3 == 0 {
+			expected = append(expected, fmt.Sprintf(`{"key":"%v","value":%d}`, key, i))
+		}
+	}
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchPattern, server.searchHandler)
+
+	searchTests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expected     string
+	}{
+		{"workers keep the key order", `{"filter":"select(.n % 3 == 0) | .n"}`, http.StatusOK, `{"results":[` + strings.Join(expected, ",") + `]}`},
+		{"variables", `{"filter":"select(.n >= $min and .n < $max) | .n","variables":{"min":10,"$max":12}}`, http.StatusOK, `{"results":[{"key":"010","value":10},{"key":"011","value":11}]}`},
+		{"key variable", `{"filter":"select($__key == \"042\") | .n"}`, http.StatusOK, `{"results":[{"key":"042","value":42}]}`},
+		{"limit", `{"filter":".n","limit":2}`, http.StatusOK, `{"results":[{"key":"000","value":0},{"key":"001","value":1}]}`},
+		{"limit of an endless filter", `{"filter":"repeat(.) | .n","limit":2}`, http.StatusOK, `{"results":[{"key":"000","value":0},{"key":"000","value":0}]}`},
+		{"slurp", `{"filter":"map(.value.n) | add","slurp":true}`, http.StatusOK, `{"results":[19900]}`},
+		{"timeout", `{"filter":"select(.n == 0) | last(range(1e9))","timeout":"100ms"}`, http.StatusRequestTimeout, ""},
+		{"invalid timeout", `{"filter":".n","timeout":"soon"}`, http.StatusBadRequest, ""},
+		{"undefined variable", `{"filter":"$missing"}`, http.StatusBadRequest, ""},
+		{"reserved variable", `{"filter":".n","variables":{"__key":1}}`, http.StatusBadRequest, ""},
+		{"missing filter", `{"limit":1}`, http.StatusBadRequest, ""},
+		{"unknown field", `{"filter":".n","limits":1}`, http.StatusBadRequest, ""},
+	}
+	for _, test := range searchTests {
+		req, _ := http.NewRequest(http.MethodPost, "/search/items", strings.NewReader(test.body))
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expected)
+		}
+	}
+
+	// compiled once per text and variable names
+	first, _ := server.filters.get(".n", nil)
+	second, _ := server.filters.get(".n", nil)
+	if first != second {
+		t.Errorf("filter compiled twice")
+	}
+	if withVariables, _ := server.filters.get(".n", []string{"$a"}); withVariables == first {
+		t.Errorf("filter shared across variable names")
+	}
+}
+
+func Test_UnitTest_SearchNamespaces(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_search_namespaces")
+	os.MkdirAll("/tmp/caffeine_search_namespaces", os.ModePerm)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.WriteFile("/tmp/caffeine_search_namespaces/keyring.json", []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), os.ModePerm)
+
+	db := &database.EncryptedDatabase{
+		Backend:     &database.MemDatabase{},
+		KeyringPath: "/tmp/caffeine_search_namespaces/keyring.json",
+		Fields:      map[string][]database.EncryptedField{"cards": {{Pointer: "/customer"}}},
+	}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"customer":"c1","name":"jack"}`), true)
+	db.Upsert("users", "2", []byte(`{"customer":"c2","name":"john"}`), true)
+	db.Upsert("orders", "1", []byte(`{"customer":"c1","amount":10}`), true)
+	db.Upsert("orders", "2", []byte(`{"customer":"c1","amount":20}`), true)
+	db.Upsert("cards", "1", []byte(`{"customer":"c1","number":"4242"}`), true)
+	db.Upsert("users"+SchemaId, SchemaId, []byte(`{"customer":"c1"}`), true)
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchNamespacesPattern, server.searchNamespacesHandler, "namespaces", "{namespaces}", "filter", "{filter}")
+
+	found := `{"key":"1","namespace":"orders","value":10},{"key":"2","namespace":"orders","value":20},{"key":"1","namespace":"users","value":"jack"}`
+	searchTests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		expected     string
+	}{
+		{"all but the encrypted and schema namespaces", `namespaces=*&filter=select(.customer == "c1") | (.amount // .name)`, http.StatusOK, `{"results":[` + found + `],"skipped":["cards"]}`},
+		{"named namespaces", `namespaces=users,orders&filter=select(.customer == "c1") | (.amount // .name)`, http.StatusOK, `{"results":[` + found + `]}`},
+		{"limit and offset across namespaces", `namespaces=*&filter=select(.customer == "c1") | $__key&limit=2&offset=1`, http.StatusOK, `{"results":[{"key":"2","namespace":"orders","value":"2"},{"key":"1","namespace":"users","value":"1"}],"skipped":["cards"]}`},
+		{"nothing skipped", `namespaces=*&filter=.number // empty`, http.StatusOK, `{"results":[{"key":"1","namespace":"cards","value":"4242"}]}`},
+		{"encrypted namespace named", `namespaces=users,cards&filter=select(.customer == "c1")`, http.StatusBadRequest, ""},
+		{"encrypted namespace not read", `namespaces=cards&filter=.number`, http.StatusOK, `{"results":[{"key":"1","namespace":"cards","value":"4242"}]}`},
+		{"missing namespace", `namespaces=users,invoices&filter=.`, http.StatusBadRequest, ""},
+		{"schema namespace", `namespaces=users_schema&filter=.`, http.StatusBadRequest, ""},
+		{"invalid filter", `namespaces=*&filter=select(`, http.StatusBadRequest, ""},
+		{"invalid limit", `namespaces=*&filter=.&limit=-1`, http.StatusBadRequest, ""},
+	}
+	for _, test := range searchTests {
+		query, _ := url.ParseQuery(test.query)
+		req, _ := http.NewRequest(http.MethodGet, "/search?"+query.Encode(), nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expected)
+		}
+	}
+}
+
+// failingScans fails the scans of its namespaces with an error
+type failingScans struct {
+	*database.MemDatabase
+	errorCode database.ErrorCode
+}
+
+func (f failingScans) Scan(namespace string, fn database.ScanFunc) *database.DbError {
+	return &database.DbError{ErrorCode: f.errorCode, Message: "error on Scan"}
+}
+
+// failingMidScan fails the scans after their first document
+type failingMidScan struct {
+	*database.MemDatabase
+}
+
+func (f failingMidScan) Scan(namespace string, fn database.ScanFunc) *database.DbError {
+	return f.ScanRange(namespace, database.KeyRange{}, fn)
+}
+
+func (f failingMidScan) ScanRange(namespace string, r database.KeyRange, fn database.ScanFunc) *database.DbError {
+	f.MemDatabase.ScanRange(namespace, r, func(key string, value []byte) bool {
+		fn(key, value)
+		return false
+	})
+	return &database.DbError{ErrorCode: database.INTERNAL_ERROR, Message: "error on Scan"}
+}
+
+// a stream failing once started ends with the error, in a body the clients can still parse
+func Test_UnitTest_StreamErrors(t *testing.T) {
+	db := failingMidScan{&database.MemDatabase{}}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack"}`), true)
+	db.Upsert("users", "2", []byte(`{"name":"john"}`), true)
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/dataset/users", `[{"key":"1","value":{"id":"1","name":"jack"}},{"error":"error on Scan (error_code: 0)"}]`},
+		{"/dataset/users?format=2", `[{"id":"1","name":"jack"},{"error":"error on Scan (error_code: 0)"}]`},
+		{"/dataset/users?format=ndjson", "{\"id\":\"1\",\"name\":\"jack\"}\n{\"error\":\"error on Scan (error_code: 0)\"}\n"},
+		{"/search/users?filter=.name", `{"results":[{"key":"1","value":"jack"}],"error":"error on Scan (error_code: 0)"}`},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, tc.path, http.StatusOK, response.Code)
+		checkResponse(t, tc.path, response.Body.String(), tc.expected)
+	}
+}
+
+// failingGets fails the reads of the documents
+type failingGets struct {
+	*database.StorageDatabase
+}
+
+func (f failingGets) Get(namespace string, key string) ([]byte, *database.DbError) {
+	return nil, &database.DbError{ErrorCode: database.INTERNAL_ERROR, Message: "error on Get"}
+}
+
+// HEAD asks the driver whether the document exists, without reading it
+func Test_UnitTest_HeadExists(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_head")
+	db := failingGets{&database.StorageDatabase{RootDirPath: "/tmp/caffeine_head"}}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack"}`), true)
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+
+	req, _ := http.NewRequest(http.MethodHead, "/dataset/users/1", nil)
+	checkResponseCode(t, "head existing", http.StatusOK, testingRouter.ExecuteRequest(req).Code)
+	req, _ = http.NewRequest(http.MethodHead, "/dataset/users/2", nil)
+	checkResponseCode(t, "head missing", http.StatusNotFound, testingRouter.ExecuteRequest(req).Code)
+	req, _ = http.NewRequest(http.MethodGet, "/dataset/users/1", nil)
+	checkResponseCode(t, "get", http.StatusInternalServerError, testingRouter.ExecuteRequest(req).Code)
+}
+
+// the errors of the database are told apart from the ones of the request
+func Test_UnitTest_SearchErrors(t *testing.T) {
+	for _, test := range []struct {
+		errorCode    database.ErrorCode
+		expectedCode int
+	}{
+		{database.NAMESPACE_NOT_FOUND, http.StatusBadRequest},
+		{database.UNAVAILABLE, http.StatusServiceUnavailable},
+		{database.INTERNAL_ERROR, http.StatusInternalServerError},
+	} {
+		db := failingScans{&database.MemDatabase{}, test.errorCode}
+		db.Init()
+		db.Upsert("users", "1", []byte(`{"name":"jack"}`), true)
+		server := Server{db: db}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+		testingRouter.AddHandler(SearchNamespacesPattern, server.searchNamespacesHandler, "namespaces", "{namespaces}", "filter", "{filter}")
+
+		for _, path := range []string{"/search/users?filter=.", "/search?namespaces=users&filter=."} {
+			req, _ := http.NewRequest(http.MethodGet, path, nil)
+			checkResponseCode(t, fmt.Sprintf("%v with error %v", path, test.errorCode), test.expectedCode, testingRouter.ExecuteRequest(req).Code)
+		}
+	}
+}
+
+func Test_UnitTest_Views(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack","age":30}`), true)
+	db.Upsert("users", "2", []byte(`{"name":"john","age":12}`), true)
+	db.Upsert("orders", "1", []byte(`{"amount":10}`), true)
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+	testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	testingRouter.AddHandler(ViewHomePattern, server.viewsHandler)
+	testingRouter.AddHandler(ViewPattern, server.viewHandler)
+
+	execute := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		return testingRouter.ExecuteRequest(req)
+	}
+
+	viewTests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		expected     string
+	}{
+		{"create a view", http.MethodPut, "/views/adults", `{"namespace":"users","filter":"select(.age >= 18) | .name"}`, http.StatusCreated, ""},
+		{"create a materialized view", http.MethodPut, "/views/names", `{"namespace":"users","filter":"{name}","materialize":"user-names"}`, http.StatusCreated, ""},
+		{"read a view", http.MethodGet, "/views/adults", "", http.StatusOK, `{"results":[{"key":"1","value":"jack"}]}`},
+		{"read a materialized view", http.MethodGet, "/views/names", "", http.StatusOK, `{"results":[{"key":"1","value":{"name":"jack"}},{"key":"2","value":{"name":"john"}}]}`},
+		{"update a document", http.MethodPut, "/dataset/users/2", `{"name":"johnny","age":20}`, http.StatusCreated, ""},
+		{"add a document", http.MethodPut, "/dataset/users/3", `{"name":"jim","age":40}`, http.StatusCreated, ""},
+		{"delete a document", http.MethodDelete, "/dataset/users/1", "", http.StatusAccepted, ""},
+		{"view follows the writes", http.MethodGet, "/views/adults", "", http.StatusOK, `{"results":[{"key":"2","value":"johnny"},{"key":"3","value":"jim"}]}`},
+		{"materialized view follows the writes", http.MethodGet, "/views/names?fields=name", "", http.StatusOK, `{"results":[{"key":"2","value":{"name":"johnny"}},{"key":"3","value":{"name":"jim"}}]}`},
+		{"list the views", http.MethodGet, "/views", "", http.StatusOK, `[{"filter":"select(.age \u003e= 18) | .name","materialize":"","name":"adults","namespace":"users"},{"filter":"{name}","materialize":"user-names","name":"names","namespace":"users"}]`},
+		{"invalid filter", http.MethodPut, "/views/broken", `{"namespace":"users","filter":"select("}`, http.StatusBadRequest, ""},
+		{"unknown field", http.MethodPut, "/views/broken", `{"namespace":"users","filter":".","where":"."}`, http.StatusBadRequest, ""},
+		{"materialized in its source", http.MethodPut, "/views/broken", `{"namespace":"users","filter":".","materialize":"users"}`, http.StatusBadRequest, ""},
+		{"materialized in the namespace of another view", http.MethodPut, "/views/broken", `{"namespace":"orders","filter":".","materialize":"user-names"}`, http.StatusBadRequest, ""},
+		{"materialized in an existing namespace", http.MethodPut, "/views/broken", `{"namespace":"users","filter":".","materialize":"orders"}`, http.StatusConflict, ""},
+		{"missing view", http.MethodGet, "/views/broken", "", http.StatusNotFound, ""},
+		{"write a result of a view", http.MethodPut, "/dataset/user-names/2", `{"name":"jo"}`, http.StatusConflict, ""},
+		{"patch a result of a view", http.MethodPatch, "/dataset/user-names/2", `{"name":"jo"}`, http.StatusConflict, ""},
+		{"delete a result of a view", http.MethodDelete, "/dataset/user-names/2", "", http.StatusConflict, ""},
+		{"delete the results of a view", http.MethodDelete, "/dataset/user-names", "", http.StatusConflict, ""},
+		{"results of a view left", http.MethodGet, "/views/names", "", http.StatusOK, `{"results":[{"key":"2","value":{"name":"johnny"}},{"key":"3","value":{"name":"jim"}}]}`},
+	}
+	for _, test := range viewTests {
+		response := execute(test.method, test.path, test.body)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expected)
+		}
+	}
+
+	openAPI, err := server.generateOpenAPIMap(db.GetNamespaces())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := openAPI["paths"].(map[string]interface{})
+	if paths["/views/adults"] == nil || paths["/views/names"] == nil || paths["/ns/names_view"] != nil {
+		t.Errorf("views expected in the openapi paths, got %v", paths)
+	}
+
+	// the views are stored with the data, the materialized ones follow the writes made without the api
+	db.Upsert("users", "4", []byte(`{"name":"joe","age":50}`), true)
+	reloaded := Server{db: db}
+	reloaded.loadViews()
+	if len(reloaded.views.list()) != 2 {
+		t.Errorf("expected 2 views after a reload, got %v", len(reloaded.views.list()))
+	}
+	materialized, _ := db.Get("user-names", "4")
+	checkResponse(t, "materialized on a reload", string(materialized), `{"name":"joe"}`)
+
+	checkResponseCode(t, "delete a view", http.StatusAccepted, execute(http.MethodDelete, "/views/names", "").Code)
+	checkResponseCode(t, "deleted view", http.StatusNotFound, execute(http.MethodGet, "/views/names", "").Code)
+	if slices.Contains(db.GetNamespaces(), "user-names") {
+		t.Errorf("namespace of the deleted view left: %v", db.GetNamespaces())
+	}
+	reloaded = Server{db: db}
+	reloaded.loadViews()
+	if len(reloaded.views.list()) != 1 {
+		t.Errorf("expected 1 view after a delete, got %v", len(reloaded.views.list()))
+	}
+}
+
+func Test_UnitTest_LiveQuery(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack","age":30}`), true)
+	db.Upsert("users", "2", []byte(`{"name":"john","age":12}`), true)
+	server := Server{db: db}
+	router := mux.NewRouter()
+	router.HandleFunc(DataSetPattern, server.dataSetHandler)
+	router.HandleFunc(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	router.HandleFunc(LivePattern, server.liveQueryHandler).Queries("filter", "{filter}")
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + "/live/users?filter=" + url.QueryEscape("select(.age >= 18) | {name}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	checkResponseCode(t, "live query", http.StatusOK, response.StatusCode)
+	reader := bufio.NewReader(response.Body)
+	// next returns the next event as "<event> <data>"
+	next := func() string {
+		var event, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return event + " " + data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+	write := func(method string, path string, body string) {
+		req, _ := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	checkResponse(t, "current results", next(), `results {"results":[{"key":"1","value":{"name":"jack"}}]}`)
+	write(http.MethodPut, "/dataset/orders/1", `{"name":"jack","age":30}`)
+	write(http.MethodPut, "/dataset/users/2", `{"name":"john","age":20}`)
+	checkResponse(t, "document entering the results", next(), `added {"key":"2","value":{"name":"john"}}`)
+	write(http.MethodPut, "/dataset/users/1", `{"name":"jack","age":31}`)
+	write(http.MethodPut, "/dataset/users/1", `{"name":"jacky","age":31}`)
+	checkResponse(t, "result changed", next(), `changed {"key":"1","value":{"name":"jacky"}}`)
+	write(http.MethodPut, "/dataset/users/3", `{"name":"jim","age":5}`)
+	write(http.MethodPut, "/dataset/users/2", `{"name":"john","age":10}`)
+	checkResponse(t, "document leaving the results", next(), `removed {"key":"2"}`)
+	write(http.MethodDelete, "/dataset/users/3", "")
+	write(http.MethodDelete, "/dataset/users/1", "")
+	checkResponse(t, "document deleted", next(), `removed {"key":"1"}`)
+
+	invalid, err := http.Get(httpServer.URL + "/live/users?filter=" + url.QueryEscape("select("))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid.Body.Close()
+	checkResponseCode(t, "invalid filter", http.StatusBadRequest, invalid.StatusCode)
+
+	// with the authentication, the filter is given the data of the payloads like in the events
+	db.Upsert("accounts", "1", []byte(`{"user_id":"u1","data":{"name":"jack","age":30}}`), true)
+	authServer := Server{db: db, AuthEnabled: true}
+	authRouter := mux.NewRouter()
+	authRouter.HandleFunc(LivePattern, authServer.liveQueryHandler).Queries("filter", "{filter}")
+	authHttpServer := httptest.NewServer(authRouter)
+	defer authHttpServer.Close()
+	response, err = http.Get(authHttpServer.URL + "/live/accounts?filter=" + url.QueryEscape("select(.age >= 18) | {name}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader = bufio.NewReader(response.Body)
+	checkResponse(t, "current results of payloads", next(), `results {"results":[{"key":"1","value":{"name":"jack"}}]}`)
+}
+
+func Test_UnitTest_Aggregate(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_aggregate")
+	os.MkdirAll("/tmp/caffeine_aggregate", os.ModePerm)
+
+	// the sqlite driver groups with GROUP BY, the memory one over a scan: both must give the same results
+	for _, db := range []Database{
+		&database.MemDatabase{},
+		&database.SQLiteDatabase{DirPath: "/tmp/caffeine_aggregate/db.sqlite"},
+	} {
+		db.Init()
+		db.Upsert("orders", "1", []byte(`{"city":"paris","amount":10,"status":"paid"}`), true)
+		db.Upsert("orders", "2", []byte(`{"city":"paris","amount":5.5,"status":"paid"}`), true)
+		db.Upsert("orders", "3", []byte(`{"city":"lyon","amount":20,"status":"paid"}`), true)
+		db.Upsert("orders", "4", []byte(`{"city":"lyon","amount":"n/a","status":"paid"}`), true)
+		db.Upsert("orders", "5", []byte(`{"amount":7,"status":"refunded"}`), true)
+		db.Upsert("orders", "6", []byte(`{"city":"nice","amount":1,"status":"refunded"}`), true)
+		server := Server{db: db}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(AggregatePattern, server.aggregateHandler)
+
+		aggregateTests := []struct {
+			body         string
+			expectedCode int
+			expected     string
+		}{
+			{`{"match":{"/status":"paid"},"group":"/city","accumulators":{"count":{"count":""},"total":{"sum":"/amount"},"avg":{"avg":"/amount"},"min":{"min":"/amount"},"max":{"max":"/amount"}},"sort":"-total"}`,
+				http.StatusOK, `[{"avg":20,"count":2,"key":"lyon","max":20,"min":20,"total":20},{"avg":7.75,"count":2,"key":"paris","max":10,"min":5.5,"total":15.5}]`},
+			{`{"accumulators":{"count":{"count":""}}}`, http.StatusOK, `[{"count":6,"key":null}]`},
+			{`{"match":{"/status":"none"},"accumulators":{"count":{"count":""},"total":{"sum":"/amount"},"avg":{"avg":"/amount"}}}`, http.StatusOK, `[{"avg":null,"count":0,"key":null,"total":0}]`},
+			{`{"group":"/city","accumulators":{"count":{"count":""}},"limit":2}`, http.StatusOK, `[{"count":1,"key":null},{"count":2,"key":"lyon"}]`},
+			{`{"group":"/city","accumulators":{"count":{"count":""}},"sort":"-count,-key"}`, http.StatusOK, `[{"count":2,"key":"paris"},{"count":2,"key":"lyon"},{"count":1,"key":"nice"},{"count":1,"key":null}]`},
+			{`{"match":{"/amount":{"gte":7,"lt":20}},"accumulators":{"n":{"count":""}}}`, http.StatusOK, `[{"key":null,"n":2}]`},
+			{`{"accumulators":{"key":{"count":""}}}`, http.StatusBadRequest, ""},
+			{`{"accumulators":{"m":{"median":"/amount"}}}`, http.StatusBadRequest, ""},
+			{`{"group":"city"}`, http.StatusBadRequest, ""},
+			{`{"match":{"/status":{"gt":true}}}`, http.StatusBadRequest, ""},
+			{`{"sort":"total"}`, http.StatusBadRequest, ""},
+			{`{"groups":"/city"}`, http.StatusBadRequest, ""},
+		}
+		for _, test := range aggregateTests {
+			name := fmt.Sprintf("%T %v", db, test.body)
+			req, _ := http.NewRequest(http.MethodPost, "/aggregate/orders", strings.NewReader(test.body))
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, name, test.expectedCode, response.Code)
+			if test.expected != "" {
+				checkResponse(t, name, response.Body.String(), test.expected)
+			}
+		}
+		db.Disconnect()
+	}
+}
+
+func Test_UnitTest_Patch(t *testing.T) {
+	db := &database.MemDatabase{}
+	testingRouter := setupCaffeineTest(db)
+	db.Upsert("user", "1", []byte(`{"firstName":"jack","lastName":"smith","tags":[]}`), true)
+	db.Upsert("user"+SchemaId, SchemaId, []byte(getUserSchema()), true)
+
+	patchTests := []struct {
+		name         string
+		contentType  string
+		path         string
+		patch        string
+		expectedCode int
+		expected     string
+	}{
+		{"merge patch", MERGE_PATCH_CONTENT_TYPE, "/dataset/ns1/key1", `{"age":26,"city":"paris"}`, http.StatusOK, `{"age":26,"name":"jack","city":"paris"}`},
+		{"merge patch null removes", MERGE_PATCH_CONTENT_TYPE + "; charset=utf-8", "/dataset/ns1/key1", `{"city":null}`, http.StatusOK, `{"age":26,"name":"jack"}`},
+		{"json patch", JSON_PATCH_CONTENT_TYPE, "/dataset/ns1/key1", `[{"op":"test","path":"/age","value":26},{"op":"replace","path":"/name","value":"john"}]`, http.StatusOK, `{"age":26,"name":"john"}`},
+		{"json patch failed test", JSON_PATCH_CONTENT_TYPE, "/dataset/ns1/key1", `[{"op":"test","path":"/age","value":30},{"op":"remove","path":"/name"}]`, http.StatusConflict, ""},
+		{"json patch missing path", JSON_PATCH_CONTENT_TYPE, "/dataset/ns1/key1", `[{"op":"remove","path":"/missing"}]`, http.StatusBadRequest, ""},
+		{"invalid patch", JSON_PATCH_CONTENT_TYPE, "/dataset/ns1/key1", `{"op":`, http.StatusBadRequest, ""},
+		{"unsupported content type", "application/json", "/dataset/ns1/key1", `{"age":27}`, http.StatusUnsupportedMediaType, ""},
+		{"missing document", MERGE_PATCH_CONTENT_TYPE, "/dataset/ns1/missing", `{"age":27}`, http.StatusNotFound, ""},
+		{"result violating the schema", MERGE_PATCH_CONTENT_TYPE, "/dataset/user/1", `{"lastName":null}`, http.StatusBadRequest, ""},
+	}
+	for _, test := range patchTests {
+		req, _ := http.NewRequest(http.MethodPatch, test.path, strings.NewReader(test.patch))
+		req.Header.Set("Content-Type", test.contentType)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expected)
+		}
+	}
+	value, _ := db.Get(testNamespace, testKey)
+	checkResponse(t, "patched value", string(value), `{"age":26,"name":"john"}`)
+
+	// concurrent patches of the same document are all applied
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPatch, "/dataset/user/1", strings.NewReader(fmt.Sprintf(`[{"op":"add","path":"/tags/-","value":%d}]`, i)))
+			req.Header.Set("Content-Type", JSON_PATCH_CONTENT_TYPE)
+			checkResponseCode(t, "concurrent patch", http.StatusOK, testingRouter.ExecuteRequest(req).Code)
+		}(i)
+	}
+	wg.Wait()
+	var user struct {
+		Tags []int `json:"tags"`
+	}
+	value, _ = db.Get("user", "1")
+	json.Unmarshal(value, &user)
+	if len(user.Tags) != 50 {
+		t.Errorf("Expected 50 tags. Got %d", len(user.Tags))
+	}
+}
+
+// a patch publishes the patched value along with the patch
+func Test_UnitTest_PatchEvent(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack","age":30}`), true)
+	server := Server{db: db}
+	router := mux.NewRouter()
+	router.HandleFunc(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	sub := server.live.subscribe("users")
+	defer server.live.unsubscribe(sub)
+
+	req, _ := http.NewRequest(http.MethodPatch, "/dataset/users/1", strings.NewReader(`{"age":31}`))
+	req.Header.Set("Content-Type", MERGE_PATCH_CONTENT_TYPE)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	checkResponseCode(t, "patch", http.StatusOK, response.Code)
+
+	select {
+	case event := <-sub.events:
+		content, _ := json.Marshal(event)
+		checkResponse(t, "patch event", string(content), `{"event":"`+EVENT_ITEM_UPDATED+`","namespace":"users","key":"1","value":{"age":31,"name":"jack"},"patch":{"age":31}}`)
+	default:
+		t.Error("no event published for the patch")
+	}
+}
+
+func Test_UnitTest_TieredDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_tiered")
+
+	for _, mode := range []string{database.TIERED_WRITE_THROUGH, database.TIERED_WRITE_BEHIND} {
+		db := &database.TieredDatabase{
+			Cold:        &database.BoltDatabase{DirPath: "/tmp/caffeine_tiered/" + mode},
+			Mode:        mode,
+			JournalPath: "/tmp/caffeine_tiered/" + mode + "/tiered.journal",
+			MaxItems:    1,
+		}
+		testHandlers(db, t)
+	}
+}
+
+// slowWrites returns from the writes a little after applying them
+type slowWrites struct {
+	*database.MemDatabase
+}
+
+func (s slowWrites) Upsert(namespace string, key string, value []byte, allowOverWrite bool) *database.DbError {
+	defer time.Sleep(time.Duration(len(value)%3) * time.Millisecond)
+	return s.MemDatabase.Upsert(namespace, key, value, allowOverWrite)
+}
+
+func (s slowWrites) Delete(namespace string, key string) *database.DbError {
+	defer time.Sleep(time.Millisecond)
+	return s.MemDatabase.Delete(namespace, key)
+}
+
+// concurrent writes of a document leave the hot tier with the value of the cold one
+func Test_UnitTest_TieredDb_ConcurrentWrites(t *testing.T) {
+	cold := slowWrites{&database.MemDatabase{}}
+	db := &database.TieredDatabase{Cold: cold, Mode: database.TIERED_WRITE_THROUGH}
+	db.Init()
+	defer db.Disconnect()
+	for round := 0; round < 50; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if i%4 == 3 {
+					db.Delete("test", "key")
+				} else {
+					db.Upsert("test", "key", []byte(fmt.Sprintf(`{"v":%d}`, i)+strings.Repeat(" ", i)), true)
+				}
+			}(i)
+		}
+		wg.Wait()
+		hot, hotErr := db.Get("test", "key")
+		stored, coldErr := cold.Get("test", "key")
+		if string(hot) != string(stored) || (hotErr == nil) != (coldErr == nil) {
+			t.Fatalf("round %d: hot tier has %s (%v), cold tier %s (%v)", round, hot, hotErr, stored, coldErr)
+		}
+	}
+}
+
+// reads of the hot tier racing with the evictions of a small budget return the stored documents
+func Test_UnitTest_TieredDb_ConcurrentReads(t *testing.T) {
+	db := &database.TieredDatabase{Cold: &database.MemDatabase{}, Mode: database.TIERED_WRITE_THROUGH, MaxItems: 4}
+	db.Init()
+	defer db.Disconnect()
+	for i := 0; i < 16; i++ {
+		db.Upsert("test", strconv.Itoa(i), []byte(fmt.Sprintf(`{"v":%d}`, i)), true)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := strconv.Itoa((g + i) % 16)
+				value, err := db.Get("test", key)
+				if err != nil || string(value) != fmt.Sprintf(`{"v":%s}`, key) {
+					t.Errorf("key %s: got %s (%v)", key, value, err)
+					return
+				}
+				if i%50 == 0 {
+					keys := []string{key, strconv.Itoa((g + i + 5) % 16), strconv.Itoa((g + i + 10) % 16)}
+					values, err := db.GetMany("test", keys)
+					if err != nil || len(values) != 3 {
+						t.Errorf("keys %v: got %v (%v)", keys, values, err)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func Test_UnitTest_TieredDb_Journal(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_tiered_journal")
+	os.MkdirAll("/tmp/caffeine_tiered_journal", os.ModePerm)
+
+	// changes acknowledged by a previous run which crashed before flushing them
+	journal := `{"op":"upsert","namespace":"test","key":"1","value":"eyJhZ2UiOjI1fQ=="}
+{"op":"upsert","namespace":"test","key":"2","value":"eyJhZ2UiOjI1fQ=="}
+{"op":"delete","namespace":"test","key":"1"}
+{"op":"upsert","namespace":"te`
+	os.WriteFile("/tmp/caffeine_tiered_journal/tiered.journal", []byte(journal), os.ModePerm)
+
+	cold := &database.BoltDatabase{DirPath: "/tmp/caffeine_tiered_journal"}
+	db := &database.TieredDatabase{
+		Cold:        cold,
+		Mode:        database.TIERED_WRITE_BEHIND,
+		JournalPath: "/tmp/caffeine_tiered_journal/tiered.journal",
+		MaxItems:    2,
+		Warm:        []string{"test"},
+	}
+	db.Init()
+	data, err := cold.GetAll("test")
+	if err != nil || len(data) != 1 || string(data["2"]) != `{"age":25}` {
+		t.Errorf("journal not replayed: %v (%v)", data, err)
+	}
+
+	// the budget evicts the least recently used documents, they are read back from the cold tier
+	for _, key := range []string{"3", "4", "5"} {
+		if err := db.Upsert("test", key, []byte(jsonPayload), false); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Upsert("test", "2", []byte(jsonPayload), false); err == nil || err.ErrorCode != database.ITEM_CONFLICT {
+		t.Errorf("expected a conflict on an evicted document, got %v", err)
+	}
+	db.Disconnect()
+
+	cold = &database.BoltDatabase{DirPath: "/tmp/caffeine_tiered_journal"}
+	cold.Init()
+	data, err = cold.GetAll("test")
+	if err != nil || len(data) != 4 {
+		t.Errorf("Expected 4 flushed documents. Got %v (%v)", data, err)
+	}
+	cold.Disconnect()
+	if info, err := os.Stat("/tmp/caffeine_tiered_journal/tiered.journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal not truncated: %v (%v)", info, err)
+	}
+}
+
+func Test_UnitTest_CompressedDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_compressed")
+
+	db := &database.CompressedDatabase{
+		Backend:    &database.StorageDatabase{RootDirPath: "/tmp/caffeine_compressed"},
+		Namespaces: map[string]string{"*": database.COMPRESSION_ZSTD},
+	}
+	testHandlers(db, t)
+
+	// plain values written before compression was enabled are read as is, then recompressed by the job
+	plain := &database.StorageDatabase{RootDirPath: "/tmp/caffeine_compressed"}
+	plain.Init()
+	document := []byte(strings.Repeat(jsonPayload, 10))
+	plain.Upsert("logs", "old", document, true)
+
+	db.Namespaces = map[string]string{"logs": database.COMPRESSION_GZIP}
+	db.Init()
+	db.Upsert("logs", "new", document, true)
+	for _, key := range []string{"old", "new"} {
+		value, err := db.Get("logs", key)
+		if err != nil || string(value) != string(document) {
+			t.Errorf("unexpected value for %v: %s (%v)", key, value, err)
+		}
+	}
+	if _, err := db.Recompress("logs"); err != nil {
+		t.Error(err)
+	}
+	if count, _ := db.Recompress("logs"); count != 0 {
+		t.Errorf("Expected nothing left to recompress. Got %d", count)
+	}
+	db.Disconnect()
+	stored, _ := plain.Get("logs", "old")
+	if len(stored) >= len(document) || stored[0] != 0 {
+		t.Errorf("Expected a compressed value. Got %d bytes", len(stored))
+	}
+}
+
+func Test_UnitTest_EncryptedDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_encrypted")
+	os.MkdirAll("/tmp/caffeine_encrypted", os.ModePerm)
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	os.WriteFile("/tmp/caffeine_encrypted/keyring.json", []byte(`{"active":"k1","keys":{"k1":"`+key1+`"}}`), os.ModePerm)
+
+	plain := &database.StorageDatabase{RootDirPath: "/tmp/caffeine_encrypted/data"}
+	db := &database.EncryptedDatabase{
+		Backend:     plain,
+		KeyringPath: "/tmp/caffeine_encrypted/keyring.json",
+		Fields: map[string][]database.EncryptedField{
+			"users": {{Pointer: "/ssn"}, {Pointer: "/contact/email", Deterministic: true}},
+		},
+	}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"contact":{"email":"jack@mail.com"},"name":"jack","ssn":"123-45-6789"}`), false)
+	db.Upsert("users", "2", []byte(`{"contact":{"email":"jack@mail.com"},"name":"jack","ssn":"123-45-6789"}`), false)
+
+	stored1, _ := plain.Get("users", "1")
+	stored2, _ := plain.Get("users", "2")
+	if strings.Contains(string(stored1), "123-45-6789") || strings.Contains(string(stored1), "jack@mail.com") {
+		t.Errorf("Expected encrypted fields. Got %s", stored1)
+	}
+	var doc1, doc2 map[string]map[string]interface{}
+	json.Unmarshal(stored1, &doc1)
+	json.Unmarshal(stored2, &doc2)
+	if doc1["contact"]["email"] != doc2["contact"]["email"] {
+		t.Error("Expected equal ciphertexts for a deterministic field")
+	}
+	value, _ := db.Get("users", "1")
+	checkResponse(t, "decrypted document", string(value), `{"contact":{"email":"jack@mail.com"},"name":"jack","ssn":"123-45-6789"}`)
+
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+	testingRouter.AddHandler(ReencryptPattern, server.reencryptHandler)
+	for filter, expectedCode := range map[string]int{
+		`select(.ssn == "123-45-6789")`:                  http.StatusBadRequest,
+		`select(.contact.email | startswith("jack"))`:    http.StatusBadRequest,
+		`select(.contact.email == "jack@mail.com")`:      http.StatusOK,
+		`select(.name == "jack") | {name, id: .["ssn"]}`: http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "/search/users?filter="+url.QueryEscape(filter), nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, "search "+filter, expectedCode, response.Code)
+	}
+	// the filters getting to the encrypted fields without naming them only see tokens, the outputs are decrypted
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/search/users?filter=" + url.QueryEscape(`select(.. == "123-45-6789")`), `{"results":[]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select(tostring | contains("123-45"))`), `{"results":[]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select(getpath(["ssn"]) | startswith("123"))`), `{"results":[]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select(to_entries[] | .value == "123-45-6789")`), `{"results":[]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select(.contact.email == "jack@mail.com") | .name`), `{"results":[{"key":"1","value":"jack"},{"key":"2","value":"jack"}]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select(.contact.email != "jack@mail.com")`), `{"results":[]}`},
+		{"/search/users?filter=" + url.QueryEscape(`select($__key == "1")`), `{"results":[{"key":"1","value":{"contact":{"email":"jack@mail.com"},"name":"jack","ssn":"123-45-6789"}}]}`},
+		{"/search/users?slurp=true&filter=" + url.QueryEscape(`map(select(.value | tostring | contains("jack@"))) | length`), `{"results":[0]}`},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, tc.path, http.StatusOK, response.Code)
+		checkResponse(t, tc.path, response.Body.String(), tc.expected)
+	}
+
+	testingRouter.AddHandler(DataSetPattern, server.dataSetHandler)
+	for _, tc := range []struct {
+		query        string
+		expectedCode int
+	}{
+		{"where[contact.email]=jack@mail.com", http.StatusOK},
+		{"where[contact.email][ne]=jack@mail.com", http.StatusBadRequest},
+		{"where[ssn]=123-45-6789", http.StatusBadRequest},
+		{"where[ssn][gt]=1", http.StatusBadRequest},
+		{"sort=contact.email", http.StatusBadRequest},
+		{"sort=-ssn", http.StatusBadRequest},
+		{"sort=name", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "/dataset/users?"+tc.query, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, "listing "+tc.query, tc.expectedCode, response.Code)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/dataset/users?where[contact.email]=jack@mail.com&fields=name", nil)
+	response := testingRouter.ExecuteRequest(req)
+	checkResponse(t, "listing on a deterministic field", response.Body.String(), `[{"key":"1","value":{"id":"1","name":"jack"}},{"key":"2","value":{"id":"2","name":"jack"}}]`)
+
+	testingRouter.AddHandler(AggregatePattern, server.aggregateHandler)
+	for _, tc := range []struct {
+		body         string
+		expectedCode int
+		expected     string
+	}{
+		{`{"match":{"/contact/email":"jack@mail.com"},"accumulators":{"n":{"count":""}}}`, http.StatusOK, `[{"key":null,"n":2}]`},
+		{`{"match":{"/ssn":"123-45-6789"},"accumulators":{"n":{"count":""}}}`, http.StatusBadRequest, ""},
+		{`{"match":{"/contact/email":{"gt":"jack"}},"accumulators":{"n":{"count":""}}}`, http.StatusBadRequest, ""},
+		{`{"match":{"/contact":{"ne":"x"}},"accumulators":{"n":{"count":""}}}`, http.StatusBadRequest, ""},
+		{`{"group":"/contact/email","accumulators":{"n":{"count":""}}}`, http.StatusBadRequest, ""},
+		{`{"accumulators":{"n":{"max":"/ssn"}}}`, http.StatusBadRequest, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/aggregate/users", strings.NewReader(tc.body))
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, "aggregate "+tc.body, tc.expectedCode, response.Code)
+		if tc.expected != "" {
+			checkResponse(t, "aggregate "+tc.body, response.Body.String(), tc.expected)
+		}
+	}
+
+	// a value of the first format, the key itself used for AES-GCM, is read then migrated by the re-encryption
+	block, _ := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	legacy := "enc:r:k1:" + base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(`"999-99-9999"`), []byte("users\x00/ssn")))
+	plain.Upsert("users", "3", []byte(`{"name":"old","ssn":"`+legacy+`"}`), false)
+	value, _ = db.Get("users", "3")
+	checkResponse(t, "decrypted legacy value", string(value), `{"name":"old","ssn":"999-99-9999"}`)
+	if count, _ := db.Reencrypt("users"); count != 1 {
+		t.Errorf("Expected the legacy value re-encrypted. Got %d", count)
+	}
+
+	// rotation, the documents are rewritten with the new active key
+	db.Disconnect()
+	os.WriteFile("/tmp/caffeine_encrypted/keyring.json", []byte(`{"active":"k2","keys":{"k1":"`+key1+`","k2":"`+key2+`"}}`), os.ModePerm)
+	db.Init()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/reencrypt/users", nil)
+	response = testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "reencrypt", http.StatusAccepted, response.Code)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, running := server.reencrypting.Load("users"); !running {
+			break
+		}
+	}
+	stored1, _ = plain.Get("users", "1")
+	if !strings.Contains(string(stored1), "enc:r2:k2:") || strings.Contains(string(stored1), ":k1:") {
+		t.Errorf("Expected fields encrypted with k2. Got %s", stored1)
+	}
+	if count, _ := db.Reencrypt("users"); count != 0 {
+		t.Errorf("Expected nothing left to re-encrypt. Got %d", count)
+	}
+	value, _ = db.Get("users", "2")
+	checkResponse(t, "decrypted after rotation", string(value), `{"contact":{"email":"jack@mail.com"},"name":"jack","ssn":"123-45-6789"}`)
+	value, _ = db.Get("users", "3")
+	checkResponse(t, "legacy value after rotation", string(value), `{"name":"old","ssn":"999-99-9999"}`)
+}
+
+func Test_UnitTest_EncryptedDb_Auth(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_encrypted_auth")
+	os.MkdirAll("/tmp/caffeine_encrypted_auth", os.ModePerm)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.WriteFile("/tmp/caffeine_encrypted_auth/keyring.json", []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), os.ModePerm)
+
+	// with the authentication, the documents are stored in the data of a payload
+	plain := &database.MemDatabase{}
+	db := &database.EncryptedDatabase{
+		Backend:     plain,
+		KeyringPath: "/tmp/caffeine_encrypted_auth/keyring.json",
+		Fields:      map[string][]database.EncryptedField{"users": {{Pointer: "/ssn"}}},
+		Envelope:    "/data",
+	}
+	db.Init()
+	server := Server{db: db, AuthEnabled: true}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+
+	req, _ := http.NewRequest(http.MethodPut, "/dataset/users/1", strings.NewReader(`{"name":"bob","ssn":"123-45-6789"}`))
+	req.Header.Set(USER_HEADER, "bob")
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "put with auth", http.StatusCreated, response.Code)
+	stored, _ := plain.Get("users", "1")
+	if strings.Contains(string(stored), "123-45-6789") || !strings.Contains(string(stored), `"ssn":"enc:r2:k1:`) {
+		t.Errorf("Expected the field of the payload encrypted. Got %s", stored)
+	}
+	value, _ := db.Get("users", "1")
+	checkResponse(t, "decrypted payload", string(value), `{"data":{"name":"bob","ssn":"123-45-6789"},"user_id":"bob"}`)
+
+	// the filters given the payloads don't see the field either
+	req, _ = http.NewRequest(http.MethodGet, "/search/users?filter="+url.QueryEscape(`select(.. == "123-45-6789")`), nil)
+	response = testingRouter.ExecuteRequest(req)
+	checkResponse(t, "search the payloads", response.Body.String(), `{"results":[]}`)
+
+	// a client value in the format of the ciphertexts would fail the reads of the namespace
+	req, _ = http.NewRequest(http.MethodPut, "/dataset/users/2", strings.NewReader(`{"name":"eve","ssn":"enc:r2:k1:AAAA"}`))
+	req.Header.Set(USER_HEADER, "eve")
+	response = testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "put a forged ciphertext", http.StatusBadRequest, response.Code)
+	if _, err := plain.Get("users", "2"); err == nil {
+		t.Error("Expected the forged ciphertext not stored")
+	}
+}
+
+func Test_UnitTest_IndexedDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_indexed")
+
+	fields := map[string][]string{"articles": {"/title", "/tags"}}
+	db := &database.IndexedDatabase{Backend: &database.StorageDatabase{RootDirPath: "/tmp/caffeine_indexed"}, Fields: fields, Stemming: true}
+	db.Init()
+	db.Upsert("articles", "1", []byte(`{"title":"Searching the docs","tags":["search"]}`), true)
+	db.Upsert("articles", "2", []byte(`{"title":"A long article about cooking, with a single search among many other words","tags":[]}`), true)
+	db.Upsert("articles", "3", []byte(`{"title":"Running shoes","body":"search"}`), true)
+	db.Upsert("articles", "4", []byte(`{"title":"searched"}`), true)
+	db.Delete("articles", "4")
+	db.Upsert("notes", "1", []byte(`{"title":"search"}`), true)
+
+	searchTests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expected     string
+	}{
+		{"ranked by bm25", "/search/articles?q=searches", http.StatusOK, `{"results":[{"key":"1","value":{"tags":["search"],"title":"Searching the docs"}},{"key":"2","value":{"tags":[],"title":"A long article about cooking, with a single search among many other words"}}]}`},
+		{"stemmed", "/search/articles?q=RUNS&fields=title", http.StatusOK, `{"results":[{"key":"3","value":{"title":"Running shoes"}}]}`},
+		{"any of the terms", "/search/articles?q=shoe%20laces&fields=title", http.StatusOK, `{"results":[{"key":"3","value":{"title":"Running shoes"}}]}`},
+		{"unknown term", "/search/articles?q=laces", http.StatusOK, `{"results":[]}`},
+		{"no term", "/search/articles?q=%2C", http.StatusBadRequest, ""},
+		{"namespace not indexed", "/search/notes?q=search", http.StatusNotImplemented, ""},
+	}
+	check := func(db Database) {
+		server := Server{db: db}
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(SearchPattern, server.fullTextSearchHandler, "q", "{q}")
+		for _, test := range searchTests {
+			req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+			response := testingRouter.ExecuteRequest(req)
+			checkResponseCode(t, test.name, test.expectedCode, response.Code)
+			if test.expected != "" {
+				checkResponse(t, test.name, response.Body.String(), test.expected)
+			}
+		}
+	}
+	check(db)
+	db.Disconnect()
+
+	// rebuilt from the stored documents
+	db = &database.IndexedDatabase{Backend: &database.StorageDatabase{RootDirPath: "/tmp/caffeine_indexed"}, Fields: fields, Stemming: true}
+	db.Init()
+	check(db)
+
+	db.DeleteAll("articles")
+	if docs, _ := db.FullTextSearch("articles", "search"); len(docs) != 0 {
+		t.Errorf("Expected an empty index after DeleteAll. Got %v documents", len(docs))
+	}
+}
+
+func Test_UnitTest_IndexedEncryptedDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_indexed_encrypted")
+	os.MkdirAll("/tmp/caffeine_indexed_encrypted", os.ModePerm)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.WriteFile("/tmp/caffeine_indexed_encrypted/keyring.json", []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), os.ModePerm)
+
+	// the text index in front of the encryption, like main does: the encrypted fields must stay protected
+	plain := &database.MemDatabase{}
+	db := &database.IndexedDatabase{
+		Backend: &database.EncryptedDatabase{
+			Backend:     plain,
+			KeyringPath: "/tmp/caffeine_indexed_encrypted/keyring.json",
+			Fields:      map[string][]database.EncryptedField{"users": {{Pointer: "/ssn"}}},
+		},
+		Fields: map[string][]string{"users": {"/name"}},
+	}
+	db.Init()
+	db.Upsert("users", "1", []byte(`{"name":"jack black","ssn":"123-45-6789"}`), true)
+	stored, _ := plain.Get("users", "1")
+	if strings.Contains(string(stored), "123-45-6789") {
+		t.Errorf("Expected encrypted fields. Got %s", stored)
+	}
+
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchPattern, server.fullTextSearchHandler, "q", "{q}")
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+	testingRouter.AddHandler(ReencryptPattern, server.reencryptHandler)
+	searchTests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expected     string
+	}{
+		{"full text search", "/search/users?q=black&fields=name", http.StatusOK, `{"results":[{"key":"1","value":{"name":"jack black"}}]}`},
+		{"encrypted field searched", "/search/users?filter=" + url.QueryEscape(`select(.ssn == "123-45-6789")`), http.StatusBadRequest, ""},
+		{"plain field searched", "/search/users?filter=" + url.QueryEscape(`select(.name == "jack black") | .name`), http.StatusOK, `{"results":[{"key":"1","value":"jack black"}]}`},
+	}
+	for _, test := range searchTests {
+		req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+		if test.expected != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expected)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/admin/reencrypt/users", nil)
+	checkResponseCode(t, "reencrypt through the index", http.StatusAccepted, testingRouter.ExecuteRequest(req).Code)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, running := server.reencrypting.Load("users"); !running {
+			break
+		}
+	}
+}
+
+func Test_UnitTest_GeoSearch(t *testing.T) {
+	db := &database.IndexedDatabase{Backend: &database.MemDatabase{}, GeoFields: map[string]string{"places": "/location"}}
+	db.Init()
+	place := func(lng float64, lat float64) []byte {
+		return []byte(fmt.Sprintf(`{"location":{"type":"Point","coordinates":[%v,%v]}}`, lng, lat))
+	}
+	db.Upsert("places", "louvre", place(2.3376, 48.8606), true)
+	db.Upsert("places", "notre-dame", place(2.3499, 48.8530), true)
+	db.Upsert("places", "eiffel", place(2.2945, 48.8584), true)
+	db.Upsert("places", "lyon", place(4.8357, 45.7640), true)
+	db.Upsert("places", "suva", place(179.99, -17.7), true)
+	db.Upsert("places", "nowhere", []byte(`{"location":"paris"}`), true)
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(SearchPattern, server.geoSearchHandler, "near", "{near}")
+	testingRouter.AddHandler(SearchPattern, server.geoSearchHandler, "bbox", "{bbox}")
+
+	search := func(name string, query string, expectedCode int, expected []string) {
+		req, _ := http.NewRequest(http.MethodGet, "/search/places?"+query, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, name, expectedCode, response.Code)
+		if expectedCode != http.StatusOK {
+			return
+		}
+		var body struct {
+			Results []struct {
+				Key      string  `json:"key"`
+				Distance float64 `json:"distance"`
+			} `json:"results"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &body)
+		keys := make([]string, 0, len(body.Results))
+		for i, result := range body.Results {
+			keys = append(keys, result.Key)
+			if i > 0 && result.Distance < body.Results[i-1].Distance {
+				t.Errorf("%v: results not sorted by distance %v", name, response.Body.String())
+			}
+		}
+		checkResponse(t, name, strings.Join(keys, ","), strings.Join(expected, ","))
+	}
+
+	search("within radius", "near=48.8566,2.3522&radius=2km", http.StatusOK, []string{"notre-dame", "louvre"})
+	search("radius in meters", "near=48.8566,2.3522&radius=500", http.StatusOK, []string{"notre-dame"})
+	search("nearest", "near=48.8566,2.3522&limit=3", http.StatusOK, []string{"notre-dame", "louvre", "eiffel"})
+	search("bbox from its center", "bbox=2.2,48.8,2.34,48.9", http.StatusOK, []string{"eiffel", "louvre"})
+	search("bbox and radius", "near=48.8566,2.3522&radius=2km&bbox=2.34,48.8,2.4,48.9", http.StatusOK, []string{"notre-dame"})
+	search("across the antimeridian", "near=-17.7,-179.99&radius=5km", http.StatusOK, []string{"suva"})
+	search("invalid near", "near=91,0", http.StatusBadRequest, nil)
+	search("radius without near", "bbox=2,48,3,49&radius=1km", http.StatusBadRequest, nil)
+	search("invalid radius", "near=48.8566,2.3522&radius=5mi", http.StatusBadRequest, nil)
+	search("invalid bbox", "bbox=3,48,2,49", http.StatusBadRequest, nil)
+
+	// the index follows the writes
+	db.Upsert("places", "louvre", place(4.8357, 45.7640), true)
+	db.Delete("places", "notre-dame")
+	search("after writes", "near=48.8566,2.3522&radius=2km", http.StatusOK, []string{})
+	search("moved", "near=45.7640,4.8357&radius=1m", http.StatusOK, []string{"louvre", "lyon"})
+
+	db.Upsert("other", "1", place(2.3376, 48.8606), true)
+	req, _ := http.NewRequest(http.MethodGet, "/search/other?near=48.8566,2.3522", nil)
+	checkResponseCode(t, "namespace without geo field", http.StatusNotImplemented, testingRouter.ExecuteRequest(req).Code)
+
+	// a text index in front of a driver with its own geo index (mongo) leaves the geo searches to it
+	outer := &database.IndexedDatabase{
+		Backend: &database.IndexedDatabase{Backend: &database.MemDatabase{}, GeoFields: map[string]string{"places": "/location"}},
+		Fields:  map[string][]string{"places": {"/name"}},
+	}
+	outer.Init()
+	outer.Upsert("places", "louvre", place(2.3376, 48.8606), true)
+	outer.Upsert("places", "lyon", place(4.8357, 45.7640), true)
+	server.db = outer
+	search("native geo index", "near=48.8566,2.3522&radius=2km", http.StatusOK, []string{"louvre"})
+}
+
+func Test_UnitTest_S3Db(t *testing.T) {
+	fake := newFakeS3(2) // small pages to go through the paginated listing
+	defer fake.Close()
+
+	db := &database.S3Database{
+		Endpoint:  strings.TrimPrefix(fake.URL, "http://"),
+		Bucket:    "caffeine",
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+	}
+	testHandlers(db, t)
+
+	db.Init()
+	for i := 0; i < 5; i++ {
+		db.Upsert("paged", fmt.Sprint(i), []byte(jsonPayload), false)
+	}
+	data, err := db.GetAll("paged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 5 {
+		t.Errorf("Expected 5 documents. Got %d", len(data))
+	}
+	err = db.Upsert("paged", "1", []byte(jsonPayload), false)
+	if err == nil || err.ErrorCode != database.ITEM_CONFLICT {
+		t.Errorf("Expected conflict on existing key. Got %v", err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		if value, err := db.NextSequence("paged"); err != nil || value != i {
+			t.Errorf("Expected sequence %d. Got %d (%v)", i, value, err)
+		}
+	}
+	if diff := cmp.Diff([]string{"ns1", "paged", "test", "user", "user_schema"}, db.GetNamespaces()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_UnitTest_GitDb(t *testing.T) {
+	db := &database.GitDatabase{
+		DirPath: "/tmp/caffeine_git",
+	}
+	testHandlers(db, t)
+	defer os.RemoveAll("/tmp/caffeine_git")
+
+	testingRouter := setupCaffeineTest(db)
+	req, _ := http.NewRequest(http.MethodPut, "/dataset/"+testNamespace+"/"+testKey, strings.NewReader(`{"age":26,"name":"jack"}`))
+	req.Header.Set(USER_HEADER, "alice")
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "test git upsert", http.StatusCreated, response.Code)
+
+	repo, err := git.PlainOpen("/tmp/caffeine_git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.Name != "alice" || commit.Message != "upsert ns1/key1" {
+		t.Errorf("unexpected commit %v by %v", commit.Message, commit.Author.Name)
+	}
+	// an empty namespace has no file to remove
+	db.CreateNameSpace("empty")
+	if dbErr := db.DeleteAll("empty"); dbErr != nil {
+		t.Errorf("delete all of an empty namespace: %v", dbErr)
+	}
+	if dbErr := db.DropNameSpace("empty"); dbErr != nil {
+		t.Errorf("drop of an empty namespace: %v", dbErr)
+	}
+
+	// the user goes through the wrappers to the commits
+	defer os.RemoveAll("/tmp/caffeine_git_compressed")
+	wrapped := &database.IndexedDatabase{
+		Backend: &database.CompressedDatabase{
+			Backend:    &database.GitDatabase{DirPath: "/tmp/caffeine_git_compressed"},
+			Namespaces: map[string]string{"*": database.COMPRESSION_ZSTD},
+		},
+		Fields: map[string][]string{testNamespace: {"/name"}},
+	}
+	testingRouter = setupCaffeineTest(wrapped)
+	defer wrapped.Disconnect()
+	repo, err = git.PlainOpen("/tmp/caffeine_git_compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, _ = http.NewRequest(method, "/dataset/"+testNamespace+"/"+testKey, strings.NewReader(`{"age":26,"name":"jack"}`))
+		req.Header.Set(USER_HEADER, "bob")
+		testingRouter.ExecuteRequest(req)
+		head, err = repo.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, err = repo.CommitObject(head.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commit.Author.Name != "bob" {
+			t.Errorf("unexpected %v commit %v by %v", method, commit.Message, commit.Author.Name)
+		}
+	}
+}
+
+func Test_UnitTest_ClusterDb(t *testing.T) {
+	defer os.RemoveAll("/tmp/caffeine_cluster")
+
+	// free ports, like separate processes would be given
+	freeAddress := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		return listener.Addr().String()
+	}
+	peers := []string{freeAddress() + "=" + freeAddress(), freeAddress() + "=" + freeAddress(), freeAddress() + "=" + freeAddress()}
+	nodes := make([]*database.ClusterDatabase, 0)
+	for i, peer := range peers {
+		httpAddress, raftAddress, _ := strings.Cut(peer, "=")
+		node := &database.ClusterDatabase{
+			HttpAddress: httpAddress,
+			RaftAddress: raftAddress,
+			Peers:       peers,
+			DirPath:     fmt.Sprintf("/tmp/caffeine_cluster/node%d", i),
+			Secret:      "cluster-secret",
+		}
+		node.Init()
+		nodes = append(nodes, node)
+	}
+
+	waitForLeader := func(nodes []*database.ClusterDatabase) (leader *database.ClusterDatabase, followers []*database.ClusterDatabase) {
+		for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			followers = nil
+			for _, node := range nodes {
+				if node.IsLeader() {
+					leader = node
+				} else {
+					followers = append(followers, node)
+				}
+			}
+			if leader != nil {
+				return
+			}
+		}
+		t.Fatal("no leader elected")
+		return
+	}
+	leader, followers := waitForLeader(nodes)
+
+	// writes on a follower are forwarded to the leader, linearizable reads see them on any node
+	server := Server{db: followers[0]}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(DataSetKeyValuePattern, server.dataSetKeyValueHandler)
+	req, _ := http.NewRequest(http.MethodPost, "/dataset/test/1", strings.NewReader(jsonPayload))
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "test cluster post on follower", http.StatusCreated, response.Code)
+	req, _ = http.NewRequest(http.MethodPost, "/dataset/test/1", strings.NewReader(jsonPayload))
+	response = testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "test cluster post conflict", http.StatusConflict, response.Code)
+	for _, node := range nodes {
+		value, err := node.Get("test", "1")
+		if err != nil || string(value) != jsonPayload {
+			t.Errorf("unexpected value %s (%v)", value, err)
+		}
+	}
+
+	// sequences go through the log, every node continues from the same value
+	for i, node := range nodes {
+		if value, err := node.NextSequence("test"); err != nil || value != int64(i+1) {
+			t.Errorf("Expected sequence %d. Got %d (%v)", i+1, value, err)
+		}
+	}
+
+	// the events of a write reach the live queries of every node, once
+	servers := []*Server{&server, {db: followers[1]}, {db: leader}}
+	subscriptions := make([]*liveSubscription, 0)
+	for _, node := range servers {
+		node.receiveEvents()
+		subscriptions = append(subscriptions, node.live.subscribe("events"))
+	}
+	req, _ = http.NewRequest(http.MethodPut, "/dataset/events/1", strings.NewReader(`{"n":1}`))
+	response = testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "test cluster put", http.StatusCreated, response.Code)
+	for i, sub := range subscriptions {
+		select {
+		case event := <-sub.events:
+			if event.Event != EVENT_ITEM_UPDATED || event.Key != "1" || !cmp.Equal(event.Value, map[string]interface{}{"n": float64(1)}) {
+				t.Errorf("unexpected event %+v on node %d", event, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event on node %d", i)
+		}
+		select {
+		case event := <-sub.events:
+			t.Errorf("unexpected second event %+v on node %d", event, i)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// the forwarding endpoint refuses the requests without the secret of the cluster
+	forwarded, postErr := http.Post("http://"+leader.HttpAddress+"/cluster/forward", "application/json", strings.NewReader(`{"op":"delete_all","namespace":"test"}`))
+	if postErr != nil {
+		t.Fatal(postErr)
+	}
+	forwarded.Body.Close()
+	checkResponseCode(t, "forward without secret", http.StatusForbidden, forwarded.StatusCode)
+
+	// stale reads are served by each node from its own copy, which catches up shortly after
+	followers[1].StaleReads = true
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		value, err := followers[1].Get("test", "1")
+		if err == nil && string(value) == jsonPayload {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale read never caught up: %s (%v)", value, err)
+		}
+	}
+	followers[1].StaleReads = false
+
+	// the scans read several pages in key order, the range bounds them
+	for i := 0; i < 300; i++ {
+		if err := leader.Upsert("pages", fmt.Sprintf("%03d", i), []byte(jsonPayload), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanned := make([]string, 0)
+	if err := followers[0].ScanRange("pages", database.KeyRange{Start: "010"}, func(key string, value []byte) bool {
+		if string(value) != jsonPayload {
+			t.Errorf("unexpected value %s for %v", value, key)
+		}
+		scanned = append(scanned, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != 290 || scanned[0] != "010" || scanned[289] != "299" || !slices.IsSorted(scanned) {
+		t.Errorf("unexpected scan of %d keys from %v to %v", len(scanned), scanned[0], scanned[len(scanned)-1])
+	}
+	scanned = scanned[:0]
+	if err := followers[0].ScanKeys("pages", database.KeyRange{Prefix: "2", End: "280"}, func(key string) bool {
+		scanned = append(scanned, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != 81 || scanned[0] != "200" || scanned[80] != "280" {
+		t.Errorf("unexpected scan of keys %v", scanned)
+	}
+
+	// the cluster keeps accepting writes once the leader is gone
+	leader.Disconnect()
+	survivors := followers
+	_, followers = waitForLeader(survivors)
+	if err := followers[0].Upsert("test", "2", []byte(jsonPayload), false); err != nil {
+		t.Error(err)
+	}
+	data, err := survivors[0].GetAll("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 {
+		t.Errorf("Expected 2 documents. Got %d", len(data))
+	}
+	for _, node := range survivors {
+		node.Disconnect()
+	}
+}
+
+func Test_UnitTest_SQLiteDb_ConcurrentWrites(t *testing.T) {
+	os.MkdirAll("/tmp/caffeine_concurrent", os.ModePerm)
+	defer os.RemoveAll("/tmp/caffeine_concurrent")
+
+	// two connections on the same file, as two processes would do
+	writers := []*database.SQLiteDatabase{
+		{DirPath: "/tmp/caffeine_concurrent/db.sqlite"},
+		{DirPath: "/tmp/caffeine_concurrent/db.sqlite"},
+	}
+	for _, db := range writers {
+		db.Init()
+		defer db.Disconnect()
+	}
+	writers[0].CreateNameSpace(testNamespace)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := writers[i%2].Upsert(testNamespace, fmt.Sprint(i), []byte(jsonPayload), true); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	data, err := writers[0].GetAll(testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 200 {
+		t.Errorf("Expected 200 documents. Got %d", len(data))
+	}
+}
@@ -1,12 +1,14 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sort"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xdung24/unirest/database"
 )
 
 type Payload struct {
@@ -19,6 +21,20 @@ func (p *Payload) wrap() (content []byte, err error) {
 	return
 }
 
+// payloadData returns the data of a document, stored in a Payload when the authentication is enabled
+func (s *Server) payloadData(value []byte) ([]byte, error) {
+	if !s.AuthEnabled {
+		return value, nil
+	}
+	var payload struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(value, &payload); err != nil {
+		return nil, err
+	}
+	return payload.Data, nil
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, jsonContent string) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -34,71 +50,184 @@ func respondWithError(w http.ResponseWriter, code int, message string) {
 		`{ "status": %v, "message": "%v" }`, code, message))
 }
 
+// dbErrorStatus is the status of a database error the handler has no better status for:
+// 503 when the database is unavailable for a while (the request can be retried), 500 otherwise
+func dbErrorStatus(dbErr *database.DbError) int {
+	switch dbErr.ErrorCode {
+	case database.UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	case database.INVALID_DOCUMENT:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func jsonWrapper(payload interface{}) (content []byte, err error) {
-	unboxed, ok := payload.(map[string][]byte)
-	if !ok {
-		content, err = json.Marshal(payload)
+	content, err = json.Marshal(payload)
+	return
+}
+
+const (
+	FORMAT_KEY_VALUE = "1"      // [{"key": "k", "value": {..., "id": "k"}}]
+	FORMAT_ARRAY     = "2"      // [{..., "id": "k"}]
+	FORMAT_RESULTS   = "3"      // {"results": [{..., "id": "k"}]}
+	FORMAT_NDJSON    = "ndjson" // one {..., "id": "k"} per line, for the exports
+)
+
+// jsonStream writes the documents to the response as they are scanned, so that only one is in memory at a time.
+// The status and the opening of the array are sent with the first document: an error happening before it
+// is still answered with respondWithError, after it the response is ended with the error, see fail.
+// Each write has writeTimeout to complete, instead of the whole response.
+type jsonStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	format     string
+	open       string
+	close      string
+	sep        string
+	started    bool
+	count      int
+	shape      *responseShape // applied by writeDocument
+}
+
+// newJsonStream returns nil for an unknown format
+func newJsonStream(w http.ResponseWriter, r *http.Request, format string) *jsonStream {
+	controller := responseController(w, r)
+	switch format {
+	case "", FORMAT_KEY_VALUE:
+		return &jsonStream{w: w, controller: controller, format: FORMAT_KEY_VALUE, open: "[", close: "]", sep: ","}
+	case FORMAT_ARRAY:
+		return &jsonStream{w: w, controller: controller, format: format, open: "[", close: "]", sep: ","}
+	case FORMAT_RESULTS:
+		return &jsonStream{w: w, controller: controller, format: format, open: `{"results":[`, close: "]}", sep: ","}
+	case FORMAT_NDJSON:
+		return &jsonStream{w: w, controller: controller, format: format, sep: "\n"}
+	}
+	return nil
+}
+
+func (j *jsonStream) start() {
+	if j.started {
 		return
 	}
-	r := make([]map[string]interface{}, 0)
-	for k, v := range unboxed {
-		var parsed interface{}
-		err = json.Unmarshal(v, &parsed)
-		if err != nil {
-			return
-		}
-		parsed.(map[string]interface{})["id"] = k // Add the key-value pair
-		r = append(r, map[string]interface{}{"key": k, "value": parsed})
+	j.started = true
+	if j.format == FORMAT_NDJSON {
+		j.w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		j.w.Header().Set("Content-Type", "application/json")
 	}
-	// ensure the ascending order
-	sort.SliceStable(r, func(i, j int) bool {
-		return r[i]["key"].(string) < r[j]["key"].(string)
-	})
-	content, err = json.Marshal(r)
-	return
+	j.w.WriteHeader(http.StatusOK)
+	j.extendDeadline()
+	j.w.Write([]byte(j.open))
 }
 
-func jsonWrapper2(payload interface{}) (content []byte, err error) {
-	unboxed, ok := payload.(map[string][]byte)
-	if !ok {
-		content, err = json.Marshal(payload)
-		return
+// extendDeadline gives the next write writeTimeout to complete, not supported by the recorders of the tests
+func (j *jsonStream) extendDeadline() {
+	j.controller.SetWriteDeadline(time.Now().Add(writeTimeout))
+}
+
+// withId parses the stored document and adds the key as its "id" field
+func withId(key string, value []byte) (interface{}, error) {
+	var parsed interface{}
+	err := json.Unmarshal(value, &parsed)
+	if err != nil {
+		return nil, err
 	}
-	r := make([]interface{}, 0)
-	for k, v := range unboxed {
-		var parsed interface{}
-		err = json.Unmarshal(v, &parsed)
-		if err != nil {
-			return
-		}
-		parsed.(map[string]interface{})["id"] = k // Add the key-value pair
-		r = append(r, parsed)
+	if object, ok := parsed.(map[string]interface{}); ok {
+		object["id"] = key
 	}
-	content, err = json.Marshal(r)
-	return
+	return parsed, nil
 }
 
-func jsonWrapper3(payload interface{}) (content []byte, err error) {
-	unboxed, ok := payload.(map[string][]byte)
+// writeDocument adds the key as the "id" field of the stored document, after the projection and before the transform
+func (j *jsonStream) writeDocument(key string, value []byte) error {
+	var parsed interface{}
+	err := json.Unmarshal(value, &parsed)
+	if err != nil {
+		return err
+	}
+	parsed = j.shape.project(parsed)
+	if object, ok := parsed.(map[string]interface{}); ok {
+		object["id"] = key
+	}
+	parsed, ok, err := j.shape.apply(parsed)
 	if !ok {
-		content, err = json.Marshal(payload)
+		return err
+	}
+	if j.format == FORMAT_KEY_VALUE {
+		return j.write(map[string]interface{}{"key": key, "value": parsed})
+	}
+	return j.write(parsed)
+}
+
+func (j *jsonStream) write(item interface{}) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	j.start()
+	if j.count > 0 {
+		content = append([]byte(j.sep), content...)
+	}
+	j.count++
+	j.extendDeadline()
+	_, err = j.w.Write(content)
+	return err
+}
+
+func (j *jsonStream) end() {
+	j.start()
+	j.extendDeadline()
+	if j.format == FORMAT_NDJSON && j.count > 0 {
+		j.w.Write([]byte("\n"))
+	}
+	j.w.Write([]byte(j.close))
+}
+
+// fail answers with the error if nothing was sent yet. Otherwise the response is ended with an {"error": message}
+// object, so that the clients can tell it was cut short: as an "error" member next to the results, as the last
+// element of an array, or as the last line of ndjson.
+func (j *jsonStream) fail(code int, message string) {
+	if !j.started {
+		respondWithError(j.w, code, message)
 		return
 	}
-	r := make([]interface{}, 0)
-	for k, v := range unboxed {
-		var parsed interface{}
-		err = json.Unmarshal(v, &parsed)
-		if err != nil {
-			return
+	log.Println("error streaming response: ", message)
+	quoted, _ := json.Marshal(message)
+	trailer := `{"error":` + string(quoted) + `}`
+	switch {
+	case j.format == FORMAT_RESULTS:
+		trailer = `],"error":` + string(quoted) + `}`
+	case j.format == FORMAT_NDJSON:
+		trailer += "\n"
+		if j.count > 0 {
+			trailer = "\n" + trailer
+		}
+	default:
+		if j.count > 0 {
+			trailer = j.sep + trailer
 		}
-		parsed.(map[string]interface{})["id"] = k // Add the key-value pair
-		r = append(r, parsed)
+		trailer += j.close
 	}
-	result := struct {
-		Results []interface{} `json:"results"`
-	}{
-		Results: r,
+	j.extendDeadline()
+	j.w.Write([]byte(trailer))
+}
+
+type responseControllerKey struct{}
+
+// withResponseController keeps the controller of the connection in the context of the requests, the writers of the
+// middlewares (compression) don't lead to it
+func withResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// responseController returns the controller of the connection of the request, the one of w without the middleware
+func responseController(w http.ResponseWriter, r *http.Request) *http.ResponseController {
+	if controller, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		return controller
 	}
-	content, err = json.Marshal(result)
-	return
+	return http.NewResponseController(w)
 }